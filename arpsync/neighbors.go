@@ -0,0 +1,320 @@
+package arpsync
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/network"
+	"github.com/vishvananda/netlink"
+)
+
+var (
+	installedLock sync.Mutex
+	// installed has the IP addresses of the permanent entries programmed
+	// by the manager, per interface
+	installed = map[string]map[string]bool{}
+)
+
+// DesiredNeighbor is a static neighbor entry which needs to be present
+// on the given interface
+type DesiredNeighbor struct {
+	IP        net.IP
+	MAC       net.HardwareAddr
+	Interface string
+}
+
+// DesiredNeighborsForNetwork returns the static neighbor entries to install
+// on the bridge for the running containers of the given network. Containers
+// without a MAC address in metadata are skipped, as their MAC address
+// can't be derived from the IP address.
+func DesiredNeighborsForNetwork(containers []metadata.Container, networkUUID string, bridgeName string) ([]DesiredNeighbor, error) {
+	desired := []DesiredNeighbor{}
+	for _, aContainer := range containers {
+		if !(aContainer.PrimaryIp != "" &&
+			(aContainer.State == "running" || aContainer.State == "starting") &&
+			aContainer.NetworkUUID == networkUUID) {
+			continue
+		}
+		if aContainer.PrimaryMacAddress == "" {
+			logrus.Debugf("arpsync: no MAC address for container %v, skipping", aContainer.UUID)
+			continue
+		}
+
+		ip := net.ParseIP(aContainer.PrimaryIp)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid primary IP(%v) of container %v", aContainer.PrimaryIp, aContainer.UUID)
+		}
+		mac, err := net.ParseMAC(aContainer.PrimaryMacAddress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC address(%v) of container %v: %v", aContainer.PrimaryMacAddress, aContainer.UUID, err)
+		}
+
+		desired = append(desired, DesiredNeighbor{IP: ip, MAC: mac, Interface: bridgeName})
+	}
+
+	return desired, nil
+}
+
+// ReconcileNeighbors programs the desired neighbors of the given interface
+// as permanent entries and removes the permanent entries programmed by the
+// manager which aren't desired anymore. The static entries of operators or
+// other tools and the ones learnt by the kernel are left alone, so are the
+// entries programmed before the manager was restarted.
+func ReconcileNeighbors(interfaceName string, desired []DesiredNeighbor) (added, removed int, err error) {
+	link, err := netlink.LinkByName(interfaceName)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "error fetching link %v", interfaceName)
+	}
+	linkIndex := link.Attrs().Index
+
+	entries, err := netlink.NeighList(linkIndex, network.PolicyFamily())
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "error listing neighbors of %v", interfaceName)
+	}
+
+	existing := map[string]netlink.Neigh{}
+	for _, aEntry := range entries {
+		if aEntry.State&netlink.NUD_PERMANENT == 0 {
+			continue
+		}
+		existing[aEntry.IP.String()] = aEntry
+	}
+
+	var lastErr error
+	wanted := map[string]bool{}
+	for _, d := range desired {
+		if d.Interface != interfaceName || !network.PolicyAllowsIP(d.IP) {
+			continue
+		}
+		wanted[d.IP.String()] = true
+		if aEntry, ok := existing[d.IP.String()]; ok && aEntry.HardwareAddr.String() == d.MAC.String() {
+			continue
+		}
+
+		if err := setNeighbor(linkIndex, interfaceName, d); err != nil {
+			lastErr = err
+			continue
+		}
+		added++
+	}
+
+	for ip, aEntry := range existing {
+		if wanted[ip] || !isInstalled(interfaceName, ip) {
+			continue
+		}
+		if err := delNeighbor(interfaceName, aEntry); err != nil {
+			lastErr = err
+			continue
+		}
+		removed++
+	}
+
+	return added, removed, lastErr
+}
+
+// ApplyContainerNeighborDelta updates the permanent neighbor entries of the
+// given interface for the containers which were added and removed, without
+// looking at the other entries. The removed containers are handled first
+// so an IP address reused by an added container gets its new MAC address.
+// Containers without a MAC address in metadata are skipped.
+func ApplyContainerNeighborDelta(interfaceName string, added, removed []metadata.Container) (int, int, error) {
+	link, err := netlink.LinkByName(interfaceName)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "error fetching link %v", interfaceName)
+	}
+	linkIndex := link.Attrs().Index
+
+	var lastErr error
+	removedCount := 0
+	if len(removed) > 0 {
+		entries, err := netlink.NeighList(linkIndex, network.PolicyFamily())
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "error listing neighbors of %v", interfaceName)
+		}
+		existing := map[string]netlink.Neigh{}
+		for _, aEntry := range entries {
+			if aEntry.State&netlink.NUD_PERMANENT != 0 {
+				existing[aEntry.IP.String()] = aEntry
+			}
+		}
+
+		for _, aContainer := range removed {
+			ip := net.ParseIP(aContainer.PrimaryIp)
+			if ip == nil {
+				continue
+			}
+			aEntry, ok := existing[ip.String()]
+			if !ok {
+				continue
+			}
+			if err := delNeighbor(interfaceName, aEntry); err != nil {
+				lastErr = err
+				continue
+			}
+			removedCount++
+		}
+	}
+
+	addedCount := 0
+	for _, aContainer := range added {
+		if aContainer.PrimaryIp == "" || aContainer.PrimaryMacAddress == "" {
+			logrus.Debugf("arpsync: no IP or MAC address for container %v, skipping", aContainer.UUID)
+			continue
+		}
+		ip := net.ParseIP(aContainer.PrimaryIp)
+		if ip == nil {
+			lastErr = fmt.Errorf("invalid primary IP(%v) of container %v", aContainer.PrimaryIp, aContainer.UUID)
+			continue
+		}
+		mac, err := net.ParseMAC(aContainer.PrimaryMacAddress)
+		if err != nil {
+			lastErr = fmt.Errorf("invalid MAC address(%v) of container %v: %v", aContainer.PrimaryMacAddress, aContainer.UUID, err)
+			continue
+		}
+		if !network.PolicyAllowsIP(ip) {
+			continue
+		}
+		if err := setNeighbor(linkIndex, interfaceName, DesiredNeighbor{IP: ip, MAC: mac, Interface: interfaceName}); err != nil {
+			lastErr = err
+			continue
+		}
+		addedCount++
+	}
+
+	return addedCount, removedCount, lastErr
+}
+
+// setNeighbor adds or replaces the permanent neighbor entry
+func setNeighbor(linkIndex int, interfaceName string, d DesiredNeighbor) error {
+	logrus.Infof("arpsync: adding neighbor %v lladdr %v dev %v", d.IP, d.MAC, interfaceName)
+	newEntry := &netlink.Neigh{
+		LinkIndex:    linkIndex,
+		Family:       netlink.FAMILY_V4,
+		State:        netlink.NUD_PERMANENT,
+		IP:           d.IP,
+		HardwareAddr: d.MAC,
+	}
+	if d.IP.To4() == nil {
+		newEntry.Family = netlink.FAMILY_V6
+	}
+	if err := netlink.NeighSet(newEntry); err != nil {
+		logrus.Errorf("arpsync: error adding neighbor %v: %v", d.IP, err)
+		return err
+	}
+	setInstalled(interfaceName, d.IP.String(), true)
+	network.RecordEvent(network.ActionAddNeighbor, interfaceName, fmt.Sprintf("%v lladdr %v", d.IP, d.MAC))
+	return nil
+}
+
+func delNeighbor(interfaceName string, aEntry netlink.Neigh) error {
+	logrus.Infof("arpsync: removing neighbor %v lladdr %v dev %v", aEntry.IP, aEntry.HardwareAddr, interfaceName)
+	if err := netlink.NeighDel(&aEntry); err != nil {
+		logrus.Errorf("arpsync: error removing neighbor %v: %v", aEntry.IP, err)
+		return err
+	}
+	setInstalled(interfaceName, aEntry.IP.String(), false)
+	network.RecordEvent(network.ActionDelNeighbor, interfaceName, fmt.Sprintf("%v lladdr %v", aEntry.IP, aEntry.HardwareAddr))
+	return nil
+}
+
+func setInstalled(interfaceName, ip string, value bool) {
+	installedLock.Lock()
+	defer installedLock.Unlock()
+	if !value {
+		delete(installed[interfaceName], ip)
+		return
+	}
+	if installed[interfaceName] == nil {
+		installed[interfaceName] = map[string]bool{}
+	}
+	installed[interfaceName][ip] = true
+}
+
+func isInstalled(interfaceName, ip string) bool {
+	installedLock.Lock()
+	defer installedLock.Unlock()
+	return installed[interfaceName][ip]
+}
+
+// FindMismatchedNeighbors returns the neighbor entries of the given
+// interface which have a different MAC address than the desired one
+// for their IP address. Entries still being resolved, without a MAC
+// address, aren't reported.
+func FindMismatchedNeighbors(interfaceName string, desired []DesiredNeighbor) ([]netlink.Neigh, error) {
+	link, err := netlink.LinkByName(interfaceName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error fetching link %v", interfaceName)
+	}
+
+	entries, err := netlink.NeighList(link.Attrs().Index, network.PolicyFamily())
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing neighbors of %v", interfaceName)
+	}
+
+	expected := map[string]string{}
+	for _, d := range desired {
+		if d.Interface == interfaceName {
+			expected[d.IP.String()] = d.MAC.String()
+		}
+	}
+
+	mismatched := []netlink.Neigh{}
+	for _, aEntry := range entries {
+		mac, ok := expected[aEntry.IP.String()]
+		if !ok || len(aEntry.HardwareAddr) == 0 || aEntry.HardwareAddr.String() == mac {
+			continue
+		}
+		logrus.Debugf("arpsync: neighbor %v has MAC %v instead of %v", aEntry.IP, aEntry.HardwareAddr, mac)
+		mismatched = append(mismatched, aEntry)
+	}
+
+	return mismatched, nil
+}
+
+// ConnectivityMatrix reports which pairs of the running containers of the
+// network can reach each other at L2 through the bridge. A container is
+// reachable when the bridge has a neighbor entry with its MAC address, a
+// pair is connected when both containers are reachable. The IP addresses
+// are the ones of the rows and columns of the matrix, in the same order.
+func ConnectivityMatrix(containers []metadata.Container, networkUUID string, bridgeName string) ([][]bool, []net.IP, error) {
+	desired, err := DesiredNeighborsForNetwork(containers, networkUUID, bridgeName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	link, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error fetching link %v", bridgeName)
+	}
+	entries, err := netlink.NeighList(link.Attrs().Index, network.PolicyFamily())
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error listing neighbors of %v", bridgeName)
+	}
+	macs := map[string]string{}
+	for _, aEntry := range entries {
+		if aEntry.State&(netlink.NUD_FAILED|netlink.NUD_INCOMPLETE) != 0 {
+			continue
+		}
+		macs[aEntry.IP.String()] = aEntry.HardwareAddr.String()
+	}
+
+	ips := []net.IP{}
+	reachable := []bool{}
+	for _, d := range desired {
+		ips = append(ips, d.IP)
+		reachable = append(reachable, macs[d.IP.String()] == d.MAC.String())
+	}
+
+	matrix := make([][]bool, len(ips))
+	for i := range matrix {
+		matrix[i] = make([]bool, len(ips))
+		for j := range matrix[i] {
+			matrix[i][j] = i == j || (reachable[i] && reachable[j])
+		}
+	}
+	return matrix, ips, nil
+}
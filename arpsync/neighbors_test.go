@@ -0,0 +1,331 @@
+package arpsync
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/testutil"
+	"github.com/vishvananda/netlink"
+)
+
+func TestDesiredNeighborsForNetwork(t *testing.T) {
+	containers := []metadata.Container{
+		{UUID: "c1", NetworkUUID: "net1", State: "running", PrimaryIp: "10.42.0.2", PrimaryMacAddress: "02:42:0a:2a:00:02"},
+		{UUID: "c2", NetworkUUID: "net1", State: "starting", PrimaryIp: "10.42.0.3", PrimaryMacAddress: "02:42:0a:2a:00:03"},
+		{UUID: "c3", NetworkUUID: "net1", State: "stopped", PrimaryIp: "10.42.0.4", PrimaryMacAddress: "02:42:0a:2a:00:04"},
+		{UUID: "c4", NetworkUUID: "net1", State: "running", PrimaryIp: "10.42.0.5"},
+		{UUID: "c5", NetworkUUID: "net2", State: "running", PrimaryIp: "10.43.0.2", PrimaryMacAddress: "02:42:0a:2b:00:02"},
+	}
+
+	desired, err := DesiredNeighborsForNetwork(containers, "net1", "docker0")
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	expected := []string{
+		"10.42.0.2 02:42:0a:2a:00:02 docker0",
+		"10.42.0.3 02:42:0a:2a:00:03 docker0",
+	}
+	if len(desired) != len(expected) {
+		t.Fatalf("expected: %v, got actual: %v", expected, desired)
+	}
+	for i, d := range desired {
+		actual := d.IP.String() + " " + d.MAC.String() + " " + d.Interface
+		if actual != expected[i] {
+			t.Errorf("expected: %v, got actual: %v", expected[i], actual)
+		}
+	}
+
+	containers[0].PrimaryMacAddress = "not-a-mac"
+	if _, err := DesiredNeighborsForNetwork(containers, "net1", "docker0"); err == nil {
+		t.Errorf("expecting error for an invalid MAC address, but got nil")
+	}
+}
+
+func neighborsOf(linkIndex int) (map[string]string, error) {
+	entries, err := netlink.NeighList(linkIndex, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	neighbors := map[string]string{}
+	for _, aEntry := range entries {
+		neighbors[aEntry.IP.String()] = aEntry.HardwareAddr.String()
+	}
+	return neighbors, nil
+}
+
+func TestReconcileNeighbors(t *testing.T) {
+	defer func() { installed = map[string]map[string]bool{} }()
+	testNS := testutil.NewTestNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(ns.NetNS) error {
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br-test"}}
+		if err := netlink.LinkAdd(bridge); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(bridge); err != nil {
+			return err
+		}
+		index := bridge.Attrs().Index
+
+		mac := func(s string) net.HardwareAddr {
+			m, _ := net.ParseMAC(s)
+			return m
+		}
+		// A stale entry added by the manager
+		if _, _, err := ReconcileNeighbors("br-test", []DesiredNeighbor{
+			{IP: net.ParseIP("10.42.0.9"), MAC: mac("02:42:0a:2a:00:09"), Interface: "br-test"},
+		}); err != nil {
+			return err
+		}
+		// An entry learnt by the kernel and a static one of an operator
+		for _, n := range []netlink.Neigh{
+			{IP: net.ParseIP("10.42.0.10"), HardwareAddr: mac("02:42:0a:2a:00:10"), State: netlink.NUD_STALE},
+			{IP: net.ParseIP("10.42.0.11"), HardwareAddr: mac("02:42:0a:2a:00:11"), State: netlink.NUD_PERMANENT},
+		} {
+			n.LinkIndex = index
+			n.Family = netlink.FAMILY_V4
+			if err := netlink.NeighAdd(&n); err != nil {
+				return err
+			}
+		}
+
+		desired := []DesiredNeighbor{
+			{IP: net.ParseIP("10.42.0.2"), MAC: mac("02:42:0a:2a:00:02"), Interface: "br-test"},
+			{IP: net.ParseIP("10.42.0.3"), MAC: mac("02:42:0a:2a:00:03"), Interface: "br-test"},
+			{IP: net.ParseIP("10.43.0.2"), MAC: mac("02:42:0a:2b:00:02"), Interface: "br-other"},
+		}
+
+		added, removed, err := ReconcileNeighbors("br-test", desired)
+		if err != nil {
+			return err
+		}
+		if added != 2 || removed != 1 {
+			t.Errorf("expected: 2 added 1 removed, got actual: %v added %v removed", added, removed)
+		}
+
+		actual, err := neighborsOf(index)
+		if err != nil {
+			return err
+		}
+		expected := map[string]string{
+			"10.42.0.2":  "02:42:0a:2a:00:02",
+			"10.42.0.3":  "02:42:0a:2a:00:03",
+			"10.42.0.10": "02:42:0a:2a:00:10",
+			"10.42.0.11": "02:42:0a:2a:00:11",
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected: %v, got actual: %v", expected, actual)
+		}
+
+		added, removed, err = ReconcileNeighbors("br-test", desired)
+		if err != nil {
+			return err
+		}
+		if added != 0 || removed != 0 {
+			t.Errorf("expected nothing to change, got actual: %v added %v removed", added, removed)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+}
+
+func TestFindMismatchedNeighbors(t *testing.T) {
+	testNS := testutil.NewTestNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(ns.NetNS) error {
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br-test"}}
+		if err := netlink.LinkAdd(bridge); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(bridge); err != nil {
+			return err
+		}
+
+		mac := func(s string) net.HardwareAddr {
+			m, _ := net.ParseMAC(s)
+			return m
+		}
+		for _, n := range []netlink.Neigh{
+			{IP: net.ParseIP("10.42.0.2"), HardwareAddr: mac("02:42:0a:2a:00:02")},
+			{IP: net.ParseIP("10.42.0.3"), HardwareAddr: mac("02:42:0a:2a:00:99")},
+			{IP: net.ParseIP("10.42.0.4"), HardwareAddr: mac("02:42:0a:2a:00:04")},
+		} {
+			n.LinkIndex = bridge.Attrs().Index
+			n.Family = netlink.FAMILY_V4
+			n.State = netlink.NUD_STALE
+			if err := netlink.NeighAdd(&n); err != nil {
+				return err
+			}
+		}
+
+		desired := []DesiredNeighbor{
+			{IP: net.ParseIP("10.42.0.2"), MAC: mac("02:42:0a:2a:00:02"), Interface: "br-test"},
+			{IP: net.ParseIP("10.42.0.3"), MAC: mac("02:42:0a:2a:00:03"), Interface: "br-test"},
+			{IP: net.ParseIP("10.42.0.5"), MAC: mac("02:42:0a:2a:00:05"), Interface: "br-test"},
+		}
+
+		mismatched, err := FindMismatchedNeighbors("br-test", desired)
+		if err != nil {
+			return err
+		}
+		if len(mismatched) != 1 || mismatched[0].IP.String() != "10.42.0.3" || mismatched[0].HardwareAddr.String() != "02:42:0a:2a:00:99" {
+			t.Errorf("expected: 10.42.0.3 with 02:42:0a:2a:00:99, got actual: %+v", mismatched)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+}
+
+func TestConnectivityMatrix(t *testing.T) {
+	testNS := testutil.NewTestNS(t)
+	defer testNS.Close()
+
+	containers := []metadata.Container{
+		{UUID: "c1", NetworkUUID: "net1", State: "running", PrimaryIp: "10.42.0.2", PrimaryMacAddress: "02:42:0a:2a:00:02"},
+		{UUID: "c2", NetworkUUID: "net1", State: "running", PrimaryIp: "10.42.0.3", PrimaryMacAddress: "02:42:0a:2a:00:03"},
+		{UUID: "c3", NetworkUUID: "net1", State: "running", PrimaryIp: "10.42.0.4", PrimaryMacAddress: "02:42:0a:2a:00:04"},
+		{UUID: "c4", NetworkUUID: "net2", State: "running", PrimaryIp: "10.43.0.2", PrimaryMacAddress: "02:42:0a:2b:00:02"},
+	}
+
+	err := testNS.Do(func(ns.NetNS) error {
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br-test"}}
+		if err := netlink.LinkAdd(bridge); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(bridge); err != nil {
+			return err
+		}
+
+		// c1 has the right entry, c2 a stale MAC and c3 none
+		for ip, mac := range map[string]string{"10.42.0.2": "02:42:0a:2a:00:02", "10.42.0.3": "02:42:0a:2a:00:99"} {
+			hw, _ := net.ParseMAC(mac)
+			n := netlink.Neigh{
+				LinkIndex:    bridge.Attrs().Index,
+				Family:       netlink.FAMILY_V4,
+				State:        netlink.NUD_PERMANENT,
+				IP:           net.ParseIP(ip),
+				HardwareAddr: hw,
+			}
+			if err := netlink.NeighAdd(&n); err != nil {
+				return err
+			}
+		}
+
+		matrix, ips, err := ConnectivityMatrix(containers, "net1", "br-test")
+		if err != nil {
+			return err
+		}
+		if expected := []net.IP{net.ParseIP("10.42.0.2"), net.ParseIP("10.42.0.3"), net.ParseIP("10.42.0.4")}; fmt.Sprint(ips) != fmt.Sprint(expected) {
+			t.Errorf("expected: %v, got actual: %v", expected, ips)
+		}
+		expected := [][]bool{
+			{true, false, false},
+			{false, true, false},
+			{false, false, true},
+		}
+		if !reflect.DeepEqual(matrix, expected) {
+			t.Errorf("expected: %v, got actual: %v", expected, matrix)
+		}
+
+		// Fixing the MAC of c2 connects it to c1
+		desired, err := DesiredNeighborsForNetwork(containers[:2], "net1", "br-test")
+		if err != nil {
+			return err
+		}
+		if _, _, err := ReconcileNeighbors("br-test", desired); err != nil {
+			return err
+		}
+		matrix, _, err = ConnectivityMatrix(containers, "net1", "br-test")
+		if err != nil {
+			return err
+		}
+		expected = [][]bool{
+			{true, true, false},
+			{true, true, false},
+			{false, false, true},
+		}
+		if !reflect.DeepEqual(matrix, expected) {
+			t.Errorf("expected: %v, got actual: %v", expected, matrix)
+		}
+
+		if _, _, err := ConnectivityMatrix(containers, "net1", "br-missing"); err == nil {
+			t.Errorf("expecting error for a missing bridge, but got nil")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+}
+
+func TestApplyContainerNeighborDelta(t *testing.T) {
+	testNS := testutil.NewTestNS(t)
+	defer testNS.Close()
+
+	c1 := metadata.Container{UUID: "c1", PrimaryIp: "10.42.0.2", PrimaryMacAddress: "02:42:0a:2a:00:02"}
+	c2 := metadata.Container{UUID: "c2", PrimaryIp: "10.42.0.3", PrimaryMacAddress: "02:42:0a:2a:00:03"}
+	noMAC := metadata.Container{UUID: "c3", PrimaryIp: "10.42.0.4"}
+	// c4 reuses the IP address of c1
+	c4 := metadata.Container{UUID: "c4", PrimaryIp: "10.42.0.2", PrimaryMacAddress: "02:42:0a:2a:00:22"}
+
+	err := testNS.Do(func(ns.NetNS) error {
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br-test"}}
+		if err := netlink.LinkAdd(bridge); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(bridge); err != nil {
+			return err
+		}
+		index := bridge.Attrs().Index
+
+		added, removed, err := ApplyContainerNeighborDelta("br-test", []metadata.Container{c1, c2, noMAC}, nil)
+		if err != nil {
+			return err
+		}
+		if added != 2 || removed != 0 {
+			t.Errorf("expected: 2 added 0 removed, got actual: %v added %v removed", added, removed)
+		}
+		actual, err := neighborsOf(index)
+		if err != nil {
+			return err
+		}
+		expected := map[string]string{
+			"10.42.0.2": "02:42:0a:2a:00:02",
+			"10.42.0.3": "02:42:0a:2a:00:03",
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected: %v, got actual: %v", expected, actual)
+		}
+
+		added, removed, err = ApplyContainerNeighborDelta("br-test", []metadata.Container{c4}, []metadata.Container{c1, c2, noMAC})
+		if err != nil {
+			return err
+		}
+		if added != 1 || removed != 2 {
+			t.Errorf("expected: 1 added 2 removed, got actual: %v added %v removed", added, removed)
+		}
+		actual, err = neighborsOf(index)
+		if err != nil {
+			return err
+		}
+		expected = map[string]string{"10.42.0.2": "02:42:0a:2a:00:22"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected: %v, got actual: %v", expected, actual)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+}
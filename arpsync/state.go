@@ -0,0 +1,107 @@
+package arpsync
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/network"
+	"github.com/vishvananda/netlink"
+)
+
+// Neighbor is an entry of the ARP table of the host
+type Neighbor struct {
+	IP      string `json:"ip"`
+	MAC     string `json:"mac"`
+	Network string `json:"network,omitempty"`
+}
+
+// nlh lists the ARP table of the host for GetState
+var nlh network.NetlinkHandle = &netlink.Handle{}
+
+// State is the ARP entries wanted on the host for the containers of the
+// networks synced by arpsync and the entries found for them. Scope tells
+// which ARP tables are checked.
+type State struct {
+	Scope   string     `json:"scope"`
+	Desired []Neighbor `json:"desired"`
+	Actual  []Neighbor `json:"actual"`
+	Diff    []string   `json:"diff"`
+}
+
+// GetState returns the state of the ARP table of the host, the diff lists
+// the entries the next sync fixes (~). Entries missing from the table are
+// left to the kernel to resolve. Only the host entries are checked, not
+// the ones of the container namespaces the sync also fixes after a router
+// change.
+func GetState(mc metadata.Client) (State, error) {
+	state := State{Scope: "host", Desired: []Neighbor{}, Actual: []Neighbor{}, Diff: []string{}}
+
+	host, err := mc.GetSelfHost()
+	if err != nil {
+		return state, errors.Wrap(err, "get self host")
+	}
+
+	containers, err := mc.GetContainers()
+	if err != nil {
+		return state, errors.Wrap(err, "error fetching containers from metadata")
+	}
+
+	localNetworks, routers, err := network.LocalNetworks(mc)
+	if err != nil {
+		return state, errors.Wrap(err, "get local networks")
+	}
+
+	desired := map[string]Neighbor{}
+	for _, localNetwork := range localNetworks {
+		networkDriverMacAddress := routers[localNetwork.UUID].PrimaryMacAddress
+		if routers[localNetwork.UUID].Labels[syncLabel] != "true" || networkDriverMacAddress == "" {
+			continue
+		}
+
+		containersMap, err := buildContainersMap(containers, localNetwork)
+		if err != nil {
+			return state, errors.Wrap(err, "building containers map")
+		}
+		for ip, container := range containersMap {
+			desired[ip] = Neighbor{
+				IP:      ip,
+				MAC:     expectedMAC(*container, networkDriverMacAddress, host),
+				Network: localNetwork.UUID,
+			}
+		}
+	}
+
+	entries, err := nlh.NeighList(0, network.PolicyFamily())
+	if err != nil {
+		return state, errors.Wrap(err, "error fetching entries from ARP table")
+	}
+	actual := map[string]Neighbor{}
+	for _, aEntry := range entries {
+		if d, ok := desired[aEntry.IP.String()]; ok {
+			actual[d.IP] = Neighbor{IP: d.IP, MAC: aEntry.HardwareAddr.String(), Network: d.Network}
+		}
+	}
+
+	ips := []string{}
+	for ip := range desired {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	for _, ip := range ips {
+		d := desired[ip]
+		state.Desired = append(state.Desired, d)
+		a, ok := actual[ip]
+		if !ok {
+			continue
+		}
+		state.Actual = append(state.Actual, a)
+		if a.MAC != d.MAC {
+			state.Diff = append(state.Diff, fmt.Sprintf("~ neighbor %v lladdr %v -> %v", ip, a.MAC, d.MAC))
+		}
+	}
+
+	return state, nil
+}
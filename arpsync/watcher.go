@@ -10,6 +10,8 @@ import (
 	"github.com/docker/engine-api/client"
 	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/changes"
+	"github.com/rancher/plugin-manager/metrics"
 	"github.com/rancher/plugin-manager/network"
 	"github.com/vishvananda/netlink"
 )
@@ -35,6 +37,24 @@ type ARPTableWatcher struct {
 // Watch starts the go routine to periodically check the ARP table
 // for any discrepancies
 func Watch(syncIntervalStr string, mc metadata.Client, dc *client.Client) error {
+	atw := newARPTableWatcher(syncIntervalStr, mc, dc)
+	go mc.OnChange(120, atw.onChangeNoError)
+
+	return nil
+}
+
+// Subscribe syncs the ARP tables when the containers, networks, services
+// or hosts change according to the given notifier, instead of on every
+// metadata change. They're also synced every resync interval.
+func Subscribe(n *changes.Notifier, syncIntervalStr, resyncIntervalStr string, mc metadata.Client, dc *client.Client) error {
+	atw := newARPTableWatcher(syncIntervalStr, mc, dc)
+	n.Subscribe("arpsync", []string{changes.Containers, changes.Networks, changes.Services, changes.Hosts},
+		atw.syncInterval, changes.ResyncInterval(resyncIntervalStr), atw.doSync)
+
+	return nil
+}
+
+func newARPTableWatcher(syncIntervalStr string, mc metadata.Client, dc *client.Client) *ARPTableWatcher {
 	logrus.Debugf("arpsync: syncIntervalStr: %v", syncIntervalStr)
 
 	syncInterval := DefaultSyncInterval
@@ -43,16 +63,12 @@ func Watch(syncIntervalStr string, mc metadata.Client, dc *client.Client) error
 
 	}
 
-	atw := &ARPTableWatcher{
+	return &ARPTableWatcher{
 		syncInterval: time.Duration(syncInterval) * time.Second,
 		mc:           mc,
 		dc:           dc,
 		knownRouters: map[string]metadata.Container{},
 	}
-
-	go mc.OnChange(120, atw.onChangeNoError)
-
-	return nil
 }
 
 func (atw *ARPTableWatcher) onChangeNoError(version string) {
@@ -63,9 +79,12 @@ func (atw *ARPTableWatcher) onChangeNoError(version string) {
 		logrus.Debugf("arpsync: sleeping for %v", timeToSleep)
 		time.Sleep(timeToSleep)
 	}
-	if err := atw.doSync(); err != nil {
+	started := time.Now()
+	err := atw.doSync()
+	if err != nil {
 		logrus.Errorf("arpsync: while syncing, got error: %v", err)
 	}
+	metrics.RecordSync("arpsync", started, err)
 	atw.lastApplied = time.Now()
 }
 
@@ -157,7 +176,7 @@ func syncArpTable(context string, networkDriverMacAddress string, containersMap
 		linkIndex = link.Attrs().Index
 	}
 	// Read the ARP table
-	entries, err := netlink.NeighList(linkIndex, netlink.FAMILY_V4)
+	entries, err := netlink.NeighList(linkIndex, network.PolicyFamily())
 	if err != nil {
 		logrus.Errorf("arpsync: error fetching entries from ARP table")
 		return err
@@ -166,14 +185,13 @@ func syncArpTable(context string, networkDriverMacAddress string, containersMap
 
 	for _, aEntry := range entries {
 		if container, found := containersMap[aEntry.IP.String()]; found {
-			expected := networkDriverMacAddress
-			if container.HostUUID == host.UUID {
-				expected = container.PrimaryMacAddress
-			}
+			expected := expectedMAC(*container, networkDriverMacAddress, host)
 
 			if aEntry.HardwareAddr.String() != expected {
 				logrus.Infof("arpsync: (%s) wrong ARP entry found=%+v(expected: %v) for local container, fixing it", context, aEntry, expected)
-				fixARPEntry(aEntry, expected)
+				if fixARPEntry(aEntry, expected) == nil {
+					metrics.RecordReconciled("arpsync", "neighbors", 1)
+				}
 			}
 		} else {
 			logrus.Debugf("arpsync: container not found for ARP entry: %+v", aEntry)
@@ -183,6 +201,15 @@ func syncArpTable(context string, networkDriverMacAddress string, containersMap
 	return nil
 }
 
+// expectedMAC returns the MAC address the ARP entry of the container
+// should have, the containers of other hosts are reached via the router
+func expectedMAC(container metadata.Container, networkDriverMacAddress string, host metadata.Host) string {
+	if container.HostUUID == host.UUID {
+		return container.PrimaryMacAddress
+	}
+	return networkDriverMacAddress
+}
+
 func fixARPEntry(oldEntry netlink.Neigh, newMACAddress string) error {
 	var err error
 	var newHardwareAddr net.HardwareAddr
@@ -0,0 +1,230 @@
+package changes
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/metrics"
+)
+
+// The resource types of metadata whose changes are tracked
+const (
+	Networks   = "networks"
+	Containers = "containers"
+	Hosts      = "hosts"
+	Services   = "services"
+)
+
+var (
+	// DefaultResyncInterval specifies the default value for the interval
+	// of the full syncs done without any change, in seconds
+	DefaultResyncInterval = 300
+
+	// metadataWaitSeconds is how long each long poll of the metadata
+	// version waits for a change
+	metadataWaitSeconds = 120
+)
+
+// ResyncInterval returns the resync interval from the given number of
+// seconds, DefaultResyncInterval if it's not a number. Zero disables the
+// resyncs.
+func ResyncInterval(resyncIntervalStr string) time.Duration {
+	resyncInterval := DefaultResyncInterval
+	if i, err := strconv.Atoi(resyncIntervalStr); err == nil {
+		resyncInterval = i
+	}
+	return time.Duration(resyncInterval) * time.Second
+}
+
+// SyncFunc brings one module in line with metadata
+type SyncFunc func() error
+
+// Notifier long polls the metadata version in place of each module doing
+// it, and triggers the modules subscribed to the resource types which
+// changed
+type Notifier struct {
+	sync.Mutex
+	mc           metadata.Client
+	subscribers  []*subscriber
+	fingerprints map[string]string
+}
+
+type subscriber struct {
+	name      string
+	resources []string
+	debounce  time.Duration
+	resync    time.Duration
+	sync      SyncFunc
+	trigger   chan struct{}
+}
+
+// NewNotifier returns a Notifier for the given metadata client, nothing
+// is polled until Start is called
+func NewNotifier(mc metadata.Client) *Notifier {
+	return &Notifier{
+		mc:           mc,
+		fingerprints: map[string]string{},
+	}
+}
+
+// Subscribe registers a module to be synced when one of the given resource
+// types changes. The changes are debounced: the module syncs once the
+// debounce duration passed since the first change, and at most once per
+// debounce duration. If resync isn't zero the module also syncs every
+// resync duration without any change, as a fallback. Subscribe has to be
+// called before Start.
+func (n *Notifier) Subscribe(name string, resources []string, debounce, resync time.Duration, sync SyncFunc) {
+	n.Lock()
+	defer n.Unlock()
+	n.subscribers = append(n.subscribers, &subscriber{
+		name:      name,
+		resources: resources,
+		debounce:  debounce,
+		resync:    resync,
+		sync:      sync,
+		trigger:   make(chan struct{}, 1),
+	})
+}
+
+// Start starts the go routines polling metadata and syncing the subscribed
+// modules
+func (n *Notifier) Start() {
+	n.Lock()
+	defer n.Unlock()
+	for _, s := range n.subscribers {
+		go s.run()
+	}
+	go n.mc.OnChange(metadataWaitSeconds, n.onChangeNoError)
+}
+
+func (n *Notifier) onChangeNoError(version string) {
+	logrus.Debugf("changes: metadata version: %v", version)
+	changed, err := n.Changed()
+	if err != nil {
+		logrus.Errorf("changes: %v", err)
+		return
+	}
+	n.Notify(changed)
+}
+
+// Changed fetches the resources from metadata and returns the resource
+// types which changed since the previous call. All of them are reported
+// as changed on the first call.
+func (n *Notifier) Changed() ([]string, error) {
+	fingerprints, err := fingerprintResources(n.mc)
+	if err != nil {
+		return nil, err
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	changed := []string{}
+	for _, resource := range []string{Networks, Containers, Hosts, Services} {
+		if previous, ok := n.fingerprints[resource]; !ok || previous != fingerprints[resource] {
+			changed = append(changed, resource)
+		}
+	}
+	n.fingerprints = fingerprints
+	return changed, nil
+}
+
+// Notify triggers the subscribers of any of the given resource types, a
+// subscriber already triggered isn't triggered twice
+func (n *Notifier) Notify(changed []string) {
+	n.Lock()
+	defer n.Unlock()
+	for _, s := range n.subscribers {
+		if !s.interestedIn(changed) {
+			continue
+		}
+		logrus.Debugf("changes: triggering %v for %v", s.name, changed)
+		select {
+		case s.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *subscriber) interestedIn(changed []string) bool {
+	for _, c := range changed {
+		for _, r := range s.resources {
+			if c == r {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *subscriber) run() {
+	var resync <-chan time.Time
+	if s.resync > 0 {
+		ticker := time.NewTicker(s.resync)
+		defer ticker.Stop()
+		resync = ticker.C
+		metrics.ExpectSyncEvery(s.name, s.resync)
+	}
+
+	for {
+		select {
+		case <-s.trigger:
+			time.Sleep(s.debounce)
+			// The changes which came in while waiting are covered
+			// by this sync
+			select {
+			case <-s.trigger:
+			default:
+			}
+		case <-resync:
+			logrus.Debugf("changes: resyncing %v", s.name)
+		}
+
+		started := time.Now()
+		err := s.sync()
+		if err != nil {
+			logrus.Errorf("changes: while syncing %v, got error: %v", s.name, err)
+		}
+		metrics.RecordSync(s.name, started, err)
+	}
+}
+
+func fingerprintResources(mc metadata.Client) (map[string]string, error) {
+	networks, err := mc.GetNetworks()
+	if err != nil {
+		return nil, errors.Wrap(err, "error fetching networks from metadata")
+	}
+	containers, err := mc.GetContainers()
+	if err != nil {
+		return nil, errors.Wrap(err, "error fetching containers from metadata")
+	}
+	hosts, err := mc.GetHosts()
+	if err != nil {
+		return nil, errors.Wrap(err, "error fetching hosts from metadata")
+	}
+	services, err := mc.GetServices()
+	if err != nil {
+		return nil, errors.Wrap(err, "error fetching services from metadata")
+	}
+
+	fingerprints := map[string]string{}
+	for resource, objects := range map[string]interface{}{
+		Networks:   networks,
+		Containers: containers,
+		Hosts:      hosts,
+		Services:   services,
+	} {
+		content, err := json.Marshal(objects)
+		if err != nil {
+			return nil, errors.Wrapf(err, "marshaling %v", resource)
+		}
+		fingerprints[resource] = fmt.Sprintf("%x", sha256.Sum256(content))
+	}
+	return fingerprints, nil
+}
@@ -0,0 +1,101 @@
+package changes
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/testutil"
+)
+
+func TestChanged(t *testing.T) {
+	mc := &testutil.FakeMetadataClient{
+		Networks:   []metadata.Network{{UUID: "net1"}},
+		Containers: []metadata.Container{{UUID: "c1", PrimaryIp: "10.42.0.2"}},
+		Hosts:      []metadata.Host{{UUID: "host1"}},
+	}
+	n := NewNotifier(mc)
+
+	for _, c := range []struct {
+		change   func()
+		expected []string
+	}{
+		{func() {}, []string{Networks, Containers, Hosts, Services}},
+		{func() {}, []string{}},
+		{func() { mc.Containers[0].PrimaryIp = "10.42.0.3" }, []string{Containers}},
+		{func() {
+			mc.Hosts = append(mc.Hosts, metadata.Host{UUID: "host2"})
+			mc.Services = []metadata.Service{{Name: "cni-driver"}}
+		}, []string{Hosts, Services}},
+	} {
+		c.change()
+		changed, err := n.Changed()
+		if err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+		if !reflect.DeepEqual(changed, c.expected) {
+			t.Errorf("expected: %v, got actual: %v", c.expected, changed)
+		}
+	}
+}
+
+type syncCounter struct {
+	sync.Mutex
+	count int
+}
+
+func (s *syncCounter) sync() error {
+	s.Lock()
+	defer s.Unlock()
+	s.count++
+	return nil
+}
+
+func (s *syncCounter) get() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.count
+}
+
+func TestNotify(t *testing.T) {
+	n := NewNotifier(&testutil.FakeMetadataClient{})
+	containers := &syncCounter{}
+	networks := &syncCounter{}
+	n.Subscribe("containers", []string{Containers}, 50*time.Millisecond, 0, containers.sync)
+	n.Subscribe("networks", []string{Networks, Hosts}, 50*time.Millisecond, 0, networks.sync)
+	n.Start()
+
+	for i := 0; i < 5; i++ {
+		n.Notify([]string{Containers})
+	}
+	time.Sleep(150 * time.Millisecond)
+	if actual := containers.get(); actual != 1 {
+		t.Errorf("expected the changes to be debounced into 1 sync, got actual: %v", actual)
+	}
+	if actual := networks.get(); actual != 0 {
+		t.Errorf("expected no sync for the unchanged resources, got actual: %v", actual)
+	}
+
+	n.Notify([]string{Hosts, Services})
+	time.Sleep(150 * time.Millisecond)
+	if actual := networks.get(); actual != 1 {
+		t.Errorf("expected: 1, got actual: %v", actual)
+	}
+	if actual := containers.get(); actual != 1 {
+		t.Errorf("expected: 1, got actual: %v", actual)
+	}
+}
+
+func TestResync(t *testing.T) {
+	n := NewNotifier(&testutil.FakeMetadataClient{})
+	counter := &syncCounter{}
+	n.Subscribe("resync", []string{Containers}, 0, 20*time.Millisecond, counter.sync)
+	n.Start()
+
+	time.Sleep(110 * time.Millisecond)
+	if actual := counter.get(); actual < 2 {
+		t.Errorf("expected at least 2 syncs without any change, got actual: %v", actual)
+	}
+}
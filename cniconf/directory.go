@@ -0,0 +1,126 @@
+package cniconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/utils"
+)
+
+// renderCNIConfig resolves the keywords of the given CNI config and
+// returns it as indented JSON
+func renderCNIConfig(config interface{}, host metadata.Host) ([]byte, error) {
+	config = utils.UpdateCNIConfigByKeywords(config, host)
+	content, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &bytes.Buffer{}
+	if err := json.Indent(out, content, "", "  "); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// WriteCNIConfigIfChanged writes the content to the given path unless the
+// file already has the same content. It returns true if the file was written.
+func WriteCNIConfigIfChanged(p string, content []byte) (bool, error) {
+	existing, err := ioutil.ReadFile(p)
+	if err == nil && bytes.Equal(existing, content) {
+		return false, nil
+	}
+
+	// The contents aren't logged as they may contain secrets
+	logrus.Debugf("Writing %s", p)
+	if err := ioutil.WriteFile(p, content, 0600); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DesiredCNIDirectory returns the CNI config files of the networks of the
+// environment of the host, keyed by their path under dir (usually /etc/cni),
+// along with their content. The managed symlink isn't part of it.
+func DesiredCNIDirectory(mc metadata.Client, dir string) (map[string][]byte, error) {
+	networks, err := mc.GetNetworks()
+	if err != nil {
+		return nil, errors.Wrap(err, "error fetching networks from metadata")
+	}
+
+	host, err := mc.GetSelfHost()
+	if err != nil {
+		return nil, errors.Wrap(err, "error fetching self host from metadata")
+	}
+
+	desired := map[string][]byte{}
+	for _, network := range networks {
+		if network.EnvironmentUUID != host.EnvironmentUUID {
+			continue
+		}
+		cniConf, ok := network.Metadata["cniConfig"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		confDir := filepath.Join(dir, network.Name+".d")
+		for file, config := range cniConf {
+			content, err := renderCNIConfig(config, host)
+			if err != nil {
+				return nil, errors.Wrapf(err, "rendering cni config %v of network %v", file, network.UUID)
+			}
+			desired[filepath.Join(confDir, utils.ResolveCNIFileName(file, network))] = content
+		}
+	}
+
+	return desired, nil
+}
+
+// DiffCNIDirectory compares the desired CNI config files with the ones
+// present in the <network>.d directories of the given managed networks
+// under dir. It returns the desired files which are missing or have a
+// different content, and the existing files of the managed directories
+// which aren't desired anymore, both sorted. The other directories under
+// dir, like the net.d of kubelet, are never looked into.
+func DiffCNIDirectory(desired map[string][]byte, dir string, networkNames []string) (toWrite, toDelete []string, err error) {
+	toWrite = []string{}
+	for p, content := range desired {
+		existing, err := ioutil.ReadFile(p)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+		if err != nil || !bytes.Equal(existing, content) {
+			toWrite = append(toWrite, p)
+		}
+	}
+	sort.Strings(toWrite)
+
+	toDelete = []string{}
+	for _, name := range networkNames {
+		confDir := filepath.Join(dir, name+".d")
+		// The managed symlink points to one of the other directories
+		if fi, err := os.Lstat(confDir); err != nil || !fi.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(confDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, f := range files {
+			p := filepath.Join(confDir, f.Name())
+			if _, ok := desired[p]; f.Mode().IsRegular() && !ok {
+				toDelete = append(toDelete, p)
+			}
+		}
+	}
+	sort.Strings(toDelete)
+
+	return toWrite, toDelete, nil
+}
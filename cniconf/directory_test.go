@@ -0,0 +1,125 @@
+package cniconf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/testutil"
+)
+
+func testNetwork(name, environmentUUID string, cniConfig map[string]interface{}) metadata.Network {
+	return metadata.Network{
+		Name:            name,
+		UUID:            name + "-uuid",
+		EnvironmentUUID: environmentUUID,
+		Metadata:        map[string]interface{}{"cniConfig": cniConfig},
+	}
+}
+
+func TestDesiredCNIDirectory(t *testing.T) {
+	mc := &testutil.FakeMetadataClient{
+		Host: metadata.Host{UUID: "host1", EnvironmentUUID: "env1", Labels: map[string]string{"mtu": "1400"}},
+		Networks: []metadata.Network{
+			testNetwork("managed-net", "env1", map[string]interface{}{
+				"10-rancher.conf": map[string]interface{}{"type": "rancher-bridge", "mtu": "__host_label__:mtu"},
+			}),
+			testNetwork("other", "env1", map[string]interface{}{
+				"10-{network_uuid}.conf": map[string]interface{}{"type": "macvlan"},
+			}),
+			testNetwork("remote", "env2", map[string]interface{}{
+				"10-remote.conf": map[string]interface{}{"type": "macvlan"},
+			}),
+			{Name: "no-cni", EnvironmentUUID: "env1"},
+		},
+	}
+
+	desired, err := DesiredCNIDirectory(mc, "/etc/cni")
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	expected := map[string][]byte{
+		"/etc/cni/managed-net.d/10-rancher.conf": []byte("{\n  \"mtu\": \"1400\",\n  \"type\": \"rancher-bridge\"\n}"),
+		"/etc/cni/other.d/10-other-uuid.conf":    []byte("{\n  \"type\": \"macvlan\"\n}"),
+	}
+	if !reflect.DeepEqual(desired, expected) {
+		t.Errorf("expected: %q, got actual: %q", expected, desired)
+	}
+}
+
+func TestWriteCNIConfigIfChanged(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "10-rancher.conf")
+
+	for _, c := range []struct {
+		content string
+		written bool
+	}{
+		{"{}", true},
+		{"{}", false},
+		{"{\"type\": \"rancher-bridge\"}", true},
+	} {
+		written, err := WriteCNIConfigIfChanged(p, []byte(c.content))
+		if err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+		if written != c.written {
+			t.Errorf("%v: expected: %v, got actual: %v", c.content, c.written, written)
+		}
+		actual, _ := ioutil.ReadFile(p)
+		if string(actual) != c.content {
+			t.Errorf("expected: %v, got actual: %s", c.content, actual)
+		}
+	}
+}
+
+func TestDiffCNIDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"net1.d", "net2.d", "net.d"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+	}
+	if err := os.Symlink("net1.d", filepath.Join(dir, "managed.d")); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	files := map[string]string{
+		"net1.d/10-rancher.conf": "{}",
+		"net1.d/20-changed.conf": "{\"mtu\": 1500}",
+		"net2.d/10-orphan.conf":  "{}",
+		"net.d/10-kubelet.conf":  "{}",
+		"README":                 "not a cni config",
+	}
+	for f, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(content), 0600); err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+	}
+
+	desired := map[string][]byte{
+		filepath.Join(dir, "net1.d", "10-rancher.conf"): []byte("{}"),
+		filepath.Join(dir, "net1.d", "20-changed.conf"): []byte("{\"mtu\": 1400}"),
+		filepath.Join(dir, "net3.d", "10-rancher.conf"): []byte("{}"),
+	}
+
+	// net.d isn't the directory of a managed network
+	toWrite, toDelete, err := DiffCNIDirectory(desired, dir, []string{"net1", "net2", "net3", "managed"})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	expectedToWrite := []string{
+		filepath.Join(dir, "net1.d", "20-changed.conf"),
+		filepath.Join(dir, "net3.d", "10-rancher.conf"),
+	}
+	if !reflect.DeepEqual(toWrite, expectedToWrite) {
+		t.Errorf("expected: %v, got actual: %v", expectedToWrite, toWrite)
+	}
+	expectedToDelete := []string{filepath.Join(dir, "net2.d", "10-orphan.conf")}
+	if !reflect.DeepEqual(toDelete, expectedToDelete) {
+		t.Errorf("expected: %v, got actual: %v", expectedToDelete, toDelete)
+	}
+}
@@ -1,10 +1,7 @@
 package cniconf
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -13,6 +10,7 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/cniglue"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/network"
 	"github.com/rancher/plugin-manager/utils"
 )
 
@@ -28,8 +26,9 @@ func init() {
 // Watch monitors metadata and generates CNI config
 func Watch(c metadata.Client) error {
 	w := &watcher{
-		c:       c,
-		applied: map[string]metadata.Network{},
+		c:             c,
+		applied:       map[string]metadata.Network{},
+		missingWarned: map[string]bool{},
 	}
 	go c.OnChange(5, w.onChangeNoError)
 	return nil
@@ -39,6 +38,9 @@ type watcher struct {
 	c           metadata.Client
 	applied     map[string]metadata.Network
 	lastApplied time.Time
+	// missingWarned holds the UUIDs of the networks already reported
+	// without cni config
+	missingWarned map[string]bool
 }
 
 func (w *watcher) onChangeNoError(version string) {
@@ -60,6 +62,8 @@ func (w *watcher) onChange(version string) error {
 
 	forceApply := time.Now().Sub(w.lastApplied) > reapplyEvery
 
+	w.warnMissingCNIConfig(network.FindNetworksMissingCNIConfig(networks, host))
+
 	for _, network := range networks {
 		if network.EnvironmentUUID != host.EnvironmentUUID {
 			logrus.Debugf("network: %v is not local to this environment", network.UUID)
@@ -80,6 +84,25 @@ func (w *watcher) onChange(version string) error {
 	return nil
 }
 
+// warnMissingCNIConfig warns once about each of the given networks, they
+// are applied on a later change once they have a cni config. A network
+// getting a cni config is warned about again if it loses it. It returns
+// the UUIDs of the networks warned about.
+func (w *watcher) warnMissingCNIConfig(missing []metadata.Network) []string {
+	warned := []string{}
+	stillMissing := map[string]bool{}
+	for _, aNetwork := range missing {
+		stillMissing[aNetwork.UUID] = true
+		if w.missingWarned[aNetwork.UUID] {
+			continue
+		}
+		logrus.Warnf("cniconf: network %v doesn't have a cni config yet, it will be applied once it has one", aNetwork.UUID)
+		warned = append(warned, aNetwork.UUID)
+	}
+	w.missingWarned = stillMissing
+	return warned
+}
+
 func (w *watcher) apply(network metadata.Network, host metadata.Host) error {
 	cniConf, _ := network.Metadata["cniConfig"].(map[string]interface{})
 	confDir := fmt.Sprintf(cniDir, network.Name)
@@ -89,22 +112,14 @@ func (w *watcher) apply(network metadata.Network, host metadata.Host) error {
 
 	var lastErr error
 	for file, config := range cniConf {
-		config = utils.UpdateCNIConfigByKeywords(config, host)
-		p := filepath.Join(confDir, file)
-		content, err := json.Marshal(config)
+		p := filepath.Join(confDir, utils.ResolveCNIFileName(file, network))
+		content, err := renderCNIConfig(config, host)
 		if err != nil {
 			lastErr = err
 			continue
 		}
 
-		out := &bytes.Buffer{}
-		if err := json.Indent(out, content, "", "  "); err != nil {
-			lastErr = err
-			continue
-		}
-
-		logrus.Debugf("Writing %s: %s", p, out)
-		if err := ioutil.WriteFile(p, out.Bytes(), 0600); err != nil {
+		if _, err := WriteCNIConfigIfChanged(p, content); err != nil {
 			lastErr = err
 		}
 	}
@@ -0,0 +1,28 @@
+package cniconf
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestWarnMissingCNIConfig(t *testing.T) {
+	w := &watcher{missingWarned: map[string]bool{}}
+	net1 := metadata.Network{UUID: "net1"}
+	net2 := metadata.Network{UUID: "net2"}
+
+	if warned := w.warnMissingCNIConfig([]metadata.Network{net1}); !reflect.DeepEqual(warned, []string{"net1"}) {
+		t.Errorf("expected: [net1], got actual: %v", warned)
+	}
+	if warned := w.warnMissingCNIConfig([]metadata.Network{net1, net2}); !reflect.DeepEqual(warned, []string{"net2"}) {
+		t.Errorf("expected: [net2], got actual: %v", warned)
+	}
+	// net1 got its cni config
+	if warned := w.warnMissingCNIConfig([]metadata.Network{net2}); len(warned) != 0 {
+		t.Errorf("expected no warning, got actual: %v", warned)
+	}
+	if warned := w.warnMissingCNIConfig([]metadata.Network{net1, net2}); !reflect.DeepEqual(warned, []string{"net1"}) {
+		t.Errorf("expected: [net1], got actual: %v", warned)
+	}
+}
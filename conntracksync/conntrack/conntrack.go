@@ -2,6 +2,7 @@ package conntrack
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"strings"
@@ -33,6 +34,40 @@ func ListDNAT() ([]CTEntry, error) {
 	return cmdCTListDNAT()
 }
 
+// FindConntrackForIPs lists the conntrack entries with any of the given IP
+// addresses as source or destination, in either direction
+func FindConntrackForIPs(ips []net.IP) ([]CTEntry, error) {
+	entries, err := cmdCTList()
+	if err != nil {
+		return nil, err
+	}
+	return filterEntriesForIPs(entries, ips), nil
+}
+
+func filterEntriesForIPs(entries []CTEntry, ips []net.IP) []CTEntry {
+	matches := func(s string) bool {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return false
+		}
+		for _, aIP := range ips {
+			if aIP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	found := []CTEntry{}
+	for _, e := range entries {
+		if matches(e.OriginalSourceIP) || matches(e.OriginalDestinationIP) ||
+			matches(e.ReplySourceIP) || matches(e.ReplyDestinationIP) {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
 // CTEntryCreate Addetes the given entry from the conntrack table
 func CTEntryCreate(e CTEntry) error {
 	cmd := exec.Command(
@@ -76,6 +111,19 @@ func CTEntryDelete(e CTEntry) error {
 	return nil
 }
 
+func cmdCTList() ([]CTEntry, error) {
+	out, err := exec.Command("conntrack", "-L").Output()
+	if err != nil {
+		logrus.Errorf("error getting conntrack entries")
+		return nil, err
+	}
+
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return parseMultipleEntries(string(out)), nil
+}
+
 func cmdCTListSNAT() ([]CTEntry, error) {
 	out, err := exec.Command("conntrack", "-n", "-L").Output()
 	if err != nil {
@@ -1,9 +1,13 @@
 package conntrack
 
 import (
+	"net"
+	"os"
+	"os/exec"
 	"testing"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
 )
 
 // Some of the tests can run only when in development,
@@ -97,3 +101,46 @@ tcp      6 431999 ESTABLISHED src=172.17.0.1 dst=169.254.169.250 sport=60830 dpo
 
 	parseMultipleEntries(entries)
 }
+
+func TestFilterEntriesForIPs(t *testing.T) {
+	entries := parseMultipleEntries(
+		"tcp      6 65 TIME_WAIT src=172.22.101.1 dst=172.22.101.101 sport=59032 dport=9901 src=10.42.205.140 dst=172.22.101.1 sport=80 dport=59032 [ASSURED] mark=0 use=1\n" +
+			"tcp      6 151 ESTABLISHED src=10.42.0.5 dst=169.254.169.250 sport=32985 dport=80 [UNREPLIED] src=169.254.169.250 dst=10.42.0.5 sport=80 dport=32985 mark=0 use=1\n" +
+			"udp      17 20 src=10.42.0.7 dst=8.8.8.8 sport=5353 dport=53 src=8.8.8.8 dst=172.22.101.101 sport=53 dport=5353 mark=0 use=1\n")
+
+	found := filterEntriesForIPs(entries, []net.IP{net.ParseIP("10.42.205.140"), net.ParseIP("10.42.0.5")})
+	if len(found) != 2 || found[0].ReplySourceIP != "10.42.205.140" || found[1].OriginalSourceIP != "10.42.0.5" {
+		t.Errorf("expected the entries of 10.42.205.140 and 10.42.0.5, got actual: %+v", found)
+	}
+
+	if found := filterEntriesForIPs(entries, []net.IP{net.ParseIP("10.42.0.99")}); len(found) != 0 {
+		t.Errorf("expected no entries, got actual: %+v", found)
+	}
+}
+
+func TestFindConntrackForIPs(t *testing.T) {
+	if _, err := exec.LookPath("conntrack"); err != nil || os.Geteuid() != 0 {
+		t.Skip("needs the conntrack binary and root privileges")
+	}
+
+	testNS, err := ns.NewNS()
+	if err != nil {
+		t.Skipf("couldn't create network namespace: %v", err)
+	}
+	defer testNS.Close()
+
+	// The conntrack table of a new network namespace is empty
+	err = testNS.Do(func(ns.NetNS) error {
+		found, err := FindConntrackForIPs([]net.IP{net.ParseIP("10.42.0.5")})
+		if err != nil {
+			return err
+		}
+		if len(found) != 0 {
+			t.Errorf("expected no entries, got actual: %+v", found)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package conntracksync
+
+import (
+	"net"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/conntracksync/conntrack"
+	"github.com/rancher/plugin-manager/metrics"
+)
+
+// endpoints is what is remembered of the local containers from one sync
+// to the next, to find the conntrack entries they left behind
+type endpoints struct {
+	// ips maps the IP of each container to the UUIDs of the containers
+	// using it, there can be several while a container is replaced
+	ips map[string]map[string]bool
+	// mappings maps each host port, keyed like the containersMap, to
+	// the IP of the container it targets
+	mappings map[string]string
+}
+
+// buildEndpoints remembers the IPs of the given containers, which own
+// their IP, and the host ports targeting them
+func buildEndpoints(containersMap map[string]*metadata.Container, owners []metadata.Container) endpoints {
+	e := endpoints{
+		ips:      map[string]map[string]bool{},
+		mappings: map[string]string{},
+	}
+	owner := map[string]bool{}
+	for _, c := range owners {
+		owner[c.UUID] = true
+		if e.ips[c.PrimaryIp] == nil {
+			e.ips[c.PrimaryIp] = map[string]bool{}
+		}
+		e.ips[c.PrimaryIp][c.UUID] = true
+	}
+	for key, c := range containersMap {
+		if owner[c.UUID] {
+			e.mappings[key] = c.PrimaryIp
+		}
+	}
+	return e
+}
+
+// staleIPs returns the IPs of the previous containers which are gone or
+// now belong only to other containers, sorted
+func staleIPs(previous, current endpoints) []net.IP {
+	stale := []string{}
+	for ip, uuids := range previous.ips {
+		kept := false
+		for uuid := range uuids {
+			if current.ips[ip][uuid] {
+				kept = true
+				break
+			}
+		}
+		if !kept {
+			stale = append(stale, ip)
+		}
+	}
+	sort.Strings(stale)
+
+	ips := []net.IP{}
+	for _, ip := range stale {
+		if parsed := net.ParseIP(ip); parsed != nil {
+			ips = append(ips, parsed)
+		}
+	}
+	return ips
+}
+
+// staleMappings returns the previous host port mappings which are gone,
+// with the IP they targeted. The mappings now targeting another IP are
+// left to the DNAT check of doSync.
+func staleMappings(previous, current endpoints) map[string]string {
+	stale := map[string]string{}
+	for key, ip := range previous.mappings {
+		if _, ok := current.mappings[key]; !ok {
+			stale[key] = ip
+		}
+	}
+	return stale
+}
+
+// staleDNATEntries returns the DNAT entries of the given mappings which
+// still reach the IP they targeted
+func staleDNATEntries(entries []conntrack.CTEntry, mappings map[string]string) []conntrack.CTEntry {
+	found := []conntrack.CTEntry{}
+	for _, e := range entries {
+		ip, ok := mappings[e.OriginalDestinationIP+":"+e.OriginalDestinationPort+"/"+e.Protocol]
+		if !ok {
+			ip, ok = mappings["0.0.0.0:"+e.OriginalDestinationPort+"/"+e.Protocol]
+		}
+		if ok && e.ReplySourceIP == ip {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// flushStaleEntries deletes the conntrack entries of the containers and
+// host port mappings removed since the previous sync, so the new flows
+// reach the container now using the IP or port instead of the old one
+func flushStaleEntries(previous, current endpoints) error {
+	var stale []conntrack.CTEntry
+
+	if ips := staleIPs(previous, current); len(ips) > 0 {
+		logrus.Debugf("conntracksync: flushing the conntrack entries of the removed IPs: %v", ips)
+		entries, err := conntrack.FindConntrackForIPs(ips)
+		if err != nil {
+			logrus.Errorf("conntracksync: error fetching the conntrack entries of the removed IPs")
+			return err
+		}
+		stale = append(stale, entries...)
+	}
+
+	if mappings := staleMappings(previous, current); len(mappings) > 0 {
+		logrus.Debugf("conntracksync: flushing the conntrack entries of the removed host ports: %v", mappings)
+		entries, err := conntrack.ListDNAT()
+		if err != nil {
+			logrus.Errorf("conntracksync: error fetching DNAT conntrack entries")
+			return err
+		}
+		stale = append(stale, staleDNATEntries(entries, mappings)...)
+	}
+
+	deleted := 0
+	seen := map[conntrack.CTEntry]bool{}
+	for _, e := range stale {
+		if seen[e] {
+			continue
+		}
+		seen[e] = true
+		logrus.Infof("conntracksync: deleting stale conntrack entry: %v", e)
+		if err := conntrack.CTEntryDelete(e); err != nil {
+			logrus.Errorf("conntracksync: error deleting the conntrack entry: %v", err)
+			continue
+		}
+		deleted++
+	}
+	metrics.RecordReconciled("conntracksync", "conntrack_entries", deleted)
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package conntracksync
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/conntracksync/conntrack"
+	"github.com/rancher/plugin-manager/testutil"
+)
+
+func testEndpoints(containers ...metadata.Container) endpoints {
+	containersMap := map[string]*metadata.Container{}
+	for i, c := range containers {
+		for _, port := range c.Ports {
+			containersMap[port] = &containers[i]
+		}
+	}
+	return buildEndpoints(containersMap, containers)
+}
+
+func TestStaleEndpoints(t *testing.T) {
+	web := metadata.Container{UUID: "web", PrimaryIp: "10.42.0.5", Ports: []string{"0.0.0.0:8080/tcp"}}
+	db := metadata.Container{UUID: "db", PrimaryIp: "10.42.0.6", Ports: []string{"172.22.101.101:5432/tcp"}}
+	dns := metadata.Container{UUID: "dns", PrimaryIp: "10.42.0.7", Ports: []string{"0.0.0.0:53/udp"}}
+	previous := testEndpoints(web, db, dns)
+
+	// web is gone and its IP reused by cache, db lost its host port
+	cache := metadata.Container{UUID: "cache", PrimaryIp: "10.42.0.5"}
+	db.Ports = nil
+	current := testEndpoints(cache, db, dns)
+
+	ips := staleIPs(previous, current)
+	if fmt.Sprint(ips) != "[10.42.0.5]" {
+		t.Errorf("expected: [10.42.0.5], got actual: %v", ips)
+	}
+
+	mappings := staleMappings(previous, current)
+	expected := map[string]string{"0.0.0.0:8080/tcp": "10.42.0.5", "172.22.101.101:5432/tcp": "10.42.0.6"}
+	if fmt.Sprint(mappings) != fmt.Sprint(expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, mappings)
+	}
+
+	if ips := staleIPs(current, current); len(ips) != 0 {
+		t.Errorf("expected no stale IPs, got actual: %v", ips)
+	}
+	if mappings := staleMappings(current, current); len(mappings) != 0 {
+		t.Errorf("expected no stale mappings, got actual: %v", mappings)
+	}
+}
+
+func TestStaleEndpointsHostNetwork(t *testing.T) {
+	mc := &testutil.FakeMetadataClient{
+		Host:     metadata.Host{UUID: "host1", AgentIP: "172.22.101.101"},
+		Networks: []metadata.Network{{UUID: "hostnet", Name: "host"}, {UUID: "net1", Name: "managed"}},
+		Containers: []metadata.Container{
+			{UUID: "agent", HostUUID: "host1", State: "running", NetworkUUID: "hostnet", PrimaryIp: "172.22.101.101"},
+			{UUID: "monitor", HostUUID: "host1", State: "running", NetworkUUID: "hostnet", PrimaryIp: "172.22.101.101", Ports: []string{"0.0.0.0:9100:9100/tcp"}},
+			{UUID: "web", HostUUID: "host1", State: "running", NetworkUUID: "net1", PrimaryIp: "10.42.0.5"},
+		},
+	}
+	ctw := &ConntrackTableWatcher{mc: mc}
+
+	containersMap, owners, err := ctw.buildContainersMaps()
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	previous := buildEndpoints(containersMap, owners)
+
+	// The monitor goes away, the host IP must not be flushed
+	mc.Containers = append(mc.Containers[:1], mc.Containers[2])
+	containersMap, owners, err = ctw.buildContainersMaps()
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	current := buildEndpoints(containersMap, owners)
+
+	if ips := staleIPs(previous, current); len(ips) != 0 {
+		t.Errorf("expected no stale IPs, got actual: %v", ips)
+	}
+	if mappings := staleMappings(previous, current); len(mappings) != 0 {
+		t.Errorf("expected no stale mappings, got actual: %v", mappings)
+	}
+	if len(current.ips) != 1 || !current.ips["10.42.0.5"]["web"] {
+		t.Errorf("expected only the IP of web, got actual: %v", current.ips)
+	}
+}
+
+func TestStaleEndpointsSharedIP(t *testing.T) {
+	old := metadata.Container{UUID: "old", PrimaryIp: "10.42.0.5"}
+	replacement := metadata.Container{UUID: "new", PrimaryIp: "10.42.0.5"}
+
+	// While the old container is replaced both use the IP, the flows of
+	// the new one are kept once the old one is gone
+	previous := testEndpoints(old, replacement)
+	if ips := staleIPs(previous, testEndpoints(replacement)); len(ips) != 0 {
+		t.Errorf("expected no stale IPs, got actual: %v", ips)
+	}
+	if ips := staleIPs(previous, testEndpoints()); fmt.Sprint(ips) != "[10.42.0.5]" {
+		t.Errorf("expected: [10.42.0.5], got actual: %v", ips)
+	}
+}
+
+func TestStaleDNATEntries(t *testing.T) {
+	mappings := map[string]string{"0.0.0.0:8080/tcp": "10.42.0.5", "172.22.101.101:5432/tcp": "10.42.0.6"}
+	entries := []conntrack.CTEntry{
+		{Protocol: "tcp", OriginalDestinationIP: "172.22.101.101", OriginalDestinationPort: "8080", ReplySourceIP: "10.42.0.5"},
+		{Protocol: "tcp", OriginalDestinationIP: "172.22.101.101", OriginalDestinationPort: "5432", ReplySourceIP: "10.42.0.6"},
+		{Protocol: "udp", OriginalDestinationIP: "172.22.101.101", OriginalDestinationPort: "8080", ReplySourceIP: "10.42.0.5"},
+		{Protocol: "tcp", OriginalDestinationIP: "172.22.101.102", OriginalDestinationPort: "5432", ReplySourceIP: "10.42.0.6"},
+		{Protocol: "tcp", OriginalDestinationIP: "172.22.101.101", OriginalDestinationPort: "8080", ReplySourceIP: "10.42.0.9"},
+	}
+
+	found := staleDNATEntries(entries, mappings)
+	if len(found) != 2 || found[0] != entries[0] || found[1] != entries[1] {
+		t.Errorf("expected: %v, got actual: %v", entries[:2], found)
+	}
+}
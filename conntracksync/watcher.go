@@ -7,7 +7,9 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/changes"
 	"github.com/rancher/plugin-manager/conntracksync/conntrack"
+	"github.com/rancher/plugin-manager/metrics"
 )
 
 var (
@@ -23,11 +25,31 @@ type ConntrackTableWatcher struct {
 	syncInterval time.Duration
 	mc           metadata.Client
 	lastApplied  time.Time
+	// endpoints of the previous sync, nil until the first one succeeded
+	endpoints *endpoints
 }
 
 // Watch starts the go routine to periodically check the conntrack table
 // for any discrepancies
 func Watch(syncIntervalStr string, mc metadata.Client) error {
+	ctw := newConntrackTableWatcher(syncIntervalStr, mc)
+	go mc.OnChange(120, ctw.onChangeNoError)
+
+	return nil
+}
+
+// Subscribe syncs the conntrack table when the containers or hosts change
+// according to the given notifier, instead of on every metadata change.
+// It's also synced every resync interval.
+func Subscribe(n *changes.Notifier, syncIntervalStr, resyncIntervalStr string, mc metadata.Client) error {
+	ctw := newConntrackTableWatcher(syncIntervalStr, mc)
+	n.Subscribe("conntracksync", []string{changes.Containers, changes.Hosts},
+		ctw.syncInterval, changes.ResyncInterval(resyncIntervalStr), ctw.doSync)
+
+	return nil
+}
+
+func newConntrackTableWatcher(syncIntervalStr string, mc metadata.Client) *ConntrackTableWatcher {
 	logrus.Debugf("ctsync: syncIntervalStr: %v", syncIntervalStr)
 
 	syncInterval := DefaultSyncInterval
@@ -36,14 +58,10 @@ func Watch(syncIntervalStr string, mc metadata.Client) error {
 
 	}
 
-	ctw := &ConntrackTableWatcher{
+	return &ConntrackTableWatcher{
 		syncInterval: time.Duration(syncInterval) * time.Second,
 		mc:           mc,
 	}
-
-	go mc.OnChange(120, ctw.onChangeNoError)
-
-	return nil
 }
 
 func (ctw *ConntrackTableWatcher) onChangeNoError(version string) {
@@ -54,14 +72,17 @@ func (ctw *ConntrackTableWatcher) onChangeNoError(version string) {
 		logrus.Debugf("ctsync: sleeping for %v", timeToSleep)
 		time.Sleep(timeToSleep)
 	}
-	if err := ctw.doSync(); err != nil {
+	started := time.Now()
+	err := ctw.doSync()
+	if err != nil {
 		logrus.Errorf("ctsync: while syncing, got error: %v", err)
 	}
+	metrics.RecordSync("conntracksync", started, err)
 	ctw.lastApplied = time.Now()
 }
 
 func (ctw *ConntrackTableWatcher) doSync() error {
-	containersMap, err := ctw.buildContainersMaps()
+	containersMap, owners, err := ctw.buildContainersMaps()
 	if err != nil {
 		logrus.Errorf("conntracksync: error building containersMap")
 		return err
@@ -119,30 +140,63 @@ func (ctw *ConntrackTableWatcher) doSync() error {
 		}
 	}
 
+	current := buildEndpoints(containersMap, owners)
+	if ctw.endpoints != nil {
+		if err := flushStaleEntries(*ctw.endpoints, current); err != nil {
+			return err
+		}
+	}
+	ctw.endpoints = &current
+
 	return nil
 }
 
+// buildContainersMaps returns the local running containers keyed by their
+// host ports, along with the local running containers owning their IP.
+// The containers using the host networking share the IP of the host and
+// aren't owners.
 func (ctw *ConntrackTableWatcher) buildContainersMaps() (
-	map[string]*metadata.Container, error) {
+	map[string]*metadata.Container, []metadata.Container, error) {
 	host, err := ctw.mc.GetSelfHost()
 	if err != nil {
 		logrus.Errorf("conntracksync: error fetching self host from metadata")
-		return nil, err
+		return nil, nil, err
 	}
 
-	containers, err := ctw.mc.GetContainers()
+	allContainers, err := ctw.mc.GetContainers()
 	if err != nil {
 		logrus.Errorf("conntracksync: error fetching containers from metadata")
-		return nil, err
+		return nil, nil, err
 	}
-	containersMap := make(map[string]*metadata.Container)
-	for index, aContainer := range containers {
+
+	networks, err := ctw.mc.GetNetworks()
+	if err != nil {
+		logrus.Errorf("conntracksync: error fetching networks from metadata")
+		return nil, nil, err
+	}
+	hostNetworks := map[string]bool{}
+	for _, aNetwork := range networks {
+		if aNetwork.Name == "host" {
+			hostNetworks[aNetwork.UUID] = true
+		}
+	}
+
+	containers := []metadata.Container{}
+	owners := []metadata.Container{}
+	for _, aContainer := range allContainers {
 		if !(aContainer.HostUUID == host.UUID &&
-			(aContainer.State == "running" || aContainer.State == "starting") &&
-			len(aContainer.Ports) > 0) {
+			(aContainer.State == "running" || aContainer.State == "starting")) {
 			continue
 		}
+		containers = append(containers, aContainer)
+		if aContainer.PrimaryIp != "" && aContainer.PrimaryIp != host.AgentIP &&
+			!hostNetworks[aContainer.NetworkUUID] {
+			owners = append(owners, aContainer)
+		}
+	}
 
+	containersMap := make(map[string]*metadata.Container)
+	for index, aContainer := range containers {
 		for _, aPort := range aContainer.Ports {
 			protocol := "tcp"
 			splits := strings.Split(aPort, ":")
@@ -157,9 +211,37 @@ func (ctw *ConntrackTableWatcher) buildContainersMaps() (
 				protocol = parts[1]
 			}
 
-			containersMap[hostIP+":"+hostPort+"/"+protocol] = &containers[index]
+			for _, port := range expandPortRange(hostPort) {
+				containersMap[hostIP+":"+port+"/"+protocol] = &containers[index]
+			}
 		}
 	}
 
-	return containersMap, nil
+	return containersMap, owners, nil
+}
+
+// expandPortRange returns the ports of a host port or port range like
+// 30000-30100, so the conntrack entries are matched by their single port.
+// It's empty for an invalid range.
+func expandPortRange(ports string) []string {
+	parts := strings.Split(ports, "-")
+	if len(parts) == 1 {
+		return parts
+	}
+	if len(parts) != 2 {
+		return nil
+	}
+	first, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil
+	}
+	last, err := strconv.Atoi(parts[1])
+	if err != nil || first < 1 || last > 65535 || first > last {
+		return nil
+	}
+	expanded := make([]string, 0, last-first+1)
+	for port := first; port <= last; port++ {
+		expanded = append(expanded, strconv.Itoa(port))
+	}
+	return expanded
 }
@@ -0,0 +1,33 @@
+package conntracksync
+
+import (
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/testutil"
+)
+
+func TestBuildContainersMapsPortRange(t *testing.T) {
+	mc := &testutil.FakeMetadataClient{
+		Host:     metadata.Host{UUID: "host1", AgentIP: "172.22.101.101"},
+		Networks: []metadata.Network{{UUID: "net1", Name: "managed"}},
+		Containers: []metadata.Container{
+			{UUID: "rtp", HostUUID: "host1", State: "running", NetworkUUID: "net1", PrimaryIp: "10.42.0.5",
+				Ports: []string{"0.0.0.0:30000-30100:30000-30100/udp", "172.22.101.101:8080:80/tcp", "0.0.0.0:40100-40000:80/tcp"}},
+		},
+	}
+	ctw := &ConntrackTableWatcher{mc: mc}
+
+	containersMap, _, err := ctw.buildContainersMaps()
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	for _, key := range []string{"0.0.0.0:30000/udp", "0.0.0.0:30042/udp", "0.0.0.0:30100/udp", "172.22.101.101:8080/tcp"} {
+		if c, ok := containersMap[key]; !ok || c.UUID != "rtp" {
+			t.Errorf("%v: expected: rtp, got actual: %v", key, c)
+		}
+	}
+	if expected, actual := 102, len(containersMap); actual != expected {
+		t.Errorf("expected: %v, got actual: %v", expected, actual)
+	}
+}
@@ -0,0 +1,87 @@
+package debugapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// stateKeys are the fields of the states, in the order they're printed
+var stateKeys = []string{"desired", "applied", "actual", "diff", "advisory"}
+
+// Get fetches the state of the given module from the API listening on
+// the given socket
+func Get(socketPath, module string) (map[string]json.RawMessage, error) {
+	c := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", socketPath)
+			},
+		},
+	}
+
+	resp, err := c.Get("http://plugin-manager/v1/state/" + module)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting the state of %v", module)
+	}
+	defer resp.Body.Close()
+
+	state := map[string]json.RawMessage{}
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return nil, errors.Wrapf(err, "decoding the state of %v", module)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var msg string
+		json.Unmarshal(state["error"], &msg)
+		return nil, fmt.Errorf("getting the state of %v: %v", module, msg)
+	}
+	return state, nil
+}
+
+// Print pretty-prints the state of the module, the diff and the advisory
+// changes one change per line
+func Print(w io.Writer, module string, state map[string]json.RawMessage) error {
+	fmt.Fprintf(w, "== %v ==\n", module)
+	for _, key := range stateKeys {
+		raw, ok := state[key]
+		if !ok {
+			continue
+		}
+
+		if key == "diff" || key == "advisory" {
+			diff := []string{}
+			if err := json.Unmarshal(raw, &diff); err != nil {
+				return errors.Wrapf(err, "decoding the %v of %v", key, module)
+			}
+			if key == "advisory" {
+				if len(diff) == 0 {
+					continue
+				}
+				fmt.Fprintln(w, "advisory (not applied by any sync):")
+			} else {
+				fmt.Fprintf(w, "%v:\n", key)
+			}
+			if len(diff) == 0 {
+				fmt.Fprintln(w, "  no changes")
+			}
+			for _, line := range diff {
+				fmt.Fprintf(w, "  %v\n", line)
+			}
+			continue
+		}
+
+		fmt.Fprintf(w, "%v:\n", key)
+		buf := &bytes.Buffer{}
+		if err := json.Indent(buf, raw, "  ", "  "); err != nil {
+			return errors.Wrapf(err, "decoding the %v state of %v", key, module)
+		}
+		fmt.Fprintf(w, "  %s\n", buf)
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
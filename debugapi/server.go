@@ -0,0 +1,126 @@
+package debugapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/arpsync"
+	"github.com/rancher/plugin-manager/hostports"
+	"github.com/rancher/plugin-manager/network"
+	"github.com/rancher/plugin-manager/routesync"
+)
+
+// DefaultSocketPath is the socket used by the state command by default
+const DefaultSocketPath = "/var/run/plugin-manager.sock"
+
+// Modules lists the modules whose state is served, in the order they're
+// printed
+var Modules = []string{"networks", "routes", "arp", "hostports"}
+
+// stateFunc computes the desired and actual state of a module along with
+// the diff its next sync applies, without changing anything
+type stateFunc func(mc metadata.Client) (interface{}, error)
+
+var states = map[string]stateFunc{
+	"networks": func(mc metadata.Client) (interface{}, error) {
+		return network.GetNetworksState(mc)
+	},
+	"routes": func(mc metadata.Client) (interface{}, error) {
+		return routesync.GetState(mc)
+	},
+	"arp": func(mc metadata.Client) (interface{}, error) {
+		return arpsync.GetState(mc)
+	},
+	"hostports": func(mc metadata.Client) (interface{}, error) {
+		return hostports.GetState(mc)
+	},
+}
+
+// Handler serves the state of each module on /v1/state/<module>, the
+// list of the modules on /v1/state
+func Handler(mc metadata.Client) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/state", func(w http.ResponseWriter, r *http.Request) {
+		if !readOnly(w, r) {
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"modules": Modules})
+	})
+	mux.HandleFunc("/v1/state/", func(w http.ResponseWriter, r *http.Request) {
+		if !readOnly(w, r) {
+			return
+		}
+		module := strings.TrimPrefix(r.URL.Path, "/v1/state/")
+		get, ok := states[module]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown module " + module})
+			return
+		}
+		state, err := get(mc)
+		if err != nil {
+			logrus.Errorf("debugapi: error getting the state of %v: %v", module, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, state)
+	})
+	return mux
+}
+
+func readOnly(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet {
+		return true
+	}
+	w.Header().Set("Allow", http.MethodGet)
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "the API is read-only"})
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Errorf("debugapi: error writing response: %v", err)
+	}
+}
+
+// Listen serves the API on the unix socket at the given path in the
+// background, replacing a socket left by a previous run. It's an error
+// if something else than a socket is at the path. Only root can connect
+// to it.
+func Listen(socketPath string, mc metadata.Client) error {
+	if info, err := os.Lstat(socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%v exists and isn't a socket", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return errors.Wrapf(err, "removing %v", socketPath)
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.Wrapf(err, "checking %v", socketPath)
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return errors.Wrapf(err, "listening on %v", socketPath)
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		l.Close()
+		return errors.Wrapf(err, "restricting access to %v", socketPath)
+	}
+
+	go func() {
+		if err := http.Serve(l, Handler(mc)); err != nil {
+			logrus.Errorf("debugapi: error serving on %v: %v", socketPath, err)
+		}
+	}()
+	logrus.Infof("debugapi: serving the state of the modules on %v", socketPath)
+	return nil
+}
@@ -0,0 +1,113 @@
+package debugapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+type testState struct {
+	Desired []string `json:"desired"`
+	Actual  []string `json:"actual"`
+	Diff    []string `json:"diff"`
+}
+
+func TestListen(t *testing.T) {
+	defer func(s map[string]stateFunc) { states = s }(states)
+	states = map[string]stateFunc{
+		"routes": func(metadata.Client) (interface{}, error) {
+			return testState{Desired: []string{"10.42.0.0/16"}, Actual: []string{}, Diff: []string{"+ route 10.42.0.0/16 dev docker0"}}, nil
+		},
+		"arp": func(metadata.Client) (interface{}, error) {
+			return nil, fmt.Errorf("no ARP table")
+		},
+	}
+
+	socketPath := filepath.Join(t.TempDir(), "plugin-manager.sock")
+	if err := Listen(socketPath, nil); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	state, err := Get(socketPath, "routes")
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	out := &bytes.Buffer{}
+	if err := Print(out, "routes", state); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	expected := "== routes ==\n" +
+		"desired:\n" +
+		"  [\n" +
+		"    \"10.42.0.0/16\"\n" +
+		"  ]\n" +
+		"actual:\n" +
+		"  []\n" +
+		"diff:\n" +
+		"  + route 10.42.0.0/16 dev docker0\n\n"
+	if out.String() != expected {
+		t.Errorf("expected:\n%v\ngot actual:\n%v", expected, out)
+	}
+
+	if _, err := Get(socketPath, "arp"); err == nil {
+		t.Errorf("expecting error for a failing module, but got nil")
+	}
+	if _, err := Get(socketPath, "conntrack"); err == nil {
+		t.Errorf("expecting error for an unknown module, but got nil")
+	}
+
+	// A socket left by a previous run is replaced, anything else is kept
+	if err := Listen(socketPath, nil); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	filePath := filepath.Join(t.TempDir(), "plugin-manager.conf")
+	if err := ioutil.WriteFile(filePath, []byte("keep"), 0644); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if err := Listen(filePath, nil); err == nil {
+		t.Errorf("expecting error for a file which isn't a socket, but got nil")
+	}
+	if content, err := ioutil.ReadFile(filePath); err != nil || string(content) != "keep" {
+		t.Errorf("expected the file to be kept, got actual: %q (%v)", content, err)
+	}
+}
+
+func TestPrintAdvisory(t *testing.T) {
+	state := map[string]json.RawMessage{
+		"diff":     json.RawMessage(`[]`),
+		"advisory": json.RawMessage(`["+ bridge docker2"]`),
+	}
+	out := &bytes.Buffer{}
+	if err := Print(out, "networks", state); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	expected := "== networks ==\n" +
+		"diff:\n" +
+		"  no changes\n" +
+		"advisory (not applied by any sync):\n" +
+		"  + bridge docker2\n\n"
+	if out.String() != expected {
+		t.Errorf("expected:\n%v\ngot actual:\n%v", expected, out)
+	}
+}
+
+func TestHandlerReadOnly(t *testing.T) {
+	server := httptest.NewServer(Handler(nil))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/v1/state/routes", "application/json", nil)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected: %v, got actual: %v", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
@@ -0,0 +1,202 @@
+package firewall
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// The supported backend modes
+const (
+	// ModeAuto probes the host for the backend already in use
+	ModeAuto = "auto"
+	// ModeLegacy uses the iptables-legacy binaries
+	ModeLegacy = "legacy"
+	// ModeNFT uses the iptables-nft binaries, which render the rules
+	// into nftables
+	ModeNFT = "nft"
+	// ModeDefault uses the iptables binaries of the host as they are
+	ModeDefault = "default"
+	// ModeNFTables programs the rules into nftables over netlink, without
+	// any binary
+	ModeNFTables = "nftables"
+)
+
+// Backend holds the binaries used to program the iptables rules, the
+// native nftables backend has none
+type Backend struct {
+	Mode    string
+	Binary  string
+	Restore string
+	Save    string
+}
+
+var (
+	legacyBackend  = Backend{Mode: ModeLegacy, Binary: "iptables-legacy", Restore: "iptables-legacy-restore", Save: "iptables-legacy-save"}
+	nftBackend     = Backend{Mode: ModeNFT, Binary: "iptables-nft", Restore: "iptables-nft-restore", Save: "iptables-nft-save"}
+	defaultBackend = Backend{Mode: ModeDefault, Binary: "iptables", Restore: "iptables-restore", Save: "iptables-save"}
+	nativeBackend  = Backend{Mode: ModeNFTables}
+
+	lookPath          = exec.LookPath
+	countRules        = countSavedRules
+	nftablesSupported = probeNFTables
+
+	backendLock sync.RWMutex
+	current     = defaultBackend
+)
+
+// Select sets the backend used by Apply and Rules for the given mode,
+// ModeAuto picks the backend holding the most rules on the host, falling
+// back to the iptables binaries of the host when unsure and to the native
+// nftables backend when there are no iptables binaries
+func Select(mode string) (Backend, error) {
+	var b Backend
+	switch mode {
+	case ModeAuto, "":
+		b = probe()
+	case ModeLegacy:
+		b = legacyBackend
+	case ModeNFT:
+		b = nftBackend
+	case ModeDefault:
+		b = defaultBackend
+	case ModeNFTables:
+		b = nativeBackend
+	default:
+		return Backend{}, fmt.Errorf("unknown firewall backend %v, expected one of %v", mode,
+			strings.Join([]string{ModeAuto, ModeLegacy, ModeNFT, ModeDefault, ModeNFTables}, ", "))
+	}
+
+	if b.Mode == ModeNFTables {
+		if err := nftablesSupported(); err != nil {
+			return Backend{}, fmt.Errorf("firewall backend %v isn't available, the kernel doesn't support nftables: %v", b.Mode, err)
+		}
+	} else if _, err := lookPath(b.Binary); err != nil {
+		return Backend{}, fmt.Errorf("firewall backend %v isn't available, the iptables binaries are needed: %v", b.Mode, err)
+	}
+
+	backendLock.Lock()
+	defer backendLock.Unlock()
+	current = b
+	logrus.Infof("firewall: using the %v backend (%v)", b.Mode, b.description())
+	return b, nil
+}
+
+func (b Backend) description() string {
+	if b.Mode == ModeNFTables {
+		return "netlink"
+	}
+	return b.Binary
+}
+
+// Current returns the backend in use
+func Current() Backend {
+	backendLock.RLock()
+	defer backendLock.RUnlock()
+	return current
+}
+
+// probe returns the backend with the most rules, like the other programs
+// on the host (docker, kube-proxy) do to stay on the same one as the rules
+// of both aren't seen by each other
+func probe() Backend {
+	counts := map[string]int{}
+	for _, b := range []Backend{legacyBackend, nftBackend} {
+		if _, err := lookPath(b.Save); err != nil {
+			continue
+		}
+		n, err := countRules(b.Save)
+		if err != nil {
+			logrus.Debugf("firewall: couldn't list the %v rules: %v", b.Mode, err)
+			continue
+		}
+		counts[b.Mode] = n
+	}
+
+	legacy, hasLegacy := counts[ModeLegacy]
+	nft, hasNFT := counts[ModeNFT]
+	switch {
+	case hasLegacy && hasNFT && legacy > nft:
+		return legacyBackend
+	case hasLegacy && hasNFT && nft > legacy:
+		return nftBackend
+	case hasLegacy && !hasNFT:
+		return legacyBackend
+	case hasNFT && !hasLegacy:
+		return nftBackend
+	}
+	if _, err := lookPath(defaultBackend.Binary); err != nil && nftablesSupported() == nil {
+		return nativeBackend
+	}
+	return defaultBackend
+}
+
+// countSavedRules returns the number of rules listed by the given save
+// binary, the chain declarations aren't counted
+func countSavedRules(save string) (int, error) {
+	out, err := exec.Command(save).Output()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "-A ") {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Apply replaces the rules of the chains with the current backend and
+// makes sure their hooks are in place
+func Apply(chains []Chain) error {
+	if Current().Mode == ModeNFTables {
+		return applyNFTables(chains)
+	}
+	return applyIPTables(chains)
+}
+
+// iptables runs the iptables binary of the current backend with the
+// given arguments
+func iptables(args ...string) error {
+	binary := Current().Binary
+	logrus.Debugf("Running %s %s", binary, strings.Join(args, " "))
+	cmd := exec.Command(binary, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Rules lists the rules of the chain of the given table with the current
+// backend, in the iptables -S format
+func Rules(table, chain string) ([]string, error) {
+	if Current().Mode == ModeNFTables {
+		return nftablesRules(chain)
+	}
+	out, err := exec.Command(Current().Binary, "-w", "-t", table, "-S", chain).Output()
+	if err != nil {
+		return nil, err
+	}
+	rules := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "-A ") {
+			rules = append(rules, line)
+		}
+	}
+	return rules, nil
+}
+
+// restore applies the given rules with the iptables-restore binary of the
+// current backend, without flushing the chains not listed in the rules
+func restore(rules io.Reader) error {
+	cmd := exec.Command(Current().Restore, "-n")
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	cmd.Stdin = rules
+	return cmd.Run()
+}
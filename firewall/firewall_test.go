@@ -0,0 +1,131 @@
+package firewall
+
+import (
+	"fmt"
+	"testing"
+)
+
+func fakeHost(binaries map[string]bool, rules map[string]int, nftables bool) {
+	lookPath = func(file string) (string, error) {
+		if !binaries[file] {
+			return "", fmt.Errorf("%v not found", file)
+		}
+		return "/usr/sbin/" + file, nil
+	}
+	countRules = func(save string) (int, error) {
+		n, ok := rules[save]
+		if !ok {
+			return 0, fmt.Errorf("%v failed", save)
+		}
+		return n, nil
+	}
+	nftablesSupported = func() error {
+		if !nftables {
+			return fmt.Errorf("nf_tables not found")
+		}
+		return nil
+	}
+}
+
+func TestSelect(t *testing.T) {
+	defer func(l func(string) (string, error), c func(string) (int, error), n func() error, b Backend) {
+		lookPath, countRules, nftablesSupported, current = l, c, n, b
+	}(lookPath, countRules, nftablesSupported, current)
+
+	all := map[string]bool{
+		"iptables": true, "iptables-save": true,
+		"iptables-legacy": true, "iptables-legacy-save": true,
+		"iptables-nft": true, "iptables-nft-save": true,
+	}
+
+	tests := []struct {
+		name     string
+		mode     string
+		binaries map[string]bool
+		rules    map[string]int
+		expected string
+	}{
+		{"more legacy rules", ModeAuto, all, map[string]int{"iptables-legacy-save": 12, "iptables-nft-save": 2}, ModeLegacy},
+		{"more nft rules", ModeAuto, all, map[string]int{"iptables-legacy-save": 0, "iptables-nft-save": 7}, ModeNFT},
+		{"no rules", ModeAuto, all, map[string]int{"iptables-legacy-save": 0, "iptables-nft-save": 0}, ModeDefault},
+		{"nft listing fails", "", all, map[string]int{"iptables-legacy-save": 0}, ModeLegacy},
+		{"only nft", ModeAuto, map[string]bool{"iptables-nft": true, "iptables-nft-save": true}, map[string]int{"iptables-nft-save": 0}, ModeNFT},
+		{"neither", ModeAuto, map[string]bool{"iptables": true}, nil, ModeDefault},
+		{"no binaries", ModeAuto, map[string]bool{}, nil, ModeNFTables},
+		{"explicit nftables", ModeNFTables, all, nil, ModeNFTables},
+		{"explicit legacy", ModeLegacy, all, map[string]int{"iptables-nft-save": 7}, ModeLegacy},
+		{"explicit nft", ModeNFT, all, nil, ModeNFT},
+		{"explicit default", ModeDefault, all, nil, ModeDefault},
+	}
+
+	for _, test := range tests {
+		fakeHost(test.binaries, test.rules, true)
+		b, err := Select(test.mode)
+		if err != nil {
+			t.Errorf("%v: not expecting error: %v", test.name, err)
+			continue
+		}
+		if b.Mode != test.expected || Current() != b {
+			t.Errorf("%v: expected: %v, got actual: %v (current %v)", test.name, test.expected, b.Mode, Current().Mode)
+		}
+	}
+
+	fakeHost(map[string]bool{"iptables": true}, nil, false)
+	if _, err := Select(ModeNFT); err == nil {
+		t.Errorf("expecting error for a missing backend, but got nil")
+	}
+	if _, err := Select(ModeNFTables); err == nil {
+		t.Errorf("expecting error for a kernel without nftables, but got nil")
+	}
+	if _, err := Select("ebtables"); err == nil {
+		t.Errorf("expecting error for an unknown backend, but got nil")
+	}
+	if Current().Mode != ModeDefault {
+		t.Errorf("expected the backend to be unchanged after an error, got actual: %v", Current().Mode)
+	}
+}
+
+func TestIptablesRestore(t *testing.T) {
+	chains := []Chain{
+		{Table: "raw", Name: "CATTLE_RAW_PREROUTING", Hook: "PREROUTING", Rules: []Rule{
+			{NotInInterface: "docker0", Protocol: "udp", DestinationPort: "30000-30100", Target: TargetMark, SetMark: 0x1068},
+		}},
+		{Table: "nat", Name: "CATTLE_PREROUTING", Hook: "PREROUTING", HookRule: Rule{DestinationType: "LOCAL"}, Rules: []Rule{
+			{Destination: "172.22.101.101", Protocol: "tcp", DestinationPort: "8080", Target: TargetDNAT, ToDestination: "10.42.0.5:80"},
+		}},
+		{Table: "nat", Name: "CATTLE_NAT_POSTROUTING", Rules: []Rule{
+			{Protocol: "tcp", Source: "10.42.0.0/16", NotOutInterface: "docker0", Target: TargetMasquerade, ToPorts: "1024-65535"},
+			{OutInterface: "docker0", SourceType: "LOCAL", DestinationType: "UNICAST", Target: TargetMasquerade},
+		}},
+		{Table: "filter", Name: "CATTLE_FORWARD", Rules: []Rule{{Mark: 0x4000, Target: TargetAccept}}},
+	}
+
+	expected := `*raw
+:CATTLE_RAW_PREROUTING -
+-F CATTLE_RAW_PREROUTING
+-A CATTLE_RAW_PREROUTING ! -i docker0 -p udp -m udp --dport 30000:30100 -j MARK --set-mark 0x1068
+COMMIT
+*nat
+:CATTLE_PREROUTING -
+:CATTLE_NAT_POSTROUTING -
+-F CATTLE_PREROUTING
+-F CATTLE_NAT_POSTROUTING
+-A CATTLE_PREROUTING -d 172.22.101.101 -p tcp -m tcp --dport 8080 -j DNAT --to-destination 10.42.0.5:80
+-A CATTLE_NAT_POSTROUTING -s 10.42.0.0/16 ! -o docker0 -p tcp -m tcp -j MASQUERADE --to-ports 1024-65535
+-A CATTLE_NAT_POSTROUTING -o docker0 -m addrtype --src-type LOCAL --dst-type UNICAST -j MASQUERADE
+COMMIT
+*filter
+:CATTLE_FORWARD -
+-F CATTLE_FORWARD
+-A CATTLE_FORWARD -m mark --mark 0x4000 -j ACCEPT
+COMMIT
+`
+	if actual := string(iptablesRestore(chains)); actual != expected {
+		t.Errorf("expected:\n%v\ngot actual:\n%v", expected, actual)
+	}
+
+	expected = "-m addrtype --dst-type LOCAL -j CATTLE_PREROUTING"
+	if actual := chains[1].hookRule().String(); actual != expected {
+		t.Errorf("expected: %v, got actual: %v", expected, actual)
+	}
+}
@@ -0,0 +1,666 @@
+package firewall
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// The chains of the native nftables backend are in this table of the ip
+// family. The hooks are base chains named after the chain they jump to.
+var (
+	nftTable      = "rancher"
+	nftHookSuffix = "_HOOK"
+)
+
+// The nf_tables netlink API, from linux/netfilter/nfnetlink.h and
+// linux/netfilter/nf_tables.h
+const (
+	nfnlSubsysNFTables = 10
+	nfnlMsgBatchBegin  = 0x10
+	nfnlMsgBatchEnd    = 0x11
+	nfprotoIPv4        = 2
+	nlaFNested         = 0x8000
+
+	nftMsgNewTable = 0
+	nftMsgNewChain = 3
+	nftMsgNewRule  = 6
+	nftMsgGetRule  = 7
+	nftMsgDelRule  = 8
+	nftMsgGetGen   = 16
+
+	nftaTableName = 1
+
+	nftaChainTable  = 1
+	nftaChainName   = 3
+	nftaChainHook   = 4
+	nftaChainPolicy = 5
+	nftaChainType   = 7
+	nftaHookHooknum = 1
+	nftaHookPrio    = 2
+
+	nftaRuleTable       = 1
+	nftaRuleChain       = 2
+	nftaRuleExpressions = 4
+	nftaRuleUserdata    = 7
+	nftUserdataMaxLen   = 256
+
+	nftaListElem     = 1
+	nftaExprName     = 1
+	nftaExprData     = 2
+	nftaDataValue    = 1
+	nftaDataVerdict  = 2
+	nftaVerdictCode  = 1
+	nftaVerdictChain = 2
+
+	nftRegVerdict = 0
+	nftReg1       = 1
+	nftReg2       = 2
+
+	nfAccept = 1
+	nftJump  = 0xfffffffd
+
+	nftCmpEq  = 0
+	nftCmpNeq = 1
+	nftCmpLte = 3
+	nftCmpGte = 5
+
+	nftMetaMark    = 3
+	nftMetaIifname = 6
+	nftMetaOifname = 7
+	nftMetaL4proto = 16
+
+	nftPayloadNetwork   = 1
+	nftPayloadTransport = 2
+
+	nftaFibFlagSaddr    = 1
+	nftaFibFlagDaddr    = 2
+	nftFibResultAddrtyp = 3
+
+	nftNatDNAT             = 1
+	nfNatRangeMapIPs       = 1
+	nfNatRangeProtoSpecify = 2
+
+	nfInetPreRouting  = 0
+	nfInetLocalIn     = 1
+	nfInetForward     = 2
+	nfInetLocalOut    = 3
+	nfInetPostRouting = 4
+)
+
+var (
+	nftProtocols    = map[string]byte{"tcp": syscall.IPPROTO_TCP, "udp": syscall.IPPROTO_UDP, "sctp": 132}
+	nftAddressTypes = map[string]uint32{"UNICAST": syscall.RTN_UNICAST, "LOCAL": syscall.RTN_LOCAL}
+	nftHooks        = map[string]uint32{"PREROUTING": nfInetPreRouting, "INPUT": nfInetLocalIn, "FORWARD": nfInetForward,
+		"OUTPUT": nfInetLocalOut, "POSTROUTING": nfInetPostRouting}
+	// nftPriorities are the priorities of the iptables chains by table and
+	// hook, which the base chains use so the rules run in the same order:
+	// the nat chains are at dstnat before routing and at srcnat after it
+	nftPriorities = map[string]int32{
+		"raw/PREROUTING": -300, "raw/OUTPUT": -300,
+		"nat/PREROUTING": -100, "nat/OUTPUT": -100, "nat/INPUT": 100, "nat/POSTROUTING": 100,
+		"filter/INPUT": 0, "filter/FORWARD": 0, "filter/OUTPUT": 0,
+	}
+)
+
+// nlattr is a netlink attribute, nested when it has children
+type nlattr struct {
+	typ      uint16
+	data     []byte
+	children []nlattr
+	nested   bool
+}
+
+func attr(typ uint16, data []byte) nlattr {
+	return nlattr{typ: typ, data: data}
+}
+
+func nested(typ uint16, children ...nlattr) nlattr {
+	return nlattr{typ: typ, children: children, nested: true}
+}
+
+func (a nlattr) encode() []byte {
+	typ, data := a.typ, a.data
+	if a.nested {
+		typ |= nlaFNested
+		data = encodeAttrs(a.children)
+	}
+	buf := make([]byte, align4(4+len(data)))
+	nl.NativeEndian().PutUint16(buf[0:2], uint16(4+len(data)))
+	nl.NativeEndian().PutUint16(buf[2:4], typ)
+	copy(buf[4:], data)
+	return buf
+}
+
+func encodeAttrs(attrs []nlattr) []byte {
+	buf := []byte{}
+	for _, a := range attrs {
+		buf = append(buf, a.encode()...)
+	}
+	return buf
+}
+
+func align4(l int) int {
+	return (l + 3) &^ 3
+}
+
+func be16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func native32(v uint32) []byte {
+	b := make([]byte, 4)
+	nl.NativeEndian().PutUint32(b, v)
+	return b
+}
+
+// ifname returns the interface name as compared by nftables, padded to
+// IFNAMSIZ
+func ifname(name string) []byte {
+	b := make([]byte, 16)
+	copy(b, name)
+	return b
+}
+
+// nftMessage returns a nf_tables netlink message of the ip family
+func nftMessage(msgType, flags uint16, seq uint32, attrs ...nlattr) []byte {
+	return nfnlMessage(nfnlSubsysNFTables<<8|msgType, flags, seq, nfprotoIPv4, 0, encodeAttrs(attrs))
+}
+
+func nfnlMessage(msgType, flags uint16, seq uint32, family uint8, resID uint16, data []byte) []byte {
+	buf := make([]byte, syscall.NLMSG_HDRLEN+4, syscall.NLMSG_HDRLEN+4+len(data))
+	native := nl.NativeEndian()
+	native.PutUint32(buf[0:4], uint32(cap(buf)))
+	native.PutUint16(buf[4:6], msgType)
+	native.PutUint16(buf[6:8], syscall.NLM_F_REQUEST|flags)
+	native.PutUint32(buf[8:12], seq)
+	buf[16] = family
+	binary.BigEndian.PutUint16(buf[18:20], resID)
+	return append(buf, data...)
+}
+
+// expression returns an element of the expression list of a rule
+func expression(name string, attrs ...nlattr) nlattr {
+	return nested(nftaListElem, attr(nftaExprName, nl.ZeroTerminated(name)), nested(nftaExprData, attrs...))
+}
+
+func metaLoad(key uint32) nlattr {
+	return expression("meta", attr(1, be32(nftReg1)), attr(2, be32(key)))
+}
+
+func cmp(op uint32, data []byte) nlattr {
+	return expression("cmp", attr(1, be32(nftReg1)), attr(2, be32(op)), nested(3, attr(nftaDataValue, data)))
+}
+
+func payloadLoad(base, offset, length uint32) nlattr {
+	return expression("payload", attr(1, be32(nftReg1)), attr(2, be32(base)), attr(3, be32(offset)), attr(4, be32(length)))
+}
+
+func immediate(reg uint32, data []byte) nlattr {
+	return expression("immediate", attr(1, be32(reg)), nested(2, attr(nftaDataValue, data)))
+}
+
+func verdict(code uint32, chain string) nlattr {
+	v := []nlattr{attr(nftaVerdictCode, be32(code))}
+	if chain != "" {
+		v = append(v, attr(nftaVerdictChain, nl.ZeroTerminated(chain)))
+	}
+	return expression("immediate", attr(1, be32(nftRegVerdict)), nested(2, nested(nftaDataVerdict, v...)))
+}
+
+// addressMatch returns the expressions matching the source or destination
+// address, at the given offset of the IPv4 header, with the subnet or the
+// address
+func addressMatch(offset uint32, address string) ([]nlattr, error) {
+	ip, subnet, err := net.ParseCIDR(address)
+	if err != nil {
+		if ip = net.ParseIP(address); ip == nil {
+			return nil, fmt.Errorf("invalid address %v", address)
+		}
+		subnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+	}
+	if subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("address %v isn't an IPv4 address", address)
+	}
+
+	exprs := []nlattr{payloadLoad(nftPayloadNetwork, offset, 4)}
+	if ones, _ := subnet.Mask.Size(); ones != 32 {
+		exprs = append(exprs, expression("bitwise", attr(1, be32(nftReg1)), attr(2, be32(nftReg1)), attr(3, be32(4)),
+			nested(4, attr(nftaDataValue, []byte(net.IP(subnet.Mask).To4()))), nested(5, attr(nftaDataValue, make([]byte, 4)))))
+	}
+	return append(exprs, cmp(nftCmpEq, subnet.IP.To4())), nil
+}
+
+func interfaceMatch(key uint32, op uint32, name string) []nlattr {
+	return []nlattr{metaLoad(key), cmp(op, ifname(name))}
+}
+
+func addressTypeMatch(flag uint32, addressType string) ([]nlattr, error) {
+	t, ok := nftAddressTypes[addressType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported address type %v", addressType)
+	}
+	return []nlattr{
+		expression("fib", attr(1, be32(nftReg1)), attr(2, be32(nftFibResultAddrtyp)), attr(3, be32(flag))),
+		cmp(nftCmpEq, native32(t)),
+	}, nil
+}
+
+// portRange returns the first and last port of a port or a port range
+// like 30000-30100
+func portRange(ports string) (uint16, uint16, error) {
+	parts := strings.SplitN(ports, "-", 2)
+	first, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %v", ports)
+	}
+	last := first
+	if len(parts) == 2 {
+		if last, err = strconv.ParseUint(parts[1], 10, 16); err != nil || last < first {
+			return 0, 0, fmt.Errorf("invalid port range %v", ports)
+		}
+	}
+	return uint16(first), uint16(last), nil
+}
+
+// nftExpressions returns the expressions of the rule
+func nftExpressions(r Rule) ([]nlattr, error) {
+	exprs := []nlattr{}
+	if r.Source != "" {
+		match, err := addressMatch(12, r.Source)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, match...)
+	}
+	if r.Destination != "" {
+		match, err := addressMatch(16, r.Destination)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, match...)
+	}
+	if r.InInterface != "" {
+		exprs = append(exprs, interfaceMatch(nftMetaIifname, nftCmpEq, r.InInterface)...)
+	}
+	if r.NotInInterface != "" {
+		exprs = append(exprs, interfaceMatch(nftMetaIifname, nftCmpNeq, r.NotInInterface)...)
+	}
+	if r.OutInterface != "" {
+		exprs = append(exprs, interfaceMatch(nftMetaOifname, nftCmpEq, r.OutInterface)...)
+	}
+	if r.NotOutInterface != "" {
+		exprs = append(exprs, interfaceMatch(nftMetaOifname, nftCmpNeq, r.NotOutInterface)...)
+	}
+	if r.Protocol != "" {
+		proto, ok := nftProtocols[r.Protocol]
+		if !ok {
+			return nil, fmt.Errorf("unsupported protocol %v", r.Protocol)
+		}
+		exprs = append(exprs, metaLoad(nftMetaL4proto), cmp(nftCmpEq, []byte{proto}))
+	}
+	if r.DestinationPort != "" {
+		if r.Protocol == "" {
+			return nil, fmt.Errorf("destination port %v without a protocol", r.DestinationPort)
+		}
+		first, last, err := portRange(r.DestinationPort)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, payloadLoad(nftPayloadTransport, 2, 2))
+		if first == last {
+			exprs = append(exprs, cmp(nftCmpEq, be16(first)))
+		} else {
+			exprs = append(exprs, cmp(nftCmpGte, be16(first)), cmp(nftCmpLte, be16(last)))
+		}
+	}
+	if r.SourceType != "" {
+		match, err := addressTypeMatch(nftaFibFlagSaddr, r.SourceType)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, match...)
+	}
+	if r.DestinationType != "" {
+		match, err := addressTypeMatch(nftaFibFlagDaddr, r.DestinationType)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, match...)
+	}
+	if r.Mark != 0 {
+		exprs = append(exprs, metaLoad(nftMetaMark), cmp(nftCmpEq, native32(r.Mark)))
+	}
+
+	switch r.Target {
+	case "":
+	case TargetAccept:
+		exprs = append(exprs, verdict(nfAccept, ""))
+	case TargetMark:
+		exprs = append(exprs, immediate(nftReg1, native32(r.SetMark)),
+			expression("meta", attr(2, be32(nftMetaMark)), attr(3, be32(nftReg1))))
+	case TargetDNAT:
+		target, err := dnatExpressions(r.ToDestination)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, target...)
+	case TargetMasquerade:
+		if r.ToPorts == "" {
+			exprs = append(exprs, expression("masq"))
+			break
+		}
+		first, last, err := portRange(r.ToPorts)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, immediate(nftReg1, be16(first)), immediate(nftReg2, be16(last)),
+			expression("masq", attr(1, be32(nfNatRangeProtoSpecify)), attr(2, be32(nftReg1)), attr(3, be32(nftReg2))))
+	default:
+		exprs = append(exprs, verdict(nftJump, r.Target))
+	}
+	return exprs, nil
+}
+
+// dnatExpressions returns the expressions of a DNAT to an address with an
+// optional port
+func dnatExpressions(to string) ([]nlattr, error) {
+	host, port := to, ""
+	if i := strings.LastIndex(to, ":"); i >= 0 {
+		host, port = to[:i], to[i+1:]
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid DNAT destination %v", to)
+	}
+
+	exprs := []nlattr{immediate(nftReg1, ip)}
+	nat := []nlattr{attr(1, be32(nftNatDNAT)), attr(2, be32(nfprotoIPv4)), attr(3, be32(nftReg1))}
+	flags := uint32(nfNatRangeMapIPs)
+	if port != "" {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNAT destination %v", to)
+		}
+		exprs = append(exprs, immediate(nftReg2, be16(uint16(p))))
+		nat = append(nat, attr(5, be32(nftReg2)))
+		flags |= nfNatRangeProtoSpecify
+	}
+	nat = append(nat, attr(7, be32(flags)))
+	return append(exprs, expression("nat", nat...)), nil
+}
+
+// comment returns the user data of a rule holding its iptables form as
+// the comment, which is what Rules lists
+func comment(text string) []byte {
+	if len(text) > nftUserdataMaxLen-3 {
+		text = text[:nftUserdataMaxLen-3]
+	}
+	return append(append([]byte{0, byte(len(text) + 1)}, text...), 0)
+}
+
+// nftBatch returns the messages of the transaction replacing the rules of
+// the chains and their hooks
+func nftBatch(chains []Chain) ([][]byte, []string, error) {
+	msgs := [][]byte{}
+	descs := []string{}
+	seq := uint32(0)
+	add := func(desc string, msgType, flags uint16, attrs ...nlattr) {
+		seq++
+		msgs = append(msgs, nftMessage(msgType, flags|syscall.NLM_F_ACK, seq, attrs...))
+		descs = append(descs, desc)
+	}
+	table := attr(nftaChainTable, nl.ZeroTerminated(nftTable))
+	ruleTable := attr(nftaRuleTable, nl.ZeroTerminated(nftTable))
+
+	add("adding table "+nftTable, nftMsgNewTable, syscall.NLM_F_CREATE, attr(nftaTableName, nl.ZeroTerminated(nftTable)))
+	for _, c := range chains {
+		add("adding chain "+c.Name, nftMsgNewChain, syscall.NLM_F_CREATE, table, attr(nftaChainName, nl.ZeroTerminated(c.Name)))
+		add("flushing chain "+c.Name, nftMsgDelRule, 0, ruleTable, attr(nftaRuleChain, nl.ZeroTerminated(c.Name)))
+	}
+	for _, c := range chains {
+		if c.Hook == "" {
+			continue
+		}
+		hook, ok := nftHooks[c.Hook]
+		priority, known := nftPriorities[c.Table+"/"+c.Hook]
+		if !ok || !known {
+			return nil, nil, fmt.Errorf("unsupported hook %v of the %v table for %v", c.Hook, c.Table, c.Name)
+		}
+		chainType := "filter"
+		if c.Table == "nat" {
+			chainType = "nat"
+		}
+		name := c.Name + nftHookSuffix
+		add("adding chain "+name, nftMsgNewChain, syscall.NLM_F_CREATE, table, attr(nftaChainName, nl.ZeroTerminated(name)),
+			nested(nftaChainHook, attr(nftaHookHooknum, be32(hook)), attr(nftaHookPrio, be32(uint32(priority)))),
+			attr(nftaChainType, nl.ZeroTerminated(chainType)), attr(nftaChainPolicy, be32(nfAccept)))
+		add("flushing chain "+name, nftMsgDelRule, 0, ruleTable, attr(nftaRuleChain, nl.ZeroTerminated(name)))
+	}
+
+	addRule := func(chain string, r Rule) error {
+		exprs, err := nftExpressions(r)
+		if err != nil {
+			return errors.Wrapf(err, "rule %v of %v", r, chain)
+		}
+		text := "-A " + chain + " " + r.String()
+		add("adding rule "+text, nftMsgNewRule, syscall.NLM_F_CREATE|syscall.NLM_F_APPEND, ruleTable,
+			attr(nftaRuleChain, nl.ZeroTerminated(chain)), nested(nftaRuleExpressions, exprs...),
+			attr(nftaRuleUserdata, comment(text)))
+		return nil
+	}
+	for _, c := range chains {
+		for _, r := range c.Rules {
+			if err := addRule(c.Name, r); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	for _, c := range chains {
+		if c.Hook != "" {
+			if err := addRule(c.Name+nftHookSuffix, c.hookRule()); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return msgs, descs, nil
+}
+
+// applyNFTables replaces the rules of the chains, and their hooks, in a
+// single nftables transaction
+func applyNFTables(chains []Chain) error {
+	msgs, descs, err := nftBatch(chains)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("firewall: applying %v nftables messages", len(msgs))
+
+	conn, err := newNFTConn()
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+	return conn.transact(msgs, descs)
+}
+
+// nftablesRules lists the rules of the chain in the nftables table, in the
+// iptables -S format kept as their comment
+func nftablesRules(chain string) ([]string, error) {
+	conn, err := newNFTConn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+
+	rules := []string{}
+	msg := nftMessage(nftMsgGetRule, syscall.NLM_F_DUMP, 1, attr(nftaRuleTable, nl.ZeroTerminated(nftTable)),
+		attr(nftaRuleChain, nl.ZeroTerminated(chain)))
+	err = conn.request(msg, func(m syscall.NetlinkMessage) error {
+		if len(m.Data) < 4 {
+			return nil
+		}
+		attrs, err := nl.ParseRouteAttr(m.Data[4:])
+		if err != nil {
+			return err
+		}
+		ruleChain, text := "", ""
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case nftaRuleChain:
+				ruleChain = strings.TrimRight(string(a.Value), "\x00")
+			case nftaRuleUserdata:
+				if len(a.Value) > 2 && a.Value[0] == 0 {
+					text = strings.TrimRight(string(a.Value[2:]), "\x00")
+				}
+			}
+		}
+		if ruleChain == chain && text != "" {
+			rules = append(rules, text)
+		}
+		return nil
+	})
+	return rules, err
+}
+
+// probeNFTables returns an error when the kernel doesn't support nftables
+func probeNFTables() error {
+	conn, err := newNFTConn()
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+	return conn.request(nftMessage(nftMsgGetGen, syscall.NLM_F_ACK, 1), nil)
+}
+
+// nftConn is a netfilter netlink socket
+type nftConn struct {
+	fd int
+}
+
+func newNFTConn() (*nftConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening the netfilter netlink socket")
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, errors.Wrap(err, "binding the netfilter netlink socket")
+	}
+	return &nftConn{fd: fd}, nil
+}
+
+func (c *nftConn) close() {
+	syscall.Close(c.fd)
+}
+
+func (c *nftConn) send(msg []byte) error {
+	return syscall.Sendto(c.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+}
+
+// receive passes the messages read to handle until it returns true
+func (c *nftConn) receive(handle func(m syscall.NetlinkMessage) (bool, error)) error {
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			done, err := handle(m)
+			if err != nil || done {
+				return err
+			}
+		}
+	}
+}
+
+// request sends the request and passes the replies to handle until the
+// acknowledgement or the end of the dump
+func (c *nftConn) request(msg []byte, handle func(m syscall.NetlinkMessage) error) error {
+	if err := c.send(msg); err != nil {
+		return err
+	}
+	return c.receive(func(m syscall.NetlinkMessage) (bool, error) {
+		switch m.Header.Type {
+		case syscall.NLMSG_DONE:
+			return true, nil
+		case syscall.NLMSG_ERROR:
+			if errno := ackErrno(m); errno != 0 {
+				return true, errno
+			}
+			return true, nil
+		}
+		if handle == nil {
+			return false, nil
+		}
+		return false, handle(m)
+	})
+}
+
+// transact sends the messages in a batch, all of them are applied or
+// none. The first error is returned with the description of its message.
+func (c *nftConn) transact(msgs [][]byte, descs []string) error {
+	resID := uint16(nfnlSubsysNFTables)
+	batch := nfnlMessage(nfnlMsgBatchBegin, 0, 0, syscall.AF_UNSPEC, resID, nil)
+	for _, m := range msgs {
+		batch = append(batch, m...)
+	}
+	batch = append(batch, nfnlMessage(nfnlMsgBatchEnd, 0, uint32(len(msgs)+1), syscall.AF_UNSPEC, resID, nil)...)
+	if err := c.send(batch); err != nil {
+		return errors.Wrap(err, "sending the nftables batch")
+	}
+
+	// The batch has an acknowledgement by message, the replies of the
+	// request sent after it tell they have all been read
+	var first error
+	sentinel := uint32(len(msgs) + 2)
+	if err := c.send(nftMessage(nftMsgGetGen, syscall.NLM_F_ACK, sentinel)); err != nil {
+		return err
+	}
+	err := c.receive(func(m syscall.NetlinkMessage) (bool, error) {
+		if m.Header.Type != syscall.NLMSG_ERROR {
+			return false, nil
+		}
+		if m.Header.Seq == sentinel {
+			return true, nil
+		}
+		if errno := ackErrno(m); errno != 0 && first == nil {
+			first = errno
+			if i := int(m.Header.Seq) - 1; i >= 0 && i < len(descs) {
+				first = errors.Wrap(errno, descs[i])
+			}
+		}
+		return false, nil
+	})
+	if first != nil {
+		return first
+	}
+	return err
+}
+
+// ackErrno returns the error of a netlink acknowledgement, 0 for success
+func ackErrno(m syscall.NetlinkMessage) syscall.Errno {
+	if len(m.Data) < 4 {
+		return 0
+	}
+	return syscall.Errno(-int32(nl.NativeEndian().Uint32(m.Data[0:4])))
+}
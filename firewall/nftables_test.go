@@ -0,0 +1,159 @@
+package firewall
+
+import (
+	"encoding/binary"
+	"reflect"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+)
+
+// inNewNetns runs f in a new network namespace, skipping the test when
+// it can't be created or the kernel doesn't support nftables
+func inNewNetns(t *testing.T, f func()) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		t.Skipf("can't get the network namespace: %v", err)
+	}
+	defer origin.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("can't create a network namespace: %v", err)
+	}
+	defer ns.Close()
+	defer netns.Set(origin)
+
+	if err := probeNFTables(); err != nil {
+		t.Skipf("nftables isn't supported: %v", err)
+	}
+	f()
+}
+
+func TestNFTExpressions(t *testing.T) {
+	invalid := []Rule{
+		{DestinationPort: "80", Target: TargetAccept},
+		{Protocol: "icmp", Target: TargetAccept},
+		{Source: "fd00::/64", Target: TargetAccept},
+		{DestinationType: "BROADCAST", Target: TargetAccept},
+		{Target: TargetDNAT, ToDestination: "10.42.0.5:http"},
+		{Target: TargetMasquerade, ToPorts: "65535-1024"},
+	}
+	for _, r := range invalid {
+		if _, err := nftExpressions(r); err == nil {
+			t.Errorf("%v: expecting error, but got nil", r)
+		}
+	}
+}
+
+// chainPriority returns the hook priority of the chain added by the given
+// nf_tables message
+func chainPriority(t *testing.T, msg []byte) int32 {
+	attrs := func(b []byte) map[uint16][]byte {
+		m := map[uint16][]byte{}
+		for len(b) >= 4 {
+			l := int(nl.NativeEndian().Uint16(b[0:2]))
+			m[nl.NativeEndian().Uint16(b[2:4])&^nlaFNested] = b[4:l]
+			b = b[align4(l):]
+		}
+		return m
+	}
+	hook, ok := attrs(msg[syscall.NLMSG_HDRLEN+4:])[nftaChainHook]
+	if !ok {
+		t.Fatalf("expected a base chain")
+	}
+	return int32(binary.BigEndian.Uint32(attrs(hook)[nftaHookPrio]))
+}
+
+func TestNFTBatchPriorities(t *testing.T) {
+	chains := []Chain{
+		{Table: "raw", Name: "CATTLE_RAW_PREROUTING", Hook: "PREROUTING"},
+		{Table: "nat", Name: "CATTLE_PREROUTING", Hook: "PREROUTING"},
+		{Table: "nat", Name: "CATTLE_OUTPUT", Hook: "OUTPUT"},
+		{Table: "nat", Name: "CATTLE_NAT_POSTROUTING", Hook: "POSTROUTING"},
+		{Table: "filter", Name: "CATTLE_FORWARD", Hook: "FORWARD"},
+	}
+	msgs, descs, err := nftBatch(chains)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	expected := map[string]int32{
+		"CATTLE_RAW_PREROUTING_HOOK":  -300,
+		"CATTLE_PREROUTING_HOOK":      -100,
+		"CATTLE_OUTPUT_HOOK":          -100,
+		"CATTLE_NAT_POSTROUTING_HOOK": 100,
+		"CATTLE_FORWARD_HOOK":         0,
+	}
+	actual := map[string]int32{}
+	for i, desc := range descs {
+		if name := strings.TrimPrefix(desc, "adding chain "); name != desc && strings.HasSuffix(name, nftHookSuffix) {
+			actual[name] = chainPriority(t, msgs[i])
+		}
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, actual)
+	}
+}
+
+func TestApplyNFTables(t *testing.T) {
+	chains := []Chain{
+		{Table: "raw", Name: "CATTLE_RAW_PREROUTING", Hook: "PREROUTING", HookRule: Rule{DestinationType: "LOCAL"}, Rules: []Rule{
+			{NotInInterface: "docker0", Protocol: "udp", DestinationPort: "30000-30100", Target: TargetMark, SetMark: 0x1068},
+		}},
+		{Table: "nat", Name: "CATTLE_PREROUTING", Hook: "PREROUTING", HookRule: Rule{DestinationType: "LOCAL"}, Rules: []Rule{
+			{Destination: "172.22.101.101", Protocol: "tcp", DestinationPort: "8080", Target: TargetDNAT, ToDestination: "10.42.0.5:80"},
+			{Protocol: "udp", DestinationPort: "30000-30100", DestinationType: "LOCAL", Target: TargetDNAT, ToDestination: "10.42.0.5"},
+		}},
+		{Table: "nat", Name: "CATTLE_NAT_POSTROUTING", Hook: "POSTROUTING", Rules: []Rule{
+			{Protocol: "tcp", Source: "10.42.0.0/16", NotOutInterface: "docker0", Target: TargetMasquerade, ToPorts: "1024-65535"},
+			{Source: "10.42.0.0/16", NotOutInterface: "docker0", Target: TargetMasquerade},
+			{OutInterface: "docker0", SourceType: "LOCAL", DestinationType: "UNICAST", Target: TargetMasquerade},
+		}},
+		{Table: "filter", Name: "CATTLE_FORWARD", Hook: "FORWARD", Rules: []Rule{{Mark: 0x4000, Target: TargetAccept}}},
+	}
+
+	inNewNetns(t, func() {
+		if err := applyNFTables(chains); err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+		// Applying again replaces the rules
+		chains[1].Rules = chains[1].Rules[1:]
+		if err := applyNFTables(chains); err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+
+		expected := []string{"-A CATTLE_PREROUTING -p udp -m udp --dport 30000:30100 -m addrtype --dst-type LOCAL -j DNAT --to-destination 10.42.0.5"}
+		actual, err := nftablesRules("CATTLE_PREROUTING")
+		if err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected: %v, got actual: %v", expected, actual)
+		}
+
+		expected = []string{"-A CATTLE_PREROUTING_HOOK -m addrtype --dst-type LOCAL -j CATTLE_PREROUTING"}
+		if actual, _ := nftablesRules("CATTLE_PREROUTING_HOOK"); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected: %v, got actual: %v", expected, actual)
+		}
+
+		// A failing batch leaves the rules as they were
+		broken := append(chains, Chain{Table: "mangle", Name: "CATTLE_MANGLE", Hook: "PREROUTING"})
+		if err := applyNFTables(broken); err == nil {
+			t.Errorf("expecting error for an unsupported hook, but got nil")
+		}
+		broken = []Chain{{Table: "nat", Name: "CATTLE_PREROUTING", Rules: []Rule{{Target: "CATTLE_MISSING"}}}}
+		if err := applyNFTables(broken); err == nil {
+			t.Errorf("expecting error for a jump to a missing chain, but got nil")
+		}
+		if actual, _ := nftablesRules("CATTLE_PREROUTING"); len(actual) != 1 {
+			t.Errorf("expected the rules to be kept, got actual: %v", actual)
+		}
+	})
+}
@@ -0,0 +1,190 @@
+package firewall
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// The targets of a rule, besides jumping to a chain
+const (
+	TargetAccept     = "ACCEPT"
+	TargetMark       = "MARK"
+	TargetDNAT       = "DNAT"
+	TargetMasquerade = "MASQUERADE"
+)
+
+// Rule is a rule of a chain, rendered by the backend in use. All the set
+// matches are needed for the target to apply, the empty ones match any
+// packet.
+type Rule struct {
+	Protocol        string
+	Source          string
+	Destination     string
+	InInterface     string
+	NotInInterface  string
+	OutInterface    string
+	NotOutInterface string
+	// DestinationPort is a port or a port range like 30000-30100, it
+	// needs the Protocol
+	DestinationPort string
+	// SourceType and DestinationType match the address type, LOCAL or
+	// UNICAST
+	SourceType      string
+	DestinationType string
+	Mark            uint32
+
+	// Target is one of the Target constants or the chain to jump to
+	Target string
+	// SetMark is the mark set by TargetMark
+	SetMark uint32
+	// ToDestination is the address, with an optional port, of TargetDNAT
+	ToDestination string
+	// ToPorts is the optional source port range of TargetMasquerade
+	ToPorts string
+}
+
+// Chain is a chain of the host rules, its rules replace the ones of the
+// previous apply
+type Chain struct {
+	// Table is the iptables table of the chain: raw, nat or filter
+	Table string
+	Name  string
+	// Hook is the built-in chain, like PREROUTING, jumping to this chain
+	// for the packets matching HookRule. Without a hook the chain is only
+	// jumped to by the other rules.
+	Hook     string
+	HookRule Rule
+	Rules    []Rule
+}
+
+// args returns the rule in the iptables arguments format, without the
+// chain
+func (r Rule) args() []string {
+	args := []string{}
+	if r.Source != "" {
+		args = append(args, "-s", r.Source)
+	}
+	if r.Destination != "" {
+		args = append(args, "-d", r.Destination)
+	}
+	if r.InInterface != "" {
+		args = append(args, "-i", r.InInterface)
+	}
+	if r.NotInInterface != "" {
+		args = append(args, "!", "-i", r.NotInInterface)
+	}
+	if r.OutInterface != "" {
+		args = append(args, "-o", r.OutInterface)
+	}
+	if r.NotOutInterface != "" {
+		args = append(args, "!", "-o", r.NotOutInterface)
+	}
+	if r.Protocol != "" {
+		args = append(args, "-p", r.Protocol, "-m", r.Protocol)
+	}
+	if r.DestinationPort != "" {
+		args = append(args, "--dport", strings.Replace(r.DestinationPort, "-", ":", 1))
+	}
+	if r.SourceType != "" || r.DestinationType != "" {
+		args = append(args, "-m", "addrtype")
+		if r.SourceType != "" {
+			args = append(args, "--src-type", r.SourceType)
+		}
+		if r.DestinationType != "" {
+			args = append(args, "--dst-type", r.DestinationType)
+		}
+	}
+	if r.Mark != 0 {
+		args = append(args, "-m", "mark", "--mark", fmt.Sprintf("0x%x", r.Mark))
+	}
+
+	if r.Target == "" {
+		return args
+	}
+	args = append(args, "-j", r.Target)
+	switch r.Target {
+	case TargetMark:
+		args = append(args, "--set-mark", fmt.Sprintf("0x%x", r.SetMark))
+	case TargetDNAT:
+		args = append(args, "--to-destination", r.ToDestination)
+	case TargetMasquerade:
+		if r.ToPorts != "" {
+			args = append(args, "--to-ports", r.ToPorts)
+		}
+	}
+	return args
+}
+
+// String returns the rule in the iptables -S format
+func (r Rule) String() string {
+	return strings.Join(r.args(), " ")
+}
+
+// hookRule returns the rule of the hook jumping to the chain
+func (c Chain) hookRule() Rule {
+	r := c.HookRule
+	r.Target = c.Name
+	return r
+}
+
+// iptablesRestore returns the chains in the iptables-restore format, the
+// chains are flushed and grouped by table
+func iptablesRestore(chains []Chain) []byte {
+	tables := []string{}
+	byTable := map[string][]Chain{}
+	for _, c := range chains {
+		if _, ok := byTable[c.Table]; !ok {
+			tables = append(tables, c.Table)
+		}
+		byTable[c.Table] = append(byTable[c.Table], c)
+	}
+
+	buf := &bytes.Buffer{}
+	for _, table := range tables {
+		buf.WriteString("*" + table + "\n")
+		for _, c := range byTable[table] {
+			buf.WriteString(":" + c.Name + " -\n")
+		}
+		for _, c := range byTable[table] {
+			buf.WriteString("-F " + c.Name + "\n")
+		}
+		for _, c := range byTable[table] {
+			for _, r := range c.Rules {
+				buf.WriteString("-A " + c.Name + " " + r.String() + "\n")
+			}
+		}
+		buf.WriteString("COMMIT\n")
+	}
+	return buf.Bytes()
+}
+
+// applyIPTables restores the chains with the iptables-restore binary and
+// inserts the missing hooks
+func applyIPTables(chains []Chain) error {
+	rules := iptablesRestore(chains)
+	logrus.Debugf("firewall: applying rules\n%s", rules)
+	if err := restore(bytes.NewReader(rules)); err != nil {
+		logrus.Errorf("firewall: failed to apply rules\n%s", rules)
+		return err
+	}
+
+	var e error
+	for _, c := range chains {
+		if c.Hook == "" {
+			continue
+		}
+		args := append([]string{"-w", "-t", c.Table, "-C", c.Hook}, c.hookRule().args()...)
+		if iptables(args...) == nil {
+			continue
+		}
+		args[3] = "-I"
+		if err := iptables(args...); err != nil {
+			e = errors.Wrapf(err, "inserting the %v hook of %v", c.Hook, c.Name)
+		}
+	}
+	return e
+}
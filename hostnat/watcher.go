@@ -3,15 +3,15 @@ package hostnat
 import (
 	"bytes"
 	"fmt"
-	"os"
 	"os/exec"
 	"reflect"
-	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/firewall"
+	"github.com/rancher/plugin-manager/metrics"
 	"github.com/rancher/plugin-manager/utils"
 )
 
@@ -43,15 +43,14 @@ type MASQRule struct {
 	Bridge string
 }
 
-func (p MASQRule) iptables() []byte {
-	buf := &bytes.Buffer{}
-	buf.WriteString(fmt.Sprintf("-A %s -p tcp -s %s ! -o %s -j MASQUERADE --to-ports 1024-65535\n", natChain, p.Subnet, p.Bridge))
-	buf.WriteString(fmt.Sprintf("-A %s -p udp -s %s ! -o %s -j MASQUERADE --to-ports 1024-65535\n", natChain, p.Subnet, p.Bridge))
-	buf.WriteString(fmt.Sprintf("-A %s -s %s ! -o %s -j MASQUERADE\n", natChain, p.Subnet, p.Bridge))
-
-	// LOCAL src
-	buf.WriteString(fmt.Sprintf("-A %s -o %s -m addrtype --src-type LOCAL --dst-type UNICAST -j MASQUERADE", natChain, p.Bridge))
-	return buf.Bytes()
+func (p MASQRule) rules() []firewall.Rule {
+	return []firewall.Rule{
+		{Protocol: "tcp", Source: p.Subnet, NotOutInterface: p.Bridge, Target: firewall.TargetMasquerade, ToPorts: "1024-65535"},
+		{Protocol: "udp", Source: p.Subnet, NotOutInterface: p.Bridge, Target: firewall.TargetMasquerade, ToPorts: "1024-65535"},
+		{Source: p.Subnet, NotOutInterface: p.Bridge, Target: firewall.TargetMasquerade},
+		// LOCAL src
+		{OutInterface: p.Bridge, SourceType: "LOCAL", DestinationType: "UNICAST", Target: firewall.TargetMasquerade},
+	}
 }
 
 func (p MASQRule) localRoutingSetting() string {
@@ -63,25 +62,13 @@ func (p MASQRule) localRoutingSetting() string {
 	return s
 }
 
-func (w *watcher) insertBaseRules() error {
-	if w.run("iptables", "-w", "-t", "nat", "-C", "POSTROUTING", "-j", natChain) != nil {
-		return w.run("iptables", "-w", "-t", "nat", "-I", "POSTROUTING", "-j", natChain)
-	}
-	return nil
-}
-
-func (w *watcher) run(args ...string) error {
-	logrus.Debugf("Running %s", strings.Join(args, " "))
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
-}
-
 func (w *watcher) onChangeNoError(version string) {
-	if err := w.onChange(version); err != nil {
+	started := time.Now()
+	err := w.onChange(version)
+	if err != nil {
 		logrus.Errorf("Failed to apply host rules: %v", err)
 	}
+	metrics.RecordSync("hostnat", started, err)
 }
 
 func (w *watcher) onChange(version string) error {
@@ -128,6 +115,10 @@ func (w *watcher) networkToRule(network metadata.Network, host metadata.Host) *M
 		bridgeSubnet, _ := props["bridgeSubnet"].(string)
 
 		if hostNat && cniType == "rancher-bridge" && bridge != "" && bridgeSubnet != "" {
+			if err := utils.ValidateInterfaceName(bridge); err != nil {
+				logrus.Errorf("Invalid bridge of network %v: %v", network.UUID, err)
+				return nil
+			}
 			return &MASQRule{
 				Subnet: bridgeSubnet,
 				Bridge: bridge,
@@ -162,30 +153,14 @@ func (w *watcher) apply(rules map[string]MASQRule) error {
 		return err
 	}
 
-	buf := &bytes.Buffer{}
-	buf.WriteString(fmt.Sprintf("*nat\n:%s -\n-F %s\n", natChain, natChain))
+	chain := firewall.Chain{Table: "nat", Name: natChain, Hook: "POSTROUTING"}
 	for _, rule := range rules {
-		buf.WriteString("\n")
-		buf.Write(rule.iptables())
-	}
-
-	buf.WriteString("\nCOMMIT\n")
-
-	if logrus.GetLevel() == logrus.DebugLevel {
-		fmt.Printf("Applying rules\n%s", buf)
-	}
-
-	cmd := exec.Command("iptables-restore", "-n")
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	cmd.Stdin = buf
-	if err := cmd.Run(); err != nil {
-		logrus.Errorf("Failed to apply rules\n%s", buf)
-		return err
+		chain.Rules = append(chain.Rules, rule.rules()...)
 	}
 
-	if err := w.insertBaseRules(); err != nil {
-		return errors.Wrap(err, "Installing base rules")
+	if err := firewall.Apply([]firewall.Chain{chain}); err != nil {
+		metrics.AddCounter(metrics.FirewallErrorsTotal, map[string]string{"module": "hostnat"}, 1)
+		return errors.Wrap(err, "Applying nat rules")
 	}
 
 	w.applied = rules
@@ -0,0 +1,89 @@
+package hostports
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/firewall"
+)
+
+var (
+	appliedLock sync.RWMutex
+	applied     = map[string]PortRule{}
+)
+
+// State is the port rules wanted for the containers of this host, the
+// ones last applied by the watcher and the host port rules found in the
+// nat table
+type State struct {
+	Desired map[string]PortRule `json:"desired"`
+	Applied map[string]PortRule `json:"applied"`
+	Actual  []string            `json:"actual"`
+	Diff    []string            `json:"diff"`
+}
+
+func (p PortRule) String() string {
+	return fmt.Sprintf("%v %v:%v -> %v:%v", p.Protocol, p.SourceIP, p.SourcePort, p.TargetIP, p.TargetPort)
+}
+
+func setApplied(rules map[string]PortRule) {
+	appliedLock.Lock()
+	defer appliedLock.Unlock()
+	applied = rules
+}
+
+// GetState returns the state of the host ports, the diff lists the rules
+// the next sync adds (+) and removes (-)
+func GetState(c metadata.Client) (State, error) {
+	desired, err := DesiredPortRules(c)
+	if err != nil {
+		return State{}, err
+	}
+
+	actual, err := firewall.Rules("nat", "CATTLE_PREROUTING")
+	if err != nil {
+		return State{}, errors.Wrap(err, "listing the host port rules")
+	}
+
+	appliedLock.RLock()
+	defer appliedLock.RUnlock()
+	return State{
+		Desired: desired,
+		Applied: applied,
+		Actual:  actual,
+		Diff:    diffPortRules(applied, desired),
+	}, nil
+}
+
+func diffPortRules(from, to map[string]PortRule) []string {
+	keys := []string{}
+	for key := range from {
+		if _, ok := to[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	for key := range to {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	diff := []string{}
+	for _, key := range keys {
+		old, hadOld := from[key]
+		rule, hasNew := to[key]
+		if hadOld && hasNew && reflect.DeepEqual(old, rule) {
+			continue
+		}
+		if hadOld {
+			diff = append(diff, fmt.Sprintf("- port %v (%v)", old, key))
+		}
+		if hasNew {
+			diff = append(diff, fmt.Sprintf("+ port %v (%v)", rule, key))
+		}
+	}
+	return diff
+}
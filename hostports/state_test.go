@@ -0,0 +1,31 @@
+package hostports
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffPortRules(t *testing.T) {
+	web, _ := parsePortRule("docker0", "172.22.101.101", "10.42.0.5", "0.0.0.0:8080:80/tcp", false)
+	db, _ := parsePortRule("docker0", "172.22.101.101", "10.42.0.6", "0.0.0.0:5432:5432/tcp", false)
+	movedDB := db
+	movedDB.TargetIP = "10.42.0.7"
+	dns, _ := parsePortRule("docker0", "172.22.101.101", "10.42.0.8", "0.0.0.0:53:53/udp", false)
+
+	applied := map[string]PortRule{"web/0.0.0.0:8080:80/tcp": web, "db/0.0.0.0:5432:5432/tcp": db}
+	desired := map[string]PortRule{"db/0.0.0.0:5432:5432/tcp": movedDB, "dns/0.0.0.0:53:53/udp": dns}
+
+	expected := []string{
+		"- port tcp 0.0.0.0:5432 -> 10.42.0.6:5432 (db/0.0.0.0:5432:5432/tcp)",
+		"+ port tcp 0.0.0.0:5432 -> 10.42.0.7:5432 (db/0.0.0.0:5432:5432/tcp)",
+		"+ port udp 0.0.0.0:53 -> 10.42.0.8:53 (dns/0.0.0.0:53:53/udp)",
+		"- port tcp 0.0.0.0:8080 -> 10.42.0.5:80 (web/0.0.0.0:8080:80/tcp)",
+	}
+	if actual := diffPortRules(applied, desired); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, actual)
+	}
+
+	if actual := diffPortRules(desired, desired); len(actual) != 0 {
+		t.Errorf("expected no changes, got actual: %v", actual)
+	}
+}
@@ -2,22 +2,36 @@ package hostports
 
 import (
 	"bytes"
-	"fmt"
 	"os"
 	"os/exec"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/firewall"
+	"github.com/rancher/plugin-manager/metrics"
 )
 
 var (
 	reapplyEvery              = 5 * time.Minute
 	hostPortsLabel            = "io.rancher.network.host_ports"
 	hostPortsPostRoutingChain = "CATTLE_HOSTPORTS_POSTROUTING"
+	// hostPortsMark is 4200, the mark of the packets to the host ports
+	hostPortsMark = uint32(0x1068)
+	// sctpConntrackPath only exists when the kernel tracks SCTP
+	// connections, which the SCTP DNAT rules depend on
+	sctpConntrackPath = "/proc/sys/net/netfilter/nf_conntrack_sctp_timeout_established"
+	// sctpSupported tells if the kernel tracks SCTP, it's checked once by
+	// DesiredPortRules
+	sctpSupported = func() bool {
+		_, err := os.Stat(sctpConntrackPath)
+		return err == nil
+	}
 )
 
 // Watch is used to monitor metadata for changes
@@ -45,8 +59,8 @@ type watcher struct {
 	metadataListenPort string
 }
 
-// PortRule is used to store the needed information for building a
-// iptables rule
+// PortRule is used to store the needed information for building the
+// firewall rules of a host port
 type PortRule struct {
 	Bridge     string
 	SourceIP   string
@@ -56,126 +70,123 @@ type PortRule struct {
 	Protocol   string
 }
 
-func (p PortRule) prefix() []byte {
-	buf := &bytes.Buffer{}
-	if p.Bridge != "" {
-		buf.WriteString(" ! -i ")
-		buf.WriteString(p.Bridge)
+// match returns the rule matching the host port of the port rule
+func (p PortRule) match() firewall.Rule {
+	r := firewall.Rule{
+		NotInInterface:  p.Bridge,
+		Protocol:        p.Protocol,
+		DestinationPort: p.SourcePort,
 	}
-	buf.WriteString(" -p ")
-	buf.WriteString(p.Protocol)
 	if p.SourceIP != "0.0.0.0" {
-		buf.WriteString(" -d ")
-		buf.WriteString(p.SourceIP)
+		r.Destination = p.SourceIP
+	}
+	return r
+}
+
+// destination returns the DNAT target of the rule. The port is left out
+// for a port range so each port is kept as is, host and target ranges
+// being the same.
+func (p PortRule) destination() string {
+	if strings.Contains(p.TargetPort, "-") {
+		return p.TargetIP
 	}
-	buf.WriteString(" --dport ")
-	buf.WriteString(p.SourcePort)
-	return buf.Bytes()
+	return p.TargetIP + ":" + p.TargetPort
 }
 
-func (p PortRule) rawIptables() []byte {
+func (p PortRule) rawRules() []firewall.Rule {
 	// Rules like
-	// -A CATTLE_PREROUTING -p ${protocol} --dport ${sourcePort} -j MARK --set-mark 4200
+	// -A CATTLE_RAW_PREROUTING -p ${protocol} --dport ${sourcePort} -j MARK --set-mark 4200
 	// We use mark 4200.  It is important whatever mark we use that the 0x8000 and 0x4000 bits are unset.
 	// Those bits are used by k8s and will conflict.
-	buf := &bytes.Buffer{}
-	buf.WriteString("-A CATTLE_RAW_PREROUTING")
-	buf.Write(p.prefix())
-	buf.WriteString(" -j MARK --set-mark 4200\n")
-	return buf.Bytes()
+	r := p.match()
+	r.Target = firewall.TargetMark
+	r.SetMark = hostPortsMark
+	return []firewall.Rule{r}
 }
 
-func (p PortRule) natIptables() []byte {
+// natRules returns the rules of the CATTLE_PREROUTING, CATTLE_OUTPUT and
+// CATTLE_HOSTPORTS_POSTROUTING chains
+func (p PortRule) natRules() ([]firewall.Rule, []firewall.Rule, []firewall.Rule) {
 	// Rules like
 	// -A CATTLE_PREROUTING -p ${protocol} --dport ${sourcePort} -j DNAT --to ${targetIP}:${targetPort}
-	buf := &bytes.Buffer{}
-	buf.WriteString("-A CATTLE_PREROUTING")
-	buf.Write(p.prefix())
-	buf.WriteString(" -j DNAT --to ")
-	buf.WriteString(p.TargetIP)
-	buf.WriteString(":")
-	buf.WriteString(p.TargetPort)
-
+	dnat := p.match()
+	dnat.Target = firewall.TargetDNAT
+	dnat.ToDestination = p.destination()
+
+	local := firewall.Rule{
+		Protocol:        p.Protocol,
+		DestinationPort: p.SourcePort,
+		Target:          firewall.TargetDNAT,
+		ToDestination:   p.destination(),
+	}
+	prerouting := local
 	if p.SourceIP == "0.0.0.0" {
-		buf.WriteString(fmt.Sprintf("\n-A CATTLE_PREROUTING -p %v -m %v --dport %v -m addrtype --dst-type LOCAL -j DNAT --to-destination %v:%v",
-			p.Protocol, p.Protocol, p.SourcePort, p.TargetIP, p.TargetPort))
+		prerouting.DestinationType = "LOCAL"
 	} else {
-		buf.WriteString(fmt.Sprintf("\n-A CATTLE_PREROUTING -p %v -m %v --dport %v -d %v -j DNAT --to-destination %v:%v",
-			p.Protocol, p.Protocol, p.SourcePort, p.SourceIP, p.TargetIP, p.TargetPort))
-	}
-
-	buf.WriteString(fmt.Sprintf("\n-A CATTLE_OUTPUT -p %v -m %v --dport %v -m addrtype --dst-type LOCAL -j DNAT --to-destination %v:%v",
-		p.Protocol, p.Protocol, p.SourcePort, p.TargetIP, p.TargetPort))
-
-	buf.WriteString(fmt.Sprintf("\n-A %s -s %v -d %v -p %v -m %v --dport %v -j MASQUERADE",
-		hostPortsPostRoutingChain, p.TargetIP, p.TargetIP, p.Protocol, p.Protocol, p.TargetPort))
-
-	return buf.Bytes()
-}
-
-func (w *watcher) insertBaseRules() error {
-	var e error
-	if w.run("iptables", "-w", "-t", "raw", "-C", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_RAW_PREROUTING") != nil {
-		if err := w.run("iptables", "-w", "-t", "raw", "-I", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_RAW_PREROUTING"); err != nil {
-			e = errors.Wrap(e, err.Error())
-		}
-	}
-	if w.run("iptables", "-w", "-t", "nat", "-C", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_PREROUTING") != nil {
-		if err := w.run("iptables", "-w", "-t", "nat", "-I", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_PREROUTING"); err != nil {
-			e = errors.Wrap(e, err.Error())
-		}
+		prerouting.Destination = p.SourceIP
 	}
-	if w.run("iptables", "-w", "-C", "FORWARD", "-j", "CATTLE_FORWARD") != nil {
-		if err := w.run("iptables", "-w", "-I", "FORWARD", "-j", "CATTLE_FORWARD"); err != nil {
-			e = errors.Wrap(e, err.Error())
-		}
+	output := local
+	output.DestinationType = "LOCAL"
+
+	postrouting := firewall.Rule{
+		Source:          p.TargetIP,
+		Destination:     p.TargetIP,
+		Protocol:        p.Protocol,
+		DestinationPort: p.TargetPort,
+		Target:          firewall.TargetMasquerade,
 	}
-	if w.run("iptables", "-w", "-t", "nat", "-C", "OUTPUT", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_OUTPUT") != nil {
-		if err := w.run("iptables", "-w", "-t", "nat", "-I", "OUTPUT", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CATTLE_OUTPUT"); err != nil {
-			e = errors.Wrap(e, err.Error())
-		}
-	}
-	if w.run("iptables", "-w", "-t", "nat", "-C", "POSTROUTING", "-j", hostPortsPostRoutingChain) != nil {
-		if err := w.run("iptables", "-w", "-t", "nat", "-I", "POSTROUTING", "-j", hostPortsPostRoutingChain); err != nil {
-			e = errors.Wrap(e, err.Error())
-		}
-	}
-	return e
-}
-
-func (w *watcher) run(args ...string) error {
-	logrus.Debugf("Running %s", strings.Join(args, " "))
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	return []firewall.Rule{dnat, prerouting}, []firewall.Rule{output}, []firewall.Rule{postrouting}
 }
 
 func (w *watcher) onChangeNoError(version string) {
-	if err := w.onChange(version); err != nil {
+	started := time.Now()
+	err := w.onChange(version)
+	if err != nil {
 		logrus.Errorf("Failed to apply host rules: %v", err)
 	}
+	metrics.RecordSync("hostports", started, err)
 }
 
 func (w *watcher) onChange(version string) error {
 	logrus.Debug("Creating rule set")
+	newPortRules, err := DesiredPortRules(w.c)
+	if err != nil {
+		return err
+	}
+
+	logrus.Debugf("New generated rules: %v", newPortRules)
+	if !reflect.DeepEqual(w.applied, newPortRules) {
+		logrus.Infof("Applying new port rules")
+		return w.apply(newPortRules)
+	} else if time.Now().Sub(w.lastApplied) > reapplyEvery {
+		return w.apply(newPortRules)
+	}
+
+	logrus.Debugf("No change in applied rules")
+	return nil
+}
+
+// DesiredPortRules returns the port rules of the running containers of
+// this host, keyed by the container ID and the port definition
+func DesiredPortRules(c metadata.Client) (map[string]PortRule, error) {
 	newPortRules := map[string]PortRule{}
 
-	host, err := w.c.GetSelfHost()
+	host, err := c.GetSelfHost()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	networks, err := networksByUUID(w.c)
+	networks, err := networksByUUID(c)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	containers, err := w.c.GetContainers()
+	containers, err := c.GetContainers()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	sctp := sctpSupported()
 	for _, container := range containers {
 		network := networks[container.NetworkUUID]
 		bridge := ""
@@ -202,7 +213,7 @@ func (w *watcher) onChange(version string) error {
 		}
 
 		for _, port := range container.Ports {
-			rule, ok := parsePortRule(bridge, host.AgentIP, container.PrimaryIp, port)
+			rule, ok := parsePortRule(bridge, host.AgentIP, container.PrimaryIp, port, sctp)
 			if !ok {
 				continue
 			}
@@ -211,81 +222,62 @@ func (w *watcher) onChange(version string) error {
 		}
 	}
 
-	logrus.Debugf("New generated rules: %v", newPortRules)
-	if !reflect.DeepEqual(w.applied, newPortRules) {
-		logrus.Infof("Applying new port rules")
-		return w.apply(newPortRules)
-	} else if time.Now().Sub(w.lastApplied) > reapplyEvery {
-		return w.apply(newPortRules)
-	}
-
-	logrus.Debugf("No change in applied rules")
-	return nil
+	return newPortRules, nil
 }
 
 func (w *watcher) apply(rules map[string]PortRule) error {
-	buf := &bytes.Buffer{}
-	buf.WriteString("*raw\n")
-	buf.WriteString(":CATTLE_RAW_PREROUTING -\n")
-	buf.WriteString("-F CATTLE_RAW_PREROUTING\n")
-	for _, rule := range rules {
-		buf.WriteString("\n")
-		buf.Write(rule.rawIptables())
-	}
-	buf.WriteString("\nCOMMIT\n")
-
+	local := firewall.Rule{DestinationType: "LOCAL"}
+	raw := firewall.Chain{Table: "raw", Name: "CATTLE_RAW_PREROUTING", Hook: "PREROUTING", HookRule: local}
+	prerouting := firewall.Chain{Table: "nat", Name: "CATTLE_PREROUTING", Hook: "PREROUTING", HookRule: local}
+	output := firewall.Chain{Table: "nat", Name: "CATTLE_OUTPUT", Hook: "OUTPUT", HookRule: local}
+	postrouting := firewall.Chain{Table: "nat", Name: hostPortsPostRoutingChain, Hook: "POSTROUTING"}
 	// NOTE: We don't use CATTLE_POSTROUTING, but for migration we just wipe it out
-	buf.WriteString("*nat\n")
-	buf.WriteString(":CATTLE_PREROUTING -\n")
-	buf.WriteString(":CATTLE_POSTROUTING -\n")
-	buf.WriteString(":CATTLE_OUTPUT -\n")
-	buf.WriteString(fmt.Sprintf(":%s -\n", hostPortsPostRoutingChain))
-	buf.WriteString("-F CATTLE_PREROUTING\n")
-	buf.WriteString("-F CATTLE_POSTROUTING\n")
-	buf.WriteString("-F CATTLE_OUTPUT\n")
-	buf.WriteString(fmt.Sprintf("-F %s\n", hostPortsPostRoutingChain))
+	migrated := firewall.Chain{Table: "nat", Name: "CATTLE_POSTROUTING"}
+	forward := firewall.Chain{Table: "filter", Name: "CATTLE_FORWARD", Hook: "FORWARD", Rules: []firewall.Rule{
+		{Mark: hostPortsMark, Target: firewall.TargetAccept},
+		// For k8s
+		{Mark: 0x4000, Target: firewall.TargetAccept},
+	}}
 
 	if w.metadataListenPort != "80" {
-		buf.WriteString(fmt.Sprintf("-A CATTLE_PREROUTING -d %s/32 -p tcp -m tcp --dport 80 -j DNAT --to-destination 169.254.169.250:%s\n", w.metadataAddress, w.metadataListenPort))
-		buf.WriteString(fmt.Sprintf("-A CATTLE_OUTPUT -d %s/32 -p tcp -m tcp --dport 80 -j DNAT --to-destination 169.254.169.250:%s\n", w.metadataAddress, w.metadataListenPort))
+		metadata := firewall.Rule{
+			Destination:     w.metadataAddress + "/32",
+			Protocol:        "tcp",
+			DestinationPort: "80",
+			Target:          firewall.TargetDNAT,
+			ToDestination:   "169.254.169.250:" + w.metadataListenPort,
+		}
+		prerouting.Rules = append(prerouting.Rules, metadata)
+		output.Rules = append(output.Rules, metadata)
 	}
 
-	for _, rule := range rules {
-		buf.WriteString("\n")
-		buf.Write(rule.natIptables())
+	keys := []string{}
+	for key := range rules {
+		keys = append(keys, key)
 	}
-
-	buf.WriteString("\nCOMMIT\n\n*filter\n:CATTLE_FORWARD -\n")
-	buf.WriteString("-F CATTLE_FORWARD\n")
-	buf.WriteString("-A CATTLE_FORWARD -m mark --mark 0x1068 -j ACCEPT\n")
-	// For k8s
-	buf.WriteString("-A CATTLE_FORWARD -m mark --mark 0x4000 -j ACCEPT\n")
-
-	buf.WriteString("\nCOMMIT\n")
-
-	if logrus.GetLevel() == logrus.DebugLevel {
-		fmt.Printf("Applying rules\n%s", buf)
+	sort.Strings(keys)
+	for _, key := range keys {
+		raw.Rules = append(raw.Rules, rules[key].rawRules()...)
+		pre, out, post := rules[key].natRules()
+		prerouting.Rules = append(prerouting.Rules, pre...)
+		output.Rules = append(output.Rules, out...)
+		postrouting.Rules = append(postrouting.Rules, post...)
 	}
 
-	cmd := exec.Command("iptables-restore", "-n")
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	cmd.Stdin = buf
-	if err := cmd.Run(); err != nil {
-		logrus.Errorf("Failed to apply port rules\n%s", buf)
-		return err
-	}
-
-	if err := w.insertBaseRules(); err != nil {
-		return errors.Wrap(err, "Applying port base iptables rules")
+	if err := firewall.Apply([]firewall.Chain{raw, prerouting, migrated, output, postrouting, forward}); err != nil {
+		metrics.AddCounter(metrics.FirewallErrorsTotal, map[string]string{"module": "hostports"}, 1)
+		return errors.Wrap(err, "Applying port rules")
 	}
 
 	w.applied = rules
 	w.lastApplied = time.Now()
+	setApplied(rules)
 	return nil
 }
 
-func parsePortRule(bridge, hostIP, targetIP, portDef string) (PortRule, bool) {
+// parsePortRule returns the port rule of the port definition, the SCTP
+// ones are skipped unless sctp tells the kernel supports them
+func parsePortRule(bridge, hostIP, targetIP, portDef string, sctp bool) (PortRule, bool) {
 	proto := "tcp"
 	parts := strings.Split(portDef, ":")
 	if len(parts) != 3 {
@@ -297,7 +289,26 @@ func parsePortRule(bridge, hostIP, targetIP, portDef string) (PortRule, bool) {
 	parts = strings.Split(targetPort, "/")
 	if len(parts) == 2 {
 		targetPort = parts[0]
-		proto = parts[1]
+		proto = strings.ToLower(parts[1])
+	}
+
+	if !supportedProtocol(proto, sctp) {
+		logrus.Debugf("Skipping port %v, protocol %v isn't supported", portDef, proto)
+		return PortRule{}, false
+	}
+
+	sourceFirst, sourceLast, ok := parsePortRange(sourcePort)
+	if !ok {
+		return PortRule{}, false
+	}
+	targetFirst, targetLast, ok := parsePortRange(targetPort)
+	if !ok {
+		return PortRule{}, false
+	}
+	// A range can only be published to the same range or to a single port
+	if targetFirst != targetLast && (targetFirst != sourceFirst || targetLast != sourceLast) {
+		logrus.Debugf("Skipping port %v, the target range differs from the host one", portDef)
+		return PortRule{}, false
 	}
 
 	return PortRule{
@@ -310,6 +321,39 @@ func parsePortRule(bridge, hostIP, targetIP, portDef string) (PortRule, bool) {
 	}, true
 }
 
+// parsePortRange returns the first and last port of the given port or
+// port range, like 8080 or 30000-30100
+func parsePortRange(ports string) (int, int, bool) {
+	parts := strings.Split(ports, "-")
+	if len(parts) > 2 {
+		return 0, 0, false
+	}
+	first, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	last := first
+	if len(parts) == 2 {
+		if last, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, false
+		}
+	}
+	if first < 1 || last > 65535 || first > last {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+func supportedProtocol(proto string, sctp bool) bool {
+	switch proto {
+	case "tcp", "udp":
+		return true
+	case "sctp":
+		return sctp
+	}
+	return false
+}
+
 func networksByUUID(c metadata.Client) (map[string]metadata.Network, error) {
 	networkByUUID := map[string]metadata.Network{}
 	networks, err := c.GetNetworks()
@@ -0,0 +1,115 @@
+package hostports
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/firewall"
+	"github.com/rancher/plugin-manager/testutil"
+)
+
+func TestParsePortRule(t *testing.T) {
+	tests := []struct {
+		portDef  string
+		ok       bool
+		expected PortRule
+	}{
+		{"0.0.0.0:8080:80", true, PortRule{SourceIP: "0.0.0.0", SourcePort: "8080", TargetPort: "80", Protocol: "tcp"}},
+		{"0.0.0.0:53:53/UDP", true, PortRule{SourceIP: "0.0.0.0", SourcePort: "53", TargetPort: "53", Protocol: "udp"}},
+		{"172.22.101.101:30000-30100:30000-30100/udp", true, PortRule{SourceIP: "172.22.101.101", SourcePort: "30000-30100", TargetPort: "30000-30100", Protocol: "udp"}},
+		{"0.0.0.0:30000-30100:80/tcp", true, PortRule{SourceIP: "0.0.0.0", SourcePort: "30000-30100", TargetPort: "80", Protocol: "tcp"}},
+		{"0.0.0.0:30000-30100:40000-40100/tcp", false, PortRule{}},
+		{"0.0.0.0:8080:30000-30100/tcp", false, PortRule{}},
+		{"0.0.0.0:30100-30000:30100-30000/tcp", false, PortRule{}},
+		{"0.0.0.0:70000:80/tcp", false, PortRule{}},
+		{"0.0.0.0:http:80/tcp", false, PortRule{}},
+		{"0.0.0.0:9899:9899/sctp", false, PortRule{}},
+		{"0.0.0.0:9899:9899/icmp", false, PortRule{}},
+		{"8080:80/tcp", false, PortRule{}},
+	}
+
+	for _, test := range tests {
+		rule, ok := parsePortRule("", "172.22.101.101", "", test.portDef, false)
+		if ok != test.ok || rule != test.expected {
+			t.Errorf("%v: expected: %v %+v, got actual: %v %+v", test.portDef, test.ok, test.expected, ok, rule)
+		}
+	}
+
+	if _, ok := parsePortRule("", "172.22.101.101", "10.42.0.5", "0.0.0.0:9899:9899/sctp", true); !ok {
+		t.Errorf("expected an SCTP rule when the kernel tracks SCTP")
+	}
+}
+
+func TestPortRuleRules(t *testing.T) {
+	rule, _ := parsePortRule("docker0", "172.22.101.101", "10.42.0.5", "0.0.0.0:30000-30100:30000-30100/udp", false)
+
+	expected := []string{"! -i docker0 -p udp -m udp --dport 30000:30100 -j MARK --set-mark 0x1068"}
+	if actual := ruleStrings(rule.rawRules()); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, actual)
+	}
+
+	pre, out, post := rule.natRules()
+	expected = []string{
+		"! -i docker0 -p udp -m udp --dport 30000:30100 -j DNAT --to-destination 10.42.0.5",
+		"-p udp -m udp --dport 30000:30100 -m addrtype --dst-type LOCAL -j DNAT --to-destination 10.42.0.5",
+		"-p udp -m udp --dport 30000:30100 -m addrtype --dst-type LOCAL -j DNAT --to-destination 10.42.0.5",
+		"-s 10.42.0.5 -d 10.42.0.5 -p udp -m udp --dport 30000:30100 -j MASQUERADE",
+	}
+	if actual := ruleStrings(pre, out, post); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, actual)
+	}
+
+	rule, _ = parsePortRule("", "172.22.101.101", "10.42.0.5", "172.22.101.101:8080:80/tcp", false)
+	pre, out, post = rule.natRules()
+	expected = []string{
+		"-d 172.22.101.101 -p tcp -m tcp --dport 8080 -j DNAT --to-destination 10.42.0.5:80",
+		"-d 172.22.101.101 -p tcp -m tcp --dport 8080 -j DNAT --to-destination 10.42.0.5:80",
+		"-p tcp -m tcp --dport 8080 -m addrtype --dst-type LOCAL -j DNAT --to-destination 10.42.0.5:80",
+		"-s 10.42.0.5 -d 10.42.0.5 -p tcp -m tcp --dport 80 -j MASQUERADE",
+	}
+	if actual := ruleStrings(pre, out, post); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, actual)
+	}
+}
+
+func ruleStrings(rules ...[]firewall.Rule) []string {
+	s := []string{}
+	for _, r := range rules {
+		for _, rule := range r {
+			s = append(s, rule.String())
+		}
+	}
+	return s
+}
+
+func TestDesiredPortRulesSCTP(t *testing.T) {
+	defer func(f func() bool) { sctpSupported = f }(sctpSupported)
+	checks := 0
+	sctpSupported = func() bool {
+		checks++
+		return true
+	}
+
+	mc := &testutil.FakeMetadataClient{
+		Host:     metadata.Host{UUID: "host1", AgentIP: "172.22.101.101"},
+		Networks: []metadata.Network{{UUID: "net1", HostPorts: true}},
+		Containers: []metadata.Container{
+			{ExternalId: "sig1", HostUUID: "host1", State: "running", NetworkUUID: "net1", PrimaryIp: "10.42.0.5",
+				Ports: []string{"0.0.0.0:9899:9899/sctp", "0.0.0.0:8080:80/tcp"}},
+			{ExternalId: "sig2", HostUUID: "host1", State: "running", NetworkUUID: "net1", PrimaryIp: "10.42.0.6",
+				Ports: []string{"0.0.0.0:9900:9899/sctp"}},
+		},
+	}
+
+	rules, err := DesiredPortRules(mc)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if len(rules) != 3 || rules["sig2/0.0.0.0:9900:9899/sctp"].Protocol != "sctp" {
+		t.Errorf("expected the SCTP rules, got actual: %v", rules)
+	}
+	if checks != 1 {
+		t.Errorf("expected SCTP to be checked once, got actual: %v", checks)
+	}
+}
@@ -10,12 +10,16 @@ import (
 	"github.com/rancher/go-rancher-metadata/metadata"
 	"github.com/rancher/plugin-manager/arpsync"
 	"github.com/rancher/plugin-manager/binexec"
+	"github.com/rancher/plugin-manager/changes"
 	"github.com/rancher/plugin-manager/cniconf"
 	"github.com/rancher/plugin-manager/conntracksync"
+	"github.com/rancher/plugin-manager/debugapi"
 	"github.com/rancher/plugin-manager/events"
+	"github.com/rancher/plugin-manager/firewall"
 	"github.com/rancher/plugin-manager/hostnat"
 	"github.com/rancher/plugin-manager/hostports"
 	"github.com/rancher/plugin-manager/macsync"
+	"github.com/rancher/plugin-manager/metrics"
 	"github.com/rancher/plugin-manager/network"
 	"github.com/rancher/plugin-manager/reaper"
 	"github.com/rancher/plugin-manager/routesync"
@@ -65,6 +69,10 @@ func main() {
 			Name:  "disable-routesync",
 			Usage: "Disable routesync",
 		},
+		cli.BoolFlag{
+			Name:  "enable-subnet-routesync",
+			Usage: "Add the missing subnet routes, IPv4 and IPv6, of the local bridges every routesync interval",
+		},
 		cli.StringFlag{
 			Name:  "routesync-interval",
 			Usage: fmt.Sprintf("Customize the interval of routesync in seconds (default: %v)", routesync.DefaultSyncInterval),
@@ -88,15 +96,73 @@ func main() {
 			Usage: fmt.Sprintf("Customize the interval of vethsync in seconds (default: %v)", vethsync.DefaultSyncInterval),
 			Value: "",
 		},
+		cli.BoolFlag{
+			Name:  "event-driven-sync",
+			Usage: "Sync arpsync, vethsync and conntracksync only when the metadata they use changes",
+		},
+		cli.StringFlag{
+			Name:  "arpsync-resync-interval",
+			Usage: fmt.Sprintf("Customize the interval of the arpsync full syncs in seconds with --event-driven-sync, 0 to disable (default: %v)", changes.DefaultResyncInterval),
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "vethsync-resync-interval",
+			Usage: fmt.Sprintf("Customize the interval of the vethsync full syncs in seconds with --event-driven-sync, 0 to disable (default: %v)", changes.DefaultResyncInterval),
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "conntracksync-resync-interval",
+			Usage: fmt.Sprintf("Customize the interval of the conntracksync full syncs in seconds with --event-driven-sync, 0 to disable (default: %v)", changes.DefaultResyncInterval),
+			Value: "",
+		},
 		cli.BoolFlag{
 			Name:  "disable-cni-setup",
 			Usage: "Disable setting up CNI config and binaries",
 		},
+		cli.StringFlag{
+			Name:   "firewall-backend",
+			EnvVar: "RANCHER_FIREWALL_BACKEND",
+			Usage:  "Select the backend programming the host rules: auto, legacy, nft, default or nftables (native, over netlink)",
+			Value:  firewall.ModeAuto,
+		},
+		cli.BoolFlag{
+			Name:  "enable-bridge-reconcile",
+			Usage: "Reconcile the bridges of the local networks on each metadata change, setting the MTU of the overlay ones, and report the readiness on /readyz",
+		},
+		cli.StringFlag{
+			Name:  "metrics-listen-address",
+			Usage: "Serve /metrics, /healthz and /readyz on the given address, e.g. 127.0.0.1:9108 (disabled by default)",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "debug-socket",
+			Usage: fmt.Sprintf("Serve the read-only state API on the given unix socket, e.g. %v (disabled by default)", debugapi.DefaultSocketPath),
+			Value: "",
+		},
+		cli.BoolFlag{
+			Name:  "check-clock-skew",
+			Usage: "Compare the local clock with the metadata server at startup, with an extra request to its /version",
+		},
 		cli.BoolFlag{
 			Name:  "debug",
 			Usage: "Turn on debug logging",
 		},
 	}
+	app.Commands = []cli.Command{
+		{
+			Name:      "state",
+			Usage:     "Print the desired and actual state of the modules of a running plugin-manager",
+			ArgsUsage: "[networks|routes|arp|hostports]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "socket",
+					Usage: "The unix socket of the state API",
+					Value: debugapi.DefaultSocketPath,
+				},
+			},
+			Action: printState,
+		},
+	}
 	app.Action = run
 	app.Run(os.Args)
 }
@@ -106,6 +172,12 @@ func run(c *cli.Context) error {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
+	if address := c.String("metrics-listen-address"); address != "" {
+		if err := metrics.Listen(address); err != nil {
+			return err
+		}
+	}
+
 	if !c.Bool("disable-routesync") {
 		if err := routesync.Watch(c.String("routesync-interval")); err != nil {
 			logrus.Errorf("Failed to start routesync: %v", err)
@@ -126,6 +198,21 @@ func run(c *cli.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "Creating metadata client")
 	}
+	mClient = metrics.InstrumentMetadataClient(mClient)
+
+	if c.Bool("check-clock-skew") {
+		if skew, err := network.DetectClockSkew(network.WithServerClock(mClient, metadataURL)); err != nil {
+			logrus.Infof("Couldn't check the clock skew with metadata: %v", err)
+		} else if skew > network.DefaultClockSkewThreshold || skew < -network.DefaultClockSkewThreshold {
+			logrus.Warnf("Local clock is %v off from the metadata server, metadata may be seen as stale", skew)
+		}
+	}
+
+	if socketPath := c.String("debug-socket"); socketPath != "" {
+		if err := debugapi.Listen(socketPath, mClient); err != nil {
+			logrus.Errorf("Failed to start the state API: %v", err)
+		}
+	}
 
 	if !c.Bool("disable-macsync") {
 		macsync.SyncMACAddresses(mClient, dClient)
@@ -136,10 +223,27 @@ func run(c *cli.Context) error {
 		return err
 	}
 
+	if c.Bool("enable-bridge-reconcile") {
+		readiness := &network.ReadinessState{}
+		network.WatchReadiness(mClient, readiness)
+		metrics.RegisterReadinessCheck(readiness.IsReady)
+	}
+
 	if err := reaper.Watch(dClient, mClient); err != nil {
 		logrus.Errorf("Failed to start unmanaged container reaper: %v", err)
 	}
 
+	if _, err := firewall.Select(c.String("firewall-backend")); err != nil {
+		b := firewall.Current()
+		logrus.Errorf("Failed to select the firewall backend, keeping the %v backend: %v", b.Mode, err)
+	}
+
+	if c.Bool("enable-subnet-routesync") {
+		if err := routesync.WatchSubnets(c.String("routesync-interval"), mClient); err != nil {
+			logrus.Errorf("Failed to start the subnet routes sync: %v", err)
+		}
+	}
+
 	if err := hostports.Watch(mClient, c.String("metadata-address"), c.String("metadata-listen-port")); err != nil {
 		logrus.Errorf("Failed to start host ports configuration: %v", err)
 	}
@@ -148,8 +252,18 @@ func run(c *cli.Context) error {
 		logrus.Errorf("Failed to start host nat configuration: %v", err)
 	}
 
+	var notifier *changes.Notifier
+	if c.Bool("event-driven-sync") {
+		notifier = changes.NewNotifier(mClient)
+	}
+
 	if !c.Bool("disable-conntracksync") {
-		if err := conntracksync.Watch(c.String("conntracksync-interval"), mClient); err != nil {
+		if notifier != nil {
+			err = conntracksync.Subscribe(notifier, c.String("conntracksync-interval"), c.String("conntracksync-resync-interval"), mClient)
+		} else {
+			err = conntracksync.Watch(c.String("conntracksync-interval"), mClient)
+		}
+		if err != nil {
 			logrus.Errorf("Failed to start conntracksync: %v", err)
 		}
 	}
@@ -161,17 +275,31 @@ func run(c *cli.Context) error {
 	}
 
 	if !c.Bool("disable-arpsync") {
-		if err := arpsync.Watch(c.String("arpsync-interval"), mClient, dClient); err != nil {
+		if notifier != nil {
+			err = arpsync.Subscribe(notifier, c.String("arpsync-interval"), c.String("arpsync-resync-interval"), mClient, dClient)
+		} else {
+			err = arpsync.Watch(c.String("arpsync-interval"), mClient, dClient)
+		}
+		if err != nil {
 			logrus.Errorf("Failed to start arpsync: %v", err)
 		}
 	}
 
 	if !c.Bool("disable-vethsync") {
-		if err := vethsync.Watch(c.String("vethsync-interval"), metadataURL, mClient, dClient, c.Bool("debug")); err != nil {
+		if notifier != nil {
+			err = vethsync.Subscribe(notifier, c.String("vethsync-interval"), c.String("vethsync-resync-interval"), metadataURL, mClient, dClient, c.Bool("debug"))
+		} else {
+			err = vethsync.Watch(c.String("vethsync-interval"), metadataURL, mClient, dClient, c.Bool("debug"))
+		}
+		if err != nil {
 			logrus.Errorf("Failed to start vethsync: %v", err)
 		}
 	}
 
+	if notifier != nil {
+		notifier.Start()
+	}
+
 	var binWatcher *binexec.Watcher
 	if !c.Bool("disable-cni-setup") {
 		binWatcher = binexec.Watch(mClient, dClient)
@@ -184,3 +312,21 @@ func run(c *cli.Context) error {
 	<-make(chan struct{})
 	return nil
 }
+
+func printState(c *cli.Context) error {
+	modules := debugapi.Modules
+	if c.NArg() > 0 {
+		modules = c.Args()
+	}
+
+	for _, module := range modules {
+		state, err := debugapi.Get(c.String("socket"), module)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		if err := debugapi.Print(os.Stdout, module, state); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	return nil
+}
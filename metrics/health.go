@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// staleIntervals is the number of sync intervals a module expected to
+// sync periodically can go without a successful sync before it's stale
+const staleIntervals = 3
+
+// ModuleHealth is the outcome of the last syncs of a module
+type ModuleHealth struct {
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+}
+
+type expectedSync struct {
+	interval time.Duration
+	since    time.Time
+}
+
+var (
+	healthLock sync.RWMutex
+	health     = map[string]ModuleHealth{}
+	// expected holds the modules syncing periodically, keyed by module
+	expected = map[string]expectedSync{}
+
+	now = time.Now
+)
+
+// RecordSync records a sync of the given module which started at the
+// given time, updating its health and its sync metrics
+func RecordSync(module string, started time.Time, err error) {
+	finished := now()
+	labels := map[string]string{"module": module}
+	SetLabeledGauge(SyncDurationSeconds, labels, finished.Sub(started).Seconds())
+	AddCounter(SyncsTotal, labels, 1)
+
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	h := health[module]
+	if err != nil {
+		AddCounter(SyncErrorsTotal, labels, 1)
+		h.LastError = err.Error()
+		h.LastFailure = &finished
+	} else {
+		SetLabeledGauge(LastSuccessfulSync, labels, float64(finished.Unix()))
+		h.LastSuccess = &finished
+	}
+	health[module] = h
+}
+
+// RecordReconciled counts the given number of resources changed by the
+// module
+func RecordReconciled(module, resource string, count int) {
+	if count == 0 {
+		return
+	}
+	AddCounter(ReconciledTotal, map[string]string{"module": module, "resource": resource}, float64(count))
+}
+
+// Health returns the health of each module which recorded a sync, keyed
+// by module
+func Health() map[string]ModuleHealth {
+	healthLock.RLock()
+	defer healthLock.RUnlock()
+	ret := map[string]ModuleHealth{}
+	for module, h := range health {
+		ret[module] = h
+	}
+	return ret
+}
+
+// ExpectSyncEvery marks the module as syncing at least every interval,
+// Unhealthy reports it once it didn't succeed for a few intervals. The
+// modules syncing only when metadata changes aren't expected to sync.
+func ExpectSyncEvery(module string, interval time.Duration) {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	expected[module] = expectedSync{interval: interval, since: now()}
+}
+
+// Unhealthy returns why each of the unhealthy modules is, keyed by
+// module: its last sync failed, or it's expected to sync periodically
+// and didn't succeed for too long.
+func Unhealthy() map[string]string {
+	healthLock.RLock()
+	defer healthLock.RUnlock()
+	ret := map[string]string{}
+	for module, h := range health {
+		if h.LastFailure != nil && (h.LastSuccess == nil || h.LastFailure.After(*h.LastSuccess)) {
+			ret[module] = fmt.Sprintf("last sync failed: %v", h.LastError)
+		}
+	}
+	for module, e := range expected {
+		if _, failed := ret[module]; failed {
+			continue
+		}
+		last := e.since
+		if h := health[module]; h.LastSuccess != nil && h.LastSuccess.After(last) {
+			last = *h.LastSuccess
+		}
+		if age := now().Sub(last); age > staleIntervals*e.interval {
+			ret[module] = fmt.Sprintf("no successful sync for %v", age)
+		}
+	}
+	return ret
+}
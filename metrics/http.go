@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+var (
+	readinessLock  sync.RWMutex
+	readinessCheck func() bool
+)
+
+// RegisterReadinessCheck sets the check of /readyz, nil means always ready
+func RegisterReadinessCheck(check func() bool) {
+	readinessLock.Lock()
+	defer readinessLock.Unlock()
+	readinessCheck = check
+}
+
+func isReady() bool {
+	readinessLock.RLock()
+	defer readinessLock.RUnlock()
+	return readinessCheck == nil || readinessCheck()
+}
+
+// Handler serves the metrics of the given collector on /metrics, the
+// health of the modules on /healthz and the readiness on /readyz.
+// /healthz answers 503 while any of the modules is unhealthy.
+func Handler(p *PrometheusCollector) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := p.Write(w); err != nil {
+			logrus.Errorf("metrics: error writing metrics: %v", err)
+		}
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		unhealthy := Unhealthy()
+		if len(unhealthy) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"modules": Health(), "unhealthy": unhealthy}); err != nil {
+			logrus.Errorf("metrics: error writing health: %v", err)
+		}
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !isReady() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+	return mux
+}
+
+// Listen registers a PrometheusCollector and serves it on the given
+// address in the background, it only fails if the address can't be
+// listened on
+func Listen(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return errors.Wrapf(err, "listening on %v", address)
+	}
+
+	p := NewPrometheusCollector()
+	RegisterCollector(p)
+
+	go func() {
+		if err := http.Serve(l, Handler(p)); err != nil {
+			logrus.Errorf("metrics: error serving on %v: %v", address, err)
+		}
+	}()
+	logrus.Infof("metrics: serving /metrics, /healthz and /readyz on %v", address)
+	return nil
+}
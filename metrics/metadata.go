@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// metadataClient counts the errors of the metadata requests done by the
+// modules, the requests not listed here aren't counted
+type metadataClient struct {
+	metadata.Client
+}
+
+// InstrumentMetadataClient returns a client counting the failed requests
+// of the given client in MetadataErrorsTotal
+func InstrumentMetadataClient(mc metadata.Client) metadata.Client {
+	return &metadataClient{mc}
+}
+
+func countMetadataError(request string, err error) {
+	if err != nil {
+		AddCounter(MetadataErrorsTotal, map[string]string{"request": request}, 1)
+	}
+}
+
+func (c *metadataClient) GetVersion() (string, error) {
+	v, err := c.Client.GetVersion()
+	countMetadataError("version", err)
+	return v, err
+}
+
+func (c *metadataClient) GetSelfHost() (metadata.Host, error) {
+	h, err := c.Client.GetSelfHost()
+	countMetadataError("self_host", err)
+	return h, err
+}
+
+func (c *metadataClient) GetHosts() ([]metadata.Host, error) {
+	h, err := c.Client.GetHosts()
+	countMetadataError("hosts", err)
+	return h, err
+}
+
+func (c *metadataClient) GetContainers() ([]metadata.Container, error) {
+	containers, err := c.Client.GetContainers()
+	countMetadataError("containers", err)
+	return containers, err
+}
+
+func (c *metadataClient) GetServices() ([]metadata.Service, error) {
+	s, err := c.Client.GetServices()
+	countMetadataError("services", err)
+	return s, err
+}
+
+func (c *metadataClient) GetNetworks() ([]metadata.Network, error) {
+	n, err := c.Client.GetNetworks()
+	countMetadataError("networks", err)
+	return n, err
+}
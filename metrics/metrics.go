@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"sync"
+)
+
+// Names of the gauges of the resources managed on the host
+const (
+	ManagedBridges   = "managed_bridges"
+	ManagedAddresses = "managed_addresses"
+	ManagedRoutes    = "managed_routes"
+	ManagedNeighbors = "managed_neighbors"
+)
+
+// NetworkInfo is the info series of the local networks, set to 1 with
+// the network_uuid, bridge, subnet and router_host labels
+const NetworkInfo = "network_info"
+
+// Names of the metrics of the sync modules, labeled with the module
+const (
+	SyncDurationSeconds = "sync_duration_seconds"
+	LastSuccessfulSync  = "last_successful_sync_timestamp_seconds"
+	SyncsTotal          = "syncs_total"
+	SyncErrorsTotal     = "sync_errors_total"
+	// ReconciledTotal counts the changes done by the modules, it also
+	// has a resource label, e.g. routes or neighbors
+	ReconciledTotal     = "reconciled_total"
+	FirewallErrorsTotal = "firewall_apply_errors_total"
+	// MetadataErrorsTotal counts the failed metadata requests, it has
+	// a request label instead of the module
+	MetadataErrorsTotal = "metadata_fetch_errors_total"
+)
+
+// Collector receives the metrics of the manager, to be exported
+// by the monitoring system in use
+type Collector interface {
+	SetGauge(name string, value float64)
+	// SetLabeledGauge sets the series of the gauge with the given labels,
+	// it's also used for the info series
+	SetLabeledGauge(name string, labels map[string]string, value float64)
+	// DeleteLabeledGauge removes the series of the gauge with the given
+	// labels, e.g. the info series of a network that's gone
+	DeleteLabeledGauge(name string, labels map[string]string)
+	// AddCounter adds delta to the series of the counter with the
+	// given labels
+	AddCounter(name string, labels map[string]string, delta float64)
+}
+
+type noopCollector struct{}
+
+func (noopCollector) SetGauge(string, float64) {}
+
+func (noopCollector) SetLabeledGauge(string, map[string]string, float64) {}
+
+func (noopCollector) DeleteLabeledGauge(string, map[string]string) {}
+
+func (noopCollector) AddCounter(string, map[string]string, float64) {}
+
+var (
+	collectorLock sync.RWMutex
+	collector     Collector = noopCollector{}
+)
+
+// RegisterCollector sets the collector receiving the metrics, passing
+// nil goes back to discarding them
+func RegisterCollector(c Collector) {
+	collectorLock.Lock()
+	defer collectorLock.Unlock()
+	if c == nil {
+		c = noopCollector{}
+	}
+	collector = c
+}
+
+// RegisteredCollector returns the collector receiving the metrics
+func RegisteredCollector() Collector {
+	collectorLock.RLock()
+	defer collectorLock.RUnlock()
+	return collector
+}
+
+// SetGauge sets the gauge on the registered Collector
+func SetGauge(name string, value float64) {
+	collectorLock.RLock()
+	defer collectorLock.RUnlock()
+	collector.SetGauge(name, value)
+}
+
+// SetLabeledGauge sets the labeled gauge on the registered Collector
+func SetLabeledGauge(name string, labels map[string]string, value float64) {
+	collectorLock.RLock()
+	defer collectorLock.RUnlock()
+	collector.SetLabeledGauge(name, labels, value)
+}
+
+// DeleteLabeledGauge removes the labeled gauge from the registered
+// Collector
+func DeleteLabeledGauge(name string, labels map[string]string) {
+	collectorLock.RLock()
+	defer collectorLock.RUnlock()
+	collector.DeleteLabeledGauge(name, labels)
+}
+
+// AddCounter adds to the counter on the registered Collector
+func AddCounter(name string, labels map[string]string, delta float64) {
+	collectorLock.RLock()
+	defer collectorLock.RUnlock()
+	collector.AddCounter(name, labels, delta)
+}
+
+// ManagedResources counts the resources managed on the host
+type ManagedResources struct {
+	Bridges   int
+	Addresses int
+	Routes    int
+	Neighbors int
+}
+
+// Add returns the sum of both counts
+func (r ManagedResources) Add(other ManagedResources) ManagedResources {
+	return ManagedResources{
+		Bridges:   r.Bridges + other.Bridges,
+		Addresses: r.Addresses + other.Addresses,
+		Routes:    r.Routes + other.Routes,
+		Neighbors: r.Neighbors + other.Neighbors,
+	}
+}
+
+// UpdateManagedResources sets the gauges of the managed resources
+func UpdateManagedResources(r ManagedResources) {
+	SetGauge(ManagedBridges, float64(r.Bridges))
+	SetGauge(ManagedAddresses, float64(r.Addresses))
+	SetGauge(ManagedRoutes, float64(r.Routes))
+	SetGauge(ManagedNeighbors, float64(r.Neighbors))
+}
@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rancher/plugin-manager/metrics/metricstest"
+)
+
+func TestUpdateManagedResources(t *testing.T) {
+	defer RegisterCollector(nil)
+
+	fake := metricstest.NewFakeCollector()
+	RegisterCollector(fake)
+
+	UpdateManagedResources(ManagedResources{Bridges: 1, Addresses: 2, Routes: 3}.Add(ManagedResources{Bridges: 1, Neighbors: 4}))
+	expected := map[string]float64{
+		ManagedBridges:   2,
+		ManagedAddresses: 2,
+		ManagedRoutes:    3,
+		ManagedNeighbors: 4,
+	}
+	if !reflect.DeepEqual(fake.Gauges, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, fake.Gauges)
+	}
+
+	RegisterCollector(nil)
+	UpdateManagedResources(ManagedResources{})
+	if fake.Gauge(ManagedBridges) != 2 {
+		t.Errorf("expected no update after unregistering, got actual: %v", fake.Gauges)
+	}
+}
+
+func TestSetLabeledGauge(t *testing.T) {
+	defer RegisterCollector(nil)
+
+	fake := metricstest.NewFakeCollector()
+	RegisterCollector(fake)
+
+	labels := map[string]string{"network_uuid": "net1"}
+	SetLabeledGauge(NetworkInfo, labels, 1)
+	expected := []metricstest.LabeledGauge{{Name: NetworkInfo, Labels: labels, Value: 1}}
+	if !reflect.DeepEqual(fake.LabeledGauges, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, fake.LabeledGauges)
+	}
+}
@@ -0,0 +1,77 @@
+package metricstest
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FakeCollector keeps the last value of each gauge and all the labeled
+// gauges set or deleted, it's meant to be registered in tests
+type FakeCollector struct {
+	sync.Mutex
+	Gauges        map[string]float64
+	LabeledGauges []LabeledGauge
+	// DeletedGauges are the labeled gauges deleted, without a value
+	DeletedGauges []LabeledGauge
+	counters      map[string]float64
+}
+
+// LabeledGauge is a labeled gauge recorded by FakeCollector
+type LabeledGauge struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// NewFakeCollector returns an empty FakeCollector
+func NewFakeCollector() *FakeCollector {
+	return &FakeCollector{Gauges: map[string]float64{}, counters: map[string]float64{}}
+}
+
+// SetGauge records the value of the gauge
+func (f *FakeCollector) SetGauge(name string, value float64) {
+	f.Lock()
+	defer f.Unlock()
+	f.Gauges[name] = value
+}
+
+// Gauge returns the last value of the gauge
+func (f *FakeCollector) Gauge(name string) float64 {
+	f.Lock()
+	defer f.Unlock()
+	return f.Gauges[name]
+}
+
+// SetLabeledGauge records the labeled gauge
+func (f *FakeCollector) SetLabeledGauge(name string, labels map[string]string, value float64) {
+	f.Lock()
+	defer f.Unlock()
+	f.LabeledGauges = append(f.LabeledGauges, LabeledGauge{Name: name, Labels: labels, Value: value})
+}
+
+// DeleteLabeledGauge records the deleted labeled gauge
+func (f *FakeCollector) DeleteLabeledGauge(name string, labels map[string]string) {
+	f.Lock()
+	defer f.Unlock()
+	f.DeletedGauges = append(f.DeletedGauges, LabeledGauge{Name: name, Labels: labels})
+}
+
+// AddCounter adds to the series of the counter
+func (f *FakeCollector) AddCounter(name string, labels map[string]string, delta float64) {
+	f.Lock()
+	defer f.Unlock()
+	f.counters[series(name, labels)] += delta
+}
+
+// Counter returns the value of the series of the counter
+func (f *FakeCollector) Counter(name string, labels map[string]string) float64 {
+	f.Lock()
+	defer f.Unlock()
+	return f.counters[series(name, labels)]
+}
+
+// series identifies the series of a counter, the labels are printed
+// sorted by key
+func series(name string, labels map[string]string) string {
+	return fmt.Sprint(name, labels)
+}
@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// namePrefix is prepended to the names of the exported metrics
+const namePrefix = "plugin_manager_"
+
+// PrometheusCollector keeps the last value of the gauges and the totals
+// of the counters, to be exported in the Prometheus text format
+type PrometheusCollector struct {
+	sync.Mutex
+	gauges   map[string]map[string]float64
+	counters map[string]map[string]float64
+}
+
+// NewPrometheusCollector returns an empty PrometheusCollector
+func NewPrometheusCollector() *PrometheusCollector {
+	return &PrometheusCollector{
+		gauges:   map[string]map[string]float64{},
+		counters: map[string]map[string]float64{},
+	}
+}
+
+// SetGauge sets the gauge
+func (p *PrometheusCollector) SetGauge(name string, value float64) {
+	p.SetLabeledGauge(name, nil, value)
+}
+
+// SetLabeledGauge sets the series of the gauge
+func (p *PrometheusCollector) SetLabeledGauge(name string, labels map[string]string, value float64) {
+	p.Lock()
+	defer p.Unlock()
+	if p.gauges[name] == nil {
+		p.gauges[name] = map[string]float64{}
+	}
+	p.gauges[name][Series(name, labels)] = value
+}
+
+// DeleteLabeledGauge removes the series of the gauge, the gauge isn't
+// written anymore once it has no series
+func (p *PrometheusCollector) DeleteLabeledGauge(name string, labels map[string]string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.gauges[name], Series(name, labels))
+	if len(p.gauges[name]) == 0 {
+		delete(p.gauges, name)
+	}
+}
+
+// AddCounter adds to the series of the counter
+func (p *PrometheusCollector) AddCounter(name string, labels map[string]string, delta float64) {
+	p.Lock()
+	defer p.Unlock()
+	if p.counters[name] == nil {
+		p.counters[name] = map[string]float64{}
+	}
+	p.counters[name][Series(name, labels)] += delta
+}
+
+// Write writes all the metrics in the Prometheus text format, sorted by
+// name and series
+func (p *PrometheusCollector) Write(w io.Writer) error {
+	p.Lock()
+	defer p.Unlock()
+
+	byType := map[string]map[string]map[string]float64{"gauge": p.gauges, "counter": p.counters}
+	names := []string{}
+	types := map[string]string{}
+	for metricType, metrics := range byType {
+		for name := range metrics {
+			names = append(names, name)
+			types[name] = metricType
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "# TYPE %v%v %v\n", namePrefix, name, types[name]); err != nil {
+			return err
+		}
+		values := byType[types[name]][name]
+		series := []string{}
+		for s := range values {
+			series = append(series, s)
+		}
+		sort.Strings(series)
+		for _, s := range series {
+			if _, err := fmt.Fprintf(w, "%v%v %v\n", namePrefix, s, strconv.FormatFloat(values[s], 'g', -1, 64)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// labelValueEscaper escapes the label values the way the Prometheus text
+// format expects, only the backslash, double quote and line feed are
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Series returns the name of the series of the metric with the given
+// labels in the Prometheus text format, e.g. syncs_total{module="arpsync"}
+func Series(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	keys := []string{}
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%v=\"%v\"", k, labelValueEscaper.Replace(labels[k])))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
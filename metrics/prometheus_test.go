@@ -0,0 +1,219 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rancher/plugin-manager/metrics/metricstest"
+)
+
+func TestPrometheusCollectorWrite(t *testing.T) {
+	p := NewPrometheusCollector()
+	p.SetGauge(ManagedRoutes, 3)
+	p.SetLabeledGauge(SyncDurationSeconds, map[string]string{"module": "vethsync"}, 0.25)
+	p.SetLabeledGauge(SyncDurationSeconds, map[string]string{"module": "arpsync"}, 1.5)
+	p.SetLabeledGauge(SyncDurationSeconds, map[string]string{"module": "arpsync"}, 0.5)
+	p.SetLabeledGauge(NetworkInfo, map[string]string{"network_uuid": "net1"}, 1)
+	p.SetLabeledGauge(SyncDurationSeconds, map[string]string{"module": "hostnat"}, 2)
+	p.DeleteLabeledGauge(NetworkInfo, map[string]string{"network_uuid": "net1"})
+	p.DeleteLabeledGauge(SyncDurationSeconds, map[string]string{"module": "hostnat"})
+	p.AddCounter(SyncsTotal, map[string]string{"module": "arpsync"}, 1)
+	p.AddCounter(SyncsTotal, map[string]string{"module": "arpsync"}, 1)
+	p.AddCounter(ReconciledTotal, map[string]string{"resource": "routes", "module": "route\"sync"}, 4)
+
+	buf := &bytes.Buffer{}
+	if err := p.Write(buf); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	expected := "# TYPE plugin_manager_managed_routes gauge\n" +
+		"plugin_manager_managed_routes 3\n" +
+		"# TYPE plugin_manager_reconciled_total counter\n" +
+		"plugin_manager_reconciled_total{module=\"route\\\"sync\",resource=\"routes\"} 4\n" +
+		"# TYPE plugin_manager_sync_duration_seconds gauge\n" +
+		"plugin_manager_sync_duration_seconds{module=\"arpsync\"} 0.5\n" +
+		"plugin_manager_sync_duration_seconds{module=\"vethsync\"} 0.25\n" +
+		"# TYPE plugin_manager_syncs_total counter\n" +
+		"plugin_manager_syncs_total{module=\"arpsync\"} 2\n"
+	if buf.String() != expected {
+		t.Errorf("expected:\n%v\ngot actual:\n%v", expected, buf)
+	}
+}
+
+func TestRecordSync(t *testing.T) {
+	defer RegisterCollector(nil)
+	defer func(n func() time.Time) { now = n }(now)
+	defer func() { health = map[string]ModuleHealth{} }()
+
+	fake := metricstest.NewFakeCollector()
+	RegisterCollector(fake)
+
+	finished := time.Unix(1500000000, 0)
+	now = func() time.Time { return finished }
+	labels := map[string]string{"module": "arpsync"}
+
+	RecordSync("arpsync", finished.Add(-2*time.Second), nil)
+	RecordSync("arpsync", finished.Add(-time.Second), fmt.Errorf("no eth0"))
+
+	if actual := fake.Counter(SyncsTotal, labels); actual != 2 {
+		t.Errorf("expected: 2, got actual: %v", actual)
+	}
+	if actual := fake.Counter(SyncErrorsTotal, labels); actual != 1 {
+		t.Errorf("expected: 1, got actual: %v", actual)
+	}
+	last := fake.LabeledGauges[len(fake.LabeledGauges)-1]
+	if last.Name != SyncDurationSeconds || last.Value != 1 {
+		t.Errorf("expected the duration of the last sync, got actual: %+v", last)
+	}
+
+	h := Health()["arpsync"]
+	if h.LastSuccess == nil || !h.LastSuccess.Equal(finished) {
+		t.Errorf("expected: %v, got actual: %v", finished, h.LastSuccess)
+	}
+	if h.LastError != "no eth0" || h.LastFailure == nil {
+		t.Errorf("expected the last failure to be kept, got actual: %+v", h)
+	}
+
+	RecordReconciled("arpsync", "neighbors", 0)
+	RecordReconciled("arpsync", "neighbors", 3)
+	if actual := fake.Counter(ReconciledTotal, map[string]string{"module": "arpsync", "resource": "neighbors"}); actual != 3 {
+		t.Errorf("expected: 3, got actual: %v", actual)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	defer RegisterCollector(nil)
+	defer func() { health = map[string]ModuleHealth{} }()
+
+	p := NewPrometheusCollector()
+	RegisterCollector(p)
+	RecordSync("vethsync", time.Now(), nil)
+
+	server := httptest.NewServer(Handler(p))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	buf.ReadFrom(resp.Body)
+	resp.Body.Close()
+	if !bytes.Contains(buf.Bytes(), []byte("plugin_manager_syncs_total{module=\"vethsync\"} 1\n")) {
+		t.Errorf("expected the syncs of vethsync, got actual:\n%v", buf)
+	}
+
+	resp, err = http.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected: %v, got actual: %v", http.StatusOK, resp.StatusCode)
+	}
+	status := struct {
+		Modules map[string]ModuleHealth `json:"modules"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if status.Modules["vethsync"].LastSuccess == nil {
+		t.Errorf("expected the last success of vethsync, got actual: %+v", status)
+	}
+}
+
+func TestHandlerReadyz(t *testing.T) {
+	defer RegisterReadinessCheck(nil)
+
+	server := httptest.NewServer(Handler(NewPrometheusCollector()))
+	defer server.Close()
+
+	ready := false
+	RegisterReadinessCheck(func() bool { return ready })
+	for _, expected := range []int{http.StatusServiceUnavailable, http.StatusOK} {
+		resp, err := http.Get(server.URL + "/readyz")
+		if err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("expected: %v, got actual: %v", expected, resp.StatusCode)
+		}
+		ready = true
+	}
+}
+
+func TestHandlerUnhealthy(t *testing.T) {
+	defer func() { health = map[string]ModuleHealth{} }()
+
+	RecordSync("arpsync", time.Now(), nil)
+	RecordSync("arpsync", time.Now(), fmt.Errorf("no eth0"))
+
+	server := httptest.NewServer(Handler(NewPrometheusCollector()))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected: %v, got actual: %v", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	status := struct {
+		Unhealthy map[string]string `json:"unhealthy"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if status.Unhealthy["arpsync"] != "last sync failed: no eth0" {
+		t.Errorf("expected arpsync to be unhealthy, got actual: %+v", status)
+	}
+}
+
+func TestUnhealthy(t *testing.T) {
+	defer func(n func() time.Time) { now = n }(now)
+	defer func() { health, expected = map[string]ModuleHealth{}, map[string]expectedSync{} }()
+
+	started := time.Unix(1500000000, 0)
+	now = func() time.Time { return started }
+	ExpectSyncEvery("routesync", time.Minute)
+	ExpectSyncEvery("arpsync", time.Minute)
+	RecordSync("hostnat", started, nil)
+	if unhealthy := Unhealthy(); len(unhealthy) != 0 {
+		t.Errorf("expected all the modules to be healthy, got actual: %v", unhealthy)
+	}
+
+	now = func() time.Time { return started.Add(2 * time.Minute) }
+	RecordSync("routesync", started, nil)
+	RecordSync("hostnat", started, fmt.Errorf("iptables-restore failed"))
+
+	// hostnat only syncs on metadata changes, it's never stale
+	now = func() time.Time { return started.Add(4 * time.Minute) }
+	expectedUnhealthy := map[string]string{
+		"arpsync": "no successful sync for 4m0s",
+		"hostnat": "last sync failed: iptables-restore failed",
+	}
+	if unhealthy := Unhealthy(); !reflect.DeepEqual(unhealthy, expectedUnhealthy) {
+		t.Errorf("expected: %v, got actual: %v", expectedUnhealthy, unhealthy)
+	}
+
+	now = func() time.Time { return started.Add(6 * time.Minute) }
+	if unhealthy := Unhealthy(); unhealthy["routesync"] == "" {
+		t.Errorf("expected routesync to be stale, got actual: %v", unhealthy)
+	}
+}
+
+func TestSeriesEscaping(t *testing.T) {
+	labels := map[string]string{"bridge": "br\\0\n\"été\""}
+	expected := `network_info{bridge="br\\0\n\"été\""}`
+	if actual := Series(NetworkInfo, labels); actual != expected {
+		t.Errorf("expected: %v, got actual: %v", expected, actual)
+	}
+}
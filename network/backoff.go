@@ -0,0 +1,106 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/rancher/plugin-manager/metrics"
+)
+
+type networkFailures struct {
+	count int
+	last  time.Time
+}
+
+// FailureBackoff tracks the consecutive reconcile failures of each network,
+// so a network which keeps failing is retried less and less often instead
+// of hot-looping
+type FailureBackoff struct {
+	mu       sync.Mutex
+	backoff  backoff.Backoff
+	failures map[string]networkFailures
+	now      func() time.Time
+}
+
+// NewFailureBackoff returns a FailureBackoff waiting min after the first
+// failure of a network, doubling on each consecutive failure up to max
+func NewFailureBackoff(min, max time.Duration) *FailureBackoff {
+	return &FailureBackoff{
+		backoff:  backoff.Backoff{Min: min, Max: max, Factor: 2},
+		failures: map[string]networkFailures{},
+		now:      time.Now,
+	}
+}
+
+// RecordFailure notes a failed reconcile of the network
+func (b *FailureBackoff) RecordFailure(networkUUID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f := b.failures[networkUUID]
+	b.failures[networkUUID] = networkFailures{count: f.count + 1, last: b.now()}
+}
+
+// RecordSuccess notes a successful reconcile of the network, resetting
+// its backoff
+func (b *FailureBackoff) RecordSuccess(networkUUID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, networkUUID)
+}
+
+// RecordResults notes the outcome of each of the results of
+// ReconcileNetworksConcurrent
+func (b *FailureBackoff) RecordResults(results []ReconcileResult) {
+	for _, r := range results {
+		if r.Err != nil {
+			b.RecordFailure(r.NetworkUUID)
+		} else {
+			b.RecordSuccess(r.NetworkUUID)
+		}
+	}
+}
+
+// NextRetry returns when the network should be reconciled next, the zero
+// time if it didn't fail
+func (b *FailureBackoff) NextRetry(networkUUID string) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.failures[networkUUID]
+	if !ok {
+		return time.Time{}
+	}
+	return f.last.Add(b.backoff.ForAttempt(float64(f.count - 1)))
+}
+
+// BackoffError is returned by the Reconciler of a FailureBackoff for the
+// networks which aren't to be retried yet
+type BackoffError struct {
+	NetworkUUID string
+	NextRetry   time.Time
+}
+
+func (e *BackoffError) Error() string {
+	return fmt.Sprintf("backing off until %v after repeated failures", e.NextRetry.Format(time.RFC3339))
+}
+
+// Reconciler returns a Reconciler running the given one on the networks
+// due for a retry and recording their outcome, the other networks fail
+// with a BackoffError without being reconciled
+func (b *FailureBackoff) Reconciler(reconciler Reconciler) Reconciler {
+	return func(info LocalNetworkInfo) (metrics.ManagedResources, error) {
+		uuid := info.Network.UUID
+		if next := b.NextRetry(uuid); b.now().Before(next) {
+			return metrics.ManagedResources{}, &BackoffError{NetworkUUID: uuid, NextRetry: next}
+		}
+
+		resources, err := reconciler(info)
+		if err != nil {
+			b.RecordFailure(uuid)
+		} else {
+			b.RecordSuccess(uuid)
+		}
+		return resources, err
+	}
+}
@@ -0,0 +1,88 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/metrics"
+)
+
+func TestFailureBackoff(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	b := NewFailureBackoff(time.Second, 10*time.Second)
+	b.now = func() time.Time { return now }
+
+	if !b.NextRetry("net1").IsZero() {
+		t.Errorf("expected a network without failures to be retried right away")
+	}
+
+	for _, expected := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		b.RecordFailure("net1")
+		if actual := b.NextRetry("net1").Sub(now); actual != expected*time.Second {
+			t.Errorf("expected: %v, got actual: %v", expected*time.Second, actual)
+		}
+	}
+	if !b.NextRetry("net2").IsZero() {
+		t.Errorf("expected the failures of net1 not to affect net2")
+	}
+
+	// Recovery
+	b.RecordSuccess("net1")
+	if !b.NextRetry("net1").IsZero() {
+		t.Errorf("expected the backoff to be reset on success")
+	}
+	b.RecordFailure("net1")
+	if actual := b.NextRetry("net1").Sub(now); actual != time.Second {
+		t.Errorf("expected: %v, got actual: %v", time.Second, actual)
+	}
+
+	b.RecordResults([]ReconcileResult{
+		{NetworkUUID: "net1"},
+		{NetworkUUID: "net2", Err: fmt.Errorf("failed net2")},
+	})
+	if !b.NextRetry("net1").IsZero() || b.NextRetry("net2").Sub(now) != time.Second {
+		t.Errorf("expected net1 to be reset and net2 to back off, got actual: %v %v", b.NextRetry("net1"), b.NextRetry("net2"))
+	}
+}
+
+func TestFailureBackoffReconciler(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	b := NewFailureBackoff(time.Second, 10*time.Second)
+	b.now = func() time.Time { return now }
+
+	calls := 0
+	fail := true
+	reconcile := b.Reconciler(func(info LocalNetworkInfo) (metrics.ManagedResources, error) {
+		calls++
+		if fail {
+			return metrics.ManagedResources{}, fmt.Errorf("failed %v", info.Network.UUID)
+		}
+		return metrics.ManagedResources{Bridges: 1}, nil
+	})
+	info := LocalNetworkInfo{Network: metadata.Network{UUID: "net1"}}
+
+	if _, err := reconcile(info); err == nil || calls != 1 {
+		t.Fatalf("expected the first failure to be returned, got actual: %v after %v calls", err, calls)
+	}
+
+	// Not retried before the backoff is over
+	_, err := reconcile(info)
+	if _, ok := err.(*BackoffError); !ok || calls != 1 {
+		t.Errorf("expected a BackoffError without reconciling, got actual: %v after %v calls", err, calls)
+	}
+	if actual := b.NextRetry("net1").Sub(now); actual != time.Second {
+		t.Errorf("expected the backoff not to grow while skipped: %v, got actual: %v", time.Second, actual)
+	}
+
+	// Recovery
+	now = now.Add(time.Second)
+	fail = false
+	if resources, err := reconcile(info); err != nil || resources.Bridges != 1 || calls != 2 {
+		t.Errorf("expected the retry to succeed, got actual: %+v, %v after %v calls", resources, err, calls)
+	}
+	if !b.NextRetry("net1").IsZero() {
+		t.Errorf("expected the backoff to be reset on success")
+	}
+}
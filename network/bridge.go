@@ -0,0 +1,200 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	// iflaBrSTPState is IFLA_BR_STP_STATE from linux/if_link.h, it's not
+	// known to the vendored netlink library
+	iflaBrSTPState = 5
+
+	// vxlanOverheadV4 and vxlanOverheadV6 are the bytes added by the VXLAN
+	// encapsulation: outer IP header, UDP, VXLAN and inner ethernet headers
+	vxlanOverheadV4 = 50
+	vxlanOverheadV6 = 70
+)
+
+func bridgeByName(bridgeName string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return nil, err
+	}
+	if link.Type() != "bridge" {
+		return nil, fmt.Errorf("%v is not a bridge but %v", bridgeName, link.Type())
+	}
+	return link, nil
+}
+
+// IsBridgeInterface checks if the interface with the given name is a
+// bridge, it's an error if there's no such interface
+func IsBridgeInterface(name string) (bool, error) {
+	_, isBridge, err := lookupBridgeInterface(nlh, name)
+	return isBridge, err
+}
+
+// lookupBridgeInterface returns the interface with the given name and if
+// it's a bridge, like IsBridgeInterface with the given handle
+func lookupBridgeInterface(h NetlinkHandle, name string) (netlink.Link, bool, error) {
+	link, err := h.LinkByName(name)
+	if err != nil {
+		return nil, false, err
+	}
+	return link, link.Type() == "bridge", nil
+}
+
+// IsSTPEnabled checks if Spanning Tree Protocol is enabled on the bridge
+func IsSTPEnabled(bridgeName string) (bool, error) {
+	link, err := bridgeByName(bridgeName)
+	if err != nil {
+		return false, err
+	}
+
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, syscall.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK)
+	if err != nil {
+		return false, err
+	}
+
+	for _, m := range msgs {
+		attrs, err := nl.ParseRouteAttr(m[nl.DeserializeIfInfomsg(m).Len():])
+		if err != nil {
+			return false, err
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type != syscall.IFLA_LINKINFO {
+				continue
+			}
+			infos, err := nl.ParseRouteAttr(attr.Value)
+			if err != nil {
+				return false, err
+			}
+			for _, info := range infos {
+				if info.Attr.Type != nl.IFLA_INFO_DATA {
+					continue
+				}
+				data, err := nl.ParseRouteAttr(info.Value)
+				if err != nil {
+					return false, err
+				}
+				for _, d := range data {
+					if d.Attr.Type == iflaBrSTPState {
+						return nl.NativeEndian().Uint32(d.Value) != 0, nil
+					}
+				}
+			}
+		}
+	}
+
+	return false, fmt.Errorf("couldn't find the STP state of bridge %v", bridgeName)
+}
+
+// SetSTP turns Spanning Tree Protocol on or off on the bridge
+func SetSTP(bridgeName string, on bool) error {
+	link, err := bridgeByName(bridgeName)
+	if err != nil {
+		return err
+	}
+
+	req := nl.NewNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+
+	var state uint32
+	if on {
+		state = 1
+	}
+	linkInfo := nl.NewRtAttr(syscall.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.NonZeroTerminated("bridge"))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+	nl.NewRtAttrChild(data, iflaBrSTPState, nl.Uint32Attr(state))
+	req.AddData(linkInfo)
+
+	if _, err := req.Execute(syscall.NETLINK_ROUTE, 0); err != nil {
+		return err
+	}
+	RecordEvent(ActionSetSTP, bridgeName, fmt.Sprintf("%v", on))
+	return nil
+}
+
+// DesiredBridgeMTUForOverlay returns the MTU the bridge needs so the
+// packets still fit in the given vxlan device once encapsulated. The IPv6
+// overhead is used when the vxlan device has an IPv6 source or group.
+func DesiredBridgeMTUForOverlay(vxlanDevice string) (int, error) {
+	return desiredBridgeMTU(nlh, vxlanDevice)
+}
+
+func desiredBridgeMTU(h NetlinkHandle, vxlanDevice string) (int, error) {
+	link, err := h.LinkByName(vxlanDevice)
+	if err != nil {
+		return 0, err
+	}
+	vxlan, ok := link.(*netlink.Vxlan)
+	if !ok {
+		return 0, fmt.Errorf("%v is not a vxlan device but %v", vxlanDevice, link.Type())
+	}
+
+	overhead := vxlanOverheadV4
+	for _, ip := range []net.IP{vxlan.SrcAddr, vxlan.Group} {
+		if ip != nil && ip.To4() == nil {
+			overhead = vxlanOverheadV6
+		}
+	}
+
+	return vxlan.Attrs().MTU - overhead, nil
+}
+
+// ReconcileBridgeMTUForOverlay sets the MTU of the bridge to the one
+// returned by DesiredBridgeMTUForOverlay, if it's not already set
+func ReconcileBridgeMTUForOverlay(bridgeName, vxlanDevice string) error {
+	bridge, err := bridgeByName(bridgeName)
+	if err != nil {
+		return err
+	}
+	return reconcileBridgeMTU(nlh, bridge, vxlanDevice)
+}
+
+func reconcileBridgeMTU(h NetlinkHandle, bridge netlink.Link, vxlanDevice string) error {
+	mtu, err := desiredBridgeMTU(h, vxlanDevice)
+	if err != nil {
+		return err
+	}
+	if bridge.Attrs().MTU == mtu {
+		return nil
+	}
+
+	bridgeName := bridge.Attrs().Name
+	logrus.Infof("Setting MTU of bridge %v to %v for overlay %v", bridgeName, mtu, vxlanDevice)
+	if err := h.LinkSetMTU(bridge, mtu); err != nil {
+		return err
+	}
+	RecordEvent(ActionSetMTU, bridgeName, fmt.Sprintf("%v", mtu))
+	return nil
+}
+
+// ValidateBridgeAddress checks the address can be assigned to a bridge,
+// rejecting loopback, unspecified and multicast addresses
+func ValidateBridgeAddress(addr *net.IPNet) error {
+	switch {
+	case addr == nil || addr.IP == nil:
+		return fmt.Errorf("bridge address is missing")
+	case addr.IP.IsLoopback():
+		return fmt.Errorf("bridge address %v is a loopback address", addr)
+	case addr.IP.IsUnspecified():
+		return fmt.Errorf("bridge address %v is unspecified", addr)
+	case addr.IP.IsMulticast():
+		return fmt.Errorf("bridge address %v is a multicast address", addr)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/rancher/plugin-manager/testutil"
+	"github.com/vishvananda/netlink"
+)
+
+func TestSTP(t *testing.T) {
+	testNS := testutil.NewTestNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "testbr0"}}); err != nil {
+			return err
+		}
+
+		enabled, err := IsSTPEnabled("testbr0")
+		if err != nil {
+			return err
+		}
+		if enabled {
+			t.Errorf("expected STP to be off on a new bridge")
+		}
+
+		for _, on := range []bool{true, false} {
+			if err := SetSTP("testbr0", on); err != nil {
+				return err
+			}
+			enabled, err := IsSTPEnabled("testbr0")
+			if err != nil {
+				return err
+			}
+			if enabled != on {
+				t.Errorf("expected: %v, got actual: %v", on, enabled)
+			}
+		}
+
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "testveth0"}, PeerName: "testveth1"}
+		if err := netlink.LinkAdd(veth); err != nil {
+			return err
+		}
+		if _, err := IsSTPEnabled("testveth0"); err == nil {
+			t.Errorf("expected error for a non bridge link, but got nil")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+}
+
+func TestIsBridgeInterface(t *testing.T) {
+	testNS := testutil.NewTestNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(ns.NetNS) error {
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "testbr0"}}
+		if err := netlink.LinkAdd(bridge); err != nil {
+			return err
+		}
+		isBridge, err := IsBridgeInterface("testbr0")
+		if err != nil {
+			return err
+		}
+		if !isBridge {
+			t.Errorf("expected testbr0 to be a bridge")
+		}
+
+		// Something else takes the name of the bridge, the dummy link
+		// type isn't always available so a veth is used instead
+		if err := netlink.LinkDel(bridge); err != nil {
+			return err
+		}
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "testbr0"}, PeerName: "testveth1"}
+		if err := netlink.LinkAdd(veth); err != nil {
+			return err
+		}
+		isBridge, err = IsBridgeInterface("testbr0")
+		if err != nil {
+			return err
+		}
+		if isBridge {
+			t.Errorf("expected testbr0 not to be a bridge")
+		}
+
+		if _, err := IsBridgeInterface("missing0"); err == nil {
+			t.Errorf("expecting error for a missing interface, but got nil")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+}
+
+func TestDesiredBridgeMTUForOverlay(t *testing.T) {
+	testNS := testutil.NewTestNS(t)
+	defer testNS.Close()
+
+	var vxlanErr error
+	err := testNS.Do(func(ns.NetNS) error {
+		for _, vxlan := range []*netlink.Vxlan{
+			{LinkAttrs: netlink.LinkAttrs{Name: "vtep4", MTU: 1500}, VxlanId: 4, Port: 4789},
+			{LinkAttrs: netlink.LinkAttrs{Name: "vtep6", MTU: 1500}, VxlanId: 6, Port: 4790, SrcAddr: net.ParseIP("fd00::1")},
+		} {
+			if vxlanErr = netlink.LinkAdd(vxlan); vxlanErr != nil {
+				return nil
+			}
+		}
+		if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "testbr0"}}); err != nil {
+			return err
+		}
+
+		for _, c := range []struct {
+			device string
+			mtu    int
+		}{
+			{"vtep4", 1450},
+			{"vtep6", 1430},
+		} {
+			mtu, err := DesiredBridgeMTUForOverlay(c.device)
+			if err != nil {
+				return err
+			}
+			if mtu != c.mtu {
+				t.Errorf("%v: expected: %v, got actual: %v", c.device, c.mtu, mtu)
+			}
+		}
+
+		if _, err := DesiredBridgeMTUForOverlay("testbr0"); err == nil {
+			t.Errorf("expected error for a non vxlan link, but got nil")
+		}
+
+		if err := ReconcileBridgeMTUForOverlay("testbr0", "vtep4"); err != nil {
+			return err
+		}
+		bridge, err := netlink.LinkByName("testbr0")
+		if err != nil {
+			return err
+		}
+		if bridge.Attrs().MTU != 1450 {
+			t.Errorf("expected: 1450, got actual: %v", bridge.Attrs().MTU)
+		}
+		return nil
+	})
+	if vxlanErr != nil {
+		t.Skipf("couldn't create vxlan device: %v", vxlanErr)
+	}
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+}
+
+func TestValidateBridgeAddress(t *testing.T) {
+	for _, c := range []struct {
+		addr  string
+		valid bool
+	}{
+		{"10.42.0.1/16", true},
+		{"fd00::1/64", true},
+		{"127.0.0.1/8", false},
+		{"::1/128", false},
+		{"0.0.0.0/0", false},
+		{"::/0", false},
+		{"224.0.0.1/4", false},
+		{"ff02::1/16", false},
+	} {
+		ip, ipNet, _ := net.ParseCIDR(c.addr)
+		ipNet.IP = ip
+		if err := ValidateBridgeAddress(ipNet); (err == nil) != c.valid {
+			t.Errorf("%v: expected valid: %v, got actual: %v", c.addr, c.valid, err)
+		}
+	}
+
+	if err := ValidateBridgeAddress(nil); err == nil {
+		t.Errorf("expected error for a missing address, but got nil")
+	}
+}
@@ -0,0 +1,59 @@
+package network
+
+import (
+	"sync"
+)
+
+// Actions of the reconcile events
+const (
+	ActionAddAddress   = "AddAddress"
+	ActionDelAddress   = "DelAddress"
+	ActionAddRoute     = "AddRoute"
+	ActionDelRoute     = "DelRoute"
+	ActionAddNeighbor  = "AddNeighbor"
+	ActionDelNeighbor  = "DelNeighbor"
+	ActionCreateBridge = "CreateBridge"
+	ActionDelLink      = "DelLink"
+	ActionSetSTP       = "SetSTP"
+	ActionSetMTU       = "SetMTU"
+)
+
+// ReconcileEvent describes a single change done to the host networking
+type ReconcileEvent struct {
+	Action    string
+	Interface string
+	Object    string
+}
+
+// EventSink receives the changes done by the reconcile helpers, it can
+// be used to keep an audit trail of what the manager changed
+type EventSink interface {
+	Record(event ReconcileEvent)
+}
+
+type noopEventSink struct{}
+
+func (noopEventSink) Record(ReconcileEvent) {}
+
+var (
+	eventSinkLock sync.RWMutex
+	eventSink     EventSink = noopEventSink{}
+)
+
+// RegisterEventSink sets the sink receiving the reconcile events, passing
+// nil goes back to discarding them
+func RegisterEventSink(sink EventSink) {
+	eventSinkLock.Lock()
+	defer eventSinkLock.Unlock()
+	if sink == nil {
+		sink = noopEventSink{}
+	}
+	eventSink = sink
+}
+
+// RecordEvent sends the event to the registered EventSink
+func RecordEvent(action, iface, object string) {
+	eventSinkLock.RLock()
+	defer eventSinkLock.RUnlock()
+	eventSink.Record(ReconcileEvent{Action: action, Interface: iface, Object: object})
+}
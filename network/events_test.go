@@ -0,0 +1,57 @@
+package network
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	glue "github.com/rancher/cniglue"
+)
+
+// fakeEventSink captures the events it receives
+type fakeEventSink struct {
+	sync.Mutex
+	events []ReconcileEvent
+}
+
+func (f *fakeEventSink) Record(event ReconcileEvent) {
+	f.Lock()
+	defer f.Unlock()
+	f.events = append(f.events, event)
+}
+
+func TestEventSink(t *testing.T) {
+	defer func(h NetlinkHandle, d string) { nlh, glue.CniDir = h, d }(nlh, glue.CniDir)
+	defer RegisterEventSink(nil)
+
+	sink := &fakeEventSink{}
+	RegisterEventSink(sink)
+
+	mc, h, _ := newTestTeardown(t)
+	nlh = h
+
+	if _, err := TeardownHost(mc, true); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if len(sink.events) != 0 {
+		t.Errorf("expected no events on dry run, got actual: %v", sink.events)
+	}
+
+	if _, err := TeardownHost(mc, false); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	expected := []ReconcileEvent{
+		{Action: ActionDelRoute, Interface: "docker0", Object: "10.42.0.0/16"},
+		{Action: ActionDelNeighbor, Interface: "docker0", Object: "10.42.0.2 lladdr 02:00:0a:2a:00:02"},
+		{Action: ActionDelLink, Interface: "docker0", Object: "docker0"},
+	}
+	if !reflect.DeepEqual(sink.events, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, sink.events)
+	}
+
+	RegisterEventSink(nil)
+	RecordEvent(ActionAddRoute, "docker0", "10.43.0.0/16")
+	if len(sink.events) != len(expected) {
+		t.Errorf("expected no events after unregistering, got actual: %v", sink.events)
+	}
+}
@@ -0,0 +1,165 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+// AddressFamilyPolicy selects the IP address families managed on the host
+type AddressFamilyPolicy int
+
+// The supported address family policies
+const (
+	DualStack AddressFamilyPolicy = iota
+	V4Only
+	V6Only
+)
+
+// familyPolicy is honored by the family aware helpers, by default both
+// IPv4 and IPv6 are managed
+var (
+	familyPolicyLock sync.RWMutex
+	familyPolicy     = DualStack
+)
+
+// SetFamilyPolicy sets the policy honored by the family aware helpers,
+// it's safe to call while the syncs are running
+func SetFamilyPolicy(p AddressFamilyPolicy) {
+	familyPolicyLock.Lock()
+	defer familyPolicyLock.Unlock()
+	familyPolicy = p
+}
+
+// FamilyPolicy returns the policy set with SetFamilyPolicy
+func FamilyPolicy() AddressFamilyPolicy {
+	familyPolicyLock.RLock()
+	defer familyPolicyLock.RUnlock()
+	return familyPolicy
+}
+
+// PolicyFamily returns the netlink family to use for listing addresses,
+// routes and neighbors according to FamilyPolicy
+func PolicyFamily() int {
+	switch FamilyPolicy() {
+	case V4Only:
+		return netlink.FAMILY_V4
+	case V6Only:
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_ALL
+}
+
+// PolicyAllowsIP checks if the family of the given IP address is
+// managed according to FamilyPolicy
+func PolicyAllowsIP(ip net.IP) bool {
+	switch FamilyPolicy() {
+	case V4Only:
+		return ip.To4() != nil
+	case V6Only:
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// ListInterfaceIPs returns the IP addresses of the given interface, of
+// the families allowed by FamilyPolicy
+func ListInterfaceIPs(name string) ([]net.IP, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error fetching link %v", name)
+	}
+
+	addrs, err := netlink.AddrList(link, PolicyFamily())
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing addresses of %v", name)
+	}
+
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// HasIPAddrFromSubnet checks if the given interface has an IP address
+// from the given subnet, which can be of either address family
+func HasIPAddrFromSubnet(name string, subnet string) (bool, error) {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return false, errors.Wrapf(err, "parsing subnet %v", subnet)
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return false, errors.Wrapf(err, "error fetching link %v", name)
+	}
+
+	family := netlink.FAMILY_V4
+	if ipNet.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	addrs, err := netlink.AddrList(link, family)
+	if err != nil {
+		return false, errors.Wrapf(err, "error listing addresses of %v", name)
+	}
+
+	for _, addr := range addrs {
+		if ipNet.Contains(addr.IP) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// FamilyMismatchError is returned by ValidateFamilyConsistency when the
+// router IP address isn't of the family of the bridge subnet
+type FamilyMismatchError struct {
+	Subnet   string
+	RouterIP string
+}
+
+func (e *FamilyMismatchError) Error() string {
+	return fmt.Sprintf("router IP %v isn't of the address family of subnet %v", e.RouterIP, e.Subnet)
+}
+
+// ValidateFamilyConsistency checks the router IP address is of the same
+// address family as the bridge subnet
+func ValidateFamilyConsistency(subnet string, routerIP string) error {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return errors.Wrapf(err, "parsing subnet %v", subnet)
+	}
+	ip := net.ParseIP(routerIP)
+	if ip == nil {
+		return fmt.Errorf("invalid router IP %v", routerIP)
+	}
+	if (ipNet.IP.To4() == nil) != (ip.To4() == nil) {
+		return &FamilyMismatchError{Subnet: subnet, RouterIP: routerIP}
+	}
+	return nil
+}
+
+// validateRouterFamily checks the router IP address is of the family of
+// one of the bridge subnets, a dual-stack bridge has one of each family
+// and a router of either. The FamilyMismatchError of the first subnet is
+// returned if none matches.
+func validateRouterFamily(subnets []string, routerIP string) error {
+	var mismatch error
+	for _, subnet := range subnets {
+		err := ValidateFamilyConsistency(subnet, routerIP)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*FamilyMismatchError); !ok {
+			return err
+		}
+		if mismatch == nil {
+			mismatch = err
+		}
+	}
+	return mismatch
+}
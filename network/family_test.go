@@ -0,0 +1,157 @@
+package network
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/rancher/plugin-manager/testutil"
+	"github.com/vishvananda/netlink"
+)
+
+func TestListInterfaceIPs(t *testing.T) {
+	defer SetFamilyPolicy(FamilyPolicy())
+
+	testNS := testutil.NewTestNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(ns.NetNS) error {
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth-a"}, PeerName: "eth-b"}
+		if err := netlink.LinkAdd(veth); err != nil {
+			return err
+		}
+		l, err := netlink.LinkByName("eth-a")
+		if err != nil {
+			return err
+		}
+		for _, a := range []string{"172.22.101.101/24", "fd00::101/64"} {
+			addr, _ := netlink.ParseAddr(a)
+			if err := netlink.AddrAdd(l, addr); err != nil {
+				return err
+			}
+		}
+
+		for _, c := range []struct {
+			policy   AddressFamilyPolicy
+			expected []string
+		}{
+			{DualStack, []string{"172.22.101.101", "fd00::101"}},
+			{V4Only, []string{"172.22.101.101"}},
+			{V6Only, []string{"fd00::101"}},
+		} {
+			SetFamilyPolicy(c.policy)
+			ips, err := ListInterfaceIPs("eth-a")
+			if err != nil {
+				return err
+			}
+			actual := []string{}
+			for _, ip := range ips {
+				actual = append(actual, ip.String())
+			}
+			if !reflect.DeepEqual(actual, c.expected) {
+				t.Errorf("policy %v: expected: %v, got actual: %v", c.policy, c.expected, actual)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+}
+
+func TestHasIPAddrFromSubnet(t *testing.T) {
+	testNS := testutil.NewTestNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(ns.NetNS) error {
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth-a"}, PeerName: "eth-b"}
+		if err := netlink.LinkAdd(veth); err != nil {
+			return err
+		}
+		l, err := netlink.LinkByName("eth-a")
+		if err != nil {
+			return err
+		}
+		for _, a := range []string{"172.22.101.101/24", "fd00::101/64"} {
+			addr, _ := netlink.ParseAddr(a)
+			if err := netlink.AddrAdd(l, addr); err != nil {
+				return err
+			}
+		}
+
+		for _, c := range []struct {
+			subnet   string
+			expected bool
+		}{
+			{"172.22.101.0/24", true},
+			{"172.22.0.0/16", true},
+			{"172.22.102.0/24", false},
+			{"fd00::/64", true},
+			{"fd00:1::/64", false},
+		} {
+			actual, err := HasIPAddrFromSubnet("eth-a", c.subnet)
+			if err != nil {
+				return err
+			}
+			if actual != c.expected {
+				t.Errorf("subnet %v: expected: %v, got actual: %v", c.subnet, c.expected, actual)
+			}
+		}
+
+		if _, err := HasIPAddrFromSubnet("eth-a", "invalid"); err == nil {
+			t.Errorf("expecting error for an invalid subnet, but got nil")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+}
+
+func TestPolicyAllowsIP(t *testing.T) {
+	defer SetFamilyPolicy(FamilyPolicy())
+
+	v4, v6 := net.ParseIP("10.42.0.1"), net.ParseIP("fd00::1")
+	for _, c := range []struct {
+		policy     AddressFamilyPolicy
+		allowV4    bool
+		allowV6    bool
+		listFamily int
+	}{
+		{DualStack, true, true, netlink.FAMILY_ALL},
+		{V4Only, true, false, netlink.FAMILY_V4},
+		{V6Only, false, true, netlink.FAMILY_V6},
+	} {
+		SetFamilyPolicy(c.policy)
+		if PolicyAllowsIP(v4) != c.allowV4 || PolicyAllowsIP(v6) != c.allowV6 || PolicyFamily() != c.listFamily {
+			t.Errorf("policy %v: unexpected v4: %v, v6: %v, family: %v", c.policy, PolicyAllowsIP(v4), PolicyAllowsIP(v6), PolicyFamily())
+		}
+	}
+}
+
+func TestValidateFamilyConsistency(t *testing.T) {
+	for _, c := range []struct {
+		subnet, routerIP string
+		mismatch         bool
+	}{
+		{"10.42.0.0/16", "10.42.0.2", false},
+		{"fd00:42::/64", "fd00:42::2", false},
+		{"fd00:42::/64", "10.42.0.2", true},
+		{"10.42.0.0/16", "fd00:42::2", true},
+	} {
+		err := ValidateFamilyConsistency(c.subnet, c.routerIP)
+		if _, mismatch := err.(*FamilyMismatchError); mismatch != c.mismatch {
+			t.Errorf("%v %v: unexpected error: %v", c.subnet, c.routerIP, err)
+		}
+		if !c.mismatch && err != nil {
+			t.Errorf("%v %v: not expecting error: %v", c.subnet, c.routerIP, err)
+		}
+	}
+
+	for _, c := range [][]string{{"10.42.0.0", "10.42.0.2"}, {"10.42.0.0/16", "not-an-ip"}} {
+		if err := ValidateFamilyConsistency(c[0], c[1]); err == nil {
+			t.Errorf("%v %v: expecting error, but got nil", c[0], c[1])
+		}
+	}
+}
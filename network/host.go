@@ -0,0 +1,200 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/vishvananda/netlink"
+)
+
+var (
+	privateSubnets = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+
+	// PublicIPDetector is used by IsBehindNAT, when set, to find out the
+	// public IP address of the host
+	PublicIPDetector func() (string, error)
+
+	// DefaultClockSkewThreshold is the clock skew over which the local
+	// clock should be reported as off
+	DefaultClockSkewThreshold = 30 * time.Second
+
+	metadataHTTPClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+func isPrivateIP(ip net.IP) bool {
+	for _, s := range privateSubnets {
+		_, subnet, _ := net.ParseCIDR(s)
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBehindNAT checks if the agent IP of the host is a private (RFC1918)
+// address which doesn't match the public IP address of the host, if
+// PublicIPDetector is available. A warning is logged if that's the case.
+func IsBehindNAT(host metadata.Host) (bool, error) {
+	ip := net.ParseIP(host.AgentIP)
+	if ip == nil {
+		return false, fmt.Errorf("invalid agent IP(%v) of host %v", host.AgentIP, host.UUID)
+	}
+
+	if !isPrivateIP(ip) {
+		return false, nil
+	}
+
+	if PublicIPDetector != nil {
+		publicIP, err := PublicIPDetector()
+		if err != nil {
+			return false, errors.Wrap(err, "detecting public IP")
+		}
+		if net.ParseIP(publicIP).Equal(ip) {
+			return false, nil
+		}
+	}
+
+	logrus.Warnf("Agent IP(%v) of host %v is a private address, the host may be behind NAT", host.AgentIP, host.UUID)
+	return true, nil
+}
+
+// MetadataClock is implemented by the metadata clients which can tell
+// the time of the metadata server
+type MetadataClock interface {
+	ServerTime() (time.Time, error)
+}
+
+type serverClockClient struct {
+	metadata.Client
+	url string
+}
+
+// WithServerClock returns a client implementing MetadataClock with the
+// Date header of the response to /version of the metadata server at
+// metadataURL, the other requests go through mc
+func WithServerClock(mc metadata.Client, metadataURL string) metadata.Client {
+	return &serverClockClient{mc, metadataURL}
+}
+
+func (c *serverClockClient) ServerTime() (time.Time, error) {
+	resp, err := metadataHTTPClient.Get(c.url + "/version")
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "requesting metadata version")
+	}
+	resp.Body.Close()
+
+	date := resp.Header.Get("Date")
+	if date == "" {
+		return time.Time{}, fmt.Errorf("metadata at %v doesn't send a Date header", c.url)
+	}
+	serverTime, err := http.ParseTime(date)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "parsing the Date header %v", date)
+	}
+	return serverTime, nil
+}
+
+// DetectClockSkew returns how far the local clock is ahead of the one of
+// the metadata server, negative if it's behind. The server time has a
+// resolution of a second. It's an error if mc doesn't implement
+// MetadataClock, see WithServerClock.
+func DetectClockSkew(mc metadata.Client) (time.Duration, error) {
+	clock, ok := mc.(MetadataClock)
+	if !ok {
+		return 0, fmt.Errorf("metadata client doesn't provide the server time")
+	}
+
+	sent := time.Now()
+	serverTime, err := clock.ServerTime()
+	if err != nil {
+		return 0, err
+	}
+	received := time.Now()
+
+	// The server time is taken halfway through the request
+	return sent.Add(received.Sub(sent) / 2).Sub(serverTime).Truncate(time.Second), nil
+}
+
+// FindInterfacesWithIP returns the names of all the interfaces which
+// have the given IP address assigned
+func FindInterfacesWithIP(ip net.IP) ([]string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing links")
+	}
+
+	names := []string{}
+	for _, l := range links {
+		addrs, err := netlink.AddrList(l, PolicyFamily())
+		if err != nil {
+			return nil, errors.Wrapf(err, "error listing addresses of %v", l.Attrs().Name)
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				names = append(names, l.Attrs().Name)
+				break
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// FindDuplicateMACs returns the names of the interfaces sharing the same
+// MAC address, keyed by the MAC address. Interfaces without a MAC address
+// or with an all-zero one, like the loopback, are ignored.
+func FindDuplicateMACs() (map[string][]string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing links")
+	}
+
+	byMAC := map[string][]string{}
+	for _, l := range links {
+		mac := l.Attrs().HardwareAddr
+		if isZeroMAC(mac) {
+			continue
+		}
+		byMAC[mac.String()] = append(byMAC[mac.String()], l.Attrs().Name)
+	}
+
+	duplicates := map[string][]string{}
+	for mac, names := range byMAC {
+		if len(names) > 1 {
+			logrus.Warnf("interfaces %v share the MAC address %v", names, mac)
+			duplicates[mac] = names
+		}
+	}
+	return duplicates, nil
+}
+
+func isZeroMAC(mac net.HardwareAddr) bool {
+	for _, b := range mac {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// GetInterfaceForIP returns the interface which has the given IP address
+// assigned. When more than one has it, which is a misconfiguration, the
+// first one is returned and a warning is logged.
+func GetInterfaceForIP(ip net.IP) (string, error) {
+	names, err := FindInterfacesWithIP(ip)
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("no interface found with IP %v", ip)
+	}
+	if len(names) > 1 {
+		logrus.Warnf("IP %v is assigned to multiple interfaces: %v, using %v", ip, names, names[0])
+	}
+	return names[0], nil
+}
@@ -0,0 +1,213 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/testutil"
+	"github.com/vishvananda/netlink"
+)
+
+func TestIsBehindNAT(t *testing.T) {
+	defer func(d func() (string, error)) { PublicIPDetector = d }(PublicIPDetector)
+
+	for _, c := range []struct {
+		agentIP  string
+		publicIP string
+		expected bool
+	}{
+		{"10.0.2.15", "", true},
+		{"172.22.101.101", "", true},
+		{"192.168.1.10", "", true},
+		{"52.12.34.56", "", false},
+		{"172.32.0.1", "", false},
+		{"10.0.2.15", "10.0.2.15", false},
+		{"10.0.2.15", "52.12.34.56", true},
+	} {
+		PublicIPDetector = nil
+		if c.publicIP != "" {
+			publicIP := c.publicIP
+			PublicIPDetector = func() (string, error) { return publicIP, nil }
+		}
+
+		actual, err := IsBehindNAT(metadata.Host{AgentIP: c.agentIP})
+		if err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+		if actual != c.expected {
+			t.Errorf("agentIP: %v, publicIP: %v, expected: %v, got actual: %v", c.agentIP, c.publicIP, c.expected, actual)
+		}
+	}
+
+	if _, err := IsBehindNAT(metadata.Host{AgentIP: "invalid"}); err == nil {
+		t.Errorf("expected error for invalid agent IP, but got nil")
+	}
+}
+
+// fakeClockClient reports the given server time
+type fakeClockClient struct {
+	metadata.Client
+	serverTime time.Time
+	err        error
+}
+
+func (c *fakeClockClient) ServerTime() (time.Time, error) {
+	return c.serverTime, c.err
+}
+
+func TestDetectClockSkew(t *testing.T) {
+	skew, err := DetectClockSkew(&fakeClockClient{serverTime: time.Now().Add(-2 * time.Minute)})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if skew < 119*time.Second || skew > 121*time.Second {
+		t.Errorf("expected the local clock 2m ahead, got actual: %v", skew)
+	}
+
+	if skew, err := DetectClockSkew(&fakeClockClient{serverTime: time.Now().Add(time.Hour)}); err != nil || skew > -59*time.Minute {
+		t.Errorf("expected the local clock 1h behind, got actual: %v, %v", skew, err)
+	}
+
+	if _, err := DetectClockSkew(&fakeClockClient{err: fmt.Errorf("unreachable")}); err == nil {
+		t.Errorf("expecting error when the server time is unknown, but got nil")
+	}
+
+	if _, err := DetectClockSkew(&testutil.FakeMetadataClient{}); err == nil {
+		t.Errorf("expecting error for a client without server time, but got nil")
+	}
+}
+
+func TestWithServerClock(t *testing.T) {
+	var date []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/version" {
+			t.Errorf("expected: /version, got actual: %v", r.URL.Path)
+		}
+		w.Header()["Date"] = date
+		w.Write([]byte(`"1"`))
+	}))
+	defer server.Close()
+
+	expected := time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+	date = []string{expected.Format(http.TimeFormat)}
+	actual, err := WithServerClock(&testutil.FakeMetadataClient{}, server.URL).(MetadataClock).ServerTime()
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if !actual.Equal(expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, actual)
+	}
+
+	// A nil value keeps the server from adding the header
+	date = nil
+	if _, err := WithServerClock(&testutil.FakeMetadataClient{}, server.URL).(MetadataClock).ServerTime(); err == nil {
+		t.Errorf("expecting error without Date header, but got nil")
+	}
+}
+
+func TestFindInterfacesWithIP(t *testing.T) {
+	testNS := testutil.NewTestNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(ns.NetNS) error {
+		// The dummy link type isn't always available, the two ends of a
+		// veth pair are used instead
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth-a"}, PeerName: "eth-b"}
+		if err := netlink.LinkAdd(veth); err != nil {
+			return err
+		}
+		for _, name := range []string{"eth-a", "eth-b"} {
+			l, err := netlink.LinkByName(name)
+			if err != nil {
+				return err
+			}
+			addr, _ := netlink.ParseAddr("172.22.101.101/24")
+			if err := netlink.AddrAdd(l, addr); err != nil {
+				return err
+			}
+		}
+
+		ip := net.ParseIP("172.22.101.101")
+		names, err := FindInterfacesWithIP(ip)
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+		if expected := []string{"eth-a", "eth-b"}; !reflect.DeepEqual(names, expected) {
+			t.Errorf("expected: %v, got actual: %v", expected, names)
+		}
+
+		name, err := GetInterfaceForIP(ip)
+		if err != nil {
+			return err
+		}
+		if name != "eth-a" && name != "eth-b" {
+			t.Errorf("expected one of %v, got actual: %v", names, name)
+		}
+
+		if _, err := GetInterfaceForIP(net.ParseIP("172.22.101.102")); err == nil {
+			t.Errorf("expecting error for an unassigned IP, but got nil")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+}
+
+func TestFindDuplicateMACs(t *testing.T) {
+	testNS := testutil.NewTestNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(ns.NetNS) error {
+		for _, pair := range [][]string{{"eth-a", "eth-b"}, {"eth-c", "eth-d"}} {
+			veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: pair[0]}, PeerName: pair[1]}
+			if err := netlink.LinkAdd(veth); err != nil {
+				return err
+			}
+		}
+
+		duplicates, err := FindDuplicateMACs()
+		if err != nil {
+			return err
+		}
+		if len(duplicates) != 0 {
+			t.Errorf("expected no duplicates, got actual: %v", duplicates)
+		}
+
+		mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+		for _, name := range []string{"eth-a", "eth-c"} {
+			l, err := netlink.LinkByName(name)
+			if err != nil {
+				return err
+			}
+			if err := netlink.LinkSetHardwareAddr(l, mac); err != nil {
+				return err
+			}
+		}
+
+		duplicates, err = FindDuplicateMACs()
+		if err != nil {
+			return err
+		}
+		for _, names := range duplicates {
+			sort.Strings(names)
+		}
+		expected := map[string][]string{"02:42:ac:11:00:02": {"eth-a", "eth-c"}}
+		if !reflect.DeepEqual(duplicates, expected) {
+			t.Errorf("expected: %v, got actual: %v", expected, duplicates)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+}
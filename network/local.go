@@ -2,60 +2,579 @@ package network
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"net"
+	"sort"
 
 	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/docker/engine-api/client"
 	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/utils"
 )
 
+const (
+	// hostNetworkName is the name of the network of the containers using
+	// the host networking
+	hostNetworkName = "host"
+	// cniDriverServiceName is the name of the network driver service of
+	// the network plugin stacks
+	cniDriverServiceName = "cni-driver"
+)
+
+// LocalNetworks returns the networks of the environments selected by Scope
+// having a CNI config, along with the routers on the host keyed by network
+// UUID. The networks of all the network driver stacks from
+// LocalNetworksByDriver are merged, e.g. while moving from one driver to
+// another, a running router being preferred when a network has one from
+// several stacks. It's an error if no network driver service can be found,
+// so it's not mistaken for the host having no local networks.
 func LocalNetworks(mc metadata.Client) ([]metadata.Network, map[string]metadata.Container, error) {
+	byDriver, err := LocalNetworksByDriver(mc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The stacks are merged by name, the networks without a router last
+	stackNames := []string{}
+	for stackName := range byDriver {
+		if stackName != "" {
+			stackNames = append(stackNames, stackName)
+		}
+	}
+	sort.Strings(stackNames)
+	stackNames = append(stackNames, "")
+
+	networks := []metadata.Network{}
+	routers := map[string]metadata.Container{}
+	seen := map[string]bool{}
+	for _, stackName := range stackNames {
+		d := byDriver[stackName]
+		for _, aNetwork := range d.Networks {
+			if !seen[aNetwork.UUID] {
+				seen[aNetwork.UUID] = true
+				networks = append(networks, aNetwork)
+			}
+		}
+		for networkUUID, aContainer := range d.Routers {
+			addRouter(routers, networkUUID, aContainer)
+		}
+	}
+	return networks, routers, nil
+}
+
+// addRouter adds the router of the network unless it already has one, a
+// running router replacing one which isn't
+func addRouter(routers map[string]metadata.Container, networkUUID string, aContainer metadata.Container) {
+	if existing, ok := routers[networkUUID]; ok &&
+		(existing.State == "running" || aContainer.State != "running") {
+		return
+	}
+	routers[networkUUID] = aContainer
+}
+
+// scopedNetworks returns the networks of the environments selected by
+// Scope having a CNI config
+func scopedNetworks(networks []metadata.Network, host metadata.Host) []metadata.Network {
+	ret := []metadata.Network{}
+	for _, aNetwork := range networks {
+		if !Scope(host, aNetwork.EnvironmentUUID) {
+			continue
+		}
+		_, ok := aNetwork.Metadata["cniConfig"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ret = append(ret, aNetwork)
+	}
+	return ret
+}
+
+// DriverNetworks are the local networks of a network driver stack, the
+// ones its routers are on, along with its routers on the host keyed by
+// network UUID
+type DriverNetworks struct {
+	Driver   metadata.Service
+	Networks []metadata.Network
+	Routers  map[string]metadata.Container
+}
+
+// LocalNetworksByDriver returns the networks selected like LocalNetworks,
+// keyed by the stack name of the network driver (cni-driver) service
+// owning them. Unlike LocalNetworks the routers of the stacks aren't
+// merged, a network with routers from more than one stack is listed for
+// each of them. The networks without a router on any host are listed
+// under the empty key. It's an error if there isn't any network driver
+// service or one of them doesn't have its primary service.
+func LocalNetworksByDriver(mc metadata.Client) (map[string]DriverNetworks, error) {
 	networks, err := mc.GetNetworks()
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "error fetching networks from metadata")
+		return nil, errors.Wrap(err, "error fetching networks from metadata")
 	}
 
 	host, err := mc.GetSelfHost()
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "error fetching self host from metadata")
+		return nil, errors.Wrap(err, "error fetching self host from metadata")
 	}
 
 	services, err := mc.GetServices()
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "error fetching services from metadata")
+		return nil, errors.Wrap(err, "error fetching services from metadata")
 	}
 
-	routers := map[string]metadata.Container{}
+	stacks, err := networkDriverStacks(services)
+	if err != nil {
+		return nil, err
+	}
+
+	localNetworks := scopedNetworks(networks, host)
+	byDriver := map[string]DriverNetworks{}
+	owned := map[string]bool{}
+	for _, stack := range stacks {
+		d := DriverNetworks{Driver: stack.driver, Networks: []metadata.Network{}, Routers: map[string]metadata.Container{}}
+		hasRouter := map[string]bool{}
+		for _, aContainer := range stack.primary.Containers {
+			hasRouter[aContainer.NetworkUUID] = true
+			if aContainer.HostUUID == host.UUID {
+				addRouter(d.Routers, aContainer.NetworkUUID, aContainer)
+			}
+		}
+		for _, aNetwork := range localNetworks {
+			if hasRouter[aNetwork.UUID] {
+				d.Networks = append(d.Networks, aNetwork)
+				owned[aNetwork.UUID] = true
+			}
+		}
+		byDriver[stack.driver.StackName] = d
+	}
+
+	for _, aNetwork := range localNetworks {
+		if owned[aNetwork.UUID] {
+			continue
+		}
+		d, ok := byDriver[""]
+		if !ok {
+			d = DriverNetworks{Networks: []metadata.Network{}, Routers: map[string]metadata.Container{}}
+		}
+		d.Networks = append(d.Networks, aNetwork)
+		byDriver[""] = d
+	}
+
+	return byDriver, nil
+}
+
+// CNIDriverRunningLocally checks if the network driver (cni-driver) service
+// has a running container on the given host. Until then the host isn't
+// managed yet. It's an error if there is no network driver service at all.
+func CNIDriverRunningLocally(services []metadata.Service, host metadata.Host) (bool, error) {
+	found := false
 	for _, service := range services {
+		if service.Kind != "networkDriverService" {
+			continue
+		}
+		found = true
+		for _, aContainer := range service.Containers {
+			if aContainer.HostUUID == host.UUID && aContainer.State == "running" {
+				return true, nil
+			}
+		}
+	}
+
+	if !found {
+		return false, fmt.Errorf("no network driver service found")
+	}
+	return false, nil
+}
+
+// GetAllBridgeInfosFromMetadata returns the bridge info of all the local
+// networks, keyed by the network UUID, fetching metadata only once.
+// Networks without a bridge are left out.
+func GetAllBridgeInfosFromMetadata(mc metadata.Client) (map[string]utils.BridgeInfo, error) {
+	localNetworks, _, err := LocalNetworks(mc)
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := mc.GetSelfHost()
+	if err != nil {
+		return nil, errors.Wrap(err, "error fetching self host from metadata")
+	}
+
+	infos := map[string]utils.BridgeInfo{}
+	for _, aNetwork := range localNetworks {
+		info := utils.GetBridgeInfoForType(aNetwork, host, "rancher-bridge")
+		if info.Name == "" {
+			continue
+		}
+		infos[aNetwork.UUID] = info
+	}
+
+	return infos, nil
+}
+
+// GetContainerEgressInterface returns the bridge the traffic of the
+// container goes out through, or host for containers using the host
+// networking.
+func GetContainerEgressInterface(container metadata.Container, networks []metadata.Network, host metadata.Host) (string, error) {
+	for _, aNetwork := range networks {
+		if aNetwork.UUID != container.NetworkUUID {
+			continue
+		}
+		if aNetwork.Name == hostNetworkName {
+			return hostNetworkName, nil
+		}
+		bridge, _ := utils.GetBridgeInfo(aNetwork, host)
+		if bridge == "" {
+			return "", fmt.Errorf("network %v of container %v has no bridge", aNetwork.UUID, container.UUID)
+		}
+		return bridge, nil
+	}
+
+	return "", fmt.Errorf("network %v of container %v not found", container.NetworkUUID, container.UUID)
+}
+
+// NetworksAffectedByContainer returns the networks to reconcile when the
+// given container changes, the network the container is on.
+func NetworksAffectedByContainer(container metadata.Container, networks []metadata.Network) ([]metadata.Network, error) {
+	if container.NetworkUUID == "" {
+		return nil, fmt.Errorf("container %v isn't on any network", container.UUID)
+	}
+
+	affected := []metadata.Network{}
+	for _, aNetwork := range networks {
+		if aNetwork.UUID == container.NetworkUUID {
+			affected = append(affected, aNetwork)
+		}
+	}
+	if len(affected) == 0 {
+		return nil, fmt.Errorf("network %v of container %v not found", container.NetworkUUID, container.UUID)
+	}
+	return affected, nil
+}
+
+// routerContainers returns the containers of the network routers of all
+// the network driver stacks on all the hosts
+func routerContainers(services []metadata.Service) ([]metadata.Container, error) {
+	stacks, err := networkDriverStacks(services)
+	if err != nil {
+		return nil, err
+	}
+	containers := []metadata.Container{}
+	for _, stack := range stacks {
+		containers = append(containers, stack.primary.Containers...)
+	}
+	return containers, nil
+}
+
+// networkDriverStack is a network driver (cni-driver) service along with
+// the primary service of its stack
+type networkDriverStack struct {
+	driver  metadata.Service
+	primary metadata.Service
+}
+
+// networkDriverStacks returns all the network driver stacks. It's an
+// error if there isn't any, or if the primary service of one of them
+// isn't found.
+func networkDriverStacks(services []metadata.Service) ([]networkDriverStack, error) {
+	stacks := []networkDriverStack{}
+	for _, cniDriver := range services {
+		if cniDriver.Kind != "networkDriverService" || cniDriver.Name != cniDriverServiceName {
+			continue
+		}
 		// Trick to select the primary service of the network plugin
 		// stack
 		// TODO: Need to check if it's needed for Calico?
-		if !(service.Kind == "networkDriverService" &&
-			service.Name == service.PrimaryServiceName) {
+		found := false
+		for _, service := range services {
+			if service.StackName == cniDriver.StackName && service.Name == cniDriver.PrimaryServiceName {
+				stacks = append(stacks, networkDriverStack{driver: cniDriver, primary: service})
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("primary service %v of %v not found in stack %v",
+				cniDriver.PrimaryServiceName, cniDriverServiceName, cniDriver.StackName)
+		}
+	}
+	if len(stacks) == 0 {
+		return nil, fmt.Errorf("no %v service found", cniDriverServiceName)
+	}
+	return stacks, nil
+}
+
+// FindNetworksMissingCNIConfig returns the networks of the environment of
+// the host which don't have a CNI config (yet).
+func FindNetworksMissingCNIConfig(networks []metadata.Network, host metadata.Host) []metadata.Network {
+	missing := []metadata.Network{}
+	for _, aNetwork := range networks {
+		if aNetwork.EnvironmentUUID != host.EnvironmentUUID {
+			continue
+		}
+		if _, ok := aNetwork.Metadata["cniConfig"].(map[string]interface{}); ok {
 			continue
 		}
+		missing = append(missing, aNetwork)
+	}
+	return missing
+}
 
-		for _, aContainer := range service.Containers {
-			if aContainer.HostUUID == host.UUID {
-				routers[aContainer.NetworkUUID] = aContainer
+// CountRunningContainersPerNetwork returns the number of running containers
+// of each of the given local networks, keyed by the network UUID.
+func CountRunningContainersPerNetwork(containers []metadata.Container, localNetworks []metadata.Network) map[string]int {
+	counts := map[string]int{}
+	for _, aNetwork := range localNetworks {
+		counts[aNetwork.UUID] = 0
+	}
+
+	for _, aContainer := range containers {
+		if aContainer.State != "running" {
+			continue
+		}
+		if _, ok := counts[aContainer.NetworkUUID]; ok {
+			counts[aContainer.NetworkUUID]++
+		}
+	}
+
+	return counts
+}
+
+// FindDuplicateContainerIPsPerNetwork returns the containers sharing their
+// primary IP address with another container of the same network, keyed by
+// "<network UUID>/<IP address>". Containers without an IP are skipped.
+func FindDuplicateContainerIPsPerNetwork(containers []metadata.Container) (map[string][]metadata.Container, error) {
+	perKey := map[string][]metadata.Container{}
+	for _, aContainer := range containers {
+		if aContainer.PrimaryIp == "" {
+			continue
+		}
+		ip := net.ParseIP(aContainer.PrimaryIp)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid primary IP(%v) of container %v", aContainer.PrimaryIp, aContainer.UUID)
+		}
+		key := aContainer.NetworkUUID + "/" + ip.String()
+		perKey[key] = append(perKey[key], aContainer)
+	}
+
+	duplicates := map[string][]metadata.Container{}
+	for key, sharing := range perKey {
+		if len(sharing) > 1 {
+			duplicates[key] = sharing
+		}
+	}
+
+	return duplicates, nil
+}
+
+// LocalNetworkFamilies returns the IP address family (4 or 6) of the bridge
+// subnet of each local network, keyed by the network UUID. Networks without
+// a bridge subnet are left out.
+func LocalNetworkFamilies(mc metadata.Client) (map[string]int, error) {
+	localNetworks, _, err := LocalNetworks(mc)
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := mc.GetSelfHost()
+	if err != nil {
+		return nil, errors.Wrap(err, "error fetching self host from metadata")
+	}
+
+	families := map[string]int{}
+	for _, aNetwork := range localNetworks {
+		_, bridgeSubnet := utils.GetBridgeInfo(aNetwork, host)
+		if bridgeSubnet == "" {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(bridgeSubnet)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing subnet of network %v", aNetwork.UUID)
+		}
+		if ip.To4() != nil {
+			families[aNetwork.UUID] = 4
+		} else {
+			families[aNetwork.UUID] = 6
+		}
+	}
+
+	return families, nil
+}
+
+// DetectSubnetChange compares the resolved bridge subnets of the previous
+// and current version of a network. The bridge address is part of the
+// subnet, so changing it is reported as well.
+func DetectSubnetChange(prev, curr metadata.Network, host metadata.Host) (changed bool, oldSubnet, newSubnet string, err error) {
+	_, oldSubnet = utils.GetBridgeInfo(prev, host)
+	_, newSubnet = utils.GetBridgeInfo(curr, host)
+	if oldSubnet == "" || newSubnet == "" {
+		return oldSubnet != newSubnet, oldSubnet, newSubnet, nil
+	}
+
+	oldIP, oldNet, err := net.ParseCIDR(oldSubnet)
+	if err != nil {
+		return false, oldSubnet, newSubnet, errors.Wrapf(err, "parsing previous subnet of network %v", prev.UUID)
+	}
+	newIP, newNet, err := net.ParseCIDR(newSubnet)
+	if err != nil {
+		return false, oldSubnet, newSubnet, errors.Wrapf(err, "parsing subnet of network %v", curr.UUID)
+	}
+
+	changed = !oldIP.Equal(newIP) || oldNet.String() != newNet.String()
+	return changed, oldSubnet, newSubnet, nil
+}
+
+// NetworkRename is a network which was recreated with a new UUID
+type NetworkRename struct {
+	Name    string
+	OldUUID string
+	NewUUID string
+}
+
+// DetectNetworkRenames matches the networks which went away with the new
+// ones having the same environment, name and bridge subnet, as done by
+// rancher when recreating a network during upgrades.
+func DetectNetworkRenames(prev, curr []metadata.Network) []NetworkRename {
+	prevUUIDs := map[string]bool{}
+	for _, aNetwork := range prev {
+		prevUUIDs[aNetwork.UUID] = true
+	}
+	currUUIDs := map[string]bool{}
+	for _, aNetwork := range curr {
+		currUUIDs[aNetwork.UUID] = true
+	}
+
+	renames := []NetworkRename{}
+	matched := map[string]bool{}
+	for _, oldNetwork := range prev {
+		if currUUIDs[oldNetwork.UUID] {
+			continue
+		}
+		// The host labels aren't known here, only the subnets
+		// which don't depend on them can be matched
+		_, oldSubnet := utils.GetBridgeInfo(oldNetwork, metadata.Host{})
+		for _, newNetwork := range curr {
+			if prevUUIDs[newNetwork.UUID] || matched[newNetwork.UUID] ||
+				newNetwork.Name != oldNetwork.Name ||
+				newNetwork.EnvironmentUUID != oldNetwork.EnvironmentUUID {
+				continue
+			}
+			_, newSubnet := utils.GetBridgeInfo(newNetwork, metadata.Host{})
+			if oldSubnet != newSubnet {
+				if equal, err := utils.SubnetsEqual(oldSubnet, newSubnet); err != nil || !equal {
+					continue
+				}
 			}
+
+			matched[newNetwork.UUID] = true
+			renames = append(renames, NetworkRename{
+				Name:    oldNetwork.Name,
+				OldUUID: oldNetwork.UUID,
+				NewUUID: newNetwork.UUID,
+			})
+			break
 		}
 	}
 
-	ret := []metadata.Network{}
+	return renames
+}
+
+// FindDuplicateSubnetNetworks returns the networks of the host environment
+// sharing the same bridge subnet, keyed by the canonical subnet. Networks
+// without a bridge subnet are ignored.
+func FindDuplicateSubnetNetworks(networks []metadata.Network, host metadata.Host) (map[string][]metadata.Network, error) {
+	bySubnet := map[string][]metadata.Network{}
 	for _, aNetwork := range networks {
 		if aNetwork.EnvironmentUUID != host.EnvironmentUUID {
 			continue
 		}
-		_, ok := aNetwork.Metadata["cniConfig"].(map[string]interface{})
-		if !ok {
+		_, bridgeSubnet := utils.GetBridgeInfo(aNetwork, host)
+		if bridgeSubnet == "" {
 			continue
 		}
-		ret = append(ret, aNetwork)
+		subnet, err := utils.CanonicalSubnet(bridgeSubnet)
+		if err != nil {
+			return nil, errors.Wrapf(err, "network %v", aNetwork.UUID)
+		}
+		bySubnet[subnet] = append(bySubnet[subnet], aNetwork)
+	}
+
+	duplicates := map[string][]metadata.Network{}
+	for subnet, subnetNetworks := range bySubnet {
+		if len(subnetNetworks) > 1 {
+			duplicates[subnet] = subnetNetworks
+		}
+	}
+	return duplicates, nil
+}
+
+// NetworkConfigChecksum returns a checksum of the effective config of the
+// network on this host: the CNI config with the keywords resolved, the IP
+// address of the network router and the bridge subnet. It can be compared
+// with the one from a previous run to skip networks which haven't changed.
+// The metadata of the network is left untouched.
+func NetworkConfigChecksum(network metadata.Network, host metadata.Host, router metadata.Container) (string, error) {
+	cniConf, _ := network.Metadata["cniConfig"].(map[string]interface{})
+	resolved := map[string]interface{}{}
+	for file, config := range cniConf {
+		resolved[file] = utils.UpdateCNIConfigByKeywords(utils.CopyConfig(config), host)
+	}
+	_, bridgeSubnet := utils.GetBridgeInfo(network, host)
+
+	content, err := json.Marshal(struct {
+		CNIConfig    map[string]interface{}
+		RouterIP     string
+		BridgeSubnet string
+	}{resolved, router.PrimaryIp, bridgeSubnet})
+	if err != nil {
+		return "", errors.Wrapf(err, "marshaling config of network %v", network.UUID)
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(content)), nil
+}
+
+// CompareEffectiveConfigAcrossHosts returns the checksum of the effective
+// config of the network on each of the hosts, keyed by host UUID, along
+// with the sorted UUIDs of the hosts whose checksum differs from the one
+// of the majority. The router is left out of the checksums as it is
+// expected to differ between hosts. On a tie the smallest checksum is
+// taken as the majority so the result is stable.
+func CompareEffectiveConfigAcrossHosts(network metadata.Network, hosts []metadata.Host) (map[string]string, []string, error) {
+	checksums := map[string]string{}
+	counts := map[string]int{}
+	for _, host := range hosts {
+		if host.UUID == "" {
+			return nil, nil, fmt.Errorf("host %v has no UUID", host.Name)
+		}
+		if _, ok := checksums[host.UUID]; ok {
+			return nil, nil, fmt.Errorf("host %v is listed more than once", host.UUID)
+		}
+		checksum, err := NetworkConfigChecksum(network, host, metadata.Container{})
+		if err != nil {
+			return nil, nil, err
+		}
+		checksums[host.UUID] = checksum
+		counts[checksum]++
+	}
+
+	majority := ""
+	for checksum, count := range counts {
+		if majority == "" || count > counts[majority] || (count == counts[majority] && checksum < majority) {
+			majority = checksum
+		}
+	}
+
+	differing := []string{}
+	for uuid, checksum := range checksums {
+		if checksum != majority {
+			differing = append(differing, uuid)
+		}
 	}
+	sort.Strings(differing)
 
-	return ret, routers, nil
+	return checksums, differing, nil
 }
 
 func ForEachContainerNS(dc *client.Client, mc metadata.Client, networkUUID string, f func(metadata.Container, ns.NetNS) error) error {
@@ -0,0 +1,562 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/testutil"
+	"github.com/rancher/plugin-manager/utils"
+)
+
+// testDriverServices returns a network driver stack with the given
+// routers
+func testDriverServices(routers ...metadata.Container) []metadata.Service {
+	return []metadata.Service{{
+		Name:               "cni-driver",
+		StackName:          "network-stack",
+		PrimaryServiceName: "cni-driver",
+		Kind:               "networkDriverService",
+		Containers:         routers,
+	}}
+}
+
+func testBridgeNetwork(uuid, environmentUUID, bridge, bridgeSubnet string) metadata.Network {
+	return metadata.Network{
+		Name:            uuid,
+		UUID:            uuid,
+		EnvironmentUUID: environmentUUID,
+		Metadata: map[string]interface{}{
+			"cniConfig": map[string]interface{}{
+				"10-rancher.conf": map[string]interface{}{
+					"type":         "rancher-bridge",
+					"bridge":       bridge,
+					"bridgeSubnet": bridgeSubnet,
+				},
+			},
+		},
+	}
+}
+
+func TestLocalNetworkFamilies(t *testing.T) {
+	mc := &testutil.FakeMetadataClient{
+		Host:     metadata.Host{UUID: "host1", EnvironmentUUID: "env1"},
+		Services: testDriverServices(),
+		Networks: []metadata.Network{
+			testBridgeNetwork("net-v4", "env1", "docker0", "10.42.0.0/16"),
+			testBridgeNetwork("net-v6", "env1", "docker1", "fd00:42::/64"),
+			testBridgeNetwork("net-other-env", "env2", "docker0", "10.43.0.0/16"),
+			{UUID: "net-no-cni", EnvironmentUUID: "env1"},
+		},
+	}
+
+	families, err := LocalNetworkFamilies(mc)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	expected := map[string]int{
+		"net-v4": 4,
+		"net-v6": 6,
+	}
+	if !reflect.DeepEqual(families, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, families)
+	}
+}
+
+func TestNetworkConfigChecksum(t *testing.T) {
+	host := metadata.Host{UUID: "host1", EnvironmentUUID: "env1"}
+	router := metadata.Container{PrimaryIp: "10.42.0.2"}
+
+	first, err := NetworkConfigChecksum(testBridgeNetwork("net1", "env1", "docker0", "10.42.0.0/16"), host, router)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	second, err := NetworkConfigChecksum(testBridgeNetwork("net1", "env1", "docker0", "10.42.0.0/16"), host, router)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if first != second {
+		t.Errorf("expected checksum to be stable, got: %v and %v", first, second)
+	}
+
+	router.PrimaryIp = "10.42.0.3"
+	changed, err := NetworkConfigChecksum(testBridgeNetwork("net1", "env1", "docker0", "10.42.0.0/16"), host, router)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if first == changed {
+		t.Errorf("expected checksum to change with the router IP, got: %v", changed)
+	}
+}
+
+func TestCompareEffectiveConfigAcrossHosts(t *testing.T) {
+	aNetwork := testBridgeNetwork("net1", "env1", "__host_label__:bridge", "10.42.0.0/16")
+	hostWithBridge := func(uuid, bridge string) metadata.Host {
+		return metadata.Host{UUID: uuid, EnvironmentUUID: "env1", Labels: map[string]string{"bridge": bridge}}
+	}
+	hosts := []metadata.Host{
+		hostWithBridge("host1", "docker0"),
+		hostWithBridge("host2", "docker1"),
+		hostWithBridge("host3", "docker0"),
+		hostWithBridge("host4", "docker0"),
+	}
+
+	checksums, differing, err := CompareEffectiveConfigAcrossHosts(aNetwork, hosts)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if len(checksums) != len(hosts) {
+		t.Fatalf("expected: %v, got actual: %v", len(hosts), len(checksums))
+	}
+	if checksums["host1"] != checksums["host3"] || checksums["host1"] != checksums["host4"] {
+		t.Errorf("expected the hosts with the same labels to have the same checksum, got actual: %v", checksums)
+	}
+	if checksums["host1"] == checksums["host2"] {
+		t.Errorf("expected host2 to have a different checksum, got actual: %v", checksums)
+	}
+	if expected := []string{"host2"}; !reflect.DeepEqual(differing, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, differing)
+	}
+
+	_, differing, err = CompareEffectiveConfigAcrossHosts(aNetwork, hosts[:1])
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if len(differing) != 0 {
+		t.Errorf("expected no differing hosts, got actual: %v", differing)
+	}
+
+	if _, _, err := CompareEffectiveConfigAcrossHosts(aNetwork, []metadata.Host{hosts[0], hosts[0]}); err == nil {
+		t.Errorf("expecting error for a duplicated host, but got nil")
+	}
+	if _, _, err := CompareEffectiveConfigAcrossHosts(aNetwork, []metadata.Host{{Name: "nameless"}}); err == nil {
+		t.Errorf("expecting error for a host without UUID, but got nil")
+	}
+}
+
+func TestFindNetworksMissingCNIConfig(t *testing.T) {
+	host := metadata.Host{UUID: "host1", EnvironmentUUID: "env1"}
+	networks := []metadata.Network{
+		testBridgeNetwork("net1", "env1", "docker0", "10.42.0.0/16"),
+		{UUID: "net-missing", EnvironmentUUID: "env1", Metadata: map[string]interface{}{}},
+		{UUID: "net-other-env", EnvironmentUUID: "env2"},
+	}
+
+	missing := FindNetworksMissingCNIConfig(networks, host)
+	if len(missing) != 1 || missing[0].UUID != "net-missing" {
+		t.Errorf("expected: [net-missing], got actual: %v", missing)
+	}
+
+	missing = FindNetworksMissingCNIConfig(networks[:1], host)
+	if len(missing) != 0 {
+		t.Errorf("expected no networks, got actual: %v", missing)
+	}
+}
+
+func TestCountRunningContainersPerNetwork(t *testing.T) {
+	localNetworks := []metadata.Network{
+		{UUID: "net1"},
+		{UUID: "net2"},
+		{UUID: "net3"},
+	}
+	containers := []metadata.Container{
+		{NetworkUUID: "net1", State: "running"},
+		{NetworkUUID: "net1", State: "running"},
+		{NetworkUUID: "net1", State: "stopped"},
+		{NetworkUUID: "net2", State: "starting"},
+		{NetworkUUID: "net2", State: "running"},
+		{NetworkUUID: "net-remote", State: "running"},
+	}
+
+	counts := CountRunningContainersPerNetwork(containers, localNetworks)
+	expected := map[string]int{
+		"net1": 2,
+		"net2": 1,
+		"net3": 0,
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, counts)
+	}
+}
+
+func TestFindDuplicateContainerIPsPerNetwork(t *testing.T) {
+	clean := []metadata.Container{
+		{UUID: "c1", NetworkUUID: "net1", PrimaryIp: "10.42.0.2"},
+		{UUID: "c2", NetworkUUID: "net1", PrimaryIp: "10.42.0.3"},
+		{UUID: "c3", NetworkUUID: "net2", PrimaryIp: "10.42.0.2"},
+		{UUID: "c4", NetworkUUID: "net1"},
+		{UUID: "c5", NetworkUUID: "net1"},
+	}
+	duplicates, err := FindDuplicateContainerIPsPerNetwork(clean)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if len(duplicates) != 0 {
+		t.Errorf("expected no duplicates, got actual: %v", duplicates)
+	}
+
+	withDuplicate := append(clean, metadata.Container{UUID: "c6", NetworkUUID: "net1", PrimaryIp: "10.42.0.3"})
+	duplicates, err = FindDuplicateContainerIPsPerNetwork(withDuplicate)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	expected := map[string][]metadata.Container{
+		"net1/10.42.0.3": {clean[1], withDuplicate[5]},
+	}
+	if !reflect.DeepEqual(duplicates, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, duplicates)
+	}
+
+	invalid := []metadata.Container{{UUID: "c1", NetworkUUID: "net1", PrimaryIp: "10.42.0"}}
+	if _, err := FindDuplicateContainerIPsPerNetwork(invalid); err == nil {
+		t.Errorf("expecting error for an invalid IP, but got nil")
+	}
+}
+
+func TestDetectSubnetChange(t *testing.T) {
+	host := metadata.Host{UUID: "host1", EnvironmentUUID: "env1"}
+	prev := testBridgeNetwork("net1", "env1", "docker0", "10.42.0.1/16")
+
+	tests := []struct {
+		subnet  string
+		changed bool
+	}{
+		{"10.42.0.1/16", false},
+		{"10.42.0.1/17", true},
+		{"10.42.0.2/16", true},
+		{"", true},
+	}
+	for _, test := range tests {
+		curr := testBridgeNetwork("net1", "env1", "docker0", test.subnet)
+		changed, oldSubnet, newSubnet, err := DetectSubnetChange(prev, curr, host)
+		if err != nil {
+			t.Errorf("%v: not expecting error: %v", test.subnet, err)
+		}
+		if changed != test.changed || oldSubnet != "10.42.0.1/16" || newSubnet != test.subnet {
+			t.Errorf("%v: expected: %v, got actual: %v %v %v", test.subnet, test.changed, changed, oldSubnet, newSubnet)
+		}
+	}
+
+	invalid := testBridgeNetwork("net1", "env1", "docker0", "10.42.0.1")
+	if _, _, _, err := DetectSubnetChange(prev, invalid, host); err == nil {
+		t.Errorf("expecting error for an invalid subnet, but got nil")
+	}
+}
+
+func TestCNIDriverRunningLocally(t *testing.T) {
+	host := metadata.Host{UUID: "host1"}
+	driver := func(containers ...metadata.Container) []metadata.Service {
+		return []metadata.Service{
+			{Name: "metadata", Kind: "service", Containers: []metadata.Container{{HostUUID: "host1", State: "running"}}},
+			{Name: "cni-driver", Kind: "networkDriverService", Containers: containers},
+		}
+	}
+
+	for _, c := range []struct {
+		name     string
+		services []metadata.Service
+		running  bool
+	}{
+		{"local", driver(metadata.Container{HostUUID: "host2", State: "running"}, metadata.Container{HostUUID: "host1", State: "running"}), true},
+		{"remote only", driver(metadata.Container{HostUUID: "host2", State: "running"}), false},
+		{"stopped", driver(metadata.Container{HostUUID: "host1", State: "stopped"}), false},
+		{"no containers", driver(), false},
+	} {
+		running, err := CNIDriverRunningLocally(c.services, host)
+		if err != nil {
+			t.Errorf("%v: not expecting error: %v", c.name, err)
+		}
+		if running != c.running {
+			t.Errorf("%v: expected: %v, got actual: %v", c.name, c.running, running)
+		}
+	}
+
+	if _, err := CNIDriverRunningLocally(driver()[:1], host); err == nil {
+		t.Errorf("expecting error without a network driver service, but got nil")
+	}
+}
+
+func TestGetAllBridgeInfosFromMetadata(t *testing.T) {
+	mc := &testutil.FakeMetadataClient{
+		Host:     metadata.Host{UUID: "host1", EnvironmentUUID: "env1"},
+		Services: testDriverServices(),
+		Networks: []metadata.Network{
+			testBridgeNetwork("net1", "env1", "docker0", "10.42.0.1/16"),
+			testBridgeNetwork("net2", "env1", "docker1", "10.43.0.1/16"),
+			testBridgeNetwork("net3", "env2", "docker2", "10.44.0.1/16"),
+			{UUID: "net4", EnvironmentUUID: "env1", Metadata: map[string]interface{}{"cniConfig": map[string]interface{}{}}},
+		},
+	}
+
+	infos, err := GetAllBridgeInfosFromMetadata(mc)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	expected := map[string]utils.BridgeInfo{
+		"net1": {Name: "docker0", Subnet: "10.42.0.1/16", CNIType: "rancher-bridge"},
+		"net2": {Name: "docker1", Subnet: "10.43.0.1/16", CNIType: "rancher-bridge"},
+	}
+	if !reflect.DeepEqual(infos, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, infos)
+	}
+}
+
+func TestDetectNetworkRenames(t *testing.T) {
+	named := func(name, uuid, environmentUUID, bridgeSubnet string) metadata.Network {
+		n := testBridgeNetwork(uuid, environmentUUID, "docker0", bridgeSubnet)
+		n.Name = name
+		return n
+	}
+
+	prev := []metadata.Network{
+		named("managed", "uuid1", "env1", "10.42.0.1/16"),
+		named("kept", "uuid2", "env1", "10.43.0.1/16"),
+		named("resized", "uuid3", "env1", "10.44.0.1/16"),
+		named("moved", "uuid4", "env1", "10.45.0.1/16"),
+		named("removed", "uuid5", "env1", "10.46.0.1/16"),
+	}
+	curr := []metadata.Network{
+		named("managed", "uuid11", "env1", "10.42.0.0/16"),
+		named("kept", "uuid2", "env1", "10.43.0.1/16"),
+		named("resized", "uuid13", "env1", "10.44.0.1/17"),
+		named("moved", "uuid14", "env2", "10.45.0.1/16"),
+		named("added", "uuid16", "env1", "10.46.0.1/16"),
+	}
+
+	renames := DetectNetworkRenames(prev, curr)
+	expected := []NetworkRename{{Name: "managed", OldUUID: "uuid1", NewUUID: "uuid11"}}
+	if !reflect.DeepEqual(renames, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, renames)
+	}
+
+	if renames := DetectNetworkRenames(prev, prev); len(renames) != 0 {
+		t.Errorf("expected no renames, got actual: %v", renames)
+	}
+}
+
+func TestFindDuplicateSubnetNetworks(t *testing.T) {
+	host := metadata.Host{UUID: "host1", EnvironmentUUID: "env1"}
+
+	clean := []metadata.Network{
+		testBridgeNetwork("net1", "env1", "docker0", "10.42.0.1/16"),
+		testBridgeNetwork("net2", "env1", "docker1", "10.43.0.1/16"),
+		testBridgeNetwork("net3", "env2", "docker0", "10.42.0.1/16"),
+		{UUID: "net4", EnvironmentUUID: "env1"},
+	}
+	duplicates, err := FindDuplicateSubnetNetworks(clean, host)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if len(duplicates) != 0 {
+		t.Errorf("expected no duplicates, got actual: %v", duplicates)
+	}
+
+	networks := append(clean, testBridgeNetwork("net5", "env1", "docker2", "10.42.200.1/16"))
+	duplicates, err = FindDuplicateSubnetNetworks(networks, host)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	actual := map[string][]string{}
+	for subnet, subnetNetworks := range duplicates {
+		for _, aNetwork := range subnetNetworks {
+			actual[subnet] = append(actual[subnet], aNetwork.UUID)
+		}
+	}
+	expected := map[string][]string{"10.42.0.0/16": {"net1", "net5"}}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, actual)
+	}
+
+	networks = append(clean, testBridgeNetwork("net6", "env1", "docker3", "not-a-subnet"))
+	if _, err := FindDuplicateSubnetNetworks(networks, host); err == nil {
+		t.Errorf("expecting error for an invalid subnet, but got nil")
+	}
+}
+
+func TestGetContainerEgressInterface(t *testing.T) {
+	host := metadata.Host{UUID: "host1", EnvironmentUUID: "env1"}
+	networks := []metadata.Network{
+		testBridgeNetwork("net1", "env1", "docker0", "10.42.0.1/16"),
+		{Name: "host", UUID: "net-host", EnvironmentUUID: "env1"},
+		{Name: "none", UUID: "net-none", EnvironmentUUID: "env1"},
+	}
+
+	for _, c := range []struct {
+		networkUUID string
+		expected    string
+		expectErr   bool
+	}{
+		{"net1", "docker0", false},
+		{"net-host", "host", false},
+		{"net-none", "", true},
+		{"net-missing", "", true},
+	} {
+		container := metadata.Container{UUID: "c1", NetworkUUID: c.networkUUID}
+		actual, err := GetContainerEgressInterface(container, networks, host)
+		if (err != nil) != c.expectErr {
+			t.Errorf("%v: unexpected error: %v", c.networkUUID, err)
+		}
+		if actual != c.expected {
+			t.Errorf("%v: expected: %v, got actual: %v", c.networkUUID, c.expected, actual)
+		}
+	}
+}
+
+func TestLocalNetworksDriverService(t *testing.T) {
+	host := metadata.Host{UUID: "host1", EnvironmentUUID: "env1"}
+	networks := []metadata.Network{testBridgeNetwork("net1", "env1", "docker0", "10.42.0.1/16")}
+	routers := []metadata.Container{
+		{UUID: "r1", HostUUID: "host1", NetworkUUID: "net1"},
+		{UUID: "r2", HostUUID: "host2", NetworkUUID: "net1"},
+	}
+
+	mc := &testutil.FakeMetadataClient{Host: host, Networks: networks, Services: testDriverServices(routers...)}
+	localNetworks, localRouters, err := LocalNetworks(mc)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if len(localNetworks) != 1 || localNetworks[0].UUID != "net1" {
+		t.Errorf("expected: [net1], got actual: %v", localNetworks)
+	}
+	if expected := map[string]metadata.Container{"net1": routers[0]}; !reflect.DeepEqual(localRouters, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, localRouters)
+	}
+
+	// The network driver is a sidekick of the primary service of the stack
+	sidekick := []metadata.Service{
+		{Name: "cni-driver", StackName: "ipsec", PrimaryServiceName: "ipsec", Kind: "networkDriverService"},
+		{Name: "ipsec", StackName: "ipsec", PrimaryServiceName: "ipsec", Kind: "service", Containers: routers},
+		{Name: "ipsec", StackName: "other", PrimaryServiceName: "ipsec", Kind: "service"},
+	}
+	mc.Services = sidekick
+	if _, localRouters, err = LocalNetworks(mc); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if localRouters["net1"].UUID != "r1" {
+		t.Errorf("expected: r1, got actual: %v", localRouters)
+	}
+
+	for name, services := range map[string][]metadata.Service{
+		"no driver": nil,
+		"two drivers not named cni-driver": {
+			{Name: "ipsec-driver", PrimaryServiceName: "ipsec-driver", Kind: "networkDriverService"},
+			{Name: "vxlan-driver", PrimaryServiceName: "vxlan-driver", Kind: "networkDriverService"},
+		},
+		"no primary service": sidekick[:1],
+	} {
+		mc.Services = services
+		if _, _, err := LocalNetworks(mc); err == nil {
+			t.Errorf("%v: expecting error, but got nil", name)
+		}
+	}
+}
+
+func TestLocalNetworksByDriver(t *testing.T) {
+	host := metadata.Host{UUID: "host1", EnvironmentUUID: "env1"}
+	networks := []metadata.Network{
+		testBridgeNetwork("net-ipsec", "env1", "docker0", "10.42.0.1/16"),
+		testBridgeNetwork("net-vxlan", "env1", "docker1", "10.43.0.1/16"),
+		testBridgeNetwork("net-moving", "env1", "docker2", "10.44.0.1/16"),
+		testBridgeNetwork("net-no-router", "env1", "docker3", "10.45.0.1/16"),
+		testBridgeNetwork("net-other-env", "env2", "docker4", "10.46.0.1/16"),
+	}
+	ipsecRouters := []metadata.Container{
+		{UUID: "r1", HostUUID: "host1", NetworkUUID: "net-ipsec"},
+		{UUID: "r2", HostUUID: "host1", NetworkUUID: "net-moving", State: "stopping"},
+	}
+	vxlanRouters := []metadata.Container{
+		{UUID: "r3", HostUUID: "host2", NetworkUUID: "net-vxlan"},
+		{UUID: "r4", HostUUID: "host1", NetworkUUID: "net-moving", State: "running"},
+	}
+	services := []metadata.Service{
+		{Name: "cni-driver", StackName: "ipsec", PrimaryServiceName: "ipsec", Kind: "networkDriverService"},
+		{Name: "ipsec", StackName: "ipsec", PrimaryServiceName: "ipsec", Kind: "service", Containers: ipsecRouters},
+		{Name: "cni-driver", StackName: "vxlan", PrimaryServiceName: "vxlan", Kind: "networkDriverService"},
+		{Name: "vxlan", StackName: "vxlan", PrimaryServiceName: "vxlan", Kind: "service", Containers: vxlanRouters},
+	}
+
+	mc := &testutil.FakeMetadataClient{Host: host, Networks: networks, Services: services}
+	byDriver, err := LocalNetworksByDriver(mc)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	uuids := func(networks []metadata.Network) []string {
+		ret := []string{}
+		for _, aNetwork := range networks {
+			ret = append(ret, aNetwork.UUID)
+		}
+		return ret
+	}
+	expected := map[string][]string{
+		"ipsec": {"net-ipsec", "net-moving"},
+		"vxlan": {"net-vxlan", "net-moving"},
+		"":      {"net-no-router"},
+	}
+	if len(byDriver) != len(expected) {
+		t.Fatalf("expected: %v, got actual: %v", expected, byDriver)
+	}
+	for key, expectedNetworks := range expected {
+		if actual := uuids(byDriver[key].Networks); !reflect.DeepEqual(actual, expectedNetworks) {
+			t.Errorf("driver %q: expected: %v, got actual: %v", key, expectedNetworks, actual)
+		}
+	}
+	if byDriver["vxlan"].Driver.StackName != "vxlan" {
+		t.Errorf("expected: vxlan, got actual: %v", byDriver["vxlan"].Driver.StackName)
+	}
+
+	expectedRouters := map[string]metadata.Container{"net-ipsec": ipsecRouters[0], "net-moving": ipsecRouters[1]}
+	if !reflect.DeepEqual(byDriver["ipsec"].Routers, expectedRouters) {
+		t.Errorf("expected: %v, got actual: %v", expectedRouters, byDriver["ipsec"].Routers)
+	}
+	expectedRouters = map[string]metadata.Container{"net-moving": vxlanRouters[1]}
+	if !reflect.DeepEqual(byDriver["vxlan"].Routers, expectedRouters) {
+		t.Errorf("expected: %v, got actual: %v", expectedRouters, byDriver["vxlan"].Routers)
+	}
+
+	// LocalNetworks merges the routers of both drivers, preferring the
+	// running one of the network being moved
+	localNetworks, localRouters, err := LocalNetworks(mc)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if actual := uuids(localNetworks); !reflect.DeepEqual(actual, []string{"net-ipsec", "net-moving", "net-vxlan", "net-no-router"}) {
+		t.Errorf("expected the networks of env1, got actual: %v", actual)
+	}
+	expectedRouters = map[string]metadata.Container{"net-ipsec": ipsecRouters[0], "net-moving": vxlanRouters[1]}
+	if !reflect.DeepEqual(localRouters, expectedRouters) {
+		t.Errorf("expected: %v, got actual: %v", expectedRouters, localRouters)
+	}
+
+	for name, services := range map[string][]metadata.Service{
+		"no driver":          nil,
+		"no primary service": services[:1],
+	} {
+		mc.Services = services
+		if _, err := LocalNetworksByDriver(mc); err == nil {
+			t.Errorf("%v: expecting error, but got nil", name)
+		}
+	}
+}
+
+func TestNetworksAffectedByContainer(t *testing.T) {
+	networks := []metadata.Network{
+		testBridgeNetwork("net1", "env1", "docker0", "10.42.0.1/16"),
+		testBridgeNetwork("net2", "env1", "docker1", "10.43.0.1/16"),
+	}
+
+	affected, err := NetworksAffectedByContainer(metadata.Container{UUID: "c1", NetworkUUID: "net2"}, networks)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if len(affected) != 1 || affected[0].UUID != "net2" {
+		t.Errorf("expected: [net2], got actual: %v", affected)
+	}
+
+	for _, networkUUID := range []string{"", "net3"} {
+		if _, err := NetworksAffectedByContainer(metadata.Container{UUID: "c1", NetworkUUID: networkUUID}, networks); err == nil {
+			t.Errorf("%q: expecting error, but got nil", networkUUID)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package network
+
+import (
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// NetlinkHandle is the subset of netlink operations used to manage the
+// host networking, it's implemented by *netlink.Handle
+type NetlinkHandle interface {
+	LinkByName(name string) (netlink.Link, error)
+	LinkDel(link netlink.Link) error
+	LinkSetMTU(link netlink.Link, mtu int) error
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	RouteList(link netlink.Link, family int) ([]netlink.Route, error)
+	RouteDel(route *netlink.Route) error
+	NeighList(linkIndex, family int) ([]netlink.Neigh, error)
+	NeighDel(neigh *netlink.Neigh) error
+}
+
+// nlh operates on the network namespace of the caller
+var nlh NetlinkHandle = &netlink.Handle{}
+
+// isLinkNotFound tells if the error of LinkByName is the link missing. The
+// vendored netlink has no LinkNotFoundError yet, it reports a missing link
+// with one of these messages.
+func isLinkNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return msg == "Link not found" || (strings.HasPrefix(msg, "Link ") && strings.HasSuffix(msg, " not found"))
+}
@@ -0,0 +1,81 @@
+package network
+
+import (
+	"sync"
+
+	"github.com/vishvananda/netlink"
+)
+
+// CachedNetlinkHandle wraps a NetlinkHandle caching the links looked up
+// by name. The cache is dropped by Invalidate and by any of the calls
+// changing the host networking. It's safe for concurrent use.
+type CachedNetlinkHandle struct {
+	NetlinkHandle
+
+	mu    sync.Mutex
+	links map[string]netlink.Link
+	// generation changes on each invalidation, so a lookup which raced
+	// with one doesn't get cached
+	generation int
+}
+
+// NewCachedNetlinkHandle returns a CachedNetlinkHandle wrapping h
+func NewCachedNetlinkHandle(h NetlinkHandle) *CachedNetlinkHandle {
+	return &CachedNetlinkHandle{NetlinkHandle: h, links: map[string]netlink.Link{}}
+}
+
+// Invalidate drops all the cached links
+func (h *CachedNetlinkHandle) Invalidate() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.links = map[string]netlink.Link{}
+	h.generation++
+}
+
+// LinkByName returns the cached link if any, looking it up otherwise.
+// Lookup errors aren't cached. The lock isn't held during the lookup.
+func (h *CachedNetlinkHandle) LinkByName(name string) (netlink.Link, error) {
+	h.mu.Lock()
+	link, ok := h.links[name]
+	generation := h.generation
+	h.mu.Unlock()
+	if ok {
+		return link, nil
+	}
+
+	link, err := h.NetlinkHandle.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.generation == generation {
+		h.links[name] = link
+	}
+	return link, nil
+}
+
+// LinkDel deletes the link and invalidates the cache
+func (h *CachedNetlinkHandle) LinkDel(link netlink.Link) error {
+	defer h.Invalidate()
+	return h.NetlinkHandle.LinkDel(link)
+}
+
+// LinkSetMTU sets the MTU of the link and invalidates the cache
+func (h *CachedNetlinkHandle) LinkSetMTU(link netlink.Link, mtu int) error {
+	defer h.Invalidate()
+	return h.NetlinkHandle.LinkSetMTU(link, mtu)
+}
+
+// RouteDel deletes the route and invalidates the cache
+func (h *CachedNetlinkHandle) RouteDel(route *netlink.Route) error {
+	defer h.Invalidate()
+	return h.NetlinkHandle.RouteDel(route)
+}
+
+// NeighDel deletes the neighbor and invalidates the cache
+func (h *CachedNetlinkHandle) NeighDel(neigh *netlink.Neigh) error {
+	defer h.Invalidate()
+	return h.NetlinkHandle.NeighDel(neigh)
+}
@@ -0,0 +1,100 @@
+package network
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// countingNetlinkHandle counts the link lookups reaching the fake handle
+type countingNetlinkHandle struct {
+	*fakeNetlinkHandle
+	sync.Mutex
+	lookups int
+}
+
+func (h *countingNetlinkHandle) LinkByName(name string) (netlink.Link, error) {
+	h.Lock()
+	h.lookups++
+	h.Unlock()
+	return h.fakeNetlinkHandle.LinkByName(name)
+}
+
+func TestCachedNetlinkHandle(t *testing.T) {
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "docker0", Index: 2}}
+	other := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "docker1", Index: 3}}
+	underlying := &countingNetlinkHandle{fakeNetlinkHandle: &fakeNetlinkHandle{
+		links: map[string]netlink.Link{"docker0": bridge, "docker1": other},
+	}}
+	h := NewCachedNetlinkHandle(underlying)
+
+	for i := 0; i < 3; i++ {
+		if _, err := h.LinkByName("docker0"); err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+	}
+	if underlying.lookups != 1 {
+		t.Errorf("expected: 1 lookup, got actual: %v", underlying.lookups)
+	}
+
+	if _, err := h.LinkByName("missing"); err == nil {
+		t.Errorf("expecting error for a missing link, but got nil")
+	}
+	h.LinkByName("missing")
+	if underlying.lookups != 3 {
+		t.Errorf("expected the errors not to be cached, got actual: %v lookups", underlying.lookups)
+	}
+
+	h.Invalidate()
+	h.LinkByName("docker0")
+	if underlying.lookups != 4 {
+		t.Errorf("expected a lookup after Invalidate, got actual: %v lookups", underlying.lookups)
+	}
+
+	if err := h.LinkDel(other); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	h.LinkByName("docker0")
+	if underlying.lookups != 5 {
+		t.Errorf("expected a lookup after LinkDel, got actual: %v lookups", underlying.lookups)
+	}
+	if _, err := h.LinkByName("docker1"); err == nil {
+		t.Errorf("expecting error for the deleted link, but got nil")
+	}
+}
+
+func TestCachedNetlinkHandleConcurrent(t *testing.T) {
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "docker0", Index: 2}}
+	underlying := &countingNetlinkHandle{fakeNetlinkHandle: &fakeNetlinkHandle{
+		links: map[string]netlink.Link{"docker0": bridge},
+	}}
+	h := NewCachedNetlinkHandle(underlying)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.LinkByName("docker0")
+			h.Invalidate()
+			h.LinkByName("docker0")
+		}()
+	}
+	wg.Wait()
+}
+
+func TestWatchReadinessCachesLinks(t *testing.T) {
+	defer func(h NetlinkHandle) { nlh = h }(nlh)
+
+	mc, h := newTestPlan()
+	mc.Networks = append(mc.Networks, testBridgeNetwork("net4", "env1", "docker0", "10.42.0.1/16"))
+	underlying := &countingNetlinkHandle{fakeNetlinkHandle: h}
+	nlh = underlying
+
+	r := &ReadinessState{}
+	r.reconcileOnChange(mc)
+	if underlying.lookups != 3 {
+		t.Errorf("expected docker0 to be looked up once for net1 and net4, got actual: %v lookups", underlying.lookups)
+	}
+}
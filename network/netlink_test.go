@@ -0,0 +1,57 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// fakeNetlinkHandle serves the given links, addresses, routes and
+// neighbors and records what gets deleted
+type fakeNetlinkHandle struct {
+	links   map[string]netlink.Link
+	addrs   map[int][]netlink.Addr
+	routes  map[int][]netlink.Route
+	neighs  map[int][]netlink.Neigh
+	deleted []string
+}
+
+func (h *fakeNetlinkHandle) LinkByName(name string) (netlink.Link, error) {
+	if l, ok := h.links[name]; ok {
+		return l, nil
+	}
+	return nil, fmt.Errorf("Link %s not found", name)
+}
+
+func (h *fakeNetlinkHandle) LinkDel(link netlink.Link) error {
+	delete(h.links, link.Attrs().Name)
+	h.deleted = append(h.deleted, "link "+link.Attrs().Name)
+	return nil
+}
+
+func (h *fakeNetlinkHandle) LinkSetMTU(link netlink.Link, mtu int) error {
+	link.Attrs().MTU = mtu
+	return nil
+}
+
+func (h *fakeNetlinkHandle) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	return h.addrs[link.Attrs().Index], nil
+}
+
+func (h *fakeNetlinkHandle) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	return h.routes[link.Attrs().Index], nil
+}
+
+func (h *fakeNetlinkHandle) RouteDel(route *netlink.Route) error {
+	h.deleted = append(h.deleted, "route "+route.Dst.String())
+	return nil
+}
+
+func (h *fakeNetlinkHandle) NeighList(linkIndex, family int) ([]netlink.Neigh, error) {
+	return h.neighs[linkIndex], nil
+}
+
+func (h *fakeNetlinkHandle) NeighDel(neigh *netlink.Neigh) error {
+	h.deleted = append(h.deleted, "neigh "+neigh.IP.String())
+	return nil
+}
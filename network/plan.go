@@ -0,0 +1,345 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/utils"
+	"github.com/vishvananda/netlink"
+)
+
+// ReconcilePlan lists the changes a reconcile would do on the host,
+// in the order they would be done
+type ReconcilePlan struct {
+	Actions []ReconcileEvent
+}
+
+func (p ReconcilePlan) String() string {
+	out := &bytes.Buffer{}
+	for _, a := range p.Actions {
+		switch a.Action {
+		case ActionCreateBridge:
+			fmt.Fprintf(out, "create bridge %v\n", a.Interface)
+		case ActionAddAddress:
+			fmt.Fprintf(out, "add address %v dev %v\n", a.Object, a.Interface)
+		case ActionAddRoute:
+			fmt.Fprintf(out, "add route %v dev %v\n", a.Object, a.Interface)
+		case ActionDelRoute:
+			fmt.Fprintf(out, "delete route %v dev %v\n", a.Object, a.Interface)
+		default:
+			fmt.Fprintf(out, "%v %v dev %v\n", a.Action, a.Object, a.Interface)
+		}
+	}
+	return out.String()
+}
+
+// RenderReconcileDiff renders the plan as a diff of the host networking:
+// a + line for each object to add, a - line for each one to delete and a
+// ~ line for each setting to change in place.
+func RenderReconcileDiff(plan ReconcilePlan) string {
+	out := &bytes.Buffer{}
+	for _, a := range plan.Actions {
+		switch a.Action {
+		case ActionCreateBridge:
+			fmt.Fprintf(out, "+ bridge %v\n", a.Interface)
+		case ActionDelLink:
+			fmt.Fprintf(out, "- link %v\n", a.Interface)
+		case ActionAddAddress:
+			fmt.Fprintf(out, "+ address %v dev %v\n", a.Object, a.Interface)
+		case ActionDelAddress:
+			fmt.Fprintf(out, "- address %v dev %v\n", a.Object, a.Interface)
+		case ActionAddRoute:
+			fmt.Fprintf(out, "+ route %v via %v\n", a.Object, a.Interface)
+		case ActionDelRoute:
+			fmt.Fprintf(out, "- route %v via %v\n", a.Object, a.Interface)
+		case ActionAddNeighbor:
+			fmt.Fprintf(out, "+ neighbor %v dev %v\n", a.Object, a.Interface)
+		case ActionDelNeighbor:
+			fmt.Fprintf(out, "- neighbor %v dev %v\n", a.Object, a.Interface)
+		case ActionSetMTU:
+			fmt.Fprintf(out, "~ mtu %v dev %v\n", a.Object, a.Interface)
+		case ActionSetSTP:
+			fmt.Fprintf(out, "~ stp %v dev %v\n", a.Object, a.Interface)
+		default:
+			fmt.Fprintf(out, "~ %v %v dev %v\n", a.Action, a.Object, a.Interface)
+		}
+	}
+	return out.String()
+}
+
+// PlanReconcile returns the changes needed for the bridges of the local
+// networks to be created and to have their address and subnet route,
+// along with the stale subnet routes to delete. Nothing is changed. It's
+// an error if a router IP isn't of the family of any of its bridge
+// subnets.
+func PlanReconcile(mc metadata.Client) (ReconcilePlan, error) {
+	plan := ReconcilePlan{Actions: []ReconcileEvent{}}
+
+	localNetworks, routers, err := LocalNetworks(mc)
+	if err != nil {
+		return plan, err
+	}
+
+	host, err := mc.GetSelfHost()
+	if err != nil {
+		return plan, errors.Wrap(err, "error fetching self host from metadata")
+	}
+
+	for _, aNetwork := range localNetworks {
+		bridgeName, bridgeSubnets := utils.GetBridgeSubnets(aNetwork, host)
+		if bridgeName == "" || len(bridgeSubnets) == 0 {
+			continue
+		}
+		if router, ok := routers[aNetwork.UUID]; ok && router.PrimaryIp != "" {
+			if err := validateRouterFamily(bridgeSubnets, router.PrimaryIp); err != nil {
+				return plan, errors.Wrapf(err, "planning network %v", aNetwork.UUID)
+			}
+		}
+		actions, err := planBridge(bridgeName, bridgeSubnets)
+		if err != nil {
+			return plan, errors.Wrapf(err, "planning network %v", aNetwork.UUID)
+		}
+		plan.Actions = append(plan.Actions, actions...)
+	}
+
+	return plan, nil
+}
+
+// FindMissingManagedInterfaces returns the bridges which don't exist on the
+// host while it runs the router of their network, the other errors looking
+// up a bridge are returned
+func FindMissingManagedInterfaces(mc metadata.Client) ([]string, error) {
+	localNetworks, routers, err := LocalNetworks(mc)
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := mc.GetSelfHost()
+	if err != nil {
+		return nil, errors.Wrap(err, "error fetching self host from metadata")
+	}
+
+	missing := []string{}
+	seen := map[string]bool{}
+	for _, aNetwork := range localNetworks {
+		if _, ok := routers[aNetwork.UUID]; !ok {
+			continue
+		}
+		bridgeName, _ := utils.GetBridgeInfo(aNetwork, host)
+		if bridgeName == "" || seen[bridgeName] {
+			continue
+		}
+		seen[bridgeName] = true
+		if _, err := nlh.LinkByName(bridgeName); isLinkNotFound(err) {
+			logrus.Debugf("Bridge %v of network %v not found: %v", bridgeName, aNetwork.UUID, err)
+			missing = append(missing, bridgeName)
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "looking up bridge %v of network %v", bridgeName, aNetwork.UUID)
+		}
+	}
+
+	return missing, nil
+}
+
+// planBridge plans the bridge to have an address and a subnet route for
+// each of the given subnets, a dual-stack bridge has one of each family
+func planBridge(bridgeName string, bridgeSubnets []string) ([]ReconcileEvent, error) {
+	if err := utils.ValidateInterfaceName(bridgeName); err != nil {
+		return nil, err
+	}
+
+	addresses := []*net.IPNet{}
+	subnets := map[string]bool{}
+	for _, bridgeSubnet := range bridgeSubnets {
+		ip, subnet, err := net.ParseCIDR(bridgeSubnet)
+		if err != nil {
+			return nil, err
+		}
+		address := &net.IPNet{IP: ip, Mask: subnet.Mask}
+		if err := ValidateBridgeAddress(address); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, address)
+		subnets[subnet.String()] = true
+	}
+
+	bridge, isBridge, err := lookupBridgeInterface(nlh, bridgeName)
+	if isLinkNotFound(err) {
+		actions := []ReconcileEvent{{Action: ActionCreateBridge, Interface: bridgeName, Object: bridgeName}}
+		for _, address := range addresses {
+			actions = append(actions,
+				ReconcileEvent{Action: ActionAddAddress, Interface: bridgeName, Object: address.String()},
+				ReconcileEvent{Action: ActionAddRoute, Interface: bridgeName, Object: subnetOf(address)})
+		}
+		return actions, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "looking up bridge %v", bridgeName)
+	}
+	if !isBridge {
+		return nil, fmt.Errorf("bridge name %v is taken by a %v device", bridgeName, bridge.Type())
+	}
+
+	actions := []ReconcileEvent{}
+	addrs, err := nlh.AddrList(bridge, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing addresses of %v", bridgeName)
+	}
+	hasAddress := map[string]bool{}
+	for _, addr := range addrs {
+		if addr.IPNet != nil {
+			hasAddress[addr.IPNet.String()] = true
+		}
+	}
+	for _, address := range addresses {
+		if !hasAddress[address.String()] {
+			actions = append(actions, ReconcileEvent{Action: ActionAddAddress, Interface: bridgeName, Object: address.String()})
+		}
+	}
+
+	routes, err := nlh.RouteList(bridge, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing routes of %v", bridgeName)
+	}
+	hasRoute := map[string]bool{}
+	stale := []ReconcileEvent{}
+	for _, r := range routes {
+		if r.Dst == nil || r.Dst.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ones, bits := r.Dst.Mask.Size(); ones == bits {
+			continue
+		}
+		if subnets[r.Dst.String()] {
+			hasRoute[r.Dst.String()] = true
+			continue
+		}
+		stale = append(stale, ReconcileEvent{Action: ActionDelRoute, Interface: bridgeName, Object: r.Dst.String()})
+	}
+	for _, address := range addresses {
+		if subnet := subnetOf(address); !hasRoute[subnet] {
+			actions = append(actions, ReconcileEvent{Action: ActionAddRoute, Interface: bridgeName, Object: subnet})
+		}
+	}
+
+	return append(actions, stale...), nil
+}
+
+// subnetOf returns the subnet the given address is part of
+func subnetOf(address *net.IPNet) string {
+	return (&net.IPNet{IP: address.IP.Mask(address.Mask), Mask: address.Mask}).String()
+}
+
+// LocalNetworkState is what the manager wants for a local network
+type LocalNetworkState struct {
+	UUID    string   `json:"uuid"`
+	Name    string   `json:"name"`
+	Bridge  string   `json:"bridge,omitempty"`
+	Subnets []string `json:"subnets,omitempty"`
+	Router  string   `json:"router,omitempty"`
+}
+
+// BridgeState is a bridge of a local network as found on the host
+type BridgeState struct {
+	Name      string   `json:"name"`
+	Exists    bool     `json:"exists"`
+	Addresses []string `json:"addresses,omitempty"`
+	Routes    []string `json:"routes,omitempty"`
+}
+
+// NetworksState is the local networks and their bridges found on the
+// host. The output of PlanReconcile is reported under Advisory as no sync
+// applies it, Diff is always empty.
+type NetworksState struct {
+	Desired  []LocalNetworkState `json:"desired"`
+	Actual   []BridgeState       `json:"actual"`
+	Diff     []string            `json:"diff"`
+	Advisory []string            `json:"advisory"`
+}
+
+// GetNetworksState returns the state of the local networks, nothing is
+// changed
+func GetNetworksState(mc metadata.Client) (NetworksState, error) {
+	state := NetworksState{Desired: []LocalNetworkState{}, Actual: []BridgeState{}, Diff: []string{}, Advisory: []string{}}
+
+	localNetworks, routers, err := LocalNetworks(mc)
+	if err != nil {
+		return state, err
+	}
+
+	host, err := mc.GetSelfHost()
+	if err != nil {
+		return state, errors.Wrap(err, "error fetching self host from metadata")
+	}
+
+	seen := map[string]bool{}
+	for _, aNetwork := range localNetworks {
+		bridgeName, bridgeSubnets := utils.GetBridgeSubnets(aNetwork, host)
+		state.Desired = append(state.Desired, LocalNetworkState{
+			UUID:    aNetwork.UUID,
+			Name:    aNetwork.Name,
+			Bridge:  bridgeName,
+			Subnets: bridgeSubnets,
+			Router:  routers[aNetwork.UUID].PrimaryIp,
+		})
+		if bridgeName == "" || seen[bridgeName] {
+			continue
+		}
+		seen[bridgeName] = true
+
+		bridge, err := inspectBridge(bridgeName)
+		if err != nil {
+			return state, err
+		}
+		state.Actual = append(state.Actual, bridge)
+	}
+
+	plan, err := PlanReconcile(mc)
+	if err != nil {
+		return state, err
+	}
+	for _, line := range strings.Split(RenderReconcileDiff(plan), "\n") {
+		if line != "" {
+			state.Advisory = append(state.Advisory, line)
+		}
+	}
+
+	return state, nil
+}
+
+func inspectBridge(bridgeName string) (BridgeState, error) {
+	state := BridgeState{Name: bridgeName}
+	bridge, err := nlh.LinkByName(bridgeName)
+	if isLinkNotFound(err) {
+		return state, nil
+	} else if err != nil {
+		return state, errors.Wrapf(err, "looking up bridge %v", bridgeName)
+	}
+	state.Exists = true
+
+	addrs, err := nlh.AddrList(bridge, netlink.FAMILY_ALL)
+	if err != nil {
+		return state, errors.Wrapf(err, "listing addresses of %v", bridgeName)
+	}
+	for _, addr := range addrs {
+		if addr.IPNet != nil {
+			state.Addresses = append(state.Addresses, addr.IPNet.String())
+		}
+	}
+
+	routes, err := nlh.RouteList(bridge, netlink.FAMILY_ALL)
+	if err != nil {
+		return state, errors.Wrapf(err, "listing routes of %v", bridgeName)
+	}
+	for _, r := range routes {
+		if r.Dst != nil {
+			state.Routes = append(state.Routes, r.Dst.String())
+		}
+	}
+
+	return state, nil
+}
@@ -0,0 +1,282 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/testutil"
+	"github.com/vishvananda/netlink"
+)
+
+// newTestPlan returns a host where docker0 has a stale route, docker1
+// misses its address and route and docker2 doesn't exist
+func newTestPlan() (*testutil.FakeMetadataClient, *fakeNetlinkHandle) {
+	parse := func(s string) *net.IPNet {
+		ip, ipNet, _ := net.ParseCIDR(s)
+		ipNet.IP = ip
+		return ipNet
+	}
+	h := &fakeNetlinkHandle{
+		links: map[string]netlink.Link{
+			"docker0": &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "docker0", Index: 3}},
+			"docker1": &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "docker1", Index: 4}},
+		},
+		addrs: map[int][]netlink.Addr{
+			3: {{IPNet: parse("10.42.0.1/16")}},
+		},
+		routes: map[int][]netlink.Route{
+			3: {
+				{LinkIndex: 3, Dst: parse("10.42.0.0/16")},
+				{LinkIndex: 3, Dst: parse("10.99.0.0/16")},
+				{LinkIndex: 3, Dst: parse("169.254.169.250/32")},
+				{LinkIndex: 3, Dst: parse("fe80::/64")},
+			},
+		},
+	}
+
+	mc := &testutil.FakeMetadataClient{
+		Host:     metadata.Host{UUID: "host1", EnvironmentUUID: "env1"},
+		Services: testDriverServices(),
+		Networks: []metadata.Network{
+			testBridgeNetwork("net1", "env1", "docker0", "10.42.0.1/16"),
+			testBridgeNetwork("net2", "env1", "docker1", "10.43.0.1/16"),
+			testBridgeNetwork("net3", "env1", "docker2", "10.44.0.1/16"),
+		},
+	}
+	return mc, h
+}
+
+func TestPlanReconcile(t *testing.T) {
+	defer func(h NetlinkHandle) { nlh = h }(nlh)
+
+	mc, h := newTestPlan()
+	nlh = h
+
+	plan, err := PlanReconcile(mc)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	expected := "delete route 10.99.0.0/16 dev docker0\n" +
+		"add address 10.43.0.1/16 dev docker1\n" +
+		"add route 10.43.0.0/16 dev docker1\n" +
+		"create bridge docker2\n" +
+		"add address 10.44.0.1/16 dev docker2\n" +
+		"add route 10.44.0.0/16 dev docker2\n"
+	if plan.String() != expected {
+		t.Errorf("expected:\n%v\ngot actual:\n%v", expected, plan)
+	}
+	if len(h.deleted) != 0 {
+		t.Errorf("expected nothing to be changed, deleted: %v", h.deleted)
+	}
+}
+
+func TestGetNetworksState(t *testing.T) {
+	defer func(h NetlinkHandle) { nlh = h }(nlh)
+
+	mc, h := newTestPlan()
+	nlh = h
+
+	state, err := GetNetworksState(mc)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	if len(state.Desired) != 3 || state.Desired[1].Bridge != "docker1" || fmt.Sprint(state.Desired[1].Subnets) != "[10.43.0.1/16]" {
+		t.Errorf("expected the three local networks, got actual: %+v", state.Desired)
+	}
+	if len(state.Actual) != 3 || !state.Actual[0].Exists || fmt.Sprint(state.Actual[0].Addresses) != "[10.42.0.1/16]" ||
+		!state.Actual[1].Exists || len(state.Actual[1].Addresses) != 0 || state.Actual[2].Exists {
+		t.Errorf("expected docker0 and docker1 to exist, got actual: %+v", state.Actual)
+	}
+	expected := "[- route 10.99.0.0/16 via docker0 + address 10.43.0.1/16 dev docker1 + route 10.43.0.0/16 via docker1 " +
+		"+ bridge docker2 + address 10.44.0.1/16 dev docker2 + route 10.44.0.0/16 via docker2]"
+	if fmt.Sprint(state.Advisory) != expected {
+		t.Errorf("expected: %v, got actual: %v", expected, state.Advisory)
+	}
+	if len(state.Diff) != 0 {
+		t.Errorf("expected no changes applied by a sync, got actual: %v", state.Diff)
+	}
+}
+
+func TestPlanReconcileInvalidAddress(t *testing.T) {
+	defer func(h NetlinkHandle) { nlh = h }(nlh)
+	nlh = &fakeNetlinkHandle{}
+
+	mc := &testutil.FakeMetadataClient{
+		Host:     metadata.Host{UUID: "host1", EnvironmentUUID: "env1"},
+		Services: testDriverServices(),
+		Networks: []metadata.Network{testBridgeNetwork("net1", "env1", "docker0", "127.0.0.1/8")},
+	}
+	if _, err := PlanReconcile(mc); err == nil {
+		t.Errorf("expecting error for a loopback bridge address, but got nil")
+	}
+}
+
+func TestPlanReconcileInvalidBridgeName(t *testing.T) {
+	defer func(h NetlinkHandle) { nlh = h }(nlh)
+	nlh = &fakeNetlinkHandle{}
+
+	mc := &testutil.FakeMetadataClient{
+		Host:     metadata.Host{UUID: "host1", EnvironmentUUID: "env1"},
+		Services: testDriverServices(),
+		Networks: []metadata.Network{testBridgeNetwork("net1", "env1", "docker:0", "10.42.0.1/16")},
+	}
+	if _, err := PlanReconcile(mc); err == nil {
+		t.Errorf("expecting error for an invalid bridge name, but got nil")
+	}
+}
+
+func TestPlanReconcileBridgeNameTaken(t *testing.T) {
+	defer func(h NetlinkHandle) { nlh = h }(nlh)
+	nlh = &fakeNetlinkHandle{
+		links: map[string]netlink.Link{
+			"docker0": &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "docker0", Index: 3}},
+		},
+	}
+
+	mc := &testutil.FakeMetadataClient{
+		Host:     metadata.Host{UUID: "host1", EnvironmentUUID: "env1"},
+		Services: testDriverServices(),
+		Networks: []metadata.Network{testBridgeNetwork("net1", "env1", "docker0", "10.42.0.1/16")},
+	}
+	if _, err := PlanReconcile(mc); err == nil {
+		t.Errorf("expecting error for a bridge name taken by a veth, but got nil")
+	}
+}
+
+func TestRenderReconcileDiff(t *testing.T) {
+	defer func(h NetlinkHandle) { nlh = h }(nlh)
+
+	mc, h := newTestPlan()
+	nlh = h
+
+	plan, err := PlanReconcile(mc)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	// The actions PlanReconcile doesn't plan yet
+	plan.Actions = append(plan.Actions,
+		ReconcileEvent{Action: ActionDelAddress, Interface: "docker0", Object: "10.99.0.1/16"},
+		ReconcileEvent{Action: ActionAddNeighbor, Interface: "docker0", Object: "10.42.0.2 lladdr 02:42:0a:2a:00:02"},
+		ReconcileEvent{Action: ActionDelNeighbor, Interface: "docker0", Object: "10.42.0.9 lladdr 02:42:0a:2a:00:09"},
+		ReconcileEvent{Action: ActionSetMTU, Interface: "docker1", Object: "1450"},
+		ReconcileEvent{Action: ActionSetSTP, Interface: "docker1", Object: "false"},
+		ReconcileEvent{Action: ActionDelLink, Interface: "vethr1234", Object: "vethr1234"},
+	)
+
+	golden, err := ioutil.ReadFile(filepath.Join("testdata", "reconcile_diff.golden"))
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if actual := RenderReconcileDiff(plan); actual != string(golden) {
+		t.Errorf("expected:\n%v\ngot actual:\n%v", string(golden), actual)
+	}
+}
+
+func TestFindMissingManagedInterfaces(t *testing.T) {
+	defer func(h NetlinkHandle) { nlh = h }(nlh)
+
+	mc, h := newTestPlan()
+	nlh = h
+	mc.Services = testDriverServices(
+		metadata.Container{UUID: "r1", HostUUID: "host1", NetworkUUID: "net1"},
+		metadata.Container{UUID: "r3", HostUUID: "host1", NetworkUUID: "net3"},
+		metadata.Container{UUID: "r4", HostUUID: "host2", NetworkUUID: "net2"},
+	)
+	mc.Networks = append(mc.Networks, testBridgeNetwork("net4", "env1", "docker3", "10.45.0.1/16"))
+
+	missing, err := FindMissingManagedInterfaces(mc)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if expected := []string{"docker2"}; !reflect.DeepEqual(missing, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, missing)
+	}
+
+	// Only a missing link is reported as missing
+	nlh = &failingLinkHandle{fakeNetlinkHandle: h, err: syscall.EPERM}
+	if _, err := FindMissingManagedInterfaces(mc); errors.Cause(err) != syscall.EPERM {
+		t.Errorf("expected: %v, got actual: %v", syscall.EPERM, err)
+	}
+}
+
+// failingLinkHandle fails the link lookups with err
+type failingLinkHandle struct {
+	*fakeNetlinkHandle
+	err error
+}
+
+func (h *failingLinkHandle) LinkByName(name string) (netlink.Link, error) {
+	return nil, h.err
+}
+
+func TestPlanReconcileLookupError(t *testing.T) {
+	defer func(h NetlinkHandle) { nlh = h }(nlh)
+
+	mc, h := newTestPlan()
+	nlh = &failingLinkHandle{fakeNetlinkHandle: h, err: syscall.EPERM}
+
+	// Only a missing link is planned to be created
+	if _, err := PlanReconcile(mc); errors.Cause(err) != syscall.EPERM {
+		t.Errorf("expected: %v, got actual: %v", syscall.EPERM, err)
+	}
+	if _, err := GetNetworksState(mc); errors.Cause(err) != syscall.EPERM {
+		t.Errorf("expected: %v, got actual: %v", syscall.EPERM, err)
+	}
+}
+
+func TestPlanReconcileFamilyMismatch(t *testing.T) {
+	defer func(h NetlinkHandle) { nlh = h }(nlh)
+
+	mc, h := newTestPlan()
+	nlh = h
+	mc.Services = testDriverServices(metadata.Container{UUID: "r1", HostUUID: "host1", NetworkUUID: "net1", PrimaryIp: "fd00:42::2"})
+
+	_, err := PlanReconcile(mc)
+	if _, ok := errors.Cause(err).(*FamilyMismatchError); !ok {
+		t.Errorf("expected a FamilyMismatchError, got actual: %v", err)
+	}
+}
+
+func TestPlanReconcileDualStack(t *testing.T) {
+	defer func(h NetlinkHandle) { nlh = h }(nlh)
+
+	mc, h := newTestPlan()
+	nlh = h
+	dualStack := func(aNetwork metadata.Network, subnetV6 string) metadata.Network {
+		aNetwork.Metadata["cniConfig"].(map[string]interface{})["10-rancher.conf"].(map[string]interface{})["bridgeSubnetV6"] = subnetV6
+		return aNetwork
+	}
+	mc.Networks = []metadata.Network{
+		dualStack(testBridgeNetwork("net1", "env1", "docker0", "10.42.0.1/16"), "fd00:42::1/64"),
+		dualStack(testBridgeNetwork("net3", "env1", "docker2", "10.44.0.1/16"), "fd00:44::1/64"),
+	}
+
+	// The router is of the family of the second subnet
+	mc.Services = testDriverServices(metadata.Container{UUID: "r1", HostUUID: "host1", NetworkUUID: "net1", PrimaryIp: "fd00:42::2"})
+
+	plan, err := PlanReconcile(mc)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	expected := "add address fd00:42::1/64 dev docker0\n" +
+		"add route fd00:42::/64 dev docker0\n" +
+		"delete route 10.99.0.0/16 dev docker0\n" +
+		"create bridge docker2\n" +
+		"add address 10.44.0.1/16 dev docker2\n" +
+		"add route 10.44.0.0/16 dev docker2\n" +
+		"add address fd00:44::1/64 dev docker2\n" +
+		"add route fd00:44::/64 dev docker2\n"
+	if plan.String() != expected {
+		t.Errorf("expected:\n%v\ngot actual:\n%v", expected, plan)
+	}
+}
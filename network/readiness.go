@@ -0,0 +1,257 @@
+package network
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/metrics"
+	"github.com/rancher/plugin-manager/utils"
+)
+
+// NetworkTopology is the view of the host networking fetched from metadata,
+// Routers are the ones on this host keyed by network UUID while AllRouters
+// are the ones on all the hosts
+type NetworkTopology struct {
+	Host       metadata.Host
+	Networks   []metadata.Network
+	Routers    map[string]metadata.Container
+	AllRouters []metadata.Container
+}
+
+// FetchTopology returns the local networks of the host along with their
+// routers
+func FetchTopology(mc metadata.Client) (NetworkTopology, error) {
+	localNetworks, routers, err := LocalNetworks(mc)
+	if err != nil {
+		return NetworkTopology{}, err
+	}
+
+	host, err := mc.GetSelfHost()
+	if err != nil {
+		return NetworkTopology{}, errors.Wrap(err, "error fetching self host from metadata")
+	}
+
+	services, err := mc.GetServices()
+	if err != nil {
+		return NetworkTopology{}, errors.Wrap(err, "error fetching services from metadata")
+	}
+
+	allRouters, err := routerContainers(services)
+	if err != nil {
+		return NetworkTopology{}, err
+	}
+
+	return NetworkTopology{
+		Host:       host,
+		Networks:   localNetworks,
+		Routers:    routers,
+		AllRouters: allRouters,
+	}, nil
+}
+
+// HostsAffectedByChange returns the UUIDs of the hosts whose connectivity
+// changed between both topologies: the hosts where a router was added or
+// removed, or changed its IP address.
+func HostsAffectedByChange(prev, curr NetworkTopology) ([]string, error) {
+	byUUID := func(routers []metadata.Container) (map[string]metadata.Container, error) {
+		m := map[string]metadata.Container{}
+		for _, r := range routers {
+			if r.HostUUID == "" {
+				return nil, fmt.Errorf("router %v isn't on any host", r.UUID)
+			}
+			m[r.UUID] = r
+		}
+		return m, nil
+	}
+
+	prevRouters, err := byUUID(prev.AllRouters)
+	if err != nil {
+		return nil, err
+	}
+	currRouters, err := byUUID(curr.AllRouters)
+	if err != nil {
+		return nil, err
+	}
+
+	affected := map[string]bool{}
+	for uuid, r := range prevRouters {
+		if c, ok := currRouters[uuid]; !ok || c.PrimaryIp != r.PrimaryIp || c.HostUUID != r.HostUUID {
+			affected[r.HostUUID] = true
+		}
+	}
+	for uuid, r := range currRouters {
+		if p, ok := prevRouters[uuid]; !ok || p.PrimaryIp != r.PrimaryIp || p.HostUUID != r.HostUUID {
+			affected[r.HostUUID] = true
+		}
+	}
+
+	hosts := []string{}
+	for host := range affected {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
+
+// networkInfoLabels returns the labels of the info series of the local
+// networks of the topology, one per subnet of the bridge
+func networkInfoLabels(topology NetworkTopology) []map[string]string {
+	series := []map[string]string{}
+	for _, aNetwork := range topology.Networks {
+		bridge, subnets := utils.GetBridgeSubnets(aNetwork, topology.Host)
+		if len(subnets) == 0 {
+			subnets = []string{""}
+		}
+		for _, subnet := range subnets {
+			series = append(series, map[string]string{
+				"network_uuid": aNetwork.UUID,
+				"bridge":       bridge,
+				"subnet":       subnet,
+				"router_host":  topology.Routers[aNetwork.UUID].HostUUID,
+			})
+		}
+	}
+	return series
+}
+
+// ExportTopologyMetrics sets the info series of each of the local networks
+// of curr on the given collector, the series of prev that curr doesn't
+// have anymore are deleted
+func ExportTopologyMetrics(prev, curr NetworkTopology, collector metrics.Collector) {
+	currLabels := networkInfoLabels(curr)
+	exported := map[string]bool{}
+	for _, labels := range currLabels {
+		exported[metrics.Series(metrics.NetworkInfo, labels)] = true
+	}
+	for _, labels := range networkInfoLabels(prev) {
+		if !exported[metrics.Series(metrics.NetworkInfo, labels)] {
+			collector.DeleteLabeledGauge(metrics.NetworkInfo, labels)
+		}
+	}
+	for _, labels := range currLabels {
+		collector.SetLabeledGauge(metrics.NetworkInfo, labels, 1)
+	}
+}
+
+// readinessWorkers is the number of networks reconciled in parallel by
+// WatchReadiness
+var readinessWorkers = 4
+
+// readinessBackoffMin and readinessBackoffMax bound how long WatchReadiness
+// waits before reconciling again a network which failed
+var (
+	readinessBackoffMin = 5 * time.Second
+	readinessBackoffMax = 5 * time.Minute
+)
+
+// WatchReadiness reconciles the local networks with BridgeReconciler each
+// time metadata changes, the state becomes ready once all the bridges
+// are set up. The syncs are recorded as the bridges module and the info
+// series of the networks are exported after each successful one. A
+// network which keeps failing is retried less and less often. The networks
+// whose bridge isn't set up yet are only logged at debug level.
+func WatchReadiness(mc metadata.Client, state *ReadinessState) {
+	go mc.OnChange(5, func(string) { state.reconcileOnChange(mc) })
+}
+
+// reconcileOnChange reconciles the local networks with TryReconcile, the
+// change is skipped if another reconcile is still running
+func (r *ReadinessState) reconcileOnChange(mc metadata.Client) {
+	err := TryReconcile(func() error {
+		started := time.Now()
+		// The links are looked up once per pass, the networks sharing a
+		// bridge don't look it up again
+		cache := NewCachedNetlinkHandle(nlh)
+		prev, _ := r.Snapshot()
+		reconciler := r.failureBackoff().Reconciler(BridgeReconciler(cache))
+		_, err := r.ReconcileHost(mc, reconciler, readinessWorkers, nil)
+		if IsNotReady(err) {
+			logrus.Debugf("network: the local networks aren't ready: %v", err)
+		} else if err != nil {
+			logrus.Errorf("network: error reconciling the local networks: %v", err)
+		} else {
+			curr, _ := r.Snapshot()
+			ExportTopologyMetrics(prev, curr, metrics.RegisteredCollector())
+		}
+		metrics.RecordSync("bridges", started, err)
+		return err
+	})
+	if err == ErrReconcileBusy {
+		logrus.Debugf("network: skipping the reconcile of the local networks: %v", err)
+	}
+}
+
+// ReadinessState tracks if the host networking has been reconciled
+// successfully at least once. The zero value is ready to use.
+type ReadinessState struct {
+	mu       sync.RWMutex
+	ready    bool
+	snapshot NetworkTopology
+	backoff  *FailureBackoff
+}
+
+// failureBackoff returns the backoff of the networks failing to reconcile
+// on changes, creating it on first use
+func (r *ReadinessState) failureBackoff() *FailureBackoff {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.backoff == nil {
+		r.backoff = NewFailureBackoff(readinessBackoffMin, readinessBackoffMax)
+	}
+	return r.backoff
+}
+
+// ReconcileHost fetches the topology and reconciles all the local networks
+// with the given reconciler using ReconcileNetworksConcurrent, reporting to
+// progress if not nil. On success the state becomes ready and the topology
+// is kept as the last successful one.
+func (r *ReadinessState) ReconcileHost(mc metadata.Client, reconciler Reconciler, workers int, progress ProgressFunc) ([]ReconcileResult, error) {
+	topology, err := FetchTopology(mc)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []LocalNetworkInfo{}
+	for _, aNetwork := range topology.Networks {
+		bridge, subnets := utils.GetBridgeSubnets(aNetwork, topology.Host)
+		infos = append(infos, LocalNetworkInfo{
+			Network:     aNetwork,
+			Router:      topology.Routers[aNetwork.UUID],
+			Bridge:      bridge,
+			Subnets:     subnets,
+			VxlanDevice: utils.GetBridgeInfoForType(aNetwork, topology.Host, "rancher-bridge").VxlanDevice,
+		})
+	}
+
+	results, err := ReconcileNetworksConcurrent(infos, reconciler, workers, progress)
+	if err != nil {
+		return results, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ready = true
+	r.snapshot = topology
+	return results, nil
+}
+
+// IsReady returns true once ReconcileHost succeeded, it stays true even
+// if later runs fail
+func (r *ReadinessState) IsReady() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ready
+}
+
+// Snapshot returns the topology of the last successful ReconcileHost,
+// the returned bool is false if there wasn't one yet
+func (r *ReadinessState) Snapshot() (NetworkTopology, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.snapshot, r.ready
+}
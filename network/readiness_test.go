@@ -0,0 +1,255 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/metrics"
+	"github.com/rancher/plugin-manager/metrics/metricstest"
+	"github.com/rancher/plugin-manager/testutil"
+	"github.com/vishvananda/netlink"
+)
+
+func TestReadinessState(t *testing.T) {
+	mc := &testutil.FakeMetadataClient{
+		Host:        metadata.Host{UUID: "host1", EnvironmentUUID: "env1"},
+		Services:    testDriverServices(),
+		Networks:    []metadata.Network{testBridgeNetwork("net1", "env1", "docker0", "10.42.0.0/16")},
+		NetworksErr: fmt.Errorf("metadata not reachable"),
+	}
+
+	var reconcileErr error
+	reconciled := []LocalNetworkInfo{}
+	reconciler := func(info LocalNetworkInfo) (metrics.ManagedResources, error) {
+		reconciled = append(reconciled, info)
+		return metrics.ManagedResources{}, reconcileErr
+	}
+
+	r := &ReadinessState{}
+	if _, ok := r.Snapshot(); ok || r.IsReady() {
+		t.Errorf("expected not to be ready before any reconcile")
+	}
+
+	if _, err := r.ReconcileHost(mc, reconciler, 1, nil); err == nil {
+		t.Errorf("expecting error when fetching the topology fails, but got nil")
+	}
+	if r.IsReady() {
+		t.Errorf("expected not to be ready after the topology fetch failed")
+	}
+
+	mc.NetworksErr = nil
+	reconcileErr = fmt.Errorf("bridge not created")
+	if _, err := r.ReconcileHost(mc, reconciler, 1, nil); err == nil {
+		t.Errorf("expecting error when the reconcile fails, but got nil")
+	}
+	if r.IsReady() {
+		t.Errorf("expected not to be ready after the reconcile failed")
+	}
+
+	reconcileErr = nil
+	if _, err := r.ReconcileHost(mc, reconciler, 1, nil); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if !r.IsReady() {
+		t.Errorf("expected to be ready after a successful reconcile")
+	}
+	if len(reconciled) != 2 || reconciled[1].Bridge != "docker0" {
+		t.Errorf("expected docker0 to be reconciled twice, got actual: %+v", reconciled)
+	}
+
+	snapshot, ok := r.Snapshot()
+	if !ok || len(snapshot.Networks) != 1 || snapshot.Networks[0].UUID != "net1" || snapshot.Host.UUID != "host1" {
+		t.Errorf("expected snapshot of net1 on host1, got actual: %+v", snapshot)
+	}
+
+	mc.NetworksErr = fmt.Errorf("metadata not reachable")
+	r.ReconcileHost(mc, reconciler, 1, nil)
+	if !r.IsReady() {
+		t.Errorf("expected to stay ready after a later failure")
+	}
+}
+
+func TestWatchReadiness(t *testing.T) {
+	defer func(h NetlinkHandle) { nlh = h }(nlh)
+	defer metrics.RegisterCollector(nil)
+
+	fake := metricstest.NewFakeCollector()
+	metrics.RegisterCollector(fake)
+
+	// docker1 doesn't have its address and docker2 doesn't exist yet
+	mc, h := newTestPlan()
+	nlh = h
+
+	r := &ReadinessState{}
+	r.reconcileOnChange(mc)
+	if r.IsReady() {
+		t.Errorf("expected not to be ready before all the bridges are set up")
+	}
+	if metrics.Health()["bridges"].LastFailure == nil {
+		t.Errorf("expected the failure of the bridges to be recorded, got actual: %+v", metrics.Health()["bridges"])
+	}
+
+	parse := func(s string) *net.IPNet {
+		ip, ipNet, _ := net.ParseCIDR(s)
+		ipNet.IP = ip
+		return ipNet
+	}
+	h.links["docker2"] = &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "docker2", Index: 5}}
+	h.addrs[4] = []netlink.Addr{{IPNet: parse("10.43.0.1/16")}}
+	h.addrs[5] = []netlink.Addr{{IPNet: parse("10.44.0.1/16")}}
+
+	// A change while another reconcile runs is skipped
+	release := make(chan struct{})
+	running := make(chan struct{})
+	go TryReconcile(func() error {
+		close(running)
+		<-release
+		return nil
+	})
+	<-running
+	r.reconcileOnChange(mc)
+	close(release)
+	if r.IsReady() {
+		t.Errorf("expected the change to be skipped while another reconcile runs")
+	}
+
+	// Wait for the lock to be released
+	for TryReconcile(func() error { return nil }) == ErrReconcileBusy {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The networks which failed aren't retried until their backoff is over
+	r.reconcileOnChange(mc)
+	if r.IsReady() {
+		t.Errorf("expected the failed networks to back off")
+	}
+	if !strings.Contains(metrics.Health()["bridges"].LastError, "backing off") {
+		t.Errorf("expected the networks backing off to fail, got actual: %+v", metrics.Health()["bridges"])
+	}
+
+	r.backoff.now = func() time.Time { return time.Now().Add(readinessBackoffMin) }
+	r.reconcileOnChange(mc)
+	if !r.IsReady() {
+		t.Errorf("expected to be ready once all the bridges are set up")
+	}
+	if fake.Gauge(metrics.ManagedBridges) != 3 || fake.Gauge(metrics.ManagedAddresses) != 3 || fake.Gauge(metrics.ManagedRoutes) != 1 {
+		t.Errorf("expected the resources of the three bridges, got actual: %v", fake.Gauges)
+	}
+}
+
+func TestHostsAffectedByChange(t *testing.T) {
+	router := func(uuid, hostUUID, ip string) metadata.Container {
+		return metadata.Container{UUID: uuid, HostUUID: hostUUID, PrimaryIp: ip, NetworkUUID: "net1"}
+	}
+	prev := NetworkTopology{AllRouters: []metadata.Container{
+		router("r1", "host1", "10.42.0.2"),
+		router("r2", "host2", "10.42.0.3"),
+		router("r3", "host3", "10.42.0.4"),
+	}}
+	curr := NetworkTopology{AllRouters: []metadata.Container{
+		router("r1", "host1", "10.42.0.2"),
+		router("r2", "host2", "10.42.0.9"),
+		router("r4", "host4", "10.42.0.5"),
+	}}
+
+	hosts, err := HostsAffectedByChange(prev, curr)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if expected := []string{"host2", "host3", "host4"}; !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, hosts)
+	}
+
+	if hosts, err := HostsAffectedByChange(curr, curr); err != nil || len(hosts) != 0 {
+		t.Errorf("expected no affected hosts, got actual: %v, %v", hosts, err)
+	}
+
+	curr.AllRouters = append(curr.AllRouters, router("r5", "", "10.42.0.6"))
+	if _, err := HostsAffectedByChange(prev, curr); err == nil {
+		t.Errorf("expecting error for a router without host, but got nil")
+	}
+}
+
+func TestFetchTopology(t *testing.T) {
+	mc := &testutil.FakeMetadataClient{
+		Host:     metadata.Host{UUID: "host1", EnvironmentUUID: "env1"},
+		Networks: []metadata.Network{testBridgeNetwork("net1", "env1", "docker0", "10.42.0.1/16")},
+		Services: []metadata.Service{{
+			Name:               "cni-driver",
+			PrimaryServiceName: "cni-driver",
+			Kind:               "networkDriverService",
+			Containers: []metadata.Container{
+				{UUID: "r1", HostUUID: "host1", NetworkUUID: "net1"},
+				{UUID: "r2", HostUUID: "host2", NetworkUUID: "net1"},
+			},
+		}},
+	}
+
+	topology, err := FetchTopology(mc)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if topology.Routers["net1"].UUID != "r1" || len(topology.AllRouters) != 2 {
+		t.Errorf("expected local router r1 out of 2, got actual: %+v", topology)
+	}
+}
+
+func TestExportTopologyMetrics(t *testing.T) {
+	dualStack := testBridgeNetwork("net1", "env1", "docker0", "10.42.0.1/16")
+	dualStack.Metadata["cniConfig"].(map[string]interface{})["10-rancher.conf"].(map[string]interface{})["bridgeSubnetV6"] = "fd00:42::1/64"
+	topology := NetworkTopology{
+		Host: metadata.Host{UUID: "host1"},
+		Networks: []metadata.Network{
+			dualStack,
+			testBridgeNetwork("net2", "env1", "docker1", "10.43.0.1/16"),
+		},
+		Routers: map[string]metadata.Container{"net1": {UUID: "r1", HostUUID: "host1"}},
+	}
+
+	fake := metricstest.NewFakeCollector()
+	ExportTopologyMetrics(NetworkTopology{}, topology, fake)
+
+	net1 := func(subnet, routerHost string) map[string]string {
+		return map[string]string{"network_uuid": "net1", "bridge": "docker0", "subnet": subnet, "router_host": routerHost}
+	}
+	net2 := map[string]string{"network_uuid": "net2", "bridge": "docker1", "subnet": "10.43.0.1/16", "router_host": ""}
+	expected := []metricstest.LabeledGauge{
+		{Name: metrics.NetworkInfo, Value: 1, Labels: net1("10.42.0.1/16", "host1")},
+		{Name: metrics.NetworkInfo, Value: 1, Labels: net1("fd00:42::1/64", "host1")},
+		{Name: metrics.NetworkInfo, Value: 1, Labels: net2},
+	}
+	if !reflect.DeepEqual(fake.LabeledGauges, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, fake.LabeledGauges)
+	}
+	if len(fake.DeletedGauges) != 0 {
+		t.Errorf("expected no deleted series, got actual: %v", fake.DeletedGauges)
+	}
+
+	// net2 is gone and the router of net1 moved to another host
+	curr := topology
+	curr.Networks = topology.Networks[:1]
+	curr.Routers = map[string]metadata.Container{"net1": {UUID: "r2", HostUUID: "host2"}}
+	fake = metricstest.NewFakeCollector()
+	ExportTopologyMetrics(topology, curr, fake)
+
+	expected = []metricstest.LabeledGauge{
+		{Name: metrics.NetworkInfo, Labels: net1("10.42.0.1/16", "host1")},
+		{Name: metrics.NetworkInfo, Labels: net1("fd00:42::1/64", "host1")},
+		{Name: metrics.NetworkInfo, Labels: net2},
+	}
+	if !reflect.DeepEqual(fake.DeletedGauges, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, fake.DeletedGauges)
+	}
+	expected = []metricstest.LabeledGauge{
+		{Name: metrics.NetworkInfo, Value: 1, Labels: net1("10.42.0.1/16", "host2")},
+		{Name: metrics.NetworkInfo, Value: 1, Labels: net1("fd00:42::1/64", "host2")},
+	}
+	if !reflect.DeepEqual(fake.LabeledGauges, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, fake.LabeledGauges)
+	}
+}
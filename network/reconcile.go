@@ -0,0 +1,296 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/locker"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/metrics"
+	"github.com/rancher/plugin-manager/utils"
+	"github.com/vishvananda/netlink"
+)
+
+// LocalNetworkInfo holds what's needed to reconcile a local network
+type LocalNetworkInfo struct {
+	Network metadata.Network
+	Router  metadata.Container
+	Bridge  string
+	// Subnets are the addresses of the bridge, with the prefix length
+	// of the subnet, e.g. 10.42.0.1/16
+	Subnets []string
+	// VxlanDevice is the vxlan device of an overlay network, the MTU of
+	// the bridge is set for the packets to fit in it
+	VxlanDevice string
+}
+
+// ReconcileResult is the outcome of reconciling a single network
+type ReconcileResult struct {
+	NetworkUUID string
+	Resources   metrics.ManagedResources
+	Err         error
+}
+
+// Reconciler brings the host networking of a single network to
+// the desired state, it returns the resources managed for the network
+type Reconciler func(info LocalNetworkInfo) (metrics.ManagedResources, error)
+
+// ProgressFunc is called each time a network is done reconciling, current
+// is the number of networks done so far out of total
+type ProgressFunc func(current, total int, networkUUID string)
+
+// interfaceLocks serializes the reconciles of networks sharing a bridge,
+// so the netlink operations on it don't race
+var interfaceLocks = locker.New()
+
+// reconcileRunning holds a token while a reconcile runs, it's used as a
+// mutex which can be tried without blocking
+var reconcileRunning = make(chan struct{}, 1)
+
+// ErrReconcileBusy is returned by TryReconcile when a reconcile is
+// already in progress
+var ErrReconcileBusy = errors.New("a reconcile is already in progress")
+
+// TryReconcile runs the given reconcile unless another one started with
+// TryReconcile is still running, in which case it returns ErrReconcileBusy
+// right away instead of waiting.
+func TryReconcile(reconcile func() error) error {
+	select {
+	case reconcileRunning <- struct{}{}:
+	default:
+		return ErrReconcileBusy
+	}
+	defer func() { <-reconcileRunning }()
+	return reconcile()
+}
+
+// ReconcileNetworksConcurrent reconciles the given networks using the
+// given reconciler, with up to workers networks in parallel. The results
+// are in the same order as the networks. A network failing doesn't stop
+// the others, the cause of the returned error is a NetworkErrors listing
+// all the networks which failed. The gauges of the managed resources are
+// updated with the totals of the networks which didn't fail. If progress
+// isn't nil it's called once per network, one call at a time, as the
+// networks complete.
+func ReconcileNetworksConcurrent(networks []LocalNetworkInfo, reconciler Reconciler, workers int, progress ProgressFunc) ([]ReconcileResult, error) {
+	if reconciler == nil {
+		return nil, fmt.Errorf("no network reconciler given")
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(networks) {
+		workers = len(networks)
+	}
+
+	results := make([]ReconcileResult, len(networks))
+	indexes := make(chan int)
+
+	var progressLock sync.Mutex
+	done := 0
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				results[idx] = reconcileNetwork(networks[idx], reconciler)
+				if progress != nil {
+					progressLock.Lock()
+					done++
+					progress(done, len(networks), networks[idx].Network.UUID)
+					progressLock.Unlock()
+				}
+			}
+		}()
+	}
+
+	for idx := range networks {
+		indexes <- idx
+	}
+	close(indexes)
+	wg.Wait()
+
+	failed := NetworkErrors{}
+	total := metrics.ManagedResources{}
+	for _, r := range results {
+		if r.Err != nil {
+			failed[r.NetworkUUID] = r.Err
+			continue
+		}
+		total = total.Add(r.Resources)
+	}
+	metrics.UpdateManagedResources(total)
+
+	if len(failed) > 0 {
+		return results, errors.Wrapf(failed, "%v of %v networks failed to reconcile", len(failed), len(networks))
+	}
+
+	return results, nil
+}
+
+// NetworkErrors holds the errors of the networks which failed to
+// reconcile, keyed by the network UUID
+type NetworkErrors map[string]error
+
+func (e NetworkErrors) Error() string {
+	uuids := []string{}
+	for uuid := range e {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	msgs := []string{}
+	for _, uuid := range uuids {
+		msgs = append(msgs, fmt.Sprintf("network %v: %v", uuid, e[uuid]))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func reconcileNetwork(info LocalNetworkInfo, reconciler Reconciler) ReconcileResult {
+	if info.Bridge != "" {
+		interfaceLocks.Lock(info.Bridge)
+		defer interfaceLocks.Unlock(info.Bridge)
+	}
+
+	resources, err := reconciler(info)
+	if IsNotReady(err) {
+		logrus.Debugf("network %v isn't ready: %v", info.Network.UUID, err)
+	} else if err != nil {
+		logrus.Errorf("error reconciling network %v: %v", info.Network.UUID, err)
+	}
+	return ReconcileResult{NetworkUUID: info.Network.UUID, Resources: resources, Err: err}
+}
+
+// BridgeNotReadyError is returned by BridgeReconciler while the CNI
+// plugin hasn't set up the bridge of the network or its addresses, which
+// it does when the first container of the network starts
+type BridgeNotReadyError struct {
+	Bridge string
+	Reason string
+}
+
+func (e *BridgeNotReadyError) Error() string {
+	return fmt.Sprintf("bridge %v %v", e.Bridge, e.Reason)
+}
+
+// IsNotReady checks if the error of a reconcile only tells that networks
+// aren't set up yet or are backing off, not that a reconcile failed
+func IsNotReady(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case *BridgeNotReadyError, *BackoffError:
+		return true
+	case NetworkErrors:
+		for _, networkErr := range e {
+			if !IsNotReady(networkErr) {
+				return false
+			}
+		}
+		return len(e) > 0
+	}
+	return false
+}
+
+// BridgeReconciler returns the Reconciler of the local networks, looking
+// up the bridges with h. The bridges, their addresses and subnet routes
+// are set up by the CNI plugin when the first container of the network
+// starts, so they aren't changed: it fails with a BridgeNotReadyError
+// until the bridge of the network has all its addresses, and returns the
+// resources found on the bridge. Only the MTU of the bridge of an overlay
+// network is set, with ReconcileBridgeMTUForOverlay. A network without
+// bridge has nothing to reconcile. It's an error if the router IP isn't
+// of the family of any of the bridge subnets.
+func BridgeReconciler(h NetlinkHandle) Reconciler {
+	return func(info LocalNetworkInfo) (metrics.ManagedResources, error) {
+		return reconcileBridge(h, info)
+	}
+}
+
+func reconcileBridge(h NetlinkHandle, info LocalNetworkInfo) (metrics.ManagedResources, error) {
+	resources := metrics.ManagedResources{}
+	if info.Bridge == "" {
+		return resources, nil
+	}
+
+	if err := utils.ValidateInterfaceName(info.Bridge); err != nil {
+		return resources, err
+	}
+	bridge, isBridge, err := lookupBridgeInterface(h, info.Bridge)
+	if isLinkNotFound(err) {
+		return resources, &BridgeNotReadyError{Bridge: info.Bridge, Reason: "doesn't exist yet"}
+	} else if err != nil {
+		return resources, errors.Wrapf(err, "looking up bridge %v", info.Bridge)
+	}
+	if !isBridge {
+		return resources, fmt.Errorf("bridge name %v is taken by a %v device", info.Bridge, bridge.Type())
+	}
+	resources.Bridges = 1
+
+	if info.VxlanDevice != "" {
+		if err := reconcileBridgeMTU(h, bridge, info.VxlanDevice); err != nil {
+			return resources, errors.Wrapf(err, "setting MTU of %v", info.Bridge)
+		}
+	}
+
+	addrs, err := h.AddrList(bridge, netlink.FAMILY_ALL)
+	if err != nil {
+		return resources, errors.Wrapf(err, "listing addresses of %v", info.Bridge)
+	}
+	hasAddress := map[string]bool{}
+	for _, addr := range addrs {
+		if addr.IPNet != nil {
+			hasAddress[addr.IPNet.String()] = true
+		}
+	}
+
+	routes, err := h.RouteList(bridge, netlink.FAMILY_ALL)
+	if err != nil {
+		return resources, errors.Wrapf(err, "listing routes of %v", info.Bridge)
+	}
+	hasRoute := map[string]bool{}
+	for _, r := range routes {
+		if r.Dst != nil {
+			hasRoute[r.Dst.String()] = true
+		}
+	}
+
+	if info.Router.PrimaryIp != "" {
+		if err := validateRouterFamily(info.Subnets, info.Router.PrimaryIp); err != nil {
+			return resources, err
+		}
+	}
+	for _, bridgeSubnet := range info.Subnets {
+		ip, subnet, err := net.ParseCIDR(bridgeSubnet)
+		if err != nil {
+			return resources, err
+		}
+		address := &net.IPNet{IP: ip, Mask: subnet.Mask}
+		if err := ValidateBridgeAddress(address); err != nil {
+			return resources, err
+		}
+		if !hasAddress[address.String()] {
+			return resources, &BridgeNotReadyError{Bridge: info.Bridge, Reason: fmt.Sprintf("doesn't have its address %v yet", address)}
+		}
+		resources.Addresses++
+		if hasRoute[subnet.String()] {
+			resources.Routes++
+		}
+	}
+
+	neighs, err := h.NeighList(bridge.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		return resources, errors.Wrapf(err, "listing neighbors of %v", info.Bridge)
+	}
+	for _, n := range neighs {
+		if n.State&netlink.NUD_PERMANENT != 0 {
+			resources.Neighbors++
+		}
+	}
+
+	return resources, nil
+}
@@ -0,0 +1,313 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/metrics"
+	"github.com/rancher/plugin-manager/metrics/metricstest"
+	"github.com/vishvananda/netlink"
+)
+
+// fakeReconciler records how many reconciles run in parallel, overall
+// and per bridge, and fails the networks listed in failures
+type fakeReconciler struct {
+	sync.Mutex
+	running       int
+	maxRunning    int
+	perBridge     map[string]int
+	bridgeOverlap bool
+	failures      map[string]bool
+}
+
+func (f *fakeReconciler) reconcile(info LocalNetworkInfo) (metrics.ManagedResources, error) {
+	f.Lock()
+	f.running++
+	if f.running > f.maxRunning {
+		f.maxRunning = f.running
+	}
+	f.perBridge[info.Bridge]++
+	if f.perBridge[info.Bridge] > 1 {
+		f.bridgeOverlap = true
+	}
+	f.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	f.Lock()
+	f.running--
+	f.perBridge[info.Bridge]--
+	f.Unlock()
+
+	if f.failures[info.Network.UUID] {
+		// Only what was found before failing
+		return metrics.ManagedResources{Bridges: 1}, fmt.Errorf("failed %v", info.Network.UUID)
+	}
+	return metrics.ManagedResources{Bridges: 1, Addresses: 1, Routes: 2, Neighbors: 3}, nil
+}
+
+func testNetworkInfos(count int, bridge func(i int) string) []LocalNetworkInfo {
+	infos := []LocalNetworkInfo{}
+	for i := 0; i < count; i++ {
+		infos = append(infos, LocalNetworkInfo{
+			Network: metadata.Network{UUID: fmt.Sprintf("net%v", i)},
+			Bridge:  bridge(i),
+		})
+	}
+	return infos
+}
+
+func TestReconcileNetworksConcurrent(t *testing.T) {
+	for _, workers := range []int{0, 1, 3, 20} {
+		f := &fakeReconciler{perBridge: map[string]int{}, failures: map[string]bool{"net4": true}}
+		infos := testNetworkInfos(8, func(i int) string { return fmt.Sprintf("br%v", i) })
+		results, err := ReconcileNetworksConcurrent(infos, f.reconcile, workers, nil)
+		if err == nil {
+			t.Errorf("workers %v: expecting error, but got nil", workers)
+		}
+		if len(results) != len(infos) {
+			t.Fatalf("workers %v: expected: %v, got actual: %v", workers, len(infos), len(results))
+		}
+		for i, r := range results {
+			if r.NetworkUUID != infos[i].Network.UUID {
+				t.Errorf("workers %v: expected: %v, got actual: %v", workers, infos[i].Network.UUID, r.NetworkUUID)
+			}
+			if (r.Err != nil) != (r.NetworkUUID == "net4") {
+				t.Errorf("workers %v: unexpected result for %v: %v", workers, r.NetworkUUID, r.Err)
+			}
+		}
+
+		expectedMax := workers
+		if expectedMax < 1 {
+			expectedMax = 1
+		}
+		if expectedMax > len(infos) {
+			expectedMax = len(infos)
+		}
+		if f.maxRunning > expectedMax {
+			t.Errorf("workers %v: expected at most %v in parallel, got actual: %v", workers, expectedMax, f.maxRunning)
+		}
+	}
+}
+
+func TestReconcileNetworksConcurrentSharedBridge(t *testing.T) {
+	f := &fakeReconciler{perBridge: map[string]int{}}
+	infos := testNetworkInfos(6, func(i int) string { return fmt.Sprintf("br%v", i%2) })
+	if _, err := ReconcileNetworksConcurrent(infos, f.reconcile, 6, nil); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if f.bridgeOverlap {
+		t.Errorf("expected the networks sharing a bridge to be reconciled one at a time")
+	}
+}
+
+func TestReconcileNetworksConcurrentNoReconciler(t *testing.T) {
+	if _, err := ReconcileNetworksConcurrent(testNetworkInfos(1, func(int) string { return "" }), nil, 1, nil); err == nil {
+		t.Errorf("expecting error, but got nil")
+	}
+}
+
+func TestReconcileNetworksConcurrentMetrics(t *testing.T) {
+	defer metrics.RegisterCollector(nil)
+
+	fake := metricstest.NewFakeCollector()
+	metrics.RegisterCollector(fake)
+
+	f := &fakeReconciler{perBridge: map[string]int{}, failures: map[string]bool{"net2": true}}
+	infos := testNetworkInfos(3, func(i int) string { return fmt.Sprintf("br%v", i) })
+	ReconcileNetworksConcurrent(infos, f.reconcile, 2, nil)
+
+	expected := map[string]float64{
+		metrics.ManagedBridges:   2,
+		metrics.ManagedAddresses: 2,
+		metrics.ManagedRoutes:    4,
+		metrics.ManagedNeighbors: 6,
+	}
+	if !reflect.DeepEqual(fake.Gauges, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, fake.Gauges)
+	}
+}
+
+func TestReconcileNetworksConcurrentErrorIsolation(t *testing.T) {
+	f := &fakeReconciler{perBridge: map[string]int{}, failures: map[string]bool{"net1": true}}
+	reconciled := map[string]bool{}
+	var lock sync.Mutex
+	reconciler := func(info LocalNetworkInfo) (metrics.ManagedResources, error) {
+		lock.Lock()
+		reconciled[info.Network.UUID] = true
+		lock.Unlock()
+		return f.reconcile(info)
+	}
+
+	infos := testNetworkInfos(3, func(i int) string { return fmt.Sprintf("br%v", i) })
+	results, err := ReconcileNetworksConcurrent(infos, reconciler, 1, nil)
+	if err == nil {
+		t.Fatalf("expecting error, but got nil")
+	}
+
+	failed, ok := errors.Cause(err).(NetworkErrors)
+	if !ok {
+		t.Fatalf("expected NetworkErrors, got actual: %T", errors.Cause(err))
+	}
+	if len(failed) != 1 || failed["net1"] == nil {
+		t.Errorf("expected only net1 to fail, got actual: %v", failed)
+	}
+	expectedMsg := "1 of 3 networks failed to reconcile: network net1: failed net1"
+	if err.Error() != expectedMsg {
+		t.Errorf("expected: %v, got actual: %v", expectedMsg, err)
+	}
+
+	for _, uuid := range []string{"net0", "net2"} {
+		if !reconciled[uuid] {
+			t.Errorf("expected %v to be reconciled despite net1 failing", uuid)
+		}
+	}
+	if results[0].Err != nil || results[1].Err == nil || results[2].Err != nil {
+		t.Errorf("unexpected results: %+v", results)
+	}
+}
+
+func TestReconcileNetworksConcurrentProgress(t *testing.T) {
+	f := &fakeReconciler{perBridge: map[string]int{}, failures: map[string]bool{"net2": true}}
+	counts := []int{}
+	reported := map[string]int{}
+	progress := func(current, total int, networkUUID string) {
+		if total != 5 {
+			t.Errorf("expected: 5, got actual: %v", total)
+		}
+		counts = append(counts, current)
+		reported[networkUUID]++
+	}
+
+	infos := testNetworkInfos(5, func(i int) string { return fmt.Sprintf("br%v", i) })
+	ReconcileNetworksConcurrent(infos, f.reconcile, 3, progress)
+
+	if expected := []int{1, 2, 3, 4, 5}; !reflect.DeepEqual(counts, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, counts)
+	}
+	for _, info := range infos {
+		if reported[info.Network.UUID] != 1 {
+			t.Errorf("expected %v to be reported once, got actual: %v", info.Network.UUID, reported[info.Network.UUID])
+		}
+	}
+}
+
+func TestTryReconcile(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- TryReconcile(func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	ran := false
+	if err := TryReconcile(func() error { ran = true; return nil }); err != ErrReconcileBusy {
+		t.Errorf("expected: %v, got actual: %v", ErrReconcileBusy, err)
+	}
+	if ran {
+		t.Errorf("expected the second reconcile not to run")
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	expectedErr := fmt.Errorf("failed")
+	if err := TryReconcile(func() error { return expectedErr }); err != expectedErr {
+		t.Errorf("expected: %v, got actual: %v", expectedErr, err)
+	}
+	if err := TryReconcile(func() error { return nil }); err != nil {
+		t.Errorf("expected the lock to be released after a failure, got actual: %v", err)
+	}
+}
+
+func TestBridgeReconciler(t *testing.T) {
+	_, h := newTestPlan()
+	h.neighs = map[int][]netlink.Neigh{3: {
+		{LinkIndex: 3, IP: net.ParseIP("10.42.0.5"), State: netlink.NUD_PERMANENT},
+		{LinkIndex: 3, IP: net.ParseIP("10.42.0.6"), State: netlink.NUD_REACHABLE},
+	}}
+	reconcile := BridgeReconciler(h)
+
+	resources, err := reconcile(LocalNetworkInfo{Bridge: "docker0", Subnets: []string{"10.42.0.1/16"}})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if expected := (metrics.ManagedResources{Bridges: 1, Addresses: 1, Routes: 1, Neighbors: 1}); resources != expected {
+		t.Errorf("expected: %+v, got actual: %+v", expected, resources)
+	}
+
+	h.links["vtep1042"] = &netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Name: "vtep1042", Index: 9, MTU: 1500}}
+	if _, err := reconcile(LocalNetworkInfo{Bridge: "docker0", Subnets: []string{"10.42.0.1/16"}, VxlanDevice: "vtep1042"}); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if mtu := h.links["docker0"].Attrs().MTU; mtu != 1450 {
+		t.Errorf("expected the bridge MTU to fit in the vxlan device: 1450, got actual: %v", mtu)
+	}
+	if _, err := reconcile(LocalNetworkInfo{Bridge: "docker0", Subnets: []string{"10.42.0.1/16"}, VxlanDevice: "docker1"}); err == nil {
+		t.Errorf("expecting error for an overlay device which isn't vxlan, but got nil")
+	}
+
+	if _, err := reconcile(LocalNetworkInfo{Bridge: "docker1", Subnets: []string{"10.43.0.1/16"}}); !IsNotReady(err) {
+		t.Errorf("expected a not ready error for a bridge without its address, got actual: %v", err)
+	}
+	if _, err := reconcile(LocalNetworkInfo{Bridge: "docker2", Subnets: []string{"10.44.0.1/16"}}); !IsNotReady(err) {
+		t.Errorf("expected a not ready error for a missing bridge, got actual: %v", err)
+	}
+	if _, err := reconcile(LocalNetworkInfo{Bridge: "docker-bridge-too-long", Subnets: []string{"10.42.0.1/16"}}); err == nil || IsNotReady(err) {
+		t.Errorf("expecting error for an invalid bridge name, got actual: %v", err)
+	}
+	for _, subnet := range []string{"127.0.0.1/8", "0.0.0.0/16"} {
+		if _, err := reconcile(LocalNetworkInfo{Bridge: "docker0", Subnets: []string{subnet}}); err == nil || IsNotReady(err) {
+			t.Errorf("expecting error for the invalid bridge address %v, got actual: %v", subnet, err)
+		}
+	}
+	mismatch := LocalNetworkInfo{Bridge: "docker0", Subnets: []string{"fd00:42::1/64"}, Router: metadata.Container{PrimaryIp: "10.42.0.2"}}
+	if _, err := reconcile(mismatch); err == nil {
+		t.Errorf("expecting error for a v4 router on a v6 bridge, but got nil")
+	} else if _, ok := err.(*FamilyMismatchError); !ok {
+		t.Errorf("expected a FamilyMismatchError, got actual: %v", err)
+	}
+	if resources, err := reconcile(LocalNetworkInfo{}); err != nil || resources != (metrics.ManagedResources{}) {
+		t.Errorf("expected nothing to reconcile without bridge, got actual: %+v, %v", resources, err)
+	}
+	if len(h.deleted) != 0 {
+		t.Errorf("expected nothing to be changed, deleted: %v", h.deleted)
+	}
+}
+
+func TestIsNotReady(t *testing.T) {
+	notReady := &BridgeNotReadyError{Bridge: "docker0", Reason: "doesn't exist yet"}
+	failed := fmt.Errorf("operation not permitted")
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{nil, false},
+		{failed, false},
+		{notReady, true},
+		{errors.Wrap(notReady, "error reconciling docker0"), true},
+		{&BackoffError{NetworkUUID: "net1"}, true},
+		{NetworkErrors{"net1": notReady, "net2": &BackoffError{}}, true},
+		{NetworkErrors{"net1": notReady, "net2": failed}, false},
+		{NetworkErrors{}, false},
+	}
+
+	for _, test := range tests {
+		if actual := IsNotReady(test.err); actual != test.expected {
+			t.Errorf("%v: expected: %v, got actual: %v", test.err, test.expected, actual)
+		}
+	}
+}
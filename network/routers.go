@@ -0,0 +1,183 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/utils"
+)
+
+// RouterProber checks if the given IP address responds within the timeout
+type RouterProber func(ip string, timeout time.Duration) (bool, error)
+
+// RouterProbe is the method used by IsRouterReachable to probe the routers
+var RouterProbe RouterProber = PingProbe
+
+// PingProbe sends a single ICMP echo request to the given IP address
+func PingProbe(ip string, timeout time.Duration) (bool, error) {
+	secs := int(timeout / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	err := exec.Command("ping", "-c", "1", "-W", strconv.Itoa(secs), ip).Run()
+	if _, ok := err.(*exec.ExitError); ok {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// TCPProbe returns a RouterProber which tries to connect to the given port
+func TCPProbe(port int) RouterProber {
+	return func(ip string, timeout time.Duration) (bool, error) {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), timeout)
+		if err != nil {
+			return false, nil
+		}
+		conn.Close()
+		return true, nil
+	}
+}
+
+// IsRouterReachable checks if the router container of a network responds
+// on its primary IP address using RouterProbe
+func IsRouterReachable(router metadata.Container, timeout time.Duration) (bool, error) {
+	if net.ParseIP(router.PrimaryIp) == nil {
+		return false, fmt.Errorf("invalid primary IP(%v) of router %v", router.PrimaryIp, router.Name)
+	}
+	return RouterProbe(router.PrimaryIp, timeout)
+}
+
+// ValidateRouterIsGateway checks the primary IP address of the router is
+// the conventional gateway of the given bridge subnet
+func ValidateRouterIsGateway(router metadata.Container, subnet string) error {
+	gateway, err := utils.GatewayIPForSubnet(subnet)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(router.PrimaryIp)
+	if ip == nil {
+		return fmt.Errorf("invalid primary IP(%v) of router %v", router.PrimaryIp, router.Name)
+	}
+	if !ip.Equal(gateway) {
+		return fmt.Errorf("router %v IP %v isn't the gateway %v of subnet %v", router.Name, router.PrimaryIp, gateway, subnet)
+	}
+	return nil
+}
+
+// ValidateRouterCardinality returns the UUIDs of the networks without a
+// router or with more than one router on the same host, as each host runs
+// a single router per network.
+func ValidateRouterCardinality(networks []metadata.Network, services []metadata.Service) ([]string, error) {
+	routers, err := routerContainers(services)
+	if err != nil {
+		return nil, err
+	}
+
+	perHost := map[string]map[string]int{}
+	for _, r := range routers {
+		if perHost[r.NetworkUUID] == nil {
+			perHost[r.NetworkUUID] = map[string]int{}
+		}
+		perHost[r.NetworkUUID][r.HostUUID]++
+	}
+
+	invalid := []string{}
+	for _, aNetwork := range networks {
+		hosts := perHost[aNetwork.UUID]
+		valid := len(hosts) > 0
+		for _, count := range hosts {
+			if count > 1 {
+				valid = false
+			}
+		}
+		if !valid {
+			invalid = append(invalid, aNetwork.UUID)
+		}
+	}
+	return invalid, nil
+}
+
+type routerTransition struct {
+	state string
+	at    time.Time
+}
+
+// RouterStabilityTracker records the state transitions of the router of
+// each network, to detect the routers which keep flapping
+type RouterStabilityTracker struct {
+	mu          sync.Mutex
+	transitions map[string][]routerTransition
+	now         func() time.Time
+}
+
+// NewRouterStabilityTracker returns an empty RouterStabilityTracker
+func NewRouterStabilityTracker() *RouterStabilityTracker {
+	return &RouterStabilityTracker{
+		transitions: map[string][]routerTransition{},
+		now:         time.Now,
+	}
+}
+
+// Record notes the current state of the router of the given network,
+// only changes from the previously recorded state count as transitions
+func (t *RouterStabilityTracker) Record(networkUUID string, router metadata.Container) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state := router.State + "/" + router.PrimaryIp
+	seen := t.transitions[networkUUID]
+	if len(seen) > 0 && seen[len(seen)-1].state == state {
+		return
+	}
+	t.transitions[networkUUID] = append(seen, routerTransition{state: state, at: t.now()})
+}
+
+// IsRouterStable checks if the router of the given network changed state
+// at most maxTransitions times within the last window. The transitions
+// older than the window are forgotten.
+func (t *RouterStabilityTracker) IsRouterStable(networkUUID string, window time.Duration, maxTransitions int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seen := t.transitions[networkUUID]
+	if len(seen) == 0 {
+		return true
+	}
+
+	since := t.now().Add(-window)
+	recent := 0
+	for _, tr := range seen {
+		if tr.at.After(since) {
+			recent++
+		}
+	}
+	// The first recorded state isn't a transition, it's kept even when
+	// old to detect the next change
+	if len(seen) > recent {
+		t.transitions[networkUUID] = seen[len(seen)-recent-1:]
+	} else {
+		recent--
+	}
+
+	return recent <= maxTransitions
+}
+
+// MigrateNetworks moves the recorded transitions of the renamed networks
+// to their new UUID
+func (t *RouterStabilityTracker) MigrateNetworks(renames []NetworkRename) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, r := range renames {
+		if seen, ok := t.transitions[r.OldUUID]; ok {
+			t.transitions[r.NewUUID] = seen
+			delete(t.transitions, r.OldUUID)
+		}
+	}
+}
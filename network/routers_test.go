@@ -0,0 +1,144 @@
+package network
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestIsRouterReachable(t *testing.T) {
+	defer func(p RouterProber) { RouterProbe = p }(RouterProbe)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	defer l.Close()
+
+	router := metadata.Container{Name: "router", PrimaryIp: "127.0.0.1"}
+
+	RouterProbe = TCPProbe(l.Addr().(*net.TCPAddr).Port)
+	reachable, err := IsRouterReachable(router, time.Second)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if !reachable {
+		t.Errorf("expected router listening on %v to be reachable", l.Addr())
+	}
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	closed.Close()
+
+	RouterProbe = TCPProbe(closed.Addr().(*net.TCPAddr).Port)
+	reachable, err = IsRouterReachable(router, time.Second)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if reachable {
+		t.Errorf("expected router not listening on %v to be unreachable", closed.Addr())
+	}
+
+	if _, err := IsRouterReachable(metadata.Container{Name: "router"}, time.Second); err == nil {
+		t.Errorf("expected error for router without primary IP, but got nil")
+	}
+}
+
+func TestRouterStabilityTracker(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	tracker := NewRouterStabilityTracker()
+	tracker.now = func() time.Time { return now }
+
+	running := metadata.Container{State: "running", PrimaryIp: "10.42.0.2"}
+	restarted := metadata.Container{State: "running", PrimaryIp: "10.42.0.3"}
+	stopped := metadata.Container{State: "stopped", PrimaryIp: "10.42.0.2"}
+
+	if !tracker.IsRouterStable("net1", time.Minute, 2) {
+		t.Errorf("expected unknown router to be stable")
+	}
+
+	// A stable router keeps reporting the same state
+	for i := 0; i < 10; i++ {
+		tracker.Record("stable", running)
+		now = now.Add(5 * time.Second)
+	}
+	if !tracker.IsRouterStable("stable", time.Minute, 0) {
+		t.Errorf("expected router with no transitions to be stable")
+	}
+
+	// A flapping router changes state every 5 seconds
+	for _, router := range []metadata.Container{running, stopped, running, stopped, restarted} {
+		tracker.Record("flapping", router)
+		now = now.Add(5 * time.Second)
+	}
+	if tracker.IsRouterStable("flapping", time.Minute, 3) {
+		t.Errorf("expected router with 4 transitions to be unstable")
+	}
+	if !tracker.IsRouterStable("flapping", time.Minute, 4) {
+		t.Errorf("expected router with 4 transitions to be stable when allowing 4")
+	}
+
+	// Once the transitions are old enough the router is stable again
+	now = now.Add(2 * time.Minute)
+	if !tracker.IsRouterStable("flapping", time.Minute, 0) {
+		t.Errorf("expected router to be stable once the transitions are out of the window")
+	}
+	tracker.Record("flapping", running)
+	if tracker.IsRouterStable("flapping", time.Minute, 0) {
+		t.Errorf("expected a new transition to be counted")
+	}
+
+	tracker.MigrateNetworks([]NetworkRename{{Name: "flapping", OldUUID: "flapping", NewUUID: "recreated"}})
+	if !tracker.IsRouterStable("flapping", time.Minute, 0) || tracker.IsRouterStable("recreated", time.Minute, 0) {
+		t.Errorf("expected the transitions to be moved to the new network UUID")
+	}
+}
+
+func TestValidateRouterIsGateway(t *testing.T) {
+	for _, c := range []struct {
+		ip, subnet string
+		expectErr  bool
+	}{
+		{"10.42.0.1", "10.42.0.0/16", false},
+		{"10.42.0.1", "10.42.0.1/16", false},
+		{"fd00::1", "fd00::/64", false},
+		{"10.42.0.2", "10.42.0.0/16", true},
+		{"10.43.0.1", "10.42.0.0/16", true},
+		{"", "10.42.0.0/16", true},
+		{"10.42.0.1", "not-a-subnet", true},
+	} {
+		router := metadata.Container{Name: "network-manager", PrimaryIp: c.ip}
+		err := ValidateRouterIsGateway(router, c.subnet)
+		if (err != nil) != c.expectErr {
+			t.Errorf("%v %v: unexpected error: %v", c.ip, c.subnet, err)
+		}
+	}
+}
+
+func TestValidateRouterCardinality(t *testing.T) {
+	networks := []metadata.Network{{UUID: "net0"}, {UUID: "net1"}, {UUID: "net2"}, {UUID: "net-multi-host"}}
+	services := testDriverServices(
+		metadata.Container{UUID: "r1", NetworkUUID: "net1", HostUUID: "host1"},
+		metadata.Container{UUID: "r2", NetworkUUID: "net2", HostUUID: "host1"},
+		metadata.Container{UUID: "r3", NetworkUUID: "net2", HostUUID: "host1"},
+		metadata.Container{UUID: "r4", NetworkUUID: "net-multi-host", HostUUID: "host1"},
+		metadata.Container{UUID: "r5", NetworkUUID: "net-multi-host", HostUUID: "host2"},
+	)
+
+	invalid, err := ValidateRouterCardinality(networks, services)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if expected := []string{"net0", "net2"}; !reflect.DeepEqual(invalid, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, invalid)
+	}
+
+	if _, err := ValidateRouterCardinality(networks, nil); err == nil {
+		t.Errorf("expecting error without a network driver service, but got nil")
+	}
+}
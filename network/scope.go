@@ -0,0 +1,30 @@
+package network
+
+import (
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// EnvironmentScope selects the environments whose networks are managed on
+// the host
+type EnvironmentScope func(host metadata.Host, environmentUUID string) bool
+
+// HostEnvironmentScope only selects the current environment of the host
+func HostEnvironmentScope(host metadata.Host, environmentUUID string) bool {
+	return environmentUUID == host.EnvironmentUUID
+}
+
+// WithEnvironments returns a scope selecting the current environment of
+// the host along with the given ones, e.g. while migrating a host
+func WithEnvironments(environmentUUIDs ...string) EnvironmentScope {
+	extra := map[string]bool{}
+	for _, uuid := range environmentUUIDs {
+		extra[uuid] = true
+	}
+	return func(host metadata.Host, environmentUUID string) bool {
+		return HostEnvironmentScope(host, environmentUUID) || extra[environmentUUID]
+	}
+}
+
+// Scope is used by LocalNetworks to discover the networks to manage, by
+// default only the ones of the current environment of the host
+var Scope EnvironmentScope = HostEnvironmentScope
@@ -0,0 +1,43 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/testutil"
+)
+
+func TestEnvironmentScope(t *testing.T) {
+	defer func(s EnvironmentScope) { Scope = s }(Scope)
+
+	mc := &testutil.FakeMetadataClient{
+		Host:     metadata.Host{UUID: "host1", EnvironmentUUID: "env2"},
+		Services: testDriverServices(),
+		Networks: []metadata.Network{
+			testBridgeNetwork("net1", "env1", "docker0", "10.42.0.1/16"),
+			testBridgeNetwork("net2", "env2", "docker1", "10.43.0.1/16"),
+			testBridgeNetwork("net3", "env3", "docker2", "10.44.0.1/16"),
+		},
+	}
+
+	uuids := func() []string {
+		localNetworks, _, err := LocalNetworks(mc)
+		if err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+		uuids := []string{}
+		for _, aNetwork := range localNetworks {
+			uuids = append(uuids, aNetwork.UUID)
+		}
+		return uuids
+	}
+
+	if actual := uuids(); len(actual) != 1 || actual[0] != "net2" {
+		t.Errorf("expected: [net2], got actual: %v", actual)
+	}
+
+	Scope = WithEnvironments("env1")
+	if actual := uuids(); len(actual) != 2 || actual[0] != "net1" || actual[1] != "net2" {
+		t.Errorf("expected: [net1 net2], got actual: %v", actual)
+	}
+}
@@ -0,0 +1,138 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	glue "github.com/rancher/cniglue"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/utils"
+	"github.com/vishvananda/netlink"
+)
+
+// TeardownReport lists what was removed by TeardownHost, or what would
+// have been removed in case of a dry run
+type TeardownReport struct {
+	Bridges        []string
+	Routes         []string
+	Neighbors      []string
+	CNIConfigFiles []string
+}
+
+// TeardownHost removes the bridges of the local networks along with their
+// routes and neighbors, and the CNI config files generated for them. When
+// dryRun is set nothing is removed and the report lists what would be.
+func TeardownHost(mc metadata.Client, dryRun bool) (TeardownReport, error) {
+	report := TeardownReport{}
+
+	localNetworks, _, err := LocalNetworks(mc)
+	if err != nil {
+		return report, err
+	}
+
+	host, err := mc.GetSelfHost()
+	if err != nil {
+		return report, errors.Wrap(err, "error fetching self host from metadata")
+	}
+
+	var lastErr error
+	for _, aNetwork := range localNetworks {
+		if err := teardownBridge(aNetwork, host, dryRun, &report); err != nil {
+			logrus.Errorf("Failed to tear down bridge of network %v: %v", aNetwork.UUID, err)
+			lastErr = err
+		}
+		if err := teardownCNIConfig(aNetwork, dryRun, &report); err != nil {
+			logrus.Errorf("Failed to tear down cni config of network %v: %v", aNetwork.UUID, err)
+			lastErr = err
+		}
+	}
+
+	return report, lastErr
+}
+
+func teardownBridge(network metadata.Network, host metadata.Host, dryRun bool, report *TeardownReport) error {
+	bridgeName, _ := utils.GetBridgeInfo(network, host)
+	if bridgeName == "" {
+		return nil
+	}
+
+	bridge, err := nlh.LinkByName(bridgeName)
+	if isLinkNotFound(err) {
+		logrus.Debugf("Bridge %v of network %v not found: %v", bridgeName, network.UUID, err)
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "looking up bridge %v", bridgeName)
+	}
+
+	routes, err := nlh.RouteList(bridge, netlink.FAMILY_ALL)
+	if err != nil {
+		return errors.Wrapf(err, "listing routes of %v", bridgeName)
+	}
+	for index, r := range routes {
+		if !dryRun {
+			if err := nlh.RouteDel(&routes[index]); err != nil {
+				return errors.Wrapf(err, "deleting route %v", r)
+			}
+			RecordEvent(ActionDelRoute, bridgeName, fmt.Sprintf("%v", r.Dst))
+		}
+		report.Routes = append(report.Routes, fmt.Sprintf("%v dev %v", r.Dst, bridgeName))
+	}
+
+	neighs, err := nlh.NeighList(bridge.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		return errors.Wrapf(err, "listing neighbors of %v", bridgeName)
+	}
+	for index, n := range neighs {
+		if !dryRun {
+			if err := nlh.NeighDel(&neighs[index]); err != nil {
+				return errors.Wrapf(err, "deleting neighbor %v", n)
+			}
+			RecordEvent(ActionDelNeighbor, bridgeName, fmt.Sprintf("%v lladdr %v", n.IP, n.HardwareAddr))
+		}
+		report.Neighbors = append(report.Neighbors, fmt.Sprintf("%v lladdr %v dev %v", n.IP, n.HardwareAddr, bridgeName))
+	}
+
+	if !dryRun {
+		if err := nlh.LinkDel(bridge); err != nil {
+			return errors.Wrapf(err, "deleting bridge %v", bridgeName)
+		}
+		RecordEvent(ActionDelLink, bridgeName, bridgeName)
+	}
+	report.Bridges = append(report.Bridges, bridgeName)
+	return nil
+}
+
+func teardownCNIConfig(network metadata.Network, dryRun bool, report *TeardownReport) error {
+	confDir := fmt.Sprintf(glue.CniDir, network.Name)
+	files, err := ioutil.ReadDir(confDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		report.CNIConfigFiles = append(report.CNIConfigFiles, filepath.Join(confDir, f.Name()))
+	}
+
+	if network.Default {
+		managedDir := fmt.Sprintf(glue.CniDir, "managed")
+		if _, err := os.Lstat(managedDir); err == nil {
+			report.CNIConfigFiles = append(report.CNIConfigFiles, managedDir)
+			if !dryRun {
+				if err := os.Remove(managedDir); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if dryRun {
+		return nil
+	}
+	return os.RemoveAll(confDir)
+}
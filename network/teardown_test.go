@@ -0,0 +1,123 @@
+package network
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	glue "github.com/rancher/cniglue"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/testutil"
+	"github.com/vishvananda/netlink"
+)
+
+func newTestTeardown(t *testing.T) (*testutil.FakeMetadataClient, *fakeNetlinkHandle, string) {
+	cniDir := t.TempDir()
+	glue.CniDir = filepath.Join(cniDir, "%s.d")
+	if err := os.MkdirAll(filepath.Join(cniDir, "net1.d"), 0700); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(cniDir, "net1.d", "10-rancher.conf"), []byte("{}"), 0600); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	_, dst, _ := net.ParseCIDR("10.42.0.0/16")
+	mac, _ := net.ParseMAC("02:00:0a:2a:00:02")
+	h := &fakeNetlinkHandle{
+		links: map[string]netlink.Link{
+			"docker0": &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "docker0", Index: 3}},
+		},
+		routes: map[int][]netlink.Route{
+			3: {{LinkIndex: 3, Dst: dst}},
+		},
+		neighs: map[int][]netlink.Neigh{
+			3: {{LinkIndex: 3, IP: net.ParseIP("10.42.0.2"), HardwareAddr: mac}},
+		},
+	}
+	mc := &testutil.FakeMetadataClient{
+		Host:     metadata.Host{UUID: "host1", EnvironmentUUID: "env1"},
+		Services: testDriverServices(),
+		Networks: []metadata.Network{
+			testBridgeNetwork("net1", "env1", "docker0", "10.42.0.0/16"),
+			testBridgeNetwork("net2", "env1", "docker1", "10.43.0.0/16"),
+		},
+	}
+	return mc, h, cniDir
+}
+
+func TestTeardownHost(t *testing.T) {
+	defer func(h NetlinkHandle, d string) { nlh, glue.CniDir = h, d }(nlh, glue.CniDir)
+
+	for _, dryRun := range []bool{true, false} {
+		mc, h, cniDir := newTestTeardown(t)
+		nlh = h
+
+		report, err := TeardownHost(mc, dryRun)
+		if err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+
+		expectedReport := TeardownReport{
+			Bridges:        []string{"docker0"},
+			Routes:         []string{"10.42.0.0/16 dev docker0"},
+			Neighbors:      []string{"10.42.0.2 lladdr 02:00:0a:2a:00:02 dev docker0"},
+			CNIConfigFiles: []string{filepath.Join(cniDir, "net1.d", "10-rancher.conf")},
+		}
+		if !reflect.DeepEqual(report, expectedReport) {
+			t.Errorf("dryRun: %v, expected: %+v, got actual: %+v", dryRun, expectedReport, report)
+		}
+
+		_, statErr := os.Stat(filepath.Join(cniDir, "net1.d"))
+		if dryRun {
+			if len(h.deleted) != 0 || statErr != nil {
+				t.Errorf("expected nothing to be removed on dry run, deleted: %v, %v", h.deleted, statErr)
+			}
+			continue
+		}
+
+		expectedDeleted := []string{"route 10.42.0.0/16", "neigh 10.42.0.2", "link docker0"}
+		if !reflect.DeepEqual(h.deleted, expectedDeleted) {
+			t.Errorf("expected: %v, got actual: %v", expectedDeleted, h.deleted)
+		}
+		if !os.IsNotExist(statErr) {
+			t.Errorf("expected cni config dir to be removed, got: %v", statErr)
+		}
+	}
+}
+
+// failingLinkDelHandle fails the link deletions with err
+type failingLinkDelHandle struct {
+	*fakeNetlinkHandle
+	err error
+}
+
+func (h *failingLinkDelHandle) LinkDel(link netlink.Link) error {
+	return h.err
+}
+
+func TestTeardownHostErrors(t *testing.T) {
+	defer func(h NetlinkHandle, d string) { nlh, glue.CniDir = h, d }(nlh, glue.CniDir)
+
+	// A bridge which fails to be deleted isn't reported as removed
+	mc, h, _ := newTestTeardown(t)
+	nlh = &failingLinkDelHandle{fakeNetlinkHandle: h, err: syscall.EBUSY}
+	report, err := TeardownHost(mc, false)
+	if errors.Cause(err) != syscall.EBUSY {
+		t.Errorf("expected: %v, got actual: %v", syscall.EBUSY, err)
+	}
+	if len(report.Bridges) != 0 {
+		t.Errorf("expected no bridge removed, got actual: %v", report.Bridges)
+	}
+
+	// Only a missing link is treated as already removed
+	mc, h, _ = newTestTeardown(t)
+	nlh = &failingLinkHandle{fakeNetlinkHandle: h, err: syscall.EPERM}
+	if _, err := TeardownHost(mc, false); errors.Cause(err) != syscall.EPERM {
+		t.Errorf("expected: %v, got actual: %v", syscall.EPERM, err)
+	}
+}
@@ -0,0 +1,125 @@
+package routesync
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/network"
+	"github.com/vishvananda/netlink"
+)
+
+// Route is a route of the host
+type Route struct {
+	Dst       string `json:"dst"`
+	Interface string `json:"interface"`
+}
+
+// State is the route to the metadata IP and the subnet routes of the
+// local networks wanted on the host, and the routes found on their
+// interfaces. The diff only has what the route syncs apply. The missing
+// subnet routes are advisory unless the subnet routes sync runs, and the
+// stale ones always are since no sync deletes them.
+type State struct {
+	Desired  []Route  `json:"desired"`
+	Actual   []Route  `json:"actual"`
+	Diff     []string `json:"diff"`
+	Advisory []string `json:"advisory"`
+}
+
+// GetState returns the state of the routes. The diff lists the route to
+// the metadata IP if it's missing (+), and the missing subnet routes when
+// the subnet routes sync runs. The advisory changes list the other
+// missing (+) and the stale (-) subnet routes of the managed interfaces.
+func GetState(mc metadata.Client) (State, error) {
+	state := State{Desired: []Route{}, Actual: []Route{}, Diff: []string{}, Advisory: []string{}}
+
+	var metadataRoute *Route
+	if ok, bridgeName, metadataIP := conditionsMetToWatch(); ok {
+		metadataRoute = &Route{Dst: metadataIPNet(metadataIP), Interface: bridgeName}
+		state.Desired = append(state.Desired, *metadataRoute)
+	}
+
+	subnetRoutes, err := LocalSubnetRoutes(mc)
+	if err != nil {
+		return state, err
+	}
+
+	bridges := map[string]bool{}
+	for _, r := range subnetRoutes {
+		state.Desired = append(state.Desired, Route{Dst: r.Dst.String(), Interface: r.Interface})
+		bridges[r.Interface] = true
+	}
+
+	interfaceNames := []string{}
+	for _, r := range state.Desired {
+		if !contains(interfaceNames, r.Interface) {
+			interfaceNames = append(interfaceNames, r.Interface)
+		}
+	}
+	sort.Strings(interfaceNames)
+
+	found := map[Route]bool{}
+	existingBridges := []string{}
+	for _, name := range interfaceNames {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			continue
+		}
+		if bridges[name] {
+			existingBridges = append(existingBridges, name)
+		}
+		routes, err := netlink.RouteList(link, network.PolicyFamily())
+		if err != nil {
+			return state, errors.Wrapf(err, "error listing routes of %v", name)
+		}
+		for _, r := range routes {
+			if r.Dst == nil {
+				continue
+			}
+			route := Route{Dst: r.Dst.String(), Interface: name}
+			state.Actual = append(state.Actual, route)
+			found[route] = true
+		}
+	}
+
+	for _, r := range state.Desired {
+		if found[r] {
+			continue
+		}
+		line := fmt.Sprintf("+ route %v dev %v", r.Dst, r.Interface)
+		if (metadataRoute != nil && r == *metadataRoute) || isSubnetSyncRunning() {
+			state.Diff = append(state.Diff, line)
+		} else {
+			state.Advisory = append(state.Advisory, line)
+		}
+	}
+
+	stale, err := FindStaleSubnetRoutes(subnetRoutes, existingBridges)
+	if err != nil {
+		return state, err
+	}
+	for _, r := range stale {
+		state.Advisory = append(state.Advisory, fmt.Sprintf("- route %v dev %v", r.Dst, interfaceName(r.LinkIndex)))
+	}
+
+	return state, nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func interfaceName(linkIndex int) string {
+	link, err := netlink.LinkByIndex(linkIndex)
+	if err != nil {
+		return fmt.Sprint(linkIndex)
+	}
+	return link.Attrs().Name
+}
@@ -0,0 +1,164 @@
+package routesync
+
+import (
+	"net"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/network"
+	"github.com/rancher/plugin-manager/utils"
+	"github.com/vishvananda/netlink"
+)
+
+// DesiredRoute is a route which needs to be present on the host
+type DesiredRoute struct {
+	Dst       *net.IPNet
+	Interface string
+}
+
+// AllLocalSubnetRoutes returns the routes needed to reach the subnets of all
+// the local networks, via the bridges given for each network UUID. A
+// dual-stack network gets a route for each of its subnets. Networks
+// without a subnet or a bridge are skipped.
+func AllLocalSubnetRoutes(mc metadata.Client, bridgePerNetwork map[string]string) ([]DesiredRoute, error) {
+	localNetworks, _, err := network.LocalNetworks(mc)
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := mc.GetSelfHost()
+	if err != nil {
+		return nil, errors.Wrap(err, "error fetching self host from metadata")
+	}
+
+	routes := []DesiredRoute{}
+	for _, aNetwork := range localNetworks {
+		_, bridgeSubnets := utils.GetBridgeSubnets(aNetwork, host)
+		bridge := bridgePerNetwork[aNetwork.UUID]
+		if len(bridgeSubnets) == 0 || bridge == "" {
+			logrus.Debugf("routesync: no subnet route needed for network %v", aNetwork.UUID)
+			continue
+		}
+
+		for _, bridgeSubnet := range bridgeSubnets {
+			_, dst, err := net.ParseCIDR(bridgeSubnet)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing subnet of network %v", aNetwork.UUID)
+			}
+			if !network.PolicyAllowsIP(dst.IP) {
+				logrus.Debugf("routesync: skipping subnet %v of network %v due to the address family policy", dst, aNetwork.UUID)
+				continue
+			}
+			routes = append(routes, DesiredRoute{Dst: dst, Interface: bridge})
+		}
+	}
+
+	return routes, nil
+}
+
+// LocalSubnetRoutes returns the subnet routes of the local networks via
+// their bridges, see AllLocalSubnetRoutes
+func LocalSubnetRoutes(mc metadata.Client) ([]DesiredRoute, error) {
+	infos, err := network.GetAllBridgeInfosFromMetadata(mc)
+	if err != nil {
+		return nil, err
+	}
+	bridgePerNetwork := map[string]string{}
+	for uuid, info := range infos {
+		bridgePerNetwork[uuid] = info.Name
+	}
+	return AllLocalSubnetRoutes(mc, bridgePerNetwork)
+}
+
+// AddMissingSubnetRoutes adds the desired routes which aren't on their
+// interface yet, of either address family, and returns how many were
+// added. The interfaces which don't exist yet are skipped, the CNI plugin
+// creates the bridge of a network with its first container.
+func AddMissingSubnetRoutes(desired []DesiredRoute) (int, error) {
+	added := 0
+	existing := map[string]map[string]bool{}
+	for _, r := range desired {
+		link, err := netlink.LinkByName(r.Interface)
+		if err != nil {
+			logrus.Debugf("routesync: skipping route %v, interface %v isn't there: %v", r.Dst, r.Interface, err)
+			continue
+		}
+
+		if existing[r.Interface] == nil {
+			routes, err := netlink.RouteList(link, network.PolicyFamily())
+			if err != nil {
+				return added, errors.Wrapf(err, "error listing routes of %v", r.Interface)
+			}
+			existing[r.Interface] = map[string]bool{}
+			for _, route := range routes {
+				if route.Dst != nil {
+					existing[r.Interface][route.Dst.String()] = true
+				}
+			}
+		}
+		if existing[r.Interface][r.Dst.String()] {
+			continue
+		}
+
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+			Dst:       r.Dst,
+		}
+		if err := netlink.RouteAdd(route); err != nil {
+			return added, errors.Wrapf(err, "error adding route %v to %v", r.Dst, r.Interface)
+		}
+		logrus.Infof("routesync: added subnet route %v to %v", r.Dst, r.Interface)
+		existing[r.Interface][r.Dst.String()] = true
+		added++
+	}
+	return added, nil
+}
+
+// FindStaleSubnetRoutes returns the routes present on the given managed
+// interfaces whose destination isn't part of the desired routes for that
+// interface, for example the subnet route of a deleted network.
+// Default routes, link-local routes and host routes (like the one to the
+// metadata IP) are not subnet routes and hence are never reported.
+func FindStaleSubnetRoutes(desired []DesiredRoute, interfaceNames []string) ([]netlink.Route, error) {
+	desiredPerInterface := map[string]map[string]bool{}
+	for _, r := range desired {
+		if r.Dst == nil {
+			continue
+		}
+		if desiredPerInterface[r.Interface] == nil {
+			desiredPerInterface[r.Interface] = map[string]bool{}
+		}
+		desiredPerInterface[r.Interface][r.Dst.String()] = true
+	}
+
+	stale := []netlink.Route{}
+	for _, name := range interfaceNames {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error fetching link %v", name)
+		}
+
+		routes, err := netlink.RouteList(link, network.PolicyFamily())
+		if err != nil {
+			return nil, errors.Wrapf(err, "error listing routes of %v", name)
+		}
+
+		for _, r := range routes {
+			if r.Dst == nil {
+				continue
+			}
+			if ones, bits := r.Dst.Mask.Size(); ones == bits || r.Dst.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if desiredPerInterface[name][r.Dst.String()] {
+				continue
+			}
+			logrus.Debugf("routesync: found stale route %v on %v", r.Dst, name)
+			stale = append(stale, r)
+		}
+	}
+
+	return stale, nil
+}
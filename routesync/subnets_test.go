@@ -0,0 +1,204 @@
+package routesync
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/testutil"
+	"github.com/vishvananda/netlink"
+)
+
+// testDriverServices is the network driver stack of the local networks
+var testDriverServices = []metadata.Service{{
+	Name:               "cni-driver",
+	StackName:          "network-stack",
+	PrimaryServiceName: "cni-driver",
+	Kind:               "networkDriverService",
+}}
+
+func testBridgeNetwork(uuid, bridgeSubnet string) metadata.Network {
+	return metadata.Network{
+		UUID:            uuid,
+		EnvironmentUUID: "env1",
+		Metadata: map[string]interface{}{
+			"cniConfig": map[string]interface{}{
+				"10-rancher.conf": map[string]interface{}{
+					"type":         "rancher-bridge",
+					"bridge":       "docker0",
+					"bridgeSubnet": bridgeSubnet,
+				},
+			},
+		},
+	}
+}
+
+func TestAllLocalSubnetRoutes(t *testing.T) {
+	mc := &testutil.FakeMetadataClient{
+		Host:     metadata.Host{UUID: "host1", EnvironmentUUID: "env1"},
+		Services: testDriverServices,
+		Networks: []metadata.Network{
+			testBridgeNetwork("net1", "10.42.0.0/16"),
+			testBridgeNetwork("net2", "10.43.0.0/16"),
+			testBridgeNetwork("net-no-bridge", "10.44.0.0/16"),
+			testBridgeNetwork("net-dual", "10.45.0.0/16"),
+		},
+	}
+	mc.Networks[3].Metadata["cniConfig"].(map[string]interface{})["10-rancher.conf"].(map[string]interface{})["bridgeSubnetV6"] = "fd00:45::/64"
+
+	routes, err := AllLocalSubnetRoutes(mc, map[string]string{
+		"net1":     "br-net1",
+		"net2":     "br-net2",
+		"net-dual": "br-dual",
+	})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	expected := []struct {
+		dst, iface string
+	}{
+		{"10.42.0.0/16", "br-net1"},
+		{"10.43.0.0/16", "br-net2"},
+		{"10.45.0.0/16", "br-dual"},
+		{"fd00:45::/64", "br-dual"},
+	}
+	if len(routes) != len(expected) {
+		t.Fatalf("expected: %v, got actual: %v", expected, routes)
+	}
+	for i, r := range routes {
+		if r.Dst.String() != expected[i].dst || r.Interface != expected[i].iface {
+			t.Errorf("expected: %v, got actual: %v %v", expected[i], r.Dst, r.Interface)
+		}
+	}
+}
+
+func addTestBridgeWithRoutes(name string, dsts ...string) error {
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}}
+	if err := netlink.LinkAdd(bridge); err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(bridge); err != nil {
+		return err
+	}
+	for _, dst := range dsts {
+		ipNet, err := netlink.ParseIPNet(dst)
+		if err != nil {
+			return err
+		}
+		r := &netlink.Route{
+			LinkIndex: bridge.Attrs().Index,
+			Dst:       ipNet,
+			Scope:     netlink.SCOPE_LINK,
+		}
+		if err := netlink.RouteAdd(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestFindStaleSubnetRoutes(t *testing.T) {
+	testNS := testutil.NewTestNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(ns.NetNS) error {
+		if err := addTestBridgeWithRoutes("br-net1", "10.42.0.0/16", "10.99.0.0/16", "169.254.169.250/32"); err != nil {
+			return err
+		}
+		if err := addTestBridgeWithRoutes("br-net2", "10.43.0.0/16"); err != nil {
+			return err
+		}
+		if err := addTestBridgeWithRoutes("br-unmanaged", "10.98.0.0/16"); err != nil {
+			return err
+		}
+
+		_, net1, _ := net.ParseCIDR("10.42.0.0/16")
+		_, net2, _ := net.ParseCIDR("10.43.0.0/16")
+		desired := []DesiredRoute{
+			{Dst: net1, Interface: "br-net1"},
+			// Same destination on another interface doesn't make it desired
+			{Dst: net2, Interface: "br-net1"},
+		}
+
+		stale, err := FindStaleSubnetRoutes(desired, []string{"br-net1", "br-net2"})
+		if err != nil {
+			return err
+		}
+
+		actual := []string{}
+		for _, r := range stale {
+			link, err := netlink.LinkByIndex(r.LinkIndex)
+			if err != nil {
+				return err
+			}
+			actual = append(actual, r.Dst.String()+" "+link.Attrs().Name)
+		}
+		expected := []string{"10.99.0.0/16 br-net1", "10.43.0.0/16 br-net2"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected: %v, got actual: %v", expected, actual)
+		}
+
+		if _, err := FindStaleSubnetRoutes(desired, []string{"br-missing"}); err == nil {
+			t.Errorf("expecting error for a missing interface, but got nil")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+}
+
+func TestAddMissingSubnetRoutes(t *testing.T) {
+	testNS := testutil.NewTestNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(ns.NetNS) error {
+		if err := addTestBridgeWithRoutes("br-dual", "10.45.0.0/16"); err != nil {
+			return err
+		}
+
+		desired := []DesiredRoute{}
+		for _, dst := range []string{"10.45.0.0/16", "fd00:45::/64"} {
+			_, subnet, _ := net.ParseCIDR(dst)
+			desired = append(desired, DesiredRoute{Dst: subnet, Interface: "br-dual"})
+		}
+		_, missing, _ := net.ParseCIDR("10.46.0.0/16")
+		desired = append(desired, DesiredRoute{Dst: missing, Interface: "br-missing"})
+
+		added, err := AddMissingSubnetRoutes(desired)
+		if err != nil {
+			return err
+		}
+		if added != 1 {
+			t.Errorf("expected: 1, got actual: %v", added)
+		}
+
+		link, err := netlink.LinkByName("br-dual")
+		if err != nil {
+			return err
+		}
+		routes, err := netlink.RouteList(link, netlink.FAMILY_V6)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, r := range routes {
+			found = found || (r.Dst != nil && r.Dst.String() == "fd00:45::/64")
+		}
+		if !found {
+			t.Errorf("expected the IPv6 subnet route, got actual: %v", routes)
+		}
+
+		// Nothing is left to add
+		if added, err := AddMissingSubnetRoutes(desired); err != nil || added != 0 {
+			t.Errorf("expected: 0, got actual: %v %v", added, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+}
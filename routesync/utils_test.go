@@ -69,3 +69,14 @@ func TestConditionsMetToWatch(t *testing.T) {
 //		t.Fail()
 //	}
 //}
+
+func TestMetadataIPNet(t *testing.T) {
+	for ip, expected := range map[string]string{
+		"169.254.169.250": "169.254.169.250/32",
+		"fd00::250":       "fd00::250/128",
+	} {
+		if actual := metadataIPNet(ip); actual != expected {
+			t.Errorf("expected: %v, got actual: %v", expected, actual)
+		}
+	}
+}
@@ -5,25 +5,38 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/metrics"
 	"github.com/vishvananda/netlink"
 )
 
 var (
 	// DefaultSyncInterval specifies the default value for routesync interval
 	DefaultSyncInterval = 60
-)
 
-// Watch makes sure the needed routes are programmed inside the container
-func Watch(syncIntervalStr string) error {
-	logrus.Debugf("routesync: syncIntervalStr: %v", syncIntervalStr)
+	// subnetSyncRunning tells if WatchSubnets started the subnet routes
+	// sync
+	subnetSyncLock    sync.RWMutex
+	subnetSyncRunning bool
+)
 
+func parseSyncInterval(syncIntervalStr string) int {
 	syncInterval := DefaultSyncInterval
 	if i, err := strconv.Atoi(syncIntervalStr); err == nil {
 		syncInterval = i
 	}
+	return syncInterval
+}
+
+// Watch makes sure the needed routes are programmed inside the container
+func Watch(syncIntervalStr string) error {
+	logrus.Debugf("routesync: syncIntervalStr: %v", syncIntervalStr)
+
+	syncInterval := parseSyncInterval(syncIntervalStr)
 
 	//if conditions met, start the watcher
 	conditionsMet, bridgeName, metadataIP := conditionsMetToWatch()
@@ -45,16 +58,58 @@ func Watch(syncIntervalStr string) error {
 
 func doRouteSync(bridgeName, metadataIP string, syncInterval int) {
 	logrus.Infof("routesync: starting monitoring on bridge: %v, for metadataIP: %v every %v seconds", bridgeName, metadataIP, syncInterval)
+	metrics.ExpectSyncEvery("routesync", time.Duration(syncInterval)*time.Second)
 	for {
 		time.Sleep(time.Duration(syncInterval) * time.Second)
 		logrus.Debugf("routesync: time to sync routes")
+		started := time.Now()
 		err := addRouteToMetadataIP(bridgeName, metadataIP)
 		if err != nil {
 			logrus.Errorf("routesync: while syncing routes, got error: %v", err)
 		}
+		metrics.RecordSync("routesync", started, err)
 	}
 }
 
+// WatchSubnets makes sure the subnet routes of the local networks, of
+// both address families, are programmed on their bridges
+func WatchSubnets(syncIntervalStr string, mc metadata.Client) error {
+	subnetSyncLock.Lock()
+	subnetSyncRunning = true
+	subnetSyncLock.Unlock()
+	go doSubnetRouteSync(mc, parseSyncInterval(syncIntervalStr))
+	return nil
+}
+
+func isSubnetSyncRunning() bool {
+	subnetSyncLock.RLock()
+	defer subnetSyncLock.RUnlock()
+	return subnetSyncRunning
+}
+
+func doSubnetRouteSync(mc metadata.Client, syncInterval int) {
+	logrus.Infof("routesync: starting monitoring of the subnet routes every %v seconds", syncInterval)
+	for {
+		started := time.Now()
+		err := syncSubnetRoutes(mc)
+		if err != nil {
+			logrus.Errorf("routesync: while syncing subnet routes, got error: %v", err)
+		}
+		metrics.RecordSync("routesync-subnets", started, err)
+		time.Sleep(time.Duration(syncInterval) * time.Second)
+	}
+}
+
+func syncSubnetRoutes(mc metadata.Client) error {
+	desired, err := LocalSubnetRoutes(mc)
+	if err != nil {
+		return err
+	}
+	added, err := AddMissingSubnetRoutes(desired)
+	metrics.RecordReconciled("routesync", "routes", added)
+	return err
+}
+
 // conditionsMetToWatch returns the status if the prerequisites
 // are met to start the watcher
 func conditionsMetToWatch() (bool, string, string) {
@@ -69,6 +124,15 @@ func conditionsMetToWatch() (bool, string, string) {
 	return false, dockerBridge, metadataIP
 }
 
+// metadataIPNet returns the destination of the route to the metadata IP,
+// a /32 for an IPv4 address or a /128 for an IPv6 one
+func metadataIPNet(metadataIP string) string {
+	if ip := net.ParseIP(metadataIP); ip != nil && ip.To4() == nil {
+		return metadataIP + "/128"
+	}
+	return metadataIP + "/32"
+}
+
 func addRouteToMetadataIP(bridgeName, metadataIP string) error {
 	logrus.Debugf("routesync: adding route to metadata IP address")
 
@@ -77,7 +141,7 @@ func addRouteToMetadataIP(bridgeName, metadataIP string) error {
 		return err
 	}
 
-	ip, err := netlink.ParseIPNet(metadataIP + "/32")
+	ip, err := netlink.ParseIPNet(metadataIPNet(metadataIP))
 	if err != nil {
 		return err
 	}
@@ -108,6 +172,7 @@ func addRouteToMetadataIP(bridgeName, metadataIP string) error {
 		}
 	} else {
 		logrus.Infof("routesync: successfully added route to metadata IP(%v): %v", metadataIP, r)
+		metrics.RecordReconciled("routesync", "routes", 1)
 	}
 
 	return nil
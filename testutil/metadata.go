@@ -0,0 +1,46 @@
+package testutil
+
+import (
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// FakeMetadataClient serves the given objects, calling any of the other
+// methods of metadata.Client panics. When NetworksErr is set it's
+// returned by GetNetworks. OnChange never calls back.
+type FakeMetadataClient struct {
+	metadata.Client
+	Host        metadata.Host
+	Hosts       []metadata.Host
+	Networks    []metadata.Network
+	NetworksErr error
+	Services    []metadata.Service
+	Containers  []metadata.Container
+}
+
+// GetSelfHost returns Host
+func (c *FakeMetadataClient) GetSelfHost() (metadata.Host, error) {
+	return c.Host, nil
+}
+
+// GetHosts returns Hosts
+func (c *FakeMetadataClient) GetHosts() ([]metadata.Host, error) {
+	return c.Hosts, nil
+}
+
+// GetNetworks returns Networks, or NetworksErr
+func (c *FakeMetadataClient) GetNetworks() ([]metadata.Network, error) {
+	return c.Networks, c.NetworksErr
+}
+
+// GetServices returns Services
+func (c *FakeMetadataClient) GetServices() ([]metadata.Service, error) {
+	return c.Services, nil
+}
+
+// GetContainers returns Containers
+func (c *FakeMetadataClient) GetContainers() ([]metadata.Container, error) {
+	return c.Containers, nil
+}
+
+// OnChange does nothing
+func (c *FakeMetadataClient) OnChange(intervalSeconds int, do func(string)) {}
@@ -0,0 +1,17 @@
+package testutil
+
+import (
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/ns"
+)
+
+// NewTestNS creates a network namespace for the tests needing to modify
+// links, skipping the test if that's not possible
+func NewTestNS(t *testing.T) ns.NetNS {
+	testNS, err := ns.NewNS()
+	if err != nil {
+		t.Skipf("couldn't create network namespace: %v", err)
+	}
+	return testNS
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+)
+
+var (
+	procVersionPath    = "/proc/version"
+	kernelVersionRegex = regexp.MustCompile(`^Linux version (\d+)\.(\d+)(?:\.(\d+))?`)
+)
+
+// GetKernelVersion returns the version of the running kernel
+func GetKernelVersion() (major, minor, patch int, err error) {
+	content, err := ioutil.ReadFile(procVersionPath)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	matches := kernelVersionRegex.FindStringSubmatch(string(content))
+	if matches == nil {
+		return 0, 0, 0, fmt.Errorf("couldn't parse kernel version from: %s", content)
+	}
+
+	major, _ = strconv.Atoi(matches[1])
+	minor, _ = strconv.Atoi(matches[2])
+	if matches[3] != "" {
+		patch, _ = strconv.Atoi(matches[3])
+	}
+	return major, minor, patch, nil
+}
+
+// KernelAtLeast checks if the running kernel is at least the given version
+func KernelAtLeast(major, minor int) (bool, error) {
+	kMajor, kMinor, _, err := GetKernelVersion()
+	if err != nil {
+		return false, err
+	}
+	return kMajor > major || (kMajor == major && kMinor >= minor), nil
+}
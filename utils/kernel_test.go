@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func setTestProcVersion(t *testing.T, content string) {
+	procVersionPath = filepath.Join(t.TempDir(), "version")
+	if err := ioutil.WriteFile(procVersionPath, []byte(content), 0644); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+}
+
+func TestGetKernelVersion(t *testing.T) {
+	defer func(p string) { procVersionPath = p }(procVersionPath)
+
+	setTestProcVersion(t, "Linux version 4.9.78-rancher (root@builder) (gcc version 6.3.0) #1 SMP Mon Jan 22 2018\n")
+	major, minor, patch, err := GetKernelVersion()
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if major != 4 || minor != 9 || patch != 78 {
+		t.Errorf("expected: 4.9.78, got actual: %v.%v.%v", major, minor, patch)
+	}
+
+	for _, c := range []struct {
+		major, minor int
+		expected     bool
+	}{
+		{3, 18, true},
+		{4, 9, true},
+		{4, 10, false},
+		{5, 0, false},
+	} {
+		actual, err := KernelAtLeast(c.major, c.minor)
+		if err != nil {
+			t.Fatalf("not expecting error: %v", err)
+		}
+		if actual != c.expected {
+			t.Errorf("KernelAtLeast(%v, %v) expected: %v, got actual: %v", c.major, c.minor, c.expected, actual)
+		}
+	}
+
+	setTestProcVersion(t, "garbage")
+	if _, _, _, err := GetKernelVersion(); err == nil {
+		t.Errorf("expected error, but got nil")
+	}
+}
@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	hostnameKeyword     = "__hostname__"
+	hostIfaceKeyword    = "__host_iface__"
+	metadataPathKeyword = "__metadata_path__"
+)
+
+var (
+	procNetRoutePath = "/proc/net/route"
+	osHostname       = os.Hostname
+)
+
+// KeywordResolver returns the value of a registered keyword, arg is what
+// follows the keyword and a colon in the raw value, empty if nothing does
+type KeywordResolver func(arg string, ctx ResolveContext) (string, error)
+
+var (
+	keywordsLock sync.RWMutex
+	keywords     = map[string]KeywordResolver{}
+)
+
+func init() {
+	keywords[hostnameKeyword] = resolveHostname
+	keywords[hostIfaceKeyword] = resolveHostIface
+	keywords[metadataPathKeyword] = resolveMetadataPath
+}
+
+// RegisterKeyword adds a keyword resolved by ResolveValue using the given
+// resolver, passing a nil resolver removes it. Keywords are written like
+// __name__ and can't replace the built-in ones.
+func RegisterKeyword(keyword string, resolver KeywordResolver) error {
+	if len(keyword) < 5 || !strings.HasPrefix(keyword, "__") || !strings.HasSuffix(keyword, "__") || strings.Contains(keyword, ":") {
+		return fmt.Errorf("invalid keyword %v, expected __name__", keyword)
+	}
+	if isBuiltinKeyword(keyword) {
+		return fmt.Errorf("keyword %v is built-in", keyword)
+	}
+
+	keywordsLock.Lock()
+	defer keywordsLock.Unlock()
+	if resolver == nil {
+		delete(keywords, keyword)
+		return nil
+	}
+	keywords[keyword] = resolver
+	return nil
+}
+
+// lookupKeyword returns the registered resolver of the keyword the given
+// raw value is made of, along with the argument of the keyword
+func lookupKeyword(raw string) (KeywordResolver, string, bool) {
+	keyword, arg := raw, ""
+	if i := strings.Index(raw, ":"); i >= 0 {
+		keyword, arg = raw[:i], strings.TrimSpace(raw[i+1:])
+	}
+
+	keywordsLock.RLock()
+	defer keywordsLock.RUnlock()
+	resolver, ok := keywords[keyword]
+	return resolver, arg, ok
+}
+
+// resolveHostname returns the hostname of the host from metadata, falling
+// back to the name of the host and then to the local hostname
+func resolveHostname(arg string, ctx ResolveContext) (string, error) {
+	if ctx.Host.Hostname != "" {
+		return ctx.Host.Hostname, nil
+	}
+	if ctx.Host.Name != "" {
+		return ctx.Host.Name, nil
+	}
+	return osHostname()
+}
+
+// resolveHostIface returns the interface of the IPv4 default route of the
+// host, the one with the lowest metric if there are several
+func resolveHostIface(arg string, ctx ResolveContext) (string, error) {
+	f, err := os.Open(procNetRoutePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	iface, metric := "", -1
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		var m int
+		if _, err := fmt.Sscanf(fields[6], "%d", &m); err != nil {
+			continue
+		}
+		if metric < 0 || m < metric {
+			iface, metric = fields[0], m
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if iface == "" {
+		return "", fmt.Errorf("no default route found in %v", procNetRoutePath)
+	}
+	return iface, nil
+}
+
+// resolveMetadataPath returns the field of the host or container from the
+// given __metadata_path__:self/host/<field> or self/container/<field>
+// keyword, using the metadata names of the fields. Labels are referred as
+// labels/<label>.
+func resolveMetadataPath(arg string, ctx ResolveContext) (string, error) {
+	parts := strings.Split(strings.Trim(arg, "/"), "/")
+	if len(parts) < 3 || parts[0] != "self" {
+		return "", fmt.Errorf("unsupported metadata path %v", arg)
+	}
+
+	var object interface{}
+	switch parts[1] {
+	case "host":
+		object = ctx.Host
+	case "container":
+		if ctx.Container == nil {
+			return "", nil
+		}
+		object = ctx.Container
+	default:
+		return "", fmt.Errorf("unsupported metadata path %v", arg)
+	}
+
+	content, err := json.Marshal(object)
+	if err != nil {
+		return "", err
+	}
+	var target interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&target); err != nil {
+		return "", err
+	}
+	for _, part := range parts[2:] {
+		fields, isMap := target.(map[string]interface{})
+		if !isMap {
+			return "", fmt.Errorf("metadata path %v not found", arg)
+		}
+		if target = fields[part]; target == nil {
+			return "", nil
+		}
+	}
+
+	switch v := target.(type) {
+	case string:
+		return v, nil
+	case map[string]interface{}, []interface{}:
+		return "", fmt.Errorf("metadata path %v is not a value", arg)
+	}
+	return fmt.Sprintf("%v", target), nil
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func setRouteTable(t *testing.T, content string) {
+	procNetRoutePath = filepath.Join(t.TempDir(), "route")
+	if err := ioutil.WriteFile(procNetRoutePath, []byte(content), 0644); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+}
+
+func TestResolveValueHostKeywords(t *testing.T) {
+	defer func(p string) { procNetRoutePath = p }(procNetRoutePath)
+	defer func(f func() (string, error)) { osHostname = f }(osHostname)
+	osHostname = func() (string, error) { return "local", nil }
+
+	setRouteTable(t, "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"+
+		"eth1\t00000000\t0101A8C0\t0003\t0\t0\t200\t00000000\t0\t0\t0\n"+
+		"eth0\t00000000\t010011AC\t0003\t0\t0\t100\t00000000\t0\t0\t0\n"+
+		"eth0\t000011AC\t00000000\t0001\t0\t0\t0\t0000FFFF\t0\t0\t0\n")
+
+	host := metadata.Host{
+		Name:     "host-1",
+		Hostname: "node1.example.com",
+		AgentIP:  "172.17.0.5",
+		HostId:   12,
+		Memory:   16777216000,
+		Labels:   map[string]string{"zone": "us-east"},
+	}
+
+	tests := []struct {
+		host     metadata.Host
+		raw      string
+		expected string
+	}{
+		{host, "__hostname__", "node1.example.com"},
+		{metadata.Host{Name: "host-1"}, "__hostname__", "host-1"},
+		{metadata.Host{}, "__hostname__", "local"},
+		{host, "__host_iface__", "eth0"},
+		{host, "__metadata_path__:self/host/agent_ip", "172.17.0.5"},
+		{host, "__metadata_path__:/self/host/host_id", "12"},
+		{host, "__metadata_path__:self/host/memory", "16777216000"},
+		{host, "__metadata_path__:self/host/labels/zone", "us-east"},
+		{host, "__metadata_path__:self/host/labels/missing", ""},
+		{host, "__metadata_path__:self/container/name", ""},
+		{host, "__metadata_path__:self/host/labels", ""},
+		{host, "__metadata_path__:self/stack/name", ""},
+		{host, "__resolve__:label=iface,keyword=__host_iface__,default=eth9", "eth0"},
+	}
+
+	for _, test := range tests {
+		config := map[string]interface{}{"value": test.raw}
+		UpdateCNIConfigByKeywords(config, test.host)
+		if config["value"] != test.expected {
+			t.Errorf("%v: expected: %q, got actual: %q", test.raw, test.expected, config["value"])
+		}
+	}
+
+	setRouteTable(t, "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n")
+	if _, err := ResolveValue("__host_iface__", ResolveContext{}); err == nil {
+		t.Errorf("expecting error without a default route, but got nil")
+	}
+	v, err := ResolveValue("__resolve__:keyword=__host_iface__,default=eth9", ResolveContext{})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if v != "eth9" {
+		t.Errorf("expected: eth9, got actual: %v", v)
+	}
+	if _, err := ResolveValue("__resolve__:keyword=eth0", ResolveContext{}); err == nil {
+		t.Errorf("expecting error for a source which isn't a keyword, but got nil")
+	}
+}
+
+func TestRegisterKeyword(t *testing.T) {
+	resolver := func(arg string, ctx ResolveContext) (string, error) {
+		if arg == "" {
+			return "", fmt.Errorf("missing argument")
+		}
+		return ctx.Host.UUID + "-" + arg, nil
+	}
+
+	if err := RegisterKeyword("__custom__", resolver); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	defer RegisterKeyword("__custom__", nil)
+
+	ctx := ResolveContext{Host: metadata.Host{UUID: "host1"}}
+	v, err := ResolveValue("__custom__:eth0", ctx)
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+	if v != "host1-eth0" {
+		t.Errorf("expected: host1-eth0, got actual: %v", v)
+	}
+	if _, err := ResolveValue("__custom__", ctx); err == nil {
+		t.Errorf("expecting error without an argument, but got nil")
+	}
+	if v, _ := ResolveValue("__custom__:a b:urlencode", ctx); v != "host1-a+b" {
+		t.Errorf("expected: host1-a+b, got actual: %v", v)
+	}
+
+	config := map[string]interface{}{"a": "__custom__:x", "b": "__hostname__"}
+	keywords := ExtractKeywords(config)
+	if len(keywords) != 2 {
+		t.Errorf("expected both keywords to be extracted, got actual: %v", keywords)
+	}
+
+	for _, keyword := range []string{"custom", "__x", "__a:b__", "__host_ip__", "__hostname__"} {
+		if err := RegisterKeyword(keyword, resolver); err == nil {
+			t.Errorf("%v: expecting error, but got nil", keyword)
+		}
+	}
+
+	RegisterKeyword("__custom__", nil)
+	if v, _ := ResolveValue("__custom__:eth0", ctx); v != "__custom__:eth0" {
+		t.Errorf("expected the removed keyword to be a literal, got actual: %v", v)
+	}
+}
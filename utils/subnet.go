@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// SubnetsEqual checks if both subnets have the same network address and
+// prefix length, regardless of how they are written. Subnets of different
+// address families are never equal.
+func SubnetsEqual(a, b string) (bool, error) {
+	_, aNet, err := net.ParseCIDR(a)
+	if err != nil {
+		return false, errors.Wrapf(err, "parsing subnet %v", a)
+	}
+	_, bNet, err := net.ParseCIDR(b)
+	if err != nil {
+		return false, errors.Wrapf(err, "parsing subnet %v", b)
+	}
+
+	aOnes, aBits := aNet.Mask.Size()
+	bOnes, bBits := bNet.Mask.Size()
+	return aNet.IP.Equal(bNet.IP) && aOnes == bOnes && aBits == bBits, nil
+}
+
+// CanonicalSubnet returns the given subnet written as its network address
+// and prefix length, e.g. 10.42.0.1/16 becomes 10.42.0.0/16
+func CanonicalSubnet(subnet string) (string, error) {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return "", errors.Wrapf(err, "parsing subnet %v", subnet)
+	}
+	return ipNet.String(), nil
+}
+
+// GatewayIPForSubnet returns the conventional gateway of the given subnet,
+// the first address after the network address
+func GatewayIPForSubnet(subnet string) (net.IP, error) {
+	return NthHostIP(subnet, 1)
+}
+
+// NthHostIP returns the nth host address of the given subnet, counting
+// from 1 for the first address after the network address. The network
+// and broadcast addresses are never returned.
+func NthHostIP(subnet string, n int) (net.IP, error) {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing subnet %v", subnet)
+	}
+	ones, bits := ipNet.Mask.Size()
+
+	hosts := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	hosts.Sub(hosts, big.NewInt(2))
+	if n < 1 || hosts.Cmp(big.NewInt(int64(n))) < 0 {
+		return nil, fmt.Errorf("subnet %v doesn't have a host number %v", subnet, n)
+	}
+
+	ip := new(big.Int).SetBytes(ipNet.IP)
+	ip.Add(ip, big.NewInt(int64(n)))
+	b := ip.Bytes()
+	host := make(net.IP, len(ipNet.IP))
+	copy(host[len(host)-len(b):], b)
+	return host, nil
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestSubnetsEqual(t *testing.T) {
+	for _, c := range []struct {
+		a, b  string
+		equal bool
+	}{
+		{"10.42.0.0/16", "10.42.0.0/16", true},
+		{"10.42.0.0/16", "10.42.0.1/16", true},
+		{"10.42.128.7/16", "10.42.0.0/16", true},
+		{"fd00:0:0::/64", "fd00::1/64", true},
+		{"FD00::/64", "fd00::/64", true},
+		{"10.42.0.0/16", "10.42.0.0/17", false},
+		{"10.42.0.0/16", "10.43.0.0/16", false},
+		{"fd00::/64", "fd01::/64", false},
+		{"10.42.0.0/16", "fd00::/16", false},
+		{"10.42.0.0/16", "::ffff:10.42.0.0/112", false},
+	} {
+		equal, err := SubnetsEqual(c.a, c.b)
+		if err != nil {
+			t.Errorf("%v %v: not expecting error: %v", c.a, c.b, err)
+		}
+		if equal != c.equal {
+			t.Errorf("%v %v: expected: %v, got actual: %v", c.a, c.b, c.equal, equal)
+		}
+	}
+
+	for _, invalid := range []string{"", "10.42.0.0", "10.42.0.0/33", "not-a-subnet/16"} {
+		if _, err := SubnetsEqual(invalid, "10.42.0.0/16"); err == nil {
+			t.Errorf("%q: expecting error, but got nil", invalid)
+		}
+		if _, err := SubnetsEqual("10.42.0.0/16", invalid); err == nil {
+			t.Errorf("%q: expecting error, but got nil", invalid)
+		}
+	}
+}
+
+func TestCanonicalSubnet(t *testing.T) {
+	for _, c := range []struct {
+		subnet, expected string
+	}{
+		{"10.42.0.0/16", "10.42.0.0/16"},
+		{"10.42.3.7/16", "10.42.0.0/16"},
+		{"FD00::1/64", "fd00::/64"},
+	} {
+		actual, err := CanonicalSubnet(c.subnet)
+		if err != nil {
+			t.Errorf("%v: not expecting error: %v", c.subnet, err)
+		}
+		if actual != c.expected {
+			t.Errorf("%v: expected: %v, got actual: %v", c.subnet, c.expected, actual)
+		}
+	}
+
+	if _, err := CanonicalSubnet("10.42.0.0"); err == nil {
+		t.Errorf("expecting error, but got nil")
+	}
+}
+
+func TestGatewayIPForSubnet(t *testing.T) {
+	for _, c := range []struct {
+		subnet, expected string
+	}{
+		{"10.42.0.0/16", "10.42.0.1"},
+		{"10.42.7.9/16", "10.42.0.1"},
+		{"192.168.1.0/30", "192.168.1.1"},
+		{"fd00::/64", "fd00::1"},
+	} {
+		actual, err := GatewayIPForSubnet(c.subnet)
+		if err != nil {
+			t.Errorf("%v: not expecting error: %v", c.subnet, err)
+			continue
+		}
+		if actual.String() != c.expected {
+			t.Errorf("%v: expected: %v, got actual: %v", c.subnet, c.expected, actual)
+		}
+	}
+
+	for _, invalid := range []string{"10.42.0.0", "10.42.0.1/32", "10.42.0.0/31"} {
+		if _, err := GatewayIPForSubnet(invalid); err == nil {
+			t.Errorf("%v: expecting error, but got nil", invalid)
+		}
+	}
+}
+
+func TestNthHostIP(t *testing.T) {
+	for _, c := range []struct {
+		subnet   string
+		n        int
+		expected string
+	}{
+		{"10.42.0.0/16", 1, "10.42.0.1"},
+		{"10.42.0.0/16", 256, "10.42.1.0"},
+		{"10.42.0.0/16", 65534, "10.42.255.254"},
+		{"192.168.1.0/30", 2, "192.168.1.2"},
+		{"fd00::/64", 1, "fd00::1"},
+		{"fd00::/64", 65536, "fd00::1:0"},
+		{"10.42.0.0/16", 0, ""},
+		{"10.42.0.0/16", -1, ""},
+		{"10.42.0.0/16", 65535, ""},
+		{"192.168.1.0/30", 3, ""},
+		{"10.42.0.1/32", 1, ""},
+	} {
+		actual, err := NthHostIP(c.subnet, c.n)
+		if c.expected == "" {
+			if err == nil {
+				t.Errorf("%v %v: expecting error, but got %v", c.subnet, c.n, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v %v: not expecting error: %v", c.subnet, c.n, err)
+			continue
+		}
+		if actual.String() != c.expected {
+			t.Errorf("%v %v: expected: %v, got actual: %v", c.subnet, c.n, c.expected, actual)
+		}
+	}
+}
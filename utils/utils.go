@@ -1,40 +1,531 @@
 package utils
 
 import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/rancher/go-rancher-metadata/metadata"
 )
 
 const (
-	hostLabelKeyword = "__host_label__"
+	hostLabelKeyword       = "__host_label__"
+	containerLabelKeyword  = "__container_label__"
+	fileKeyword            = "__file__"
+	refKeyword             = "__ref__"
+	resolveKeyword         = "__resolve__"
+	hostIPKeyword          = "__host_ip__"
+	hostUUIDKeyword        = "__host_uuid__"
+	environmentUUIDKeyword = "__environment_uuid__"
+	subnetHostKeyword      = "__subnet_host__"
+	urlEncodeSuffix        = ":urlencode"
+	networkUUIDKeyword     = "{network_uuid}"
+
+	rancherBridgeType = "rancher-bridge"
+
+	// maxRefDepth limits how many references are followed to resolve
+	// a single value, which also stops reference cycles
+	maxRefDepth = 10
+
+	// maxInterfaceNameLength is IFNAMSIZ without the trailing NUL
+	maxInterfaceNameLength = 15
+	// minInterfaceNameSuffix is the number of hash characters always
+	// kept in the generated interface names
+	minInterfaceNameSuffix = 4
 )
 
+// ResolveContext holds what's needed to resolve the keywords of a CNI config
+type ResolveContext struct {
+	Host metadata.Host
+	// Container is optional, without it the container keywords
+	// resolve to empty values
+	Container *metadata.Container
+	// Overrides maps raw values to the value to use instead, they take
+	// precedence over the keywords
+	Overrides map[string]string
+
+	// root is the config the references are resolved against
+	root     map[string]interface{}
+	refDepth int
+	// bridgeSubnet is the resolved bridgeSubnet of root, used by the
+	// __subnet_host__ keyword
+	bridgeSubnet string
+}
+
 // UpdateCNIConfigByKeywords takes in the given CNI config, replaces the rancher
 // specific keywords with the appropriate values.
 func UpdateCNIConfigByKeywords(config interface{}, host metadata.Host) interface{} {
+	return ResolveCNIConfig(config, ResolveContext{Host: host})
+}
+
+// ResolveCNIConfig replaces the values of the given CNI config using
+// ResolveValue. Values which can't be resolved are set to empty. The
+// references to other fields, __ref__:<dotted path>, are resolved in a
+// second pass so they get the already resolved value of the field. Only
+// the strings are resolved, other values like the numeric IDs of the CNI
+// args are left untouched. The bridgeSubnet is resolved before the other
+// fields, so the __subnet_host__ keywords all use its resolved value, a
+// bridgeSubnet referring another field can't be used by them.
+func ResolveCNIConfig(config interface{}, ctx ResolveContext) interface{} {
 	props, isMap := config.(map[string]interface{})
 	if !isMap {
 		return config
 	}
 
+	ctx.root = props
+	rawSubnet, subnetFirst := props["bridgeSubnet"].(string)
+	subnetFirst = subnetFirst && !strings.HasPrefix(rawSubnet, refKeyword)
+	if subnetFirst {
+		props["bridgeSubnet"] = resolveProp("bridgeSubnet", rawSubnet, ctx, false)
+		ctx.bridgeSubnet = props["bridgeSubnet"].(string)
+	}
+	for aKey, aValue := range props {
+		if aKey != "bridgeSubnet" || !subnetFirst {
+			props[aKey] = resolveProp(aKey, aValue, ctx, false)
+		}
+	}
+	resolveProps(props, ctx, true)
+	return props
+}
+
+func resolveProps(props map[string]interface{}, ctx ResolveContext, refPass bool) {
 	for aKey, aValue := range props {
-		if v, isString := aValue.(string); isString {
-			if strings.HasPrefix(v, hostLabelKeyword) {
-				props[aKey] = ""
-				splits := strings.SplitN(v, ":", 2)
-				if len(splits) > 1 {
-					label := strings.TrimSpace(splits[1])
-					labelValue := host.Labels[label]
-					if labelValue != "" {
-						props[aKey] = labelValue
-					}
+		props[aKey] = resolveProp(aKey, aValue, ctx, refPass)
+	}
+}
+
+// resolveProp returns the resolved value of the given property, the maps
+// and slices are resolved in place
+func resolveProp(key string, value interface{}, ctx ResolveContext, refPass bool) interface{} {
+	switch v := value.(type) {
+	case string:
+		if strings.HasPrefix(v, refKeyword) != refPass {
+			return v
+		}
+		resolved, err := ResolveValue(v, ctx)
+		if err != nil {
+			logrus.Warnf("Couldn't resolve value of %v: %v", key, err)
+		}
+		return resolved
+	case map[string]interface{}:
+		resolveProps(v, ctx, refPass)
+	case []interface{}:
+		for i, item := range v {
+			v[i] = resolveProp(fmt.Sprintf("%v[%v]", key, i), item, ctx, refPass)
+		}
+	}
+	return value
+}
+
+// ResolveValue returns the value to use for the given raw CNI config value.
+// An explicit override of the raw value from the context takes precedence,
+// then the value of the keyword the raw value starts with, if any, built-in
+// or added with RegisterKeyword, and last the raw value itself as a
+// literal. The keywords without argument, like __host_ip__, have to match
+// the whole raw value. When a keyword can't be resolved an empty value is returned. A
+// keyword ending with :urlencode has its value URL encoded.
+func ResolveValue(raw string, ctx ResolveContext) (string, error) {
+	if v, ok := ctx.Overrides[raw]; ok {
+		return v, nil
+	}
+
+	if isKeyword(raw) && strings.HasSuffix(raw, urlEncodeSuffix) {
+		v, err := ResolveValue(strings.TrimSuffix(raw, urlEncodeSuffix), ctx)
+		return url.QueryEscape(v), err
+	}
+
+	switch {
+	case strings.HasPrefix(raw, hostLabelKeyword):
+		splits := strings.SplitN(raw, ":", 2)
+		if len(splits) > 1 {
+			label := strings.TrimSpace(splits[1])
+			return ctx.Host.Labels[label], nil
+		}
+		return "", nil
+	case strings.HasPrefix(raw, containerLabelKeyword):
+		splits := strings.SplitN(raw, ":", 2)
+		if len(splits) > 1 && ctx.Container != nil {
+			label := strings.TrimSpace(splits[1])
+			return ctx.Container.Labels[label], nil
+		}
+		return "", nil
+	case strings.HasPrefix(raw, fileKeyword):
+		return readKeywordFile(raw)
+	case strings.HasPrefix(raw, refKeyword):
+		return resolveRef(raw, ctx)
+	case strings.HasPrefix(raw, resolveKeyword):
+		return resolveChain(raw, ctx)
+	case raw == hostIPKeyword:
+		return ctx.Host.AgentIP, nil
+	case raw == hostUUIDKeyword:
+		return ctx.Host.UUID, nil
+	case raw == environmentUUIDKeyword:
+		return ctx.Host.EnvironmentUUID, nil
+	case strings.HasPrefix(raw, subnetHostKeyword):
+		return resolveSubnetHost(raw, ctx)
+	}
+
+	if resolver, arg, ok := lookupKeyword(raw); ok {
+		return resolver(arg, ctx)
+	}
+
+	return raw, nil
+}
+
+// builtinKeywords are the keywords which can't be registered
+var builtinKeywords = []string{
+	hostLabelKeyword,
+	containerLabelKeyword,
+	fileKeyword,
+	refKeyword,
+	resolveKeyword,
+	hostIPKeyword,
+	hostUUIDKeyword,
+	environmentUUIDKeyword,
+	subnetHostKeyword,
+	hostnameKeyword,
+	hostIfaceKeyword,
+	metadataPathKeyword,
+}
+
+func isBuiltinKeyword(keyword string) bool {
+	for _, k := range builtinKeywords {
+		if k == keyword {
+			return true
+		}
+	}
+	return false
+}
+
+func isKeyword(raw string) bool {
+	for _, k := range builtinKeywords {
+		if strings.HasPrefix(raw, k) {
+			return true
+		}
+	}
+	_, _, ok := lookupKeyword(raw)
+	return ok
+}
+
+// ExtractKeywords returns the distinct keywords used by the values of the
+// given config, sorted, e.g. to know what a config needs before resolving it
+func ExtractKeywords(config interface{}) []string {
+	found := map[string]bool{}
+	collectKeywords(config, found)
+
+	keywords := []string{}
+	for k := range found {
+		keywords = append(keywords, k)
+	}
+	sort.Strings(keywords)
+	return keywords
+}
+
+func collectKeywords(value interface{}, found map[string]bool) {
+	switch v := value.(type) {
+	case string:
+		if isKeyword(v) {
+			found[v] = true
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			collectKeywords(item, found)
+		}
+	case []interface{}:
+		for _, item := range v {
+			collectKeywords(item, found)
+		}
+	}
+}
+
+// resolveSubnetHost returns the host address referred by the given
+// __subnet_host__:N keyword, the Nth one of the resolved bridgeSubnet of
+// the config
+func resolveSubnetHost(raw string, ctx ResolveContext) (string, error) {
+	splits := strings.SplitN(raw, ":", 2)
+	if len(splits) < 2 {
+		return "", nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(splits[1]))
+	if err != nil {
+		return "", fmt.Errorf("invalid host number in %v: %v", raw, err)
+	}
+
+	if ctx.bridgeSubnet == "" {
+		return "", fmt.Errorf("no bridgeSubnet to resolve %v", raw)
+	}
+
+	ip, err := NthHostIP(ctx.bridgeSubnet, n)
+	if err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+// resolveChainSources are the sources of the __resolve__ keyword, in the
+// order they're tried whatever the order they're listed in
+var resolveChainSources = []string{"label", "env", "keyword", "default"}
+
+// resolveChain returns the first non empty value of the sources of the
+// given __resolve__:label=<host label>,env=<env var>,keyword=<keyword>,
+// default=<literal> keyword. The host label is tried first, then the env
+// var, the keyword and last the literal default, an override of the whole
+// raw value from the context coming before all of them. A keyword source
+// which can't be resolved falls through to the next source.
+func resolveChain(raw string, ctx ResolveContext) (string, error) {
+	splits := strings.SplitN(raw, ":", 2)
+	if len(splits) < 2 {
+		return "", nil
+	}
+
+	args := map[string][]string{}
+	for _, source := range strings.Split(splits[1], ",") {
+		kv := strings.SplitN(source, "=", 2)
+		if len(kv) < 2 {
+			return "", fmt.Errorf("invalid source %v in %v", source, raw)
+		}
+		name, arg := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch name {
+		case "label", "env", "default":
+		case "keyword":
+			if !isKeyword(arg) {
+				return "", fmt.Errorf("unknown keyword %v in %v", arg, raw)
+			}
+		default:
+			return "", fmt.Errorf("unknown source %v in %v", name, raw)
+		}
+		args[name] = append(args[name], arg)
+	}
+
+	for _, name := range resolveChainSources {
+		for _, arg := range args[name] {
+			var v string
+			switch name {
+			case "label":
+				v = ctx.Host.Labels[arg]
+			case "env":
+				v = os.Getenv(arg)
+			case "keyword":
+				var err error
+				if v, err = ResolveValue(arg, ctx); err != nil {
+					logrus.Debugf("Couldn't resolve %v of %v: %v", arg, raw, err)
 				}
+			case "default":
+				v = arg
+			}
+			if v != "" {
+				return v, nil
 			}
-		} else {
-			props[aKey] = UpdateCNIConfigByKeywords(aValue, host)
 		}
 	}
+	return "", nil
+}
 
-	return props
+// resolveRef returns the resolved value of the field referred by the given
+// __ref__:<dotted path> keyword. The value of the field is used as it is,
+// unless it's another reference.
+func resolveRef(raw string, ctx ResolveContext) (string, error) {
+	splits := strings.SplitN(raw, ":", 2)
+	if len(splits) < 2 || ctx.root == nil {
+		return "", nil
+	}
+	if ctx.refDepth >= maxRefDepth {
+		return "", fmt.Errorf("more than %v references followed for %v, there may be a cycle", maxRefDepth, raw)
+	}
+
+	var target interface{} = ctx.root
+	for _, part := range strings.Split(strings.TrimSpace(splits[1]), ".") {
+		props, isMap := target.(map[string]interface{})
+		if !isMap {
+			return "", fmt.Errorf("field %v referred by %v not found", splits[1], raw)
+		}
+		var found bool
+		if target, found = props[part]; !found {
+			return "", fmt.Errorf("field %v referred by %v not found", splits[1], raw)
+		}
+	}
+
+	switch v := target.(type) {
+	case string:
+		// The other fields are resolved by the first pass already, only
+		// a reference still has to be followed
+		if !strings.HasPrefix(v, refKeyword) {
+			return v, nil
+		}
+		ctx.refDepth++
+		return ResolveValue(v, ctx)
+	case map[string]interface{}, []interface{}:
+		return "", fmt.Errorf("field %v referred by %v is not a value", splits[1], raw)
+	}
+	return fmt.Sprintf("%v", target), nil
+}
+
+// readKeywordFile returns the trimmed contents of the file referred by
+// the given __file__:<path> keyword. As these are usually secrets, the
+// contents must never be logged.
+func readKeywordFile(v string) (string, error) {
+	splits := strings.SplitN(v, ":", 2)
+	if len(splits) < 2 {
+		return "", nil
+	}
+	path := strings.TrimSpace(splits[1])
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read file %v for %v keyword: %v", path, fileKeyword, err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// ResolveCNIFileName takes in the given CNI config file name and replaces
+// the rancher specific placeholders with the values of the network.
+func ResolveCNIFileName(template string, network metadata.Network) string {
+	return strings.Replace(template, networkUUIDKeyword, network.UUID, -1)
+}
+
+// BridgeInfo is the bridge config of a network, from its CNI config
+type BridgeInfo struct {
+	Name   string
+	Subnet string
+	// SubnetV6 is the optional second subnet of a dual-stack bridge,
+	// from bridgeSubnetV6
+	SubnetV6 string
+	MTU      int
+	Gateway  string
+	CNIType  string
+	// VxlanDevice is the vxlan device of an overlay network, from
+	// vxlanDevice
+	VxlanDevice string
+}
+
+// CopyConfig returns a deep copy of the maps and slices of the given
+// config, UpdateCNIConfigByKeywords resolves the keywords in place so the
+// metadata has to be copied to be left untouched
+func CopyConfig(config interface{}) interface{} {
+	switch v := config.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			c[key] = CopyConfig(value)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, value := range v {
+			c[i] = CopyConfig(value)
+		}
+		return c
+	}
+	return config
+}
+
+// GetBridgeInfo returns the bridge name and subnet from the rancher-bridge
+// CNI config of the given network, empty if the network doesn't have one.
+func GetBridgeInfo(network metadata.Network, host metadata.Host) (bridge string, bridgeSubnet string) {
+	info := GetBridgeInfoForType(network, host, rancherBridgeType)
+	return info.Name, info.Subnet
+}
+
+// GetBridgeSubnets returns the bridge name and all the subnets from the
+// rancher-bridge CNI config of the given network: the bridgeSubnet and,
+// for a dual-stack bridge, the bridgeSubnetV6.
+func GetBridgeSubnets(network metadata.Network, host metadata.Host) (bridge string, subnets []string) {
+	info := GetBridgeInfoForType(network, host, rancherBridgeType)
+	for _, subnet := range []string{info.Subnet, info.SubnetV6} {
+		if subnet != "" {
+			subnets = append(subnets, subnet)
+		}
+	}
+	return info.Name, subnets
+}
+
+// GetBridgeInfoForType returns the bridge config from the CNI config of
+// the given type of the network, empty if the network doesn't have one.
+// The configs without a type or a bridge are skipped. The keywords are
+// resolved on a copy, the metadata of the network is left untouched.
+func GetBridgeInfoForType(network metadata.Network, host metadata.Host, cniType string) BridgeInfo {
+	conf, _ := network.Metadata["cniConfig"].(map[string]interface{})
+	for _, file := range conf {
+		file = UpdateCNIConfigByKeywords(CopyConfig(file), host)
+		props, _ := file.(map[string]interface{})
+		checkType, ok := props["type"].(string)
+		if !ok || checkType != cniType {
+			continue
+		}
+		checkBridge, _ := props["bridge"].(string)
+		if checkBridge == "" {
+			continue
+		}
+
+		info := BridgeInfo{Name: checkBridge, CNIType: checkType}
+		info.Subnet, _ = props["bridgeSubnet"].(string)
+		info.SubnetV6, _ = props["bridgeSubnetV6"].(string)
+		info.Gateway, _ = props["gateway"].(string)
+		info.MTU = intProp(props["mtu"])
+		info.VxlanDevice, _ = props["vxlanDevice"].(string)
+		return info
+	}
+
+	return BridgeInfo{}
+}
+
+// intProp returns the integer value of a CNI config property, the numbers
+// decoded from JSON are float64 and the resolved keywords are strings.
+// It's 0 if the value isn't a whole number.
+func intProp(v interface{}) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case float64:
+		if n != math.Trunc(n) || n > math.MaxInt32 || n < math.MinInt32 {
+			return 0
+		}
+		return int(n)
+	case string:
+		i, err := strconv.Atoi(strings.TrimSpace(n))
+		if err != nil {
+			return 0
+		}
+		return i
+	}
+	return 0
+}
+
+// InterfaceNameForNetwork generates a short and stable interface name for
+// the given network UUID, made of the prefix followed by a hash of the UUID.
+// The prefix is shortened if needed to fit the kernel interface name limit.
+func InterfaceNameForNetwork(prefix string, uuid string) string {
+	if len(prefix) > maxInterfaceNameLength-minInterfaceNameSuffix {
+		prefix = prefix[:maxInterfaceNameLength-minInterfaceNameSuffix]
+	}
+	sum := fmt.Sprintf("%x", sha1.Sum([]byte(uuid)))
+	return prefix + sum[:maxInterfaceNameLength-len(prefix)]
+}
+
+// ValidateInterfaceName checks the given name is accepted by the kernel as
+// an interface name: not empty, at most 15 characters long, not "." nor
+// ".." and without any '/', ':' or whitespace characters.
+func ValidateInterfaceName(name string) error {
+	if name == "" {
+		return fmt.Errorf("interface name is empty")
+	}
+	if len(name) > maxInterfaceNameLength {
+		return fmt.Errorf("interface name %v is longer than %v characters", name, maxInterfaceNameLength)
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("invalid interface name %v", name)
+	}
+	for _, c := range name {
+		if c == '/' || c == ':' || unicode.IsSpace(c) {
+			return fmt.Errorf("invalid character %q in interface name %v", c, name)
+		}
+	}
+	return nil
 }
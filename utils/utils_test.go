@@ -0,0 +1,628 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestResolveCNIFileName(t *testing.T) {
+	network := metadata.Network{
+		Name: "ipsec",
+		UUID: "8b9d4b6c-0f3a-4c1e-9d4a-6a1f6e0c2b7e",
+	}
+
+	actual := ResolveCNIFileName("10-{network_uuid}.conf", network)
+	expected := "10-8b9d4b6c-0f3a-4c1e-9d4a-6a1f6e0c2b7e.conf"
+	if actual != expected {
+		t.Errorf("expected: %v, got actual: %v", expected, actual)
+	}
+
+	actual = ResolveCNIFileName("10-rancher.conf", network)
+	expected = "10-rancher.conf"
+	if actual != expected {
+		t.Errorf("expected: %v, got actual: %v", expected, actual)
+	}
+}
+
+func TestGetBridgeInfo(t *testing.T) {
+	host := metadata.Host{
+		Labels: map[string]string{"bridge": "docker0"},
+	}
+	network := metadata.Network{
+		Metadata: map[string]interface{}{
+			"cniConfig": map[string]interface{}{
+				"10-rancher.conf": map[string]interface{}{
+					"type":         "rancher-bridge",
+					"bridge":       "__host_label__:bridge",
+					"bridgeSubnet": "10.42.0.0/16",
+				},
+			},
+		},
+	}
+
+	bridge, bridgeSubnet := GetBridgeInfo(network, host)
+	if bridge != "docker0" || bridgeSubnet != "10.42.0.0/16" {
+		t.Errorf("expected: docker0 10.42.0.0/16, got actual: %v %v", bridge, bridgeSubnet)
+	}
+
+	// The keywords are resolved on a copy, so resolving again for
+	// another host sees them
+	props := network.Metadata["cniConfig"].(map[string]interface{})["10-rancher.conf"].(map[string]interface{})
+	if props["bridge"] != "__host_label__:bridge" {
+		t.Errorf("expected the network to be left untouched, got actual: %v", props["bridge"])
+	}
+	bridge, _ = GetBridgeInfo(network, metadata.Host{Labels: map[string]string{"bridge": "docker1"}})
+	if bridge != "docker1" {
+		t.Errorf("expected: docker1, got actual: %v", bridge)
+	}
+
+	bridge, bridgeSubnet = GetBridgeInfo(metadata.Network{}, host)
+	if bridge != "" || bridgeSubnet != "" {
+		t.Errorf("expected empty bridge info, got actual: %v %v", bridge, bridgeSubnet)
+	}
+}
+
+func TestGetBridgeSubnets(t *testing.T) {
+	network := func(props map[string]interface{}) metadata.Network {
+		props["type"] = "rancher-bridge"
+		props["bridge"] = "docker0"
+		return metadata.Network{Metadata: map[string]interface{}{
+			"cniConfig": map[string]interface{}{"10-rancher.conf": props},
+		}}
+	}
+
+	for _, c := range []struct {
+		props    map[string]interface{}
+		expected []string
+	}{
+		{map[string]interface{}{"bridgeSubnet": "10.42.0.1/16"}, []string{"10.42.0.1/16"}},
+		{map[string]interface{}{"bridgeSubnet": "fd00:42::1/64"}, []string{"fd00:42::1/64"}},
+		{map[string]interface{}{"bridgeSubnet": "10.42.0.1/16", "bridgeSubnetV6": "fd00:42::1/64"}, []string{"10.42.0.1/16", "fd00:42::1/64"}},
+		{map[string]interface{}{}, nil},
+	} {
+		bridge, subnets := GetBridgeSubnets(network(c.props), metadata.Host{})
+		if bridge != "docker0" {
+			t.Errorf("expected: docker0, got actual: %v", bridge)
+		}
+		if !reflect.DeepEqual(subnets, c.expected) {
+			t.Errorf("expected: %v, got actual: %v", c.expected, subnets)
+		}
+	}
+}
+
+func TestGetBridgeInfoForType(t *testing.T) {
+	host := metadata.Host{Labels: map[string]string{"mtu": "1400"}}
+	network := func(props map[string]interface{}) metadata.Network {
+		return metadata.Network{Metadata: map[string]interface{}{
+			"cniConfig": map[string]interface{}{"10-test.conf": props},
+		}}
+	}
+
+	tests := []struct {
+		name     string
+		props    map[string]interface{}
+		cniType  string
+		expected BridgeInfo
+	}{
+		{
+			"rancher-bridge",
+			map[string]interface{}{
+				"type":         "rancher-bridge",
+				"bridge":       "docker0",
+				"bridgeSubnet": "10.42.0.1/16",
+				"gateway":      "10.42.0.1",
+				"mtu":          float64(1500),
+				"vxlanDevice":  "vtep1042",
+			},
+			"rancher-bridge",
+			BridgeInfo{Name: "docker0", Subnet: "10.42.0.1/16", MTU: 1500, Gateway: "10.42.0.1", CNIType: "rancher-bridge", VxlanDevice: "vtep1042"},
+		},
+		{
+			"custom type",
+			map[string]interface{}{
+				"type":         "custom-bridge",
+				"bridge":       "cbr0",
+				"bridgeSubnet": "10.50.0.0/16",
+				"mtu":          "__host_label__:mtu",
+			},
+			"custom-bridge",
+			BridgeInfo{Name: "cbr0", Subnet: "10.50.0.0/16", MTU: 1400, CNIType: "custom-bridge"},
+		},
+		{
+			"other type",
+			map[string]interface{}{"type": "custom-bridge", "bridge": "cbr0"},
+			"rancher-bridge",
+			BridgeInfo{},
+		},
+		{
+			"missing bridge",
+			map[string]interface{}{"type": "rancher-bridge", "bridgeSubnet": "10.42.0.1/16"},
+			"rancher-bridge",
+			BridgeInfo{},
+		},
+		{
+			"missing type",
+			map[string]interface{}{"bridge": "docker0"},
+			"",
+			BridgeInfo{},
+		},
+		{
+			"invalid mtu",
+			map[string]interface{}{"type": "rancher-bridge", "bridge": "docker0", "mtu": 1500.5},
+			"rancher-bridge",
+			BridgeInfo{Name: "docker0", CNIType: "rancher-bridge"},
+		},
+	}
+
+	for _, test := range tests {
+		actual := GetBridgeInfoForType(network(test.props), host, test.cniType)
+		if actual != test.expected {
+			t.Errorf("%v: expected: %+v, got actual: %+v", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestInterfaceNameForNetwork(t *testing.T) {
+	uuid := "8b9d4b6c-0f3a-4c1e-9d4a-6a1f6e0c2b7e"
+	for _, prefix := range []string{"", "vx-", "averyverylongprefix"} {
+		name := InterfaceNameForNetwork(prefix, uuid)
+		if len(name) > 15 {
+			t.Errorf("expected at most 15 characters, got actual: %v", name)
+		}
+		if again := InterfaceNameForNetwork(prefix, uuid); again != name {
+			t.Errorf("expected: %v, got actual: %v", name, again)
+		}
+	}
+
+	name := InterfaceNameForNetwork("vx-", uuid)
+	if !strings.HasPrefix(name, "vx-") {
+		t.Errorf("expected prefix vx-, got actual: %v", name)
+	}
+	if other := InterfaceNameForNetwork("vx-", "a-different-uuid"); other == name {
+		t.Errorf("expected different names for different networks, got: %v", other)
+	}
+}
+
+func TestUpdateCNIConfigByKeywordsFile(t *testing.T) {
+	pskFile := filepath.Join(t.TempDir(), "psk")
+	if err := ioutil.WriteFile(pskFile, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	config := map[string]interface{}{
+		"psk":     "__file__:" + pskFile,
+		"missing": "__file__:" + filepath.Join(t.TempDir(), "missing"),
+	}
+	UpdateCNIConfigByKeywords(config, metadata.Host{})
+
+	if config["psk"] != "s3cr3t" {
+		t.Errorf("expected: s3cr3t, got actual: %v", config["psk"])
+	}
+	if config["missing"] != "" {
+		t.Errorf("expected missing file to collapse to empty, got actual: %v", config["missing"])
+	}
+}
+
+func TestUpdateCNIConfigByKeywordsHost(t *testing.T) {
+	host := metadata.Host{
+		UUID:            "host1",
+		EnvironmentUUID: "env1",
+		AgentIP:         "172.17.0.5",
+		Labels:          map[string]string{"zone": "us-east"},
+	}
+
+	tests := []struct {
+		host     metadata.Host
+		raw      string
+		expected string
+	}{
+		{host, "__host_ip__", "172.17.0.5"},
+		{host, "__host_uuid__", "host1"},
+		{host, "__environment_uuid__", "env1"},
+		{host, "__host_label__:zone", "us-east"},
+		{metadata.Host{}, "__host_ip__", ""},
+		{metadata.Host{}, "__host_uuid__", ""},
+		{metadata.Host{}, "__environment_uuid__", ""},
+		{metadata.Host{}, "__host_label__:zone", ""},
+		// only the exact keywords are resolved
+		{host, "__host_ip__foo", "__host_ip__foo"},
+		{host, "__host_uuid__:x", "__host_uuid__:x"},
+		{host, "__environment_uuid___suffix", "__environment_uuid___suffix"},
+	}
+
+	for _, test := range tests {
+		config := map[string]interface{}{"value": test.raw}
+		UpdateCNIConfigByKeywords(config, test.host)
+		if config["value"] != test.expected {
+			t.Errorf("%v: expected: %q, got actual: %q", test.raw, test.expected, config["value"])
+		}
+	}
+}
+
+func TestUpdateCNIConfigByKeywordsSlices(t *testing.T) {
+	host := metadata.Host{AgentIP: "172.17.0.5", Labels: map[string]string{"gw": "10.42.0.1"}}
+	config := map[string]interface{}{
+		"ipam": map[string]interface{}{
+			"routes": []interface{}{
+				map[string]interface{}{"dst": "0.0.0.0/0", "gw": "__host_label__:gw"},
+				map[string]interface{}{"dst": "__host_ip__", "gw": "__host_label__:missing"},
+			},
+		},
+		"names": []interface{}{"__host_ip__", []interface{}{"__host_label__:gw"}, 1500},
+	}
+	UpdateCNIConfigByKeywords(config, host)
+
+	expected := map[string]interface{}{
+		"ipam": map[string]interface{}{
+			"routes": []interface{}{
+				map[string]interface{}{"dst": "0.0.0.0/0", "gw": "10.42.0.1"},
+				map[string]interface{}{"dst": "172.17.0.5", "gw": ""},
+			},
+		},
+		"names": []interface{}{"172.17.0.5", []interface{}{"10.42.0.1"}, 1500},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, config)
+	}
+}
+
+func TestUpdateCNIConfigByKeywordsArgs(t *testing.T) {
+	host := metadata.Host{UUID: "host1", Labels: map[string]string{"zone": "us-east"}}
+	config := map[string]interface{}{
+		"type": "rancher-bridge",
+		"args": map[string]interface{}{
+			"cni": map[string]interface{}{
+				"zone":     "__host_label__:zone",
+				"host":     "__host_uuid__",
+				"uid":      float64(1000),
+				"vlanID":   json.Number("42"),
+				"hairpin":  true,
+				"literal":  "1000",
+				"portMaps": []interface{}{map[string]interface{}{"hostPort": float64(8080), "protocol": "tcp"}},
+			},
+		},
+	}
+	UpdateCNIConfigByKeywords(config, host)
+
+	expected := map[string]interface{}{
+		"type": "rancher-bridge",
+		"args": map[string]interface{}{
+			"cni": map[string]interface{}{
+				"zone":     "us-east",
+				"host":     "host1",
+				"uid":      float64(1000),
+				"vlanID":   json.Number("42"),
+				"hairpin":  true,
+				"literal":  "1000",
+				"portMaps": []interface{}{map[string]interface{}{"hostPort": float64(8080), "protocol": "tcp"}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, config)
+	}
+}
+
+func TestResolveValue(t *testing.T) {
+	pskFile := filepath.Join(t.TempDir(), "psk")
+	if err := ioutil.WriteFile(pskFile, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	ctx := ResolveContext{
+		Host: metadata.Host{Labels: map[string]string{"mtu": "1400"}},
+		Overrides: map[string]string{
+			"__host_label__:mtu":         "9000",
+			"cni0":                       "br0",
+			"__host_label__:overridden":  "",
+			"__file__:/nonexistent/file": "from-override",
+		},
+	}
+
+	tests := []struct {
+		raw, expected string
+		expectErr     bool
+	}{
+		// override > keyword
+		{"__host_label__:mtu", "9000", false},
+		{"__host_label__:overridden", "", false},
+		{"__file__:/nonexistent/file", "from-override", false},
+		// override > literal
+		{"cni0", "br0", false},
+		// keyword > literal
+		{"__host_label__: mtu", "1400", false},
+		{"__file__:" + pskFile, "s3cr3t", false},
+		{"__host_label__:missing", "", false},
+		{"__host_label__", "", false},
+		{"__file__:/nonexistent/other", "", true},
+		// literal
+		{"rancher-bridge", "rancher-bridge", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		actual, err := ResolveValue(test.raw, ctx)
+		if (err != nil) != test.expectErr {
+			t.Errorf("%v: unexpected error: %v", test.raw, err)
+		}
+		if actual != test.expected {
+			t.Errorf("%v: expected: %v, got actual: %v", test.raw, test.expected, actual)
+		}
+	}
+}
+
+func TestResolveValueURLEncode(t *testing.T) {
+	ctx := ResolveContext{
+		Host: metadata.Host{Labels: map[string]string{"endpoint": "http://a b/c?d=e&f"}},
+	}
+
+	tests := []struct {
+		raw, expected string
+	}{
+		{"__host_label__:endpoint:urlencode", "http%3A%2F%2Fa+b%2Fc%3Fd%3De%26f"},
+		{"__host_label__:endpoint", "http://a b/c?d=e&f"},
+		{"__host_label__:missing:urlencode", ""},
+		{"a literal:urlencode", "a literal:urlencode"},
+	}
+	for _, test := range tests {
+		actual, err := ResolveValue(test.raw, ctx)
+		if err != nil {
+			t.Errorf("%v: not expecting error: %v", test.raw, err)
+		}
+		if actual != test.expected {
+			t.Errorf("%v: expected: %v, got actual: %v", test.raw, test.expected, actual)
+		}
+	}
+}
+
+func TestResolveValueChain(t *testing.T) {
+	t.Setenv("PLUGIN_MANAGER_TEST_ZONE", "eu-west")
+	ctx := ResolveContext{
+		Host: metadata.Host{Labels: map[string]string{"zone": "us-west"}},
+		Overrides: map[string]string{
+			"__resolve__:label=zone,default=us-east": "ap-south",
+		},
+	}
+
+	tests := []struct {
+		raw, expected string
+		expectErr     bool
+	}{
+		// override
+		{"__resolve__:label=zone,default=us-east", "ap-south", false},
+		// host label
+		{"__resolve__:label=zone,env=PLUGIN_MANAGER_TEST_ZONE,default=us-east", "us-west", false},
+		// env var
+		{"__resolve__:label=missing,env=PLUGIN_MANAGER_TEST_ZONE,default=us-east", "eu-west", false},
+		// literal default
+		{"__resolve__:label=missing,env=PLUGIN_MANAGER_TEST_MISSING,default=us-east", "us-east", false},
+		// the precedence doesn't depend on the order of the sources
+		{"__resolve__:env=PLUGIN_MANAGER_TEST_ZONE,label=zone", "us-west", false},
+		{"__resolve__:default=us-east,env=PLUGIN_MANAGER_TEST_ZONE", "eu-west", false},
+		{"__resolve__:default=us-east,label=missing", "us-east", false},
+		{"__resolve__:label=missing", "", false},
+		{"__resolve__:label=missing,default=us-east:urlencode", "us-east", false},
+		{"__resolve__:label", "", true},
+		{"__resolve__:file=/etc/zone", "", true},
+	}
+
+	for _, test := range tests {
+		actual, err := ResolveValue(test.raw, ctx)
+		if (err != nil) != test.expectErr {
+			t.Errorf("%v: unexpected error: %v", test.raw, err)
+		}
+		if actual != test.expected {
+			t.Errorf("%v: expected: %v, got actual: %v", test.raw, test.expected, actual)
+		}
+	}
+}
+
+func TestResolveCNIConfigSubnetHost(t *testing.T) {
+	host := metadata.Host{Labels: map[string]string{"subnet": "10.50.0.0/24"}}
+	tests := []struct {
+		bridgeSubnet, raw, expected string
+	}{
+		{"10.42.0.0/16", "__subnet_host__:1", "10.42.0.1"},
+		{"10.42.0.0/16", "__subnet_host__: 2", "10.42.0.2"},
+		{"__host_label__:subnet", "__subnet_host__:1", "10.50.0.1"},
+		// out of range, invalid or without a subnet collapse to empty
+		{"10.50.0.0/24", "__subnet_host__:255", ""},
+		{"10.42.0.0/16", "__subnet_host__:0", ""},
+		{"10.42.0.0/16", "__subnet_host__:first", ""},
+		{"", "__subnet_host__:1", ""},
+		{"__ref__:otherSubnet", "__subnet_host__:1", ""},
+	}
+
+	for _, test := range tests {
+		config := map[string]interface{}{
+			"bridgeSubnet": test.bridgeSubnet,
+			"gateway":      test.raw,
+		}
+		UpdateCNIConfigByKeywords(config, host)
+		if config["gateway"] != test.expected {
+			t.Errorf("%v %v: expected: %q, got actual: %q", test.bridgeSubnet, test.raw, test.expected, config["gateway"])
+		}
+	}
+}
+
+func TestResolveCNIConfigSubnetHostResolvesSubnetOnce(t *testing.T) {
+	// The resolved subnet would be resolved again to 10.60.0.0/24
+	host := metadata.Host{Labels: map[string]string{"subnet": "__host_label__:other", "other": "10.60.0.0/24"}}
+	for i := 0; i < 20; i++ {
+		config := map[string]interface{}{
+			"bridgeSubnet": "__host_label__:subnet",
+			"a":            "__subnet_host__:1",
+			"b":            "__subnet_host__:1",
+			"z":            "__subnet_host__:1",
+		}
+		UpdateCNIConfigByKeywords(config, host)
+		if config["bridgeSubnet"] != "__host_label__:other" {
+			t.Fatalf("expected the bridgeSubnet to be resolved once, got actual: %v", config["bridgeSubnet"])
+		}
+		for _, key := range []string{"a", "b", "z"} {
+			if config[key] != "" {
+				t.Fatalf("%v: expected the resolved bridgeSubnet to be used, got actual: %v", key, config[key])
+			}
+		}
+	}
+}
+
+func TestExtractKeywords(t *testing.T) {
+	config := map[string]interface{}{
+		"type":   "rancher-bridge",
+		"bridge": "__host_label__:bridge",
+		"mtu":    float64(1500),
+		"ipam": map[string]interface{}{
+			"routes": []interface{}{
+				map[string]interface{}{"dst": "0.0.0.0/0", "gw": "__subnet_host__:1"},
+				map[string]interface{}{"dst": "__host_ip__", "gw": "__host_label__:bridge"},
+			},
+		},
+		"args": map[string]interface{}{
+			"cni": map[string]interface{}{"psk": "__file__:/etc/psk:urlencode", "tags": []interface{}{"__host_uuid__", "literal"}},
+		},
+	}
+
+	expected := []string{
+		"__file__:/etc/psk:urlencode",
+		"__host_ip__",
+		"__host_label__:bridge",
+		"__host_uuid__",
+		"__subnet_host__:1",
+	}
+	if actual := ExtractKeywords(config); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected: %v, got actual: %v", expected, actual)
+	}
+
+	if actual := ExtractKeywords("no keywords"); len(actual) != 0 {
+		t.Errorf("expected no keywords, got actual: %v", actual)
+	}
+}
+
+func TestValidateInterfaceName(t *testing.T) {
+	valid := []string{"docker0", "br-0123456789ab", "eth0.100", "veth_x-1"}
+	for _, name := range valid {
+		if err := ValidateInterfaceName(name); err != nil {
+			t.Errorf("%v: not expecting error: %v", name, err)
+		}
+	}
+
+	invalid := []string{"", "br-0123456789abc", ".", "..", "br/0", "br:0", "br 0", "br\t0"}
+	for _, name := range invalid {
+		if err := ValidateInterfaceName(name); err == nil {
+			t.Errorf("%q: expecting error, but got nil", name)
+		}
+	}
+}
+
+func TestResolveValueContainerLabel(t *testing.T) {
+	container := &metadata.Container{Labels: map[string]string{"io.rancher.cni.vlan": "100"}}
+	ctx := ResolveContext{Container: container}
+
+	tests := []struct {
+		raw, expected string
+	}{
+		{"__container_label__:io.rancher.cni.vlan", "100"},
+		{"__container_label__: io.rancher.cni.vlan", "100"},
+		{"__container_label__:missing", ""},
+		{"__container_label__", ""},
+	}
+	for _, test := range tests {
+		actual, err := ResolveValue(test.raw, ctx)
+		if err != nil {
+			t.Errorf("%v: not expecting error: %v", test.raw, err)
+		}
+		if actual != test.expected {
+			t.Errorf("%v: expected: %v, got actual: %v", test.raw, test.expected, actual)
+		}
+	}
+
+	config := map[string]interface{}{
+		"vlan":  "__container_label__:io.rancher.cni.vlan",
+		"extra": "__container_label__:missing",
+	}
+	resolved := ResolveCNIConfig(config, ctx).(map[string]interface{})
+	if resolved["vlan"] != "100" || resolved["extra"] != "" {
+		t.Errorf("expected: vlan 100 and empty extra, got actual: %v", resolved)
+	}
+
+	withoutContainer, _ := ResolveValue("__container_label__:io.rancher.cni.vlan", ResolveContext{})
+	if withoutContainer != "" {
+		t.Errorf("expected empty value without a container, got actual: %v", withoutContainer)
+	}
+}
+
+func TestResolveCNIConfigRef(t *testing.T) {
+	host := metadata.Host{Labels: map[string]string{"etcd-host": "10.0.0.5"}}
+	config := map[string]interface{}{
+		"type": "rancher-bridge",
+		"etcd": map[string]interface{}{
+			"host": "__host_label__:etcd-host",
+			"port": 2379,
+		},
+		"endpointHost": "__ref__:etcd.host",
+		"endpointPort": "__ref__:etcd.port",
+		"endpointCopy": "__ref__:endpointHost",
+		"encodedType":  "__ref__:type:urlencode",
+		"missing":      "__ref__:etcd.user",
+		"notAValue":    "__ref__:etcd",
+		"cycleA":       "__ref__:cycleB",
+		"cycleB":       "__ref__:cycleA",
+	}
+
+	resolved := UpdateCNIConfigByKeywords(config, host).(map[string]interface{})
+	expected := map[string]string{
+		"endpointHost": "10.0.0.5",
+		"endpointPort": "2379",
+		"endpointCopy": "10.0.0.5",
+		"encodedType":  "rancher-bridge",
+		"missing":      "",
+		"notAValue":    "",
+		"cycleA":       "",
+		"cycleB":       "",
+	}
+	for key, value := range expected {
+		if resolved[key] != value {
+			t.Errorf("%v: expected: %v, got actual: %v", key, value, resolved[key])
+		}
+	}
+
+	cycle := map[string]interface{}{"a": "__ref__:b", "b": "__ref__:a"}
+	_, err := ResolveValue("__ref__:a", ResolveContext{root: cycle})
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("expecting cycle error, got actual: %v", err)
+	}
+}
+
+func TestResolveCNIConfigRefResolvedOnce(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secret, []byte("not to be read"), 0600); err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	// label resolves to a value looking like a keyword, which must not
+	// be resolved again through the reference
+	host := metadata.Host{Labels: map[string]string{"label": "__file__:" + secret}}
+	config := map[string]interface{}{
+		"label":    "__host_label__:label",
+		"labelRef": "__ref__:label",
+		"counter":  "a",
+		"ref":      "__ref__:counter",
+	}
+	ctx := ResolveContext{Host: host, Overrides: map[string]string{"a": "b", "b": "c"}}
+	resolved := ResolveCNIConfig(config, ctx).(map[string]interface{})
+
+	if expected := "__file__:" + secret; resolved["labelRef"] != expected {
+		t.Errorf("expected: %v, got actual: %v", expected, resolved["labelRef"])
+	}
+	if resolved["ref"] != "b" {
+		t.Errorf("expected the override to be applied once, got actual: %v", resolved["ref"])
+	}
+}
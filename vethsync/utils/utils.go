@@ -3,8 +3,10 @@ package utils
 import (
 	"context"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/containernetworking/cni/pkg/ns"
@@ -12,6 +14,7 @@ import (
 	"github.com/docker/engine-api/types"
 	//"github.com/pkg/errors"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/metrics"
 	"github.com/rancher/plugin-manager/network"
 	"github.com/vishvananda/netlink"
 )
@@ -184,11 +187,110 @@ func GetDanglingVeths(
 // CleanUpDanglingVeths deletes the given dangling veths from the host
 func CleanUpDanglingVeths(dangling map[string]*netlink.Link) error {
 	logrus.Debugf("vethsync/utils: cleaning up dangling veths")
+	deleted := 0
 	for _, v := range dangling {
 		if err := netlink.LinkDel(*v); err != nil {
 			logrus.Errorf("vethsync/utils: error deleting dangling veth: %v", *v)
 			continue
 		}
+		deleted++
 	}
+	metrics.RecordReconciled("vethsync", "veths", deleted)
 	return nil
 }
+
+// FindOrphanedVeths returns the names of the veths enslaved to the given
+// bridge which can't be matched to any of the given running container IPs.
+// The matching is done using the MAC addresses learnt by the bridge on each
+// veth port and the IP to MAC mappings from the neighbor table of the bridge.
+// Veths without any neighbor information are not reported, since there is
+// nothing to match them against.
+func FindOrphanedVeths(bridgeName string, validContainerIPs []net.IP) ([]string, error) {
+	bridge, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		logrus.Errorf("vethsync/utils: error fetching bridge %v: %v", bridgeName, err)
+		return nil, err
+	}
+
+	neighs, err := netlink.NeighList(bridge.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		logrus.Errorf("vethsync/utils: error fetching neighbors of bridge %v: %v", bridgeName, err)
+		return nil, err
+	}
+	ipsByMAC := make(map[string][]net.IP)
+	for _, n := range neighs {
+		if n.HardwareAddr == nil || n.IP == nil {
+			continue
+		}
+		mac := n.HardwareAddr.String()
+		ipsByMAC[mac] = append(ipsByMAC[mac], n.IP)
+	}
+
+	valid := make(map[string]bool)
+	for _, ip := range validContainerIPs {
+		valid[ip.String()] = true
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		logrus.Errorf("vethsync/utils: error getting links: %v", err)
+		return nil, err
+	}
+
+	orphaned := []string{}
+	for _, l := range links {
+		if l.Type() != "veth" || l.Attrs().MasterIndex != bridge.Attrs().Index {
+			continue
+		}
+
+		fdbEntries, err := netlink.NeighList(l.Attrs().Index, syscall.AF_BRIDGE)
+		if err != nil {
+			logrus.Errorf("vethsync/utils: error fetching fdb entries of %v: %v", l.Attrs().Name, err)
+			return nil, err
+		}
+
+		var seen, matched bool
+		for _, e := range fdbEntries {
+			if e.HardwareAddr.String() == l.Attrs().HardwareAddr.String() {
+				continue
+			}
+			for _, ip := range ipsByMAC[e.HardwareAddr.String()] {
+				seen = true
+				if valid[ip.String()] {
+					matched = true
+				}
+			}
+		}
+
+		if seen && !matched {
+			logrus.Debugf("vethsync/utils: orphaned veth found: %v", l.Attrs().Name)
+			orphaned = append(orphaned, l.Attrs().Name)
+		}
+	}
+
+	return orphaned, nil
+}
+
+// DeleteOrphanedVeths deletes the veths with the given names from the host.
+// It keeps going when a veth can't be deleted and returns the names of the
+// ones which were deleted along with the last error seen.
+func DeleteOrphanedVeths(names []string) (deleted []string, err error) {
+	logrus.Debugf("vethsync/utils: deleting orphaned veths: %v", names)
+	deleted = []string{}
+	for _, name := range names {
+		l, lErr := netlink.LinkByName(name)
+		if lErr != nil {
+			logrus.Errorf("vethsync/utils: error fetching orphaned veth %v: %v", name, lErr)
+			err = lErr
+			continue
+		}
+		if lErr := netlink.LinkDel(l); lErr != nil {
+			logrus.Errorf("vethsync/utils: error deleting orphaned veth %v: %v", name, lErr)
+			err = lErr
+			continue
+		}
+		network.RecordEvent(network.ActionDelLink, name, name)
+		deleted = append(deleted, name)
+	}
+	return deleted, err
+}
@@ -2,11 +2,17 @@ package utils
 
 import (
 	"encoding/json"
+	"net"
+	"reflect"
+	"syscall"
 	"testing"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/docker/engine-api/client"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/testutil"
+	"github.com/vishvananda/netlink"
 )
 
 // Some of the tests can run only when in development,
@@ -140,3 +146,131 @@ func TestGetDanglingVeths(t *testing.T) {
 	}
 	logrus.Debugf("vethsync: dangling: %v", dangling)
 }
+
+// addTestVeth creates a veth pair and enslaves the host end to the bridge
+func addTestVeth(name string, bridge *netlink.Bridge) (netlink.Link, error) {
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		PeerName:  name + "p",
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return nil, err
+	}
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := netlink.LinkSetMaster(l, bridge); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// addTestNeighbor programs the bridge as if it had learnt the given
+// IP/MAC on the veth
+func addTestNeighbor(bridge *netlink.Bridge, veth netlink.Link, ip, mac string) error {
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	err = netlink.NeighAdd(&netlink.Neigh{
+		LinkIndex:    veth.Attrs().Index,
+		Family:       syscall.AF_BRIDGE,
+		Flags:        netlink.NTF_MASTER,
+		State:        netlink.NUD_PERMANENT,
+		HardwareAddr: hwAddr,
+	})
+	if err != nil {
+		return err
+	}
+	return netlink.NeighAdd(&netlink.Neigh{
+		LinkIndex:    bridge.Attrs().Index,
+		State:        netlink.NUD_PERMANENT,
+		IP:           net.ParseIP(ip),
+		HardwareAddr: hwAddr,
+	})
+}
+
+func TestFindOrphanedVeths(t *testing.T) {
+	testNS := testutil.NewTestNS(t)
+	defer testNS.Close()
+
+	var orphaned []string
+	err := testNS.Do(func(ns.NetNS) error {
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "testbr0"}}
+		if err := netlink.LinkAdd(bridge); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(bridge); err != nil {
+			return err
+		}
+
+		running, err := addTestVeth("vethrrunning", bridge)
+		if err != nil {
+			return err
+		}
+		dead, err := addTestVeth("vethrdead", bridge)
+		if err != nil {
+			return err
+		}
+		// Nothing is known about this one, so it must not be reported
+		if _, err := addTestVeth("vethrunknown", bridge); err != nil {
+			return err
+		}
+
+		// Enslaving can change the MAC address of the bridge, which
+		// flushes its neighbors, so program them after adding the veths
+		if err := addTestNeighbor(bridge, running, "10.42.0.2", "02:00:0a:2a:00:02"); err != nil {
+			return err
+		}
+		if err := addTestNeighbor(bridge, dead, "10.42.0.3", "02:00:0a:2a:00:03"); err != nil {
+			return err
+		}
+
+		orphaned, err = FindOrphanedVeths("testbr0", []net.IP{net.ParseIP("10.42.0.2")})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	expected := []string{"vethrdead"}
+	if !reflect.DeepEqual(orphaned, expected) {
+		t.Fatalf("expected: %v, got actual: %v", expected, orphaned)
+	}
+}
+
+func TestDeleteOrphanedVeths(t *testing.T) {
+	testNS := testutil.NewTestNS(t)
+	defer testNS.Close()
+
+	var deleted []string
+	var deleteErr error
+	err := testNS.Do(func(ns.NetNS) error {
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "testbr0"}}
+		if err := netlink.LinkAdd(bridge); err != nil {
+			return err
+		}
+		if _, err := addTestVeth("vethrorphan", bridge); err != nil {
+			return err
+		}
+
+		deleted, deleteErr = DeleteOrphanedVeths([]string{"vethrmissing", "vethrorphan"})
+
+		if _, err := netlink.LinkByName("vethrorphan"); err == nil {
+			t.Errorf("expected vethrorphan to be deleted")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("not expecting error: %v", err)
+	}
+
+	if deleteErr == nil {
+		t.Errorf("expected error for the missing veth, but got nil")
+	}
+	expected := []string{"vethrorphan"}
+	if !reflect.DeepEqual(deleted, expected) {
+		t.Fatalf("expected: %v, got actual: %v", expected, deleted)
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/engine-api/client"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/plugin-manager/changes"
+	"github.com/rancher/plugin-manager/metrics"
 	"github.com/rancher/plugin-manager/vethsync/utils"
 )
 
@@ -33,6 +35,24 @@ type VethWatcher struct {
 // Watch starts the go routine to periodically check the conntrack table
 // for any discrepancies
 func Watch(syncIntervalStr, metadataURL string, mc metadata.Client, dc *client.Client, debug bool) error {
+	vw := newVethWatcher(syncIntervalStr, metadataURL, mc, dc, debug)
+	go mc.OnChange(120, vw.onChangeNoError)
+
+	return nil
+}
+
+// Subscribe looks for dangling veths when the containers change according
+// to the given notifier, instead of on every metadata change. It's also
+// done every resync interval.
+func Subscribe(n *changes.Notifier, syncIntervalStr, resyncIntervalStr, metadataURL string, mc metadata.Client, dc *client.Client, debug bool) error {
+	vw := newVethWatcher(syncIntervalStr, metadataURL, mc, dc, debug)
+	n.Subscribe("vethsync", []string{changes.Containers},
+		vw.syncInterval, changes.ResyncInterval(resyncIntervalStr), vw.doSync)
+
+	return nil
+}
+
+func newVethWatcher(syncIntervalStr, metadataURL string, mc metadata.Client, dc *client.Client, debug bool) *VethWatcher {
 	logrus.Debugf("vethsync: syncIntervalStr: %v", syncIntervalStr)
 
 	syncInterval := DefaultSyncInterval
@@ -41,17 +61,13 @@ func Watch(syncIntervalStr, metadataURL string, mc metadata.Client, dc *client.C
 
 	}
 
-	vw := &VethWatcher{
+	return &VethWatcher{
 		syncInterval: time.Duration(syncInterval) * time.Second,
 		mc:           mc,
 		metadataURL:  metadataURL,
 		dc:           dc,
 		debug:        debug,
 	}
-
-	go mc.OnChange(120, vw.onChangeNoError)
-
-	return nil
 }
 
 func (vw *VethWatcher) onChangeNoError(version string) {
@@ -62,9 +78,12 @@ func (vw *VethWatcher) onChangeNoError(version string) {
 		logrus.Debugf("vethsync: sleeping for %v", timeToSleep)
 		time.Sleep(timeToSleep)
 	}
-	if err := vw.doSync(); err != nil {
+	started := time.Now()
+	err := vw.doSync()
+	if err != nil {
 		logrus.Errorf("vethsync: while syncing, got error: %v", err)
 	}
+	metrics.RecordSync("vethsync", started, err)
 	vw.lastApplied = time.Now()
 }
 